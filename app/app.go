@@ -8,6 +8,7 @@ import (
 	"net/netip"
 	"os"
 	"path/filepath"
+	"time"
 
 	"github.com/bepass-org/warp-plus/psiphon"
 	"github.com/bepass-org/warp-plus/warp"
@@ -17,6 +18,17 @@ import (
 const singleMTU = 1400
 const doubleMTU = 1320
 
+// wireguardOverhead is what WireGuard adds to the packets it carries, with
+// IPv6 headers: the gap between the MTUs of the gool tunnels.
+const wireguardOverhead = singleMTU - doubleMTU
+
+// wireguardMTU is the MTU of WireGuard profiles that don't set one, the
+// wg-quick default.
+const wireguardMTU = 1420
+
+// peerStatusInterval is how often the status of multi-peer tunnels is logged.
+const peerStatusInterval = time.Minute
+
 // WarpOptions holds the configuration options for running Warp.
 type WarpOptions struct {
 	Bind     netip.AddrPort
@@ -25,6 +37,58 @@ type WarpOptions struct {
 	Psiphon  *PsiphonOptions
 	Gool     bool
 	Scan     *wiresocks.ScanOptions
+	Rescan   *wiresocks.RescanOptions
+	Import   string
+	Teams    *warp.TeamsOptions
+	// UAPI serves the device's UAPI under this interface name, empty to disable.
+	UAPI string
+	// Obfuscation holds AmneziaWG parameters for every peer. WARP only
+	// accepts the junk packets.
+	Obfuscation *wiresocks.Obfuscation
+	// Noise replaces the default noise sent ahead of WARP handshakes. In
+	// wireguard mode, where none is sent by default, it sets it.
+	Noise *wiresocks.Noise
+	// Hop moves the tunnel's UDP flow to fresh ports, nil to disable.
+	Hop *HopOptions
+	// MTU is the tunnel MTU, that of the inner tunnel in gool mode, zero to
+	// discover the path MTU or, in wireguard mode, use the profile's.
+	MTU int
+	// Capture writes the decrypted traffic of the tunnel to a file, nil to
+	// disable.
+	Capture *CaptureOptions
+	// Wireguard runs an arbitrary WireGuard profile instead of WARP.
+	Wireguard *WireguardOptions
+}
+
+// WireguardOptions holds the configuration options for running a WireGuard profile.
+type WireguardOptions struct {
+	Config string // Path of the wg-quick profile
+}
+
+// HopOptions holds the port hopping options for every peer.
+type HopOptions struct {
+	Interval    time.Duration // Hop this often, zero to only hop on collapse
+	OnCollapse  bool          // Also hop when throughput collapses
+	Source      bool          // Move to a new local port
+	Destination bool          // Move to another WARP port, or another of the profile's HopPorts
+}
+
+// portHopping returns the hopping of a peer whose destination ports to
+// hop between are ports.
+func (o *HopOptions) portHopping(ports []uint16) wiresocks.PortHopping {
+	h := wiresocks.PortHopping{Interval: o.Interval, OnCollapse: o.OnCollapse, Source: o.Source}
+	if o.Destination {
+		h.Ports = ports
+	}
+	return h
+}
+
+// CaptureOptions holds the options for capturing the traffic inside the
+// tunnel.
+type CaptureOptions struct {
+	wiresocks.CaptureOptions
+	Paused  bool           // Only capture once toggled on
+	Control netip.AddrPort // Where captures are started and stopped over HTTP, zero for nowhere
 }
 
 // PsiphonOptions holds the configuration options for running Psiphon.
@@ -34,16 +98,49 @@ type PsiphonOptions struct {
 
 // RunWarp runs Warp with the given options.
 func RunWarp(ctx context.Context, l *slog.Logger, opts WarpOptions) error {
+	if opts.MTU != 0 && opts.MTU < wiresocks.MinMTU {
+		return fmt.Errorf("mtu must be at least %d", wiresocks.MinMTU)
+	}
+
+	if opts.Wireguard != nil {
+		return runWireguard(ctx, l, opts)
+	}
+
 	// Check if Psiphon and Gool are not set at the same time.
 	if opts.Psiphon != nil && opts.Gool {
 		return errors.New("can't use psiphon and gool at the same time")
 	}
 
+	// Team identities are single devices, so there is no secondary for gool.
+	if opts.Teams != nil && opts.Gool {
+		return errors.New("can't use teams and gool at the same time")
+	}
+
+	// Team identities are enrolled by the organization, not imported.
+	if opts.Teams != nil && opts.Import != "" {
+		return errors.New("can't import an identity with teams")
+	}
+
+	// WARP drops anything but plain WireGuard messages, and ignores junk.
+	if o := opts.Obfuscation; o != nil && (o.InitPadding != 0 || o.ResponsePadding != 0 ||
+		o.InitHeader != 0 || o.ResponseHeader != 0 || o.CookieHeader != 0 || o.TransportHeader != 0) {
+		return errors.New("warp only accepts junk packets (jc, jmin, jmax), not s1, s2 or h1-h4")
+	}
+
 	// Check if a country is provided when using Psiphon.
 	if opts.Psiphon != nil && opts.Psiphon.Country == "" {
 		return errors.New("must provide country for psiphon")
 	}
 
+	// Resolve the import path before the working directory changes.
+	if opts.Import != "" {
+		path, err := filepath.Abs(opts.Import)
+		if err != nil {
+			return err
+		}
+		opts.Import = path
+	}
+
 	// Create necessary directories.
 	if err := makeDirs(); err != nil {
 		return err
@@ -56,8 +153,32 @@ func RunWarp(ctx context.Context, l *slog.Logger, opts WarpOptions) error {
 	}
 	l.Debug("Changed working directory to 'stuff'")
 
-	// Create primary and secondary identities.
-	if err := createPrimaryAndSecondaryIdentities(l.With("subsystem", "warp/account"), opts.License); err != nil {
+	// Import an existing identity as the primary identity.
+	if opts.Import != "" {
+		warp.UpdatePath("./primary")
+		identity, err := warp.ImportIdentity(l.With("subsystem", "warp/account"), opts.Import, opts.License)
+		if err != nil {
+			return fmt.Errorf("failed to import identity: %w", err)
+		}
+		opts.License = identity.LicenseKey
+	}
+
+	// Use the organization's identity, kept apart from the consumer ones,
+	// or create the primary identity. Gool creates the secondary one once
+	// the primary tunnel is up.
+	profile := "./primary/wgcf-profile.ini"
+	if opts.Teams != nil {
+		if err := os.MkdirAll("teams", 0o755); err != nil {
+			return fmt.Errorf("error creating 'teams' directory: %w", err)
+		}
+		warp.UpdatePath("./teams")
+		if !warp.CheckProfileExists("notset") {
+			if err := warp.LoadOrCreateTeamsIdentity(l.With("subsystem", "warp/account"), *opts.Teams); err != nil {
+				return fmt.Errorf("couldn't enroll teams identity: %w", err)
+			}
+		}
+		profile = "./teams/wgcf-profile.ini"
+	} else if err := createIdentity(l.With("subsystem", "warp/account"), "./primary", opts.License); err != nil {
 		return err
 	}
 
@@ -65,7 +186,9 @@ func RunWarp(ctx context.Context, l *slog.Logger, opts WarpOptions) error {
 	endpoints := []string{opts.Endpoint, opts.Endpoint}
 
 	if opts.Scan != nil {
-		res, err := wiresocks.RunScan(ctx, l, *opts.Scan)
+		opts.Scan.Profile = profile
+		opts.Scan.Cache = "./scan-cache.json"
+		res, err := wiresocks.RunCachedScan(ctx, l, *opts.Scan)
 		if err != nil {
 			return err
 		}
@@ -79,71 +202,408 @@ func RunWarp(ctx context.Context, l *slog.Logger, opts WarpOptions) error {
 	}
 	l.Info("using warp endpoints", "endpoints", endpoints)
 
+	if mode, dropped := dropUnsupported(&opts); len(dropped) > 0 {
+		l.Warn("ignoring options this mode doesn't support", "mode", mode, "options", dropped)
+	}
+
+	if opts.Rescan != nil {
+		opts.Rescan.Profile = profile
+	}
+
+	noise := wiresocks.DefaultNoise
+	if opts.Noise != nil {
+		noise = *opts.Noise
+	}
+
 	var warpErr error
 	switch {
 	case opts.Psiphon != nil:
 		l.Info("running in Psiphon (cfon) mode")
 		// Run primary warp on a random TCP port and run psiphon on bind address.
-		warpErr = runWarpWithPsiphon(ctx, l, opts.Bind, endpoints[0], opts.Psiphon.Country)
+		warpErr = runWarpWithPsiphon(ctx, l, opts.Bind, profile, endpoints[0], opts.Psiphon.Country, noise)
 	case opts.Gool:
 		l.Info("running in warp-in-warp (gool) mode")
 		// Run warp in warp.
-		warpErr = runWarpInWarp(ctx, l, opts.Bind, endpoints)
+		warpErr = runGool(ctx, l, opts, endpoints)
 	default:
 		l.Info("running in normal warp mode")
 		// Just run primary warp on bindAddress.
-		warpErr = runWarp(ctx, l, opts.Bind, endpoints[0])
+		warpErr = runWarp(ctx, l, opts, profile, endpoints[0], noise)
 	}
 
 	return warpErr
 }
 
-// runWarp runs primary warp on the given bind address and endpoint.
-func runWarp(ctx context.Context, l *slog.Logger, bind netip.AddrPort, endpoint string) error {
+// dropUnsupported clears the options that the psiphon or gool mode of opts
+// doesn't support, and returns the mode and the flags of those options.
+func dropUnsupported(opts *WarpOptions) (string, []string) {
+	var mode string
+	switch {
+	case opts.Psiphon != nil:
+		mode = "psiphon"
+	case opts.Gool:
+		mode = "gool"
+	default:
+		return "", nil
+	}
+
+	var dropped []string
+	drop := func(set bool, flag string, clear func()) {
+		if set {
+			dropped = append(dropped, flag)
+			clear()
+		}
+	}
+	drop(opts.Rescan != nil, "rescan", func() { opts.Rescan = nil })
+	drop(opts.UAPI != "", "uapi", func() { opts.UAPI = "" })
+	drop(opts.Obfuscation != nil, "awg", func() { opts.Obfuscation = nil })
+	drop(opts.Hop != nil, "hop", func() { opts.Hop = nil })
+	drop(opts.Noise != nil && opts.Gool, "noise", func() { opts.Noise = nil })
+	drop(opts.MTU != 0 && opts.Psiphon != nil, "mtu", func() { opts.MTU = 0 })
+	drop(opts.Capture != nil && opts.Psiphon != nil, "capture", func() { opts.Capture = nil })
+	return mode, dropped
+}
+
+// runWireguard runs the WireGuard profile of opts.Wireguard on the bind
+// address. It skips everything WARP specific: no identities are created,
+// noise is only used if asked for, and there is no scanning, which only
+// knows the WARP prefixes.
+func runWireguard(ctx context.Context, l *slog.Logger, opts WarpOptions) error {
+	switch {
+	case opts.Psiphon != nil:
+		return errors.New("can't use psiphon with a wireguard profile")
+	case opts.Gool:
+		return errors.New("can't use gool with a wireguard profile")
+	case opts.Teams != nil:
+		return errors.New("can't use teams with a wireguard profile")
+	case opts.Import != "":
+		return errors.New("can't import an identity with a wireguard profile")
+	case opts.Scan != nil, opts.Rescan != nil:
+		return errors.New("can't scan for warp endpoints with a wireguard profile")
+	}
+
+	conf, err := wiresocks.ParseConfig(l, opts.Wireguard.Config)
+	if err != nil {
+		return err
+	}
+
+	if opts.Endpoint != "" {
+		if len(conf.Peers) != 1 {
+			return errors.New("can't override the endpoint of a profile with several peers")
+		}
+		conf.Peers[0].Endpoint = opts.Endpoint
+	}
+
+	for i, peer := range conf.Peers {
+		if opts.Noise != nil {
+			peer.Noise = *opts.Noise
+		}
+		if opts.Hop != nil {
+			peer.Hopping = opts.Hop.portHopping(peer.Hopping.Ports)
+		}
+		if opts.Obfuscation != nil {
+			peer.Obfuscation = *opts.Obfuscation
+		}
+		conf.Peers[i] = peer
+	}
+
+	l.Info("running wireguard profile", "profile", opts.Wireguard.Config, "peers", len(conf.Peers))
+	for _, peer := range conf.Peers {
+		l.Info("peer routes", "peer", peer.PublicKey, "endpoint", peer.Endpoint, "allowed-ips", peer.AllowedIPs)
+	}
+
+	var discover bool
+	switch {
+	case opts.MTU != 0:
+		conf.Interface.MTU = opts.MTU
+	case conf.Interface.MTU == 0:
+		conf.Interface.MTU = singleMTU
+		discover = true
+	}
+
+	tnet, err := wiresocks.StartWireguard(ctx, l, conf)
+	if err != nil {
+		return err
+	}
+
+	if discover {
+		discoverMTU(l, conf, tnet, wireguardMTU)
+	}
+
+	if opts.Capture != nil {
+		startCapture(ctx, l, *opts.Capture, captureTarget{tnet, opts.Capture.CaptureOptions})
+	}
+
+	_, err = tnet.StartProxy(opts.Bind)
+	if err != nil {
+		return err
+	}
+
+	l.Info("serving proxy", "address", opts.Bind)
+
+	if opts.UAPI != "" {
+		startUAPI(l, tnet, opts.UAPI)
+	}
+
+	if len(conf.Peers) > 1 {
+		go logPeerStatus(ctx, l, tnet, peerStatusInterval)
+	}
+
+	return nil
+}
+
+// logPeerStatus logs the handshake and transfer counters of every peer of
+// tnet each interval until ctx is done.
+func logPeerStatus(ctx context.Context, l *slog.Logger, tnet *wiresocks.VirtualTun, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+
+		for _, p := range tnet.PeerStatus() {
+			l.Info("peer status",
+				"peer", p.PublicKey,
+				"endpoint", p.Endpoint,
+				"last-handshake", p.LastHandshake,
+				"rx", p.RxBytes,
+				"tx", p.TxBytes,
+				"connections", p.ActiveConnections,
+				"port-hops", p.PortHops,
+			)
+		}
+	}
+}
+
+// runWarp serves the proxy on opts.Bind through a tunnel to endpoint from
+// the given profile, sending noise ahead of the handshakes. Of the other
+// options, it uses:
+//   - Rescan, to keep scanning and move to a better endpoint when the
+//     current one degrades
+//   - UAPI, to serve the UAPI of the device under that name
+//   - Obfuscation, to send junk packets after the noise
+//   - Hop, to move the tunnel between WARP ports
+//   - MTU, or if zero, to discover the path MTU and watch it
+//   - Capture, to capture the traffic inside the tunnel
+func runWarp(ctx context.Context, l *slog.Logger, opts WarpOptions, profile, endpoint string, noise wiresocks.Noise) error {
 	// Parse the configuration from the profile file.
-	conf, err := wiresocks.ParseConfig("./primary/wgcf-profile.ini", endpoint)
+	conf, err := wiresocks.ParseConfig(l, profile)
 	if err != nil {
 		return err
 	}
-	conf.Interface.MTU = singleMTU
 
-	// Update the keep-alive and trick settings for all peers.
+	// Update the endpoint, keep-alive, noise, hopping and obfuscation settings for all peers.
 	for i, peer := range conf.Peers {
-		peer.Trick = true
-		peer.KeepAlive = 3
+		peer.Endpoint = endpoint
+		peer.Noise = noise
+		peer.PersistentKeepalive = 3
+		if opts.Hop != nil {
+			peer.Hopping = opts.Hop.portHopping(warp.WarpPorts())
+		}
+		if opts.Obfuscation != nil {
+			peer.Obfuscation = *opts.Obfuscation
+		}
 		conf.Peers[i] = peer
 	}
 
+	// Unless given an MTU, start at a safe one and probe the path for its
+	// MTU once the tunnel is up.
+	conf.Interface.MTU = opts.MTU
+	if opts.MTU == 0 {
+		conf.Interface.MTU = singleMTU
+	}
+
 	// Start Wireguard with the given configuration.
 	tnet, err := wiresocks.StartWireguard(ctx, l, conf)
 	if err != nil {
 		return err
 	}
 
+	if opts.MTU == 0 {
+		discoverMTU(l, conf, tnet, wireguardMTU)
+	}
+
+	if opts.Capture != nil {
+		startCapture(ctx, l, *opts.Capture, captureTarget{tnet, opts.Capture.CaptureOptions})
+	}
+
 	// Start a proxy server on the given bind address.
-	_, err = tnet.StartProxy(bind)
+	_, err = tnet.StartProxy(opts.Bind)
 	if err != nil {
 		return err
 	}
 
-	l.Info("serving proxy", "address", bind)
+	l.Info("serving proxy", "address", opts.Bind)
+
+	if opts.UAPI != "" {
+		startUAPI(l, tnet, opts.UAPI)
+	}
+
+	if opts.Rescan != nil {
+		startRescan(ctx, l, tnet, conf.Peers[0].PublicKey, endpoint, *opts.Rescan)
+	}
+
+	return nil
+}
+
+// discoverMTU probes the path of tnet, started with the MTU of conf, for
+// its MTU up to max in the background, applies it and keeps watching it.
+// tnet keeps the MTU of conf until probing finishes, and if it fails.
+func discoverMTU(l *slog.Logger, conf *wiresocks.Configuration, tnet *wiresocks.VirtualTun, max int) {
+	target, err := wiresocks.ProbeTarget(conf)
+	if err != nil {
+		l.Warn("unable to discover the path mtu", "mtu", conf.Interface.MTU, "error", err)
+		return
+	}
+	go tnet.DiscoverMTU(target, max)
+}
+
+// startUAPI serves the UAPI of tnet under name. Failures are logged, as the
+// tunnel works without it.
+func startUAPI(l *slog.Logger, tnet *wiresocks.VirtualTun, name string) {
+	addr, err := tnet.ServeUAPI(name)
+	if err != nil {
+		l.Warn("unable to serve uapi", "name", name, "error", err)
+		return
+	}
+	l.Info("serving uapi", "name", name, "address", addr)
+}
+
+// startRescan starts a background rescanner for the peer with the given
+// hex encoded public key, currently at endpoint.
+func startRescan(ctx context.Context, l *slog.Logger, tnet *wiresocks.VirtualTun, peerKey, endpoint string, opts wiresocks.RescanOptions) {
+	current, err := netip.ParseAddrPort(endpoint)
+	if err != nil {
+		l.Warn("background rescanning needs an ip endpoint", "endpoint", endpoint, "error", err)
+		return
+	}
+
+	r, err := wiresocks.NewRescanner(l, tnet, peerKey, current, opts)
+	if err != nil {
+		l.Warn("unable to start background rescanning", "error", err)
+		return
+	}
+
+	l.Info("background rescanning enabled", "interval", opts.Interval)
+	go r.Run(ctx)
+}
+
+// createIdentity creates the identity kept under path, unless it already
+// has a profile for license.
+func createIdentity(l *slog.Logger, path, license string) error {
+	warp.UpdatePath(path)
+	if warp.CheckProfileExists(license) {
+		return nil
+	}
+	return warp.LoadOrCreateIdentity(l, license)
+}
+
+// runGool runs warp in warp: the primary identity's tunnel to the first
+// endpoint carries the secondary identity's tunnel to the second, which
+// serves the proxy on opts.Bind. The secondary identity is created through
+// the primary tunnel, so it registers where the API is blocked.
+// opts.MTU is that of the inner tunnel, the outer one being larger by the
+// WireGuard overhead. If zero, the tunnels start at safe MTUs and the path
+// of the outer one is probed for its MTU, and watched, the inner one
+// following it. With opts.Capture set, the inner tunnel is captured to its
+// path and the outer one next to it.
+func runGool(ctx context.Context, l *slog.Logger, opts WarpOptions, endpoints []string) error {
+	// Run the outer tunnel.
+	conf, err := wiresocks.ParseConfig(l, "./primary/wgcf-profile.ini")
+	if err != nil {
+		return err
+	}
+	outerMTU := opts.MTU + wireguardOverhead
+	maxMTU := outerMTU
+	if opts.MTU == 0 {
+		outerMTU, maxMTU = singleMTU, wireguardMTU
+	}
+	conf.Interface.MTU = outerMTU
+	for i, peer := range conf.Peers {
+		peer.Endpoint = endpoints[0]
+		peer.Noise = wiresocks.DefaultNoise
+		peer.PersistentKeepalive = 3
+		conf.Peers[i] = peer
+	}
+
+	outer, err := wiresocks.StartWireguard(ctx, l.With("tunnel", "outer"), conf)
+	if err != nil {
+		return err
+	}
+	outerConf := conf
+
+	err = warp.WithDialContext(outer.DialContext, func() error {
+		return createIdentity(l.With("subsystem", "warp/account"), "./secondary", opts.License)
+	})
+	if err != nil {
+		return fmt.Errorf("couldn't create secondary identity through the primary tunnel: %w", err)
+	}
+
+	// Forward a local UDP port to the second endpoint through the outer
+	// tunnel, with room for packets of the largest MTU probing may find.
+	addr, err := wiresocks.NewVtunUDPForwarder(ctx, netip.MustParseAddrPort("127.0.0.1:0"), endpoints[1], outer, maxMTU)
+	if err != nil {
+		return err
+	}
+
+	// Run the inner tunnel through the forwarder.
+	conf, err = wiresocks.ParseConfig(l, "./secondary/wgcf-profile.ini")
+	if err != nil {
+		return err
+	}
+	conf.Interface.MTU = outerMTU - wireguardOverhead
+	for i, peer := range conf.Peers {
+		peer.Endpoint = addr.String()
+		peer.PersistentKeepalive = 10
+		conf.Peers[i] = peer
+	}
+
+	inner, err := wiresocks.StartWireguard(ctx, l.With("tunnel", "inner"), conf)
+	if err != nil {
+		return err
+	}
+	inner.SetCarrier(outer)
+
+	if opts.MTU == 0 {
+		discoverMTU(l, outerConf, outer, maxMTU)
+	}
+
+	if opts.Capture != nil {
+		outerCapture := opts.Capture.CaptureOptions
+		outerCapture.Path = outerCapturePath(opts.Capture.Path)
+		startCapture(ctx, l, *opts.Capture,
+			captureTarget{inner, opts.Capture.CaptureOptions},
+			captureTarget{outer, outerCapture},
+		)
+	}
+
+	_, err = inner.StartProxy(opts.Bind)
+	if err != nil {
+		return err
+	}
 
+	l.Info("serving proxy", "address", opts.Bind)
 	return nil
 }
 
-// runWarpWithPsiphon runs primary warp on a random TCP port and runs psiphon on the bind address.
-func runWarpWithPsiphon(ctx context.Context, l *slog.Logger, bind netip.AddrPort, endpoint string, country string) error {
+// runWarpWithPsiphon runs warp from the given profile on a random TCP port and runs psiphon on the bind address.
+func runWarpWithPsiphon(ctx context.Context, l *slog.Logger, bind netip.AddrPort, profile, endpoint string, country string, noise wiresocks.Noise) error {
 	// Parse the configuration from the profile file.
-	conf, err := wiresocks.ParseConfig("./primary/wgcf-profile.ini", endpoint)
+	conf, err := wiresocks.ParseConfig(l, profile)
 	if err != nil {
 		return err
 	}
 	conf.Interface.MTU = singleMTU
 
-	// Update the keep-alive and trick settings for all peers.
+	// Update the endpoint, keep-alive and noise settings for all peers.
 	for i, peer := range conf.Peers {
-		peer.Trick = true
-		peer.KeepAlive = 3
+		peer.Endpoint = endpoint
+		peer.Noise = noise
+		peer.PersistentKeepalive = 3
 		conf.Peers[i] = peer
 	}
 
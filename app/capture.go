@@ -0,0 +1,195 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bepass-org/warp-plus/wiresocks"
+)
+
+// captureTarget is a tunnel and the capture it is started with.
+type captureTarget struct {
+	tnet *wiresocks.VirtualTun
+	opts wiresocks.CaptureOptions
+}
+
+// captureControl starts and stops the captures of the tunnels of a mode
+// together: the one tunnel, or both in gool mode.
+type captureControl struct {
+	l       *slog.Logger
+	mu      sync.Mutex
+	targets []captureTarget
+}
+
+// Start starts capturing every tunnel, replacing the running captures.
+func (c *captureControl) Start() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, t := range c.targets {
+		if err := t.tnet.StartCapture(t.opts); err != nil {
+			c.stopLocked()
+			return err
+		}
+	}
+	for _, t := range c.targets {
+		c.l.Info("capturing packets", "path", t.opts.Path, "filter", t.opts.Filter)
+	}
+	return nil
+}
+
+// Stop stops the running captures.
+func (c *captureControl) Stop() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := c.stopLocked(); err != nil {
+		return err
+	}
+	for _, t := range c.targets {
+		c.l.Info("capture stopped", "path", t.opts.Path)
+	}
+	return nil
+}
+
+func (c *captureControl) stopLocked() error {
+	var errs []error
+	for _, t := range c.targets {
+		errs = append(errs, t.tnet.StopCapture())
+	}
+	return errors.Join(errs...)
+}
+
+// Capturing reports whether a capture is running. A capture stops by
+// itself when its file can't be written.
+func (c *captureControl) Capturing() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, t := range c.targets {
+		if t.tnet.Capturing() {
+			return true
+		}
+	}
+	return false
+}
+
+// toggle stops the captures if one is running, and starts them otherwise.
+func (c *captureControl) toggle() {
+	if c.Capturing() {
+		if err := c.Stop(); err != nil {
+			c.l.Warn("unable to stop capture", "error", err)
+		}
+		return
+	}
+	if err := c.Start(); err != nil {
+		c.l.Warn("unable to start capture", "error", err)
+	}
+}
+
+// captureStatus is the body of the replies of the capture control.
+type captureStatus struct {
+	Capturing bool   `json:"capturing"`
+	Error     string `json:"error,omitempty"`
+}
+
+// ServeHTTP serves the capture control: GET /capture returns whether a
+// capture is running, and POST /capture/start and POST /capture/stop start
+// and stop it.
+func (c *captureControl) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var err error
+	switch {
+	case r.URL.Path == "/capture" && r.Method == http.MethodGet:
+	case r.URL.Path == "/capture/start" && r.Method == http.MethodPost:
+		err = c.Start()
+	case r.URL.Path == "/capture/stop" && r.Method == http.MethodPost:
+		err = c.Stop()
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	status := captureStatus{Capturing: c.Capturing()}
+	w.Header().Set("Content-Type", "application/json")
+	if err != nil {
+		status.Error = err.Error()
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+	json.NewEncoder(w).Encode(status)
+}
+
+// outerCapturePath returns the file the outer gool tunnel is captured to,
+// next to path.
+func outerCapturePath(path string) string {
+	ext := filepath.Ext(path)
+	return strings.TrimSuffix(path, ext) + ".outer" + ext
+}
+
+// startCapture captures the traffic inside the tunnels of targets, from
+// now unless opts.Paused. The captures are stopped and restarted through
+// the control address of opts, if it has one, and where there is a toggle
+// signal, with it. Failures are logged, as the tunnels work without
+// captures.
+func startCapture(ctx context.Context, l *slog.Logger, opts CaptureOptions, targets ...captureTarget) {
+	c := &captureControl{l: l, targets: targets}
+
+	if !opts.Paused {
+		if err := c.Start(); err != nil {
+			l.Warn("unable to start capture", "path", opts.Path, "error", err)
+		}
+	}
+
+	if opts.Control.IsValid() {
+		serveCaptureControl(ctx, l, c, opts.Control.String())
+	}
+
+	signals := make(chan os.Signal, 1)
+	if notifyCaptureToggle(signals) {
+		l.Info("capture can be toggled", "signal", captureToggleSignal)
+	}
+	go func() {
+		defer signal.Stop(signals)
+		for {
+			select {
+			case <-ctx.Done():
+				c.mu.Lock()
+				c.stopLocked()
+				c.mu.Unlock()
+				return
+			case <-signals:
+				c.toggle()
+			}
+		}
+	}()
+}
+
+// serveCaptureControl serves c over HTTP on addr until ctx is done.
+func serveCaptureControl(ctx context.Context, l *slog.Logger, c *captureControl, addr string) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		l.Warn("unable to serve capture control", "address", addr, "error", err)
+		return
+	}
+
+	srv := &http.Server{Handler: c, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+	go func() {
+		if err := srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			l.Warn("capture control stopped", "error", err)
+		}
+	}()
+	l.Info("serving capture control", "address", ln.Addr())
+}
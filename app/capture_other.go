@@ -0,0 +1,12 @@
+//go:build !linux && !darwin && !freebsd && !openbsd
+
+package app
+
+import "os"
+
+// captureToggleSignal is unset, there's no signal to toggle captures with.
+const captureToggleSignal = ""
+
+func notifyCaptureToggle(c chan<- os.Signal) bool {
+	return false
+}
@@ -0,0 +1,19 @@
+//go:build linux || darwin || freebsd || openbsd
+
+package app
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// captureToggleSignal stops and restarts packet captures.
+const captureToggleSignal = syscall.SIGUSR1
+
+// notifyCaptureToggle relays captureToggleSignal to c, and reports whether
+// the platform has it.
+func notifyCaptureToggle(c chan<- os.Signal) bool {
+	signal.Notify(c, captureToggleSignal)
+	return true
+}
@@ -0,0 +1,196 @@
+package ipscanner
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// EdgeOptions configures MeasureEdge.
+type EdgeOptions struct {
+	DownloadURL string        // Fetched to measure download throughput, empty to skip
+	UploadURL   string        // Posted to to measure upload throughput, empty to skip
+	UploadBytes int           // Size of the upload, zero for 5 MB
+	SNI         string        // TLS server name and trace host, defaults to the host of DownloadURL
+	Timeout     time.Duration // Limit for each request, zero for 10s
+	Insecure    bool          // Skip certificate verification
+}
+
+// MeasureEdge connects to the Cloudflare edge at info.AddrPort, reads the
+// data center serving it from /cdn-cgi/trace, and measures download and
+// upload throughput against the configured URLs. Requests are sent to the
+// edge whatever the URL host, so the results describe that edge IP. It
+// returns info with Colo, Download and Upload filled in.
+func MeasureEdge(ctx context.Context, info IPInfo, opts EdgeOptions) (IPInfo, error) {
+	if opts.Timeout <= 0 {
+		opts.Timeout = 10 * time.Second
+	}
+	if opts.UploadBytes <= 0 {
+		opts.UploadBytes = 5 << 20
+	}
+
+	sni := opts.SNI
+	if sni == "" {
+		u, err := url.Parse(opts.DownloadURL)
+		if err != nil {
+			return info, fmt.Errorf("invalid download url: %w", err)
+		}
+		sni = u.Hostname()
+	}
+	if sni == "" {
+		return info, errors.New("no sni and no download url to take it from")
+	}
+
+	client := edgeClient(info.AddrPort, sni, opts.Insecure)
+	defer client.CloseIdleConnections()
+
+	colo, err := edgeColo(ctx, client, sni, opts.Timeout)
+	if err != nil {
+		return info, fmt.Errorf("trace: %w", err)
+	}
+	info.Colo = colo
+
+	if opts.DownloadURL != "" {
+		info.Download, err = edgeDownload(ctx, client, opts.DownloadURL, opts.Timeout)
+		if err != nil {
+			return info, fmt.Errorf("download: %w", err)
+		}
+	}
+
+	if opts.UploadURL != "" {
+		info.Upload, err = edgeUpload(ctx, client, opts.UploadURL, opts.UploadBytes, opts.Timeout)
+		if err != nil {
+			return info, fmt.Errorf("upload: %w", err)
+		}
+	}
+
+	return info, nil
+}
+
+// edgeClient returns an HTTP client that sends every request to addr,
+// presenting sni in the TLS handshake.
+func edgeClient(addr netip.AddrPort, sni string, insecure bool) *http.Client {
+	dialer := &net.Dialer{Timeout: 5 * time.Second}
+	return &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				return dialer.DialContext(ctx, network, addr.String())
+			},
+			TLSClientConfig: &tls.Config{
+				ServerName:         sni,
+				InsecureSkipVerify: insecure,
+			},
+			ForceAttemptHTTP2:  true,
+			DisableCompression: true,
+		},
+	}
+}
+
+// edgeColo returns the colo field of the trace served by host.
+func edgeColo(ctx context.Context, client *http.Client, host string, timeout time.Duration) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "https://"+host+"/cdn-cgi/trace", nil)
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	s := bufio.NewScanner(resp.Body)
+	for s.Scan() {
+		if colo, found := strings.CutPrefix(s.Text(), "colo="); found {
+			return colo, nil
+		}
+	}
+	if err := s.Err(); err != nil {
+		return "", err
+	}
+	return "", errors.New("no colo in trace")
+}
+
+// edgeDownload fetches target and returns the throughput of the body in bytes
+// per second. A body cut short by the timeout still counts.
+func edgeDownload(ctx context.Context, client *http.Client, target string, timeout time.Duration) (float64, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	start := time.Now()
+	n, err := io.Copy(io.Discard, resp.Body)
+	elapsed := time.Since(start)
+	if err != nil && (n == 0 || ctx.Err() == nil) {
+		return 0, err
+	}
+
+	return throughput(n, elapsed), nil
+}
+
+// edgeUpload posts size bytes to target and returns the throughput in bytes
+// per second, timed until the response arrives.
+func edgeUpload(ctx context.Context, client *http.Client, target string, size int, timeout time.Duration) (float64, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target, bytes.NewReader(make([]byte, size)))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	elapsed := time.Since(start)
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	return throughput(int64(size), elapsed), nil
+}
+
+// throughput returns n bytes over d in bytes per second.
+func throughput(n int64, d time.Duration) float64 {
+	if d <= 0 {
+		return 0
+	}
+	return float64(n) / d.Seconds()
+}
@@ -0,0 +1,81 @@
+package ipscanner
+
+// Subscribe returns a channel of scan events with room for buffer events.
+// Probe events that don't fit are dropped rather than slowing the scan
+// down. Queue changes and the end of the scan make room by dropping the
+// oldest event instead, so the latest queue always arrives. The channel is
+// closed once the scan finished, and subscribing after that returns a
+// closed channel. A buffer below 1 is raised to 1, so that there always is
+// an event to drop.
+func (i *IPScanner) Subscribe(buffer int) <-chan Event {
+	ch := make(chan Event, max(buffer, 1))
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	select {
+	case <-i.done:
+		close(ch)
+	default:
+		i.subs = append(i.subs, ch)
+	}
+	return ch
+}
+
+// Done returns a channel that is closed once the scan finished.
+func (i *IPScanner) Done() <-chan struct{} {
+	return i.done
+}
+
+// Wait blocks until the scan finished and returns the best endpoints found.
+func (i *IPScanner) Wait() []IPInfo {
+	<-i.done
+	return i.GetAvailableIPs()
+}
+
+// emit hands ev to the event callback and every subscriber.
+func (i *IPScanner) emit(ev Event) {
+	if i.events != nil {
+		i.events(ev)
+	}
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	for _, ch := range i.subs {
+		select {
+		case ch <- ev:
+			continue
+		default:
+		}
+		if ev.Type != EventQueueChanged && ev.Type != EventFinished {
+			continue
+		}
+
+		// Only emit sends on ch, and i.mu is held, so once the oldest
+		// event is out there is room for ev.
+		select {
+		case <-ch:
+		default:
+		}
+		select {
+		case ch <- ev:
+		default:
+		}
+	}
+}
+
+// finish reports the end of the scan, closes the subscriber channels and
+// wakes up Wait.
+func (i *IPScanner) finish() {
+	i.emit(Event{Type: EventFinished})
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	for _, ch := range i.subs {
+		close(ch)
+	}
+	i.subs = nil
+	close(i.done)
+}
@@ -0,0 +1,161 @@
+package ipscanner
+
+import (
+	"context"
+	"slices"
+	"testing"
+	"time"
+)
+
+// drain returns the types of the events buffered in ch, and whether ch was
+// closed.
+func drain(ch <-chan Event) ([]EventType, bool) {
+	var types []EventType
+	for {
+		select {
+		case ev, ok := <-ch:
+			if !ok {
+				return types, true
+			}
+			types = append(types, ev.Type)
+		default:
+			return types, false
+		}
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	tests := []struct {
+		name   string
+		buffer int
+		emit   []EventType
+		finish bool
+		want   []EventType
+	}{
+		{
+			name:   "room for everything",
+			buffer: 4,
+			emit:   []EventType{EventProbeStarted, EventProbeSucceeded, EventQueueChanged},
+			want:   []EventType{EventProbeStarted, EventProbeSucceeded, EventQueueChanged},
+		},
+		{
+			name:   "probes dropped when full",
+			buffer: 2,
+			emit:   []EventType{EventProbeStarted, EventProbeFailed, EventProbeStarted, EventProbeSucceeded},
+			want:   []EventType{EventProbeStarted, EventProbeFailed},
+		},
+		{
+			name:   "queue change evicts the oldest",
+			buffer: 2,
+			emit:   []EventType{EventProbeStarted, EventProbeSucceeded, EventQueueChanged, EventProbeFailed},
+			want:   []EventType{EventProbeSucceeded, EventQueueChanged},
+		},
+		{
+			name:   "latest queue kept",
+			buffer: 1,
+			emit:   []EventType{EventQueueChanged, EventQueueChanged, EventProbeStarted},
+			want:   []EventType{EventQueueChanged},
+		},
+		{
+			name:   "finish evicts the oldest",
+			buffer: 2,
+			emit:   []EventType{EventProbeStarted, EventProbeSucceeded},
+			finish: true,
+			want:   []EventType{EventProbeSucceeded, EventFinished},
+		},
+		{
+			name: "zero buffer holds one",
+			emit: []EventType{EventProbeStarted, EventQueueChanged, EventProbeFailed},
+			want: []EventType{EventQueueChanged},
+		},
+		{
+			name:   "zero buffer gets the end",
+			emit:   []EventType{EventProbeStarted, EventQueueChanged},
+			finish: true,
+			want:   []EventType{EventFinished},
+		},
+		{
+			name:   "negative buffer",
+			buffer: -1,
+			emit:   []EventType{EventQueueChanged},
+			want:   []EventType{EventQueueChanged},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var called []EventType
+			i := NewScanner(WithEventCallback(func(ev Event) { called = append(called, ev.Type) }))
+			ch := i.Subscribe(tt.buffer)
+
+			for _, typ := range tt.emit {
+				i.emit(Event{Type: typ})
+			}
+			if tt.finish {
+				i.finish()
+			}
+
+			got, closed := drain(ch)
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("got events %v, want %v", got, tt.want)
+			}
+			if closed != tt.finish {
+				t.Errorf("got closed %v, want %v", closed, tt.finish)
+			}
+
+			// The callback misses nothing.
+			wantCalled := slices.Clone(tt.emit)
+			if tt.finish {
+				wantCalled = append(wantCalled, EventFinished)
+			}
+			if !slices.Equal(called, wantCalled) {
+				t.Errorf("callback got %v, want %v", called, wantCalled)
+			}
+		})
+	}
+}
+
+func TestSubscribeAfterFinish(t *testing.T) {
+	i := NewScanner()
+	i.finish()
+
+	got, closed := drain(i.Subscribe(4))
+	if len(got) != 0 || !closed {
+		t.Errorf("got events %v and closed %v, want none and closed", got, closed)
+	}
+}
+
+func TestWait(t *testing.T) {
+	// Nothing to scan, so the scan finishes right away.
+	i := NewScanner(WithUseIPv4(false), WithUseIPv6(false))
+	ch := i.Subscribe(1)
+
+	select {
+	case <-i.Done():
+		t.Fatal("done before the scan ran")
+	default:
+	}
+
+	i.Run(context.Background())
+
+	waited := make(chan []IPInfo)
+	go func() { waited <- i.Wait() }()
+	select {
+	case ips := <-waited:
+		if len(ips) != 0 {
+			t.Errorf("got %v, want no endpoints", ips)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Wait didn't return")
+	}
+
+	select {
+	case <-i.Done():
+	default:
+		t.Error("Done not closed after Wait returned")
+	}
+	got, closed := drain(ch)
+	if !slices.Equal(got, []EventType{EventFinished}) || !closed {
+		t.Errorf("got events %v and closed %v, want %v and closed", got, closed, []EventType{EventFinished})
+	}
+}
@@ -4,20 +4,31 @@ import (
 	"context"
 	"log/slog"
 	"net/netip"
+	"sync"
 	"time"
 
 	"github.com/bepass-org/warp-plus/ipscanner/internal/iterator"
 	"github.com/bepass-org/warp-plus/ipscanner/internal/ping"
 	"github.com/bepass-org/warp-plus/ipscanner/internal/statute"
+	"github.com/bepass-org/warp-plus/warp"
 )
 
+// defaultConcurrency is the number of probes in flight when the options
+// don't set one.
+const defaultConcurrency = 16
+
 // Engine represents the scanner engine that generates IP addresses, pings them,
 // and manages the IP queue.
 type Engine struct {
-	generator *iterator.IpGenerator   // IP address generator
-	ipQueue   *IPQueue                // IP address queue
-	ping      func(netip.Addr) (statute.IPInfo, error) // Ping function to check IP availability
-	log       *slog.Logger             // Logger for the engine
+	generator *iterator.IpGenerator                                             // IP address generator
+	ipQueue   *IPQueue                                                          // IP address queue
+	ping      func(context.Context, netip.Addr, uint16) (statute.IPInfo, error) // Ping function to check IP availability
+	log       *slog.Logger                                                      // Logger for the engine
+	opts      *statute.ScannerOptions                                           // Scanner options
+	ports     *portSampler                                                      // Port picker that learns reachable ports
+	limiter   *limiter                                                          // Paces all probes, nil for no limit
+	goodMu    sync.Mutex                                                        // Protects good
+	good      map[netip.AddrPort]struct{}                                       // Endpoints within MaxDesirableRTT so far
 }
 
 // NewScannerEngine initializes and returns a new ScannerEngine instance.
@@ -32,6 +43,23 @@ func NewScannerEngine(opts *statute.ScannerOptions) *Engine {
 		ping:      p.DoPing,
 		generator: iterator.NewIterator(opts),
 		log:       opts.Logger.With(slog.String("subsystem", "scanner/engine")),
+		opts:      opts,
+		ports:     newPortSampler(candidatePorts(opts), opts.Seed),
+		limiter:   newLimiter(opts.RateLimit),
+		good:      make(map[netip.AddrPort]struct{}),
+	}
+}
+
+// candidatePorts returns the ports probes are spread over: the configured
+// Ports, every WARP port for WARP-only scans, or the single Port otherwise.
+func candidatePorts(opts *statute.ScannerOptions) []uint16 {
+	switch {
+	case len(opts.Ports) > 0:
+		return opts.Ports
+	case opts.SelectedOps == statute.WARPPing:
+		return warp.WarpPorts()
+	default:
+		return []uint16{opts.Port}
 	}
 }
 
@@ -43,11 +71,188 @@ func (e *Engine) GetAvailableIPs(desc bool) []statute.IPInfo {
 	return nil
 }
 
-// Run is the main function of the engine that runs the IP scanning process in a loop.
+// PortStats returns how many probes went to each port and how many of them
+// succeeded.
+func (e *Engine) PortStats() []statute.PortStat {
+	return e.ports.Stats()
+}
+
+// target is a single probe handed to a worker.
+type target struct {
+	addr netip.Addr
+	port uint16
+}
+
+// Run is the main function of the engine. It feeds generated addresses to
+// a pool of Concurrency workers, paced to RateLimit probes per second, and
+// returns when ctx is done or StopAfter good endpoints were found.
 func (e *Engine) Run(ctx context.Context) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	concurrency := e.opts.Concurrency
+	if concurrency <= 0 {
+		concurrency = defaultConcurrency
+	}
+
+	targets := make(chan target)
+
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			e.worker(ctx, cancel, targets)
+		}()
+	}
+
+	e.produce(ctx, targets)
+	close(targets)
+	wg.Wait()
+	e.limiter.Stop()
+}
+
+// produce sends targets until ctx is done. It pauses while the queue is in
+// ideal mode and expires old queue members meanwhile.
+//
+// Each batch from the generator holds as many addresses as there are
+// prefixes, each from a sub-prefix weighted by how well it answered so far.
+// Each address is paired with a port from the port sampler, which favors
+// ports that answered before.
+func (e *Engine) produce(ctx context.Context, targets chan<- target) {
+	t := time.NewTicker(200 * time.Millisecond)
+	defer t.Stop()
+
 	for {
-		select {
-		case <-ctx.Done():
-			return
-		case <-e.ipQueue.available:
-	
+		if e.ipQueue.Expire() {
+			e.queueChanged()
+		}
+		if e.ipQueue.Ideal() {
+			select {
+			case <-ctx.Done():
+				return
+			case <-e.ipQueue.available:
+			case <-t.C:
+			}
+			continue
+		}
+
+		batch, err := e.generator.NextBatch()
+		if err != nil {
+			e.log.Error("error while generating IP", "error", err)
+			// in case of disastrous error, to prevent resource draining wait for 2 seconds and try again
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(2 * time.Second):
+			}
+			continue
+		}
+
+		for _, ip := range batch {
+			if err := e.limiter.Wait(ctx); err != nil {
+				return
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case targets <- target{addr: ip, port: e.ports.Pick()}:
+			}
+		}
+	}
+}
+
+// worker probes targets and feeds the results into the queue. It calls stop
+// once StopAfter good endpoints were found.
+func (e *Engine) worker(ctx context.Context, stop context.CancelFunc, targets <-chan target) {
+	for t := range targets {
+		if ctx.Err() != nil {
+			continue
+		}
+
+		addr := netip.AddrPortFrom(t.addr, t.port)
+		e.log.Debug("pinging IP", "addr", t.addr, "port", t.port)
+		e.emit(statute.Event{Type: statute.EventProbeStarted, AddrPort: addr})
+		ipInfo, err := e.ping(ctx, t.addr, t.port)
+		if ctx.Err() != nil {
+			// Cancelled probes say nothing about the endpoint.
+			continue
+		}
+		e.ports.Record(t.port, err == nil)
+		e.generator.Record(t.addr, err == nil)
+		if err != nil {
+			e.log.Debug("ping error", "addr", t.addr, "error", err)
+			e.emit(statute.Event{Type: statute.EventProbeFailed, AddrPort: addr, Err: err})
+			continue
+		}
+
+		ipInfo = e.sample(ctx, ipInfo)
+		e.log.Debug("ping success", "addr", ipInfo.AddrPort, "rtt", ipInfo.RTT, "jitter", ipInfo.Jitter, "loss", ipInfo.Loss)
+		e.emit(statute.Event{Type: statute.EventProbeSucceeded, AddrPort: ipInfo.AddrPort, Info: ipInfo})
+		if e.ipQueue.Enqueue(ipInfo) {
+			e.queueChanged()
+		}
+
+		if ipInfo.RTT > e.opts.MaxDesirableRTT {
+			continue
+		}
+		if n := e.addGood(ipInfo.AddrPort); e.opts.StopAfter > 0 && n >= e.opts.StopAfter {
+			e.log.Debug("found enough endpoints, stopping", "count", n)
+			stop()
+		}
+	}
+}
+
+// addGood records addr as an endpoint within MaxDesirableRTT and returns
+// how many distinct ones were found, so that probing an endpoint again
+// doesn't count it twice.
+func (e *Engine) addGood(addr netip.AddrPort) int {
+	e.goodMu.Lock()
+	defer e.goodMu.Unlock()
+
+	e.good[addr] = struct{}{}
+	return len(e.good)
+}
+
+// emit hands ev to the event callback, if any.
+func (e *Engine) emit(ev statute.Event) {
+	if e.opts.EventCallback != nil {
+		e.opts.EventCallback(ev)
+	}
+}
+
+// queueChanged reports the current queue to the queue change and event
+// callbacks.
+func (e *Engine) queueChanged() {
+	if e.opts.IPQueueChangeCallback == nil && e.opts.EventCallback == nil {
+		return
+	}
+
+	ips := e.ipQueue.AvailableIPs(false)
+	if e.opts.IPQueueChangeCallback != nil {
+		e.opts.IPQueueChangeCallback(ips)
+	}
+	e.emit(statute.Event{Type: statute.EventQueueChanged, Queue: ips})
+}
+
+// sample probes an endpoint that answered its first probe Samples-1 more
+// times and returns its figures over the whole window. Only endpoints that
+// answer get the extra probes, so dead addresses cost a single probe.
+func (e *Engine) sample(ctx context.Context, first statute.IPInfo) statute.IPInfo {
+	rtts := []time.Duration{first.RTT}
+
+	sent := 1
+	for ; sent < e.opts.Samples; sent++ {
+		if err := e.limiter.Wait(ctx); err != nil {
+			break
+		}
+
+		res, err := e.ping(ctx, first.AddrPort.Addr(), first.AddrPort.Port())
+		if err == nil {
+			rtts = append(rtts, res.RTT)
+		}
+	}
+
+	return statute.NewIPInfoFromSamples(first.AddrPort, rtts, sent)
+}
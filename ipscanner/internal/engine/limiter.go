@@ -0,0 +1,48 @@
+package engine
+
+import (
+	"context"
+	"time"
+)
+
+// limiter paces probes to a fixed number per second. A nil limiter never
+// waits.
+type limiter struct {
+	ticker *time.Ticker
+}
+
+// newLimiter returns a limiter for pps probes per second, or nil if pps is
+// not positive.
+func newLimiter(pps int) *limiter {
+	if pps <= 0 {
+		return nil
+	}
+
+	interval := time.Second / time.Duration(pps)
+	if interval <= 0 {
+		return nil
+	}
+
+	return &limiter{ticker: time.NewTicker(interval)}
+}
+
+// Wait blocks until the next probe may start or ctx is done.
+func (l *limiter) Wait(ctx context.Context) error {
+	if l == nil {
+		return nil
+	}
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-l.ticker.C:
+		return nil
+	}
+}
+
+// Stop releases the limiter's ticker.
+func (l *limiter) Stop() {
+	if l != nil {
+		l.ticker.Stop()
+	}
+}
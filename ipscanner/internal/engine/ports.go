@@ -0,0 +1,120 @@
+package engine
+
+import (
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/bepass-org/warp-plus/ipscanner/internal/statute"
+)
+
+const (
+	// portExplore is the share of probes sent to a uniformly chosen port,
+	// regardless of how it did so far.
+	portExplore = 0.1
+	// portGiveUp is the number of failed probes after which a port that
+	// never answered only gets exploration probes.
+	portGiveUp = 16
+)
+
+// portSampler picks the port for each probe. It starts out uniform and
+// shifts probes toward ports that answered, so that on networks blocking
+// some ports most probes go to ports that work.
+type portSampler struct {
+	mu    sync.Mutex
+	ports []uint16
+	stats map[uint16]*statute.PortStat
+	rng   *rand.Rand
+}
+
+// newPortSampler returns a sampler over ports. A non-zero seed makes the
+// picks reproducible.
+func newPortSampler(ports []uint16, seed int64) *portSampler {
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+
+	s := &portSampler{
+		ports: ports,
+		stats: make(map[uint16]*statute.PortStat, len(ports)),
+		rng:   rand.New(rand.NewSource(seed)),
+	}
+	for _, port := range ports {
+		s.stats[port] = &statute.PortStat{Port: port}
+	}
+	return s
+}
+
+// Pick returns the port for the next probe, or zero if there are no ports
+// to choose from.
+func (s *portSampler) Pick() uint16 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch len(s.ports) {
+	case 0:
+		return 0
+	case 1:
+		return s.ports[0]
+	}
+
+	if s.rng.Float64() < portExplore {
+		return s.ports[s.rng.Intn(len(s.ports))]
+	}
+
+	// Weigh each port by its smoothed success rate.
+	weights := make([]float64, len(s.ports))
+	total := 0.0
+	for i, port := range s.ports {
+		st := s.stats[port]
+		if st.Successes == 0 && st.Attempts >= portGiveUp {
+			continue
+		}
+		weights[i] = float64(st.Successes+1) / float64(st.Attempts+2)
+		total += weights[i]
+	}
+
+	if total == 0 {
+		return s.ports[s.rng.Intn(len(s.ports))]
+	}
+
+	r := s.rng.Float64() * total
+	for i, w := range weights {
+		if r < w {
+			return s.ports[i]
+		}
+		r -= w
+	}
+	return s.ports[len(s.ports)-1]
+}
+
+// Record counts a probe of port and whether it succeeded.
+func (s *portSampler) Record(port uint16, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	st, found := s.stats[port]
+	if !found {
+		return
+	}
+	st.Attempts++
+	if ok {
+		st.Successes++
+	}
+}
+
+// Stats returns the probe counts of every port, ordered by port.
+func (s *portSampler) Stats() []statute.PortStat {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	res := make([]statute.PortStat, 0, len(s.stats))
+	for _, st := range s.stats {
+		res = append(res, *st)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Port < res[j].Port
+	})
+	return res
+}
@@ -0,0 +1,117 @@
+package engine
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/bepass-org/warp-plus/ipscanner/internal/statute"
+)
+
+func TestPortSamplerPick(t *testing.T) {
+	const picks = 10000
+
+	// train records the probes of each port as attempts and successes.
+	type train map[uint16][2]int
+
+	tests := []struct {
+		name  string
+		ports []uint16
+		train train
+		// Share of picks each port must get, as min and max.
+		want map[uint16][2]float64
+	}{
+		{
+			name: "no ports",
+			want: map[uint16][2]float64{0: {1, 1}},
+		},
+		{
+			name:  "single port",
+			ports: []uint16{2408},
+			train: train{2408: {100, 0}},
+			want:  map[uint16][2]float64{2408: {1, 1}},
+		},
+		{
+			name:  "untrained is uniform",
+			ports: []uint16{500, 854, 2408, 4500},
+			want: map[uint16][2]float64{
+				500:  {0.22, 0.28},
+				854:  {0.22, 0.28},
+				2408: {0.22, 0.28},
+				4500: {0.22, 0.28},
+			},
+		},
+		{
+			name:  "answering port preferred",
+			ports: []uint16{500, 854, 2408},
+			train: train{500: {portGiveUp, 0}, 854: {portGiveUp, 0}, 2408: {portGiveUp, portGiveUp}},
+			// Ports that gave up only get their share of exploration.
+			want: map[uint16][2]float64{
+				500:  {0.02, 0.05},
+				854:  {0.02, 0.05},
+				2408: {0.9, 0.96},
+			},
+		},
+		{
+			name:  "failing port not given up yet",
+			ports: []uint16{500, 2408},
+			train: train{500: {portGiveUp - 1, 0}, 2408: {portGiveUp - 1, portGiveUp - 1}},
+			// Weights 1/17 and 16/17, plus exploration.
+			want: map[uint16][2]float64{
+				500:  {0.07, 0.13},
+				2408: {0.87, 0.93},
+			},
+		},
+		{
+			name:  "all given up is uniform",
+			ports: []uint16{500, 2408},
+			train: train{500: {portGiveUp, 0}, 2408: {portGiveUp * 2, 0}},
+			want: map[uint16][2]float64{
+				500:  {0.47, 0.53},
+				2408: {0.47, 0.53},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newPortSampler(tt.ports, 42)
+			for port, counts := range tt.train {
+				for i := 0; i < counts[0]; i++ {
+					s.Record(port, i < counts[1])
+				}
+			}
+
+			got := make(map[uint16]int)
+			for i := 0; i < picks; i++ {
+				got[s.Pick()]++
+			}
+			for port, n := range got {
+				if _, ok := tt.want[port]; !ok {
+					t.Errorf("picked port %d %d times, want never", port, n)
+				}
+			}
+			for port, share := range tt.want {
+				if f := float64(got[port]) / picks; f < share[0] || f > share[1] {
+					t.Errorf("port %d got %.3f of picks, want %.2f to %.2f", port, f, share[0], share[1])
+				}
+			}
+		})
+	}
+}
+
+func TestPortSamplerStats(t *testing.T) {
+	s := newPortSampler([]uint16{2408, 500, 854}, 42)
+	s.Record(2408, true)
+	s.Record(2408, false)
+	s.Record(500, false)
+	s.Record(1234, true) // Not sampled, ignored
+
+	want := []statute.PortStat{
+		{Port: 500, Attempts: 1},
+		{Port: 854},
+		{Port: 2408, Attempts: 2, Successes: 1},
+	}
+	if got := s.Stats(); !slices.Equal(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
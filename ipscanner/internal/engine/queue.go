@@ -2,6 +2,8 @@ package engine
 
 import (
 	"log/slog"
+	"net/netip"
+	"slices"
 	"sort"
 	"sync"
 	"time"
@@ -9,17 +11,17 @@ import (
 	"github.com/bepass-org/warp-plus/ipscanner/internal/statute"
 )
 
-// IPQueue represents a queue of IPInfo structs with a limited size and RTT-based sorting.
+// IPQueue represents a queue of IPInfo structs with a limited size and score-based sorting.
 type IPQueue struct {
-	queue        []statute.IPInfo       // The main IPInfo queue
-	maxQueueSize int                    // Maximum queue size
-	mu           sync.Mutex             // Mutex for thread safety
-	available    chan struct{}           // Channel for signaling available queue slots
-	maxTTL       time.Duration          // Maximum Time To Live for IPInfo entries
-	rttThreshold time.Duration          // RTT threshold for queue membership
-	inIdealMode  bool                   // Flag indicating if the queue is in ideal mode
-	log          *slog.Logger            // Logger for the queue
-	reserved     statute.IPInfQueue     // Queue for reserved IPInfos
+	queue        []statute.IPInfo   // The main IPInfo queue
+	maxQueueSize int                // Maximum queue size
+	mu           sync.Mutex         // Mutex for thread safety
+	available    chan struct{}      // Channel for signaling available queue slots
+	maxTTL       time.Duration      // Maximum Time To Live for IPInfo entries
+	rttThreshold time.Duration      // RTT threshold for queue membership
+	inIdealMode  bool               // Flag indicating if the queue is in ideal mode
+	log          *slog.Logger       // Logger for the queue
+	reserved     statute.IPInfQueue // Queue for reserved IPInfos
 }
 
 // NewIPQueue creates a new IPQueue instance with the given options.
@@ -29,4 +31,136 @@ func NewIPQueue(opts *statute.ScannerOptions) *IPQueue {
 		queue:        make([]statute.IPInfo, 0),
 		maxQueueSize: opts.IPQueueSize,
 		maxTTL:       opts.IPQueueTTL,
-	
+		rttThreshold: opts.MaxDesirableRTT,
+		available:    make(chan struct{}, 1),
+		log:          opts.Logger.With(slog.String("subsystem", "engine/queue")),
+	}
+}
+
+// Enqueue adds info to the queue in score order, replacing the entry of the
+// same endpoint if there is one. Once the queue is full of members within
+// the RTT threshold it enters ideal mode, and further good results are kept
+// in the reserved queue until members expire. It reports whether the members
+// of the queue changed.
+func (q *IPQueue) Enqueue(info statute.IPInfo) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if info.RTT > q.rttThreshold {
+		return false
+	}
+
+	// A new probe of a member replaces its entry, placed by the new score.
+	if i := q.index(info.AddrPort); i >= 0 {
+		q.queue = slices.Delete(q.queue, i, i+1)
+	}
+
+	changed := true
+	switch {
+	case len(q.queue) < q.maxQueueSize:
+		// Insert the new item in a sorted position.
+		index := sort.Search(len(q.queue), func(i int) bool { return q.queue[i].Score() > info.Score() })
+		q.queue = append(q.queue[:index], append([]statute.IPInfo{info}, q.queue[index:]...)...)
+	case info.Score() < q.queue[len(q.queue)-1].Score():
+		// The queue is full, the worst member moves to the reserved queue.
+		q.reserved.Enqueue(q.queue[len(q.queue)-1])
+		index := sort.Search(len(q.queue)-1, func(i int) bool { return q.queue[i].Score() > info.Score() })
+		q.queue = append(q.queue[:index], append([]statute.IPInfo{info}, q.queue[index:len(q.queue)-1]...)...)
+	default:
+		// The queue is full but we keep the new item in the reserved queue.
+		q.reserved.Enqueue(info)
+		changed = false
+	}
+
+	q.log.Debug("queue change", "len", len(q.queue), "reserved", q.reserved.Size())
+
+	q.inIdealMode = len(q.queue) >= q.maxQueueSize
+	return changed
+}
+
+// Expire removes members older than the queue TTL and refills the queue
+// from the reserved queue. If the queue is left with free slots it leaves
+// ideal mode and signals that scanning should resume. It reports whether
+// the members of the queue changed.
+func (q *IPQueue) Expire() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	expired, refilled := false, false
+	resQ := make([]statute.IPInfo, 0, len(q.queue))
+	for _, info := range q.queue {
+		if time.Since(info.CreatedAt) > q.maxTTL {
+			expired = true
+			continue
+		}
+		resQ = append(resQ, info)
+	}
+	q.queue = resQ
+
+	for len(q.queue) < q.maxQueueSize && !q.reserved.IsEmpty() {
+		info := q.reserved.Dequeue()
+		// The reserved queue may still hold an older result of a member.
+		if time.Since(info.CreatedAt) > q.maxTTL || q.index(info.AddrPort) >= 0 {
+			continue
+		}
+		q.queue = append(q.queue, info)
+		refilled = true
+	}
+	sort.Slice(q.queue, func(i, j int) bool {
+		return q.queue[i].Score() < q.queue[j].Score()
+	})
+
+	if expired {
+		q.log.Debug("expired queue members", "len", len(q.queue))
+	}
+
+	if len(q.queue) < q.maxQueueSize && q.inIdealMode {
+		q.inIdealMode = false
+		q.signal()
+	}
+
+	return expired || refilled
+}
+
+// Ideal reports whether the queue is full of members within the RTT
+// threshold, in which case there is no need to keep scanning.
+func (q *IPQueue) Ideal() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.inIdealMode
+}
+
+// index returns the position of the member for addr, or -1 if there is
+// none. q.mu must be held.
+func (q *IPQueue) index(addr netip.AddrPort) int {
+	return slices.IndexFunc(q.queue, func(info statute.IPInfo) bool { return info.AddrPort == addr })
+}
+
+// signal wakes up a scanner waiting for free slots. q.mu must be held.
+func (q *IPQueue) signal() {
+	select {
+	case q.available <- struct{}{}:
+	default:
+	}
+}
+
+// AvailableIPs returns a copy of the queue sorted by score, best first
+// unless desc is set.
+func (q *IPQueue) AvailableIPs(desc bool) []statute.IPInfo {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	// Create a separate slice for sorting
+	sortedQueue := make([]statute.IPInfo, len(q.queue))
+	copy(sortedQueue, q.queue)
+
+	// Sort by score ascending/descending
+	sort.Slice(sortedQueue, func(i, j int) bool {
+		if desc {
+			return sortedQueue[i].Score() > sortedQueue[j].Score()
+		}
+		return sortedQueue[i].Score() < sortedQueue[j].Score()
+	})
+
+	return sortedQueue
+}
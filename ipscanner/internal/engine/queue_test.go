@@ -0,0 +1,130 @@
+package engine
+
+import (
+	"log/slog"
+	"net/netip"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/bepass-org/warp-plus/ipscanner/internal/statute"
+)
+
+func TestIPQueueEnqueue(t *testing.T) {
+	ms := time.Millisecond
+	a := netip.MustParseAddrPort("162.159.192.1:2408")
+	b := netip.MustParseAddrPort("162.159.192.2:2408")
+	c := netip.MustParseAddrPort("162.159.192.3:2408")
+
+	type probe struct {
+		addr netip.AddrPort
+		rtt  time.Duration
+	}
+
+	tests := []struct {
+		name    string
+		probes  []probe
+		want    []netip.AddrPort // Members, best first
+		changed []bool
+	}{
+		{
+			name:    "sorted by score",
+			probes:  []probe{{a, 80 * ms}, {b, 40 * ms}, {c, 60 * ms}},
+			want:    []netip.AddrPort{b, c, a},
+			changed: []bool{true, true, true},
+		},
+		{
+			name:    "over the threshold",
+			probes:  []probe{{a, 80 * ms}, {b, time.Second}},
+			want:    []netip.AddrPort{a},
+			changed: []bool{true, false},
+		},
+		{
+			name:    "probed again better",
+			probes:  []probe{{a, 80 * ms}, {b, 60 * ms}, {a, 40 * ms}},
+			want:    []netip.AddrPort{a, b},
+			changed: []bool{true, true, true},
+		},
+		{
+			name:    "probed again worse",
+			probes:  []probe{{a, 40 * ms}, {b, 60 * ms}, {a, 80 * ms}},
+			want:    []netip.AddrPort{b, a},
+			changed: []bool{true, true, true},
+		},
+		{
+			name:    "full queue probed again",
+			probes:  []probe{{a, 40 * ms}, {b, 60 * ms}, {c, 80 * ms}, {b, 50 * ms}, {c, 90 * ms}},
+			want:    []netip.AddrPort{a, b, c},
+			changed: []bool{true, true, true, true, true},
+		},
+		{
+			name:    "full queue member probed worse",
+			probes:  []probe{{a, 40 * ms}, {b, 60 * ms}, {c, 80 * ms}, {c, 200 * ms}},
+			want:    []netip.AddrPort{a, b, c},
+			changed: []bool{true, true, true, true},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := NewIPQueue(&statute.ScannerOptions{
+				IPQueueSize:     3,
+				IPQueueTTL:      time.Minute,
+				MaxDesirableRTT: 400 * ms,
+				Logger:          slog.Default(),
+			})
+
+			for i, p := range tt.probes {
+				info := statute.NewIPInfoFromSamples(p.addr, []time.Duration{p.rtt}, 1)
+				if got := q.Enqueue(info); got != tt.changed[i] {
+					t.Errorf("probe %d: got changed %v, want %v", i, got, tt.changed[i])
+				}
+			}
+
+			var got []netip.AddrPort
+			for _, info := range q.AvailableIPs(false) {
+				got = append(got, info.AddrPort)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("got members %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIPQueueExpireSkipsMembers(t *testing.T) {
+	ms := time.Millisecond
+	a := netip.MustParseAddrPort("162.159.192.1:2408")
+	b := netip.MustParseAddrPort("162.159.192.2:2408")
+	c := netip.MustParseAddrPort("162.159.192.3:2408")
+
+	q := NewIPQueue(&statute.ScannerOptions{
+		IPQueueSize:     2,
+		IPQueueTTL:      time.Minute,
+		MaxDesirableRTT: 400 * ms,
+		Logger:          slog.Default(),
+	})
+	info := func(addr netip.AddrPort, rtt time.Duration, age time.Duration) statute.IPInfo {
+		info := statute.NewIPInfoFromSamples(addr, []time.Duration{rtt}, 1)
+		info.CreatedAt = time.Now().Add(-age)
+		return info
+	}
+
+	q.Enqueue(info(c, 30*ms, 2*time.Minute)) // Expires
+	q.Enqueue(info(b, 60*ms, 0))
+	q.Enqueue(info(a, 50*ms, 2*time.Minute)) // b moves to the reserved queue
+	q.Enqueue(info(b, 45*ms, 0))             // b is back, a moves to the reserved queue
+
+	if !q.Expire() {
+		t.Error("got unchanged, want c expired")
+	}
+
+	// Neither a, expired, nor the older result of b refill the queue.
+	var got []netip.AddrPort
+	for _, info := range q.AvailableIPs(false) {
+		got = append(got, info.AddrPort)
+	}
+	if want := []netip.AddrPort{b}; !slices.Equal(got, want) {
+		t.Errorf("got members %v, want %v", got, want)
+	}
+}
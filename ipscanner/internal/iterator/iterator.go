@@ -1,16 +1,31 @@
 package iterator
 
 import (
-	"crypto/rand"
 	"errors"
 	"math/big"
-	"net"
+	"math/rand"
 	"net/netip"
+	"slices"
+	"sync"
+	"time"
 
-	"github.com/bepass-org/warp-plus/ipscanner/internal/cache"
 	"github.com/bepass-org/warp-plus/ipscanner/internal/statute"
 )
 
+const (
+	// maxSplitBits limits how many sub-prefixes a prefix is split into,
+	// 1<<maxSplitBits at most.
+	maxSplitBits = 4
+	// explore is the share of addresses drawn from a uniformly chosen
+	// sub-prefix of the next prefix in turn, regardless of past results.
+	explore = 0.2
+	// giveUp is the number of failed probes after which a sub-prefix that
+	// never answered only gets exploration probes.
+	giveUp = 8
+	// maxExcludedTries bounds the draws spent skipping excluded addresses.
+	maxExcludedTries = 64
+)
+
 // LCG represents a linear congruential generator with full period.
 type LCG struct {
 	modulus    *big.Int // Modulus of the LCG
@@ -19,76 +34,333 @@ type LCG struct {
 	current    *big.Int // Current value of the LCG
 }
 
-// NewLCG creates a new LCG instance with a given size.
-func NewLCG(size *big.Int) *LCG {
-	// Initialize a new LCG with the given size
+// NewLCG creates a new LCG instance with a given size, drawing its
+// parameters from rng.
+func NewLCG(size *big.Int, rng *rand.Rand) *LCG {
+	modulus := new(big.Int).Set(size)
+
+	// Generate random multiplier (a) and increment (c) that satisfy Hull-Dobell Theorem
+	var multiplier, increment *big.Int
+	for {
+		multiplier = new(big.Int).Rand(rng, modulus)
+		increment = new(big.Int).Rand(rng, modulus)
+		if checkHullDobell(modulus, multiplier, increment) {
+			break
+		}
+	}
+
+	return &LCG{
+		modulus:    modulus,
+		multiplier: multiplier,
+		increment:  increment,
+		current:    big.NewInt(0),
+	}
 }
 
 // checkHullDobell checks if the given parameters satisfy the Hull-Dobell Theorem.
+// Range sizes are powers of two, so 2 is the only prime factor to check.
 func checkHullDobell(modulus, multiplier, increment *big.Int) bool {
-	// Check if the given parameters satisfy the Hull-Dobell Theorem
+	// c and m are relatively prime
+	gcd := new(big.Int).GCD(nil, nil, increment, modulus)
+	if gcd.Cmp(big.NewInt(1)) != 0 {
+		return false
+	}
+
+	aMinusOne := new(big.Int).Sub(multiplier, big.NewInt(1))
+
+	// a - 1 is divisible by all prime factors of m
+	if modulus.Bit(0) == 0 && aMinusOne.Bit(0) != 0 {
+		return false
+	}
+
+	// a - 1 is divisible by 4 if m is divisible by 4
+	if new(big.Int).And(modulus, big.NewInt(3)).Sign() == 0 {
+		if new(big.Int).And(aMinusOne, big.NewInt(3)).Sign() != 0 {
+			return false
+		}
+	}
+
+	return true
 }
 
 // Next generates the next number in the sequence.
 func (lcg *LCG) Next() *big.Int {
-	// Generate the next number in the LCG sequence
+	next := new(big.Int)
+	next.Mul(lcg.multiplier, lcg.current)
+	next.Add(next, lcg.increment)
+	next.Mod(next, lcg.modulus)
+	lcg.current.Set(next)
+	return next
 }
 
 // ipRange represents a range of IP addresses with associated LCG and size.
+// Every range is one arm of the sampler, with its own probe record.
 type ipRange struct {
-	lcg   *LCG   // LCG for generating IP addresses in the range
-	start netip.Addr  // Starting IP address of the range
-	stop  netip.Addr  // Ending IP address of the range
-	size  *big.Int  // Size of the range
-	index *big.Int  // Current index of the range
+	lcg       *LCG         // LCG for generating IP addresses in the range
+	prefix    netip.Prefix // Prefix covering the range
+	start     netip.Addr   // Starting IP address of the range
+	stop      netip.Addr   // Ending IP address of the range
+	size      *big.Int     // Size of the range
+	index     *big.Int     // Current index of the range
+	attempts  int          // Probes sent to addresses of the range
+	successes int          // Probes that got an answer
 }
 
 // newIPRange creates a new ipRange instance for a given CIDR prefix.
-func newIPRange(cidr netip.Prefix) (ipRange, error) {
-	// Create a new ipRange instance for the given CIDR prefix
-}
-
-// lastIP calculates the last IP address in a given CIDR prefix.
-func lastIP(prefix netip.Prefix) netip.Addr {
-	// Calculate the last IP address in the given CIDR prefix
+func newIPRange(cidr netip.Prefix, rng *rand.Rand) ipRange {
+	size := ipRangeSize(cidr)
+	return ipRange{
+		lcg:    NewLCG(size, rng),
+		prefix: cidr,
+		start:  cidr.Addr(),
+		stop:   lastIP(cidr),
+		size:   size,
+		index:  big.NewInt(0),
+	}
 }
 
-// ipToBigInt converts a netip.Addr to a *big.Int.
-func ipToBigInt(ip netip.Addr) *big.Int {
-	// Convert a netip.Addr to a *big.Int
+// weight returns the smoothed success rate of the range, or zero if it
+// looks dead.
+func (r *ipRange) weight() float64 {
+	if r.successes == 0 && r.attempts >= giveUp {
+		return 0
+	}
+	return float64(r.successes+1) / float64(r.attempts+2)
 }
 
-// bigIntToIP converts a *big.Int to a netip.Addr.
-func bigIntToIP(n *big.Int) netip.Addr {
-	// Convert a *big.Int to a netip.Addr
+// lastIP calculates the last IP address in a given CIDR prefix.
+func lastIP(prefix netip.Prefix) netip.Addr {
+	size := ipRangeSize(prefix)
+	return addIP(prefix.Addr(), size.Sub(size, big.NewInt(1)))
 }
 
 // addIP adds a given big integer value to a netip.Addr.
 func addIP(ip netip.Addr, num *big.Int) netip.Addr {
-	// Add a given big integer value to a netip.Addr
+	addrAs16 := ip.As16()
+	ipInt := new(big.Int).SetBytes(addrAs16[:])
+	ipInt.Add(ipInt, num)
+	addr := netip.AddrFrom16([16]byte(ipInt.FillBytes(make([]byte, 16))))
+	if ip.Is4() {
+		return addr.Unmap()
+	}
+	return addr
 }
 
 // ipRangeSize calculates the size of an IP range based on a given CIDR prefix.
 func ipRangeSize(prefix netip.Prefix) *big.Int {
-	// Calculate the size of an IP range based on a given CIDR prefix
+	size := big.NewInt(1)
+	return size.Lsh(size, uint(prefix.Addr().BitLen()-prefix.Bits()))
 }
 
-// IpGenerator generates IP addresses from a list of ipRanges.
-type IpGenerator struct {
-	ipRanges []ipRange // List of ipRanges to generate IP addresses from
+// splitBits returns the length of the sub-prefixes a prefix is split into.
+// IPv4 prefixes are not split beyond /24 and IPv6 prefixes beyond /64, the
+// granularity networks usually block at.
+func splitBits(prefix netip.Prefix) int {
+	limit := 64
+	if prefix.Addr().Is4() {
+		limit = 24
+	}
+
+	bits := prefix.Bits() + maxSplitBits
+	if bits > limit {
+		bits = limit
+	}
+	if bits < prefix.Bits() {
+		bits = prefix.Bits()
+	}
+	return bits
 }
 
-// NextBatch generates a batch of IP addresses from the ipRanges.
-func (g *IpGenerator) NextBatch() ([]netip.Addr, error) {
-	// Generate a batch of IP addresses from the ipRanges
+// splitPrefix splits prefix into sub-prefixes of length bits.
+func splitPrefix(prefix netip.Prefix, bits int) []netip.Prefix {
+	step := ipRangeSize(netip.PrefixFrom(prefix.Addr(), bits))
+	count := 1 << (bits - prefix.Bits())
+
+	res := make([]netip.Prefix, 0, count)
+	offset := new(big.Int)
+	for i := 0; i < count; i++ {
+		res = append(res, netip.PrefixFrom(addIP(prefix.Addr(), offset), bits))
+		offset.Add(offset, step)
+	}
+	return res
 }
 
-// shuffleSubnetsIpRange shuffles a slice of ipRange using crypto/rand.
-func shuffleSubnetsIpRange(subnets []ipRange) error {
-	// Shuffle a slice of ipRange using crypto/rand
+// IpGenerator generates IP addresses from a list of prefixes. It splits
+// every prefix into sub-prefixes and samples them like a multi-armed
+// bandit: sub-prefixes that produced successful probes are drawn more
+// often, and ones that never answered are only drawn for exploration.
+// Results are reported back with Record.
+type IpGenerator struct {
+	mu       sync.Mutex
+	ipRanges []ipRange            // Sub-prefixes to generate IP addresses from
+	sources  [][]int              // Indices into ipRanges for each scanned prefix
+	byPrefix map[netip.Prefix]int // Index into ipRanges by sub-prefix
+	bits     []int                // Distinct sub-prefix lengths in use
+	exclude  []netip.Prefix       // Addresses never to generate
+	rng      *rand.Rand           // Source of all randomness
+	turn     int                  // Prefix whose turn it is for exploration
 }
 
 // NewIterator creates a new IpGenerator instance with a given statute.ScannerOptions.
+// A non-zero Seed makes the generated sequence reproducible.
 func NewIterator(opts *statute.ScannerOptions) *IpGenerator {
-	// Create a new IpGenerator instance with the given statute.ScannerOptions
+	seed := opts.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+
+	g := &IpGenerator{
+		byPrefix: make(map[netip.Prefix]int),
+		exclude:  opts.ExcludeList,
+		rng:      rand.New(rand.NewSource(seed)),
+	}
+
+	for _, cidr := range opts.CidrList {
+		cidr = cidr.Masked()
+		if !opts.UseIPv6 && cidr.Addr().Is6() {
+			continue
+		}
+		if !opts.UseIPv4 && cidr.Addr().Is4() {
+			continue
+		}
+
+		bits := splitBits(cidr)
+		var arms []int
+		for _, sub := range splitPrefix(cidr, bits) {
+			if _, dup := g.byPrefix[sub]; dup || g.excludesPrefix(sub) {
+				continue
+			}
+			g.byPrefix[sub] = len(g.ipRanges)
+			arms = append(arms, len(g.ipRanges))
+			g.ipRanges = append(g.ipRanges, newIPRange(sub, g.rng))
+		}
+		if len(arms) == 0 {
+			continue
+		}
+
+		g.sources = append(g.sources, arms)
+		if !slices.Contains(g.bits, bits) {
+			g.bits = append(g.bits, bits)
+		}
+	}
+
+	// Start exploring from a random prefix.
+	g.rng.Shuffle(len(g.sources), func(i, j int) {
+		g.sources[i], g.sources[j] = g.sources[j], g.sources[i]
+	})
+
+	return g
+}
+
+// NextBatch generates a batch of as many IP addresses as there are scanned
+// prefixes, each drawn from a sub-prefix chosen by pick.
+func (g *IpGenerator) NextBatch() ([]netip.Addr, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if len(g.ipRanges) == 0 {
+		return nil, errors.New("no IP ranges to scan")
+	}
+
+	results := make([]netip.Addr, 0, len(g.sources))
+	for i := 0; i < len(g.sources); i++ {
+		r := &g.ipRanges[g.pick()]
+		if ip, ok := g.nextIP(r); ok {
+			results = append(results, ip)
+		}
+	}
+
+	if len(results) == 0 {
+		return nil, errors.New("no more IP addresses")
+	}
+	return results, nil
+}
+
+// Record reports whether a probe of ip succeeded, so that its sub-prefix
+// is drawn more or less often from now on.
+func (g *IpGenerator) Record(ip netip.Addr, ok bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	ip = ip.Unmap()
+	for _, bits := range g.bits {
+		if bits > ip.BitLen() {
+			continue
+		}
+		sub, err := ip.Prefix(bits)
+		if err != nil {
+			continue
+		}
+		if i, found := g.byPrefix[sub]; found {
+			g.ipRanges[i].attempts++
+			if ok {
+				g.ipRanges[i].successes++
+			}
+			return
+		}
+	}
+}
+
+// pick returns the index of the range to draw the next address from.
+func (g *IpGenerator) pick() int {
+	if g.rng.Float64() >= explore {
+		total := 0.0
+		for i := range g.ipRanges {
+			total += g.ipRanges[i].weight()
+		}
+
+		if total > 0 {
+			x := g.rng.Float64() * total
+			for i := range g.ipRanges {
+				w := g.ipRanges[i].weight()
+				if x < w {
+					return i
+				}
+				x -= w
+			}
+			return len(g.ipRanges) - 1
+		}
+	}
+
+	// Explore: a random sub-prefix of the prefix whose turn it is.
+	arms := g.sources[g.turn%len(g.sources)]
+	g.turn++
+	return arms[g.rng.Intn(len(arms))]
+}
+
+// nextIP returns the next address of r that is not excluded. Once every
+// address of r was generated it starts over.
+func (g *IpGenerator) nextIP(r *ipRange) (netip.Addr, bool) {
+	for tries := 0; tries < maxExcludedTries; tries++ {
+		if r.index.Cmp(r.size) >= 0 {
+			r.index.SetInt64(0)
+		}
+		ip := addIP(r.start, r.lcg.Next())
+		r.index.Add(r.index, big.NewInt(1))
+
+		if !g.excluded(ip) {
+			return ip, true
+		}
+	}
+	return netip.Addr{}, false
+}
+
+// excluded reports whether ip is in one of the excluded prefixes.
+func (g *IpGenerator) excluded(ip netip.Addr) bool {
+	for _, ex := range g.exclude {
+		if ex.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// excludesPrefix reports whether prefix lies entirely in an excluded prefix.
+func (g *IpGenerator) excludesPrefix(prefix netip.Prefix) bool {
+	for _, ex := range g.exclude {
+		if ex.Bits() <= prefix.Bits() && ex.Contains(prefix.Addr()) {
+			return true
+		}
+	}
+	return false
 }
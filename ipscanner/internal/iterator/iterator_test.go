@@ -0,0 +1,128 @@
+package iterator
+
+import (
+	"log/slog"
+	"math/big"
+	"math/rand"
+	"net/netip"
+	"slices"
+	"testing"
+
+	"github.com/bepass-org/warp-plus/ipscanner/internal/statute"
+)
+
+func testOptions(cidrs ...string) *statute.ScannerOptions {
+	opts := &statute.ScannerOptions{
+		UseIPv4: true,
+		UseIPv6: true,
+		Seed:    42,
+		Logger:  slog.Default(),
+	}
+	for _, c := range cidrs {
+		opts.CidrList = append(opts.CidrList, netip.MustParsePrefix(c))
+	}
+	return opts
+}
+
+func TestLCGFullPeriod(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for _, size := range []int64{1, 2, 4, 256, 4096} {
+		lcg := NewLCG(big.NewInt(size), rng)
+		seen := make(map[int64]bool)
+		for i := int64(0); i < size; i++ {
+			seen[lcg.Next().Int64()] = true
+		}
+		if int64(len(seen)) != size {
+			t.Errorf("size %d: got %d distinct values", size, len(seen))
+		}
+	}
+}
+
+func TestNextBatchSeed(t *testing.T) {
+	draw := func(seed int64) []netip.Addr {
+		opts := testOptions("188.114.96.0/24", "162.159.192.0/22", "2606:4700:d0::/48")
+		opts.Seed = seed
+		g := NewIterator(opts)
+
+		var res []netip.Addr
+		for i := 0; i < 20; i++ {
+			batch, err := g.NextBatch()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(batch) != 3 {
+				t.Fatalf("got batch of %d, want as many addresses as prefixes", len(batch))
+			}
+			for _, ip := range batch {
+				g.Record(ip, ip.Is6())
+			}
+			res = append(res, batch...)
+		}
+		return res
+	}
+
+	a, b := draw(7), draw(7)
+	if !slices.Equal(a, b) {
+		t.Error("same seed produced different sequences")
+	}
+	if slices.Equal(a, draw(8)) {
+		t.Error("different seeds produced the same sequence")
+	}
+}
+
+func TestExcludeList(t *testing.T) {
+	opts := testOptions("10.0.0.0/22")
+	opts.ExcludeList = []netip.Prefix{
+		netip.MustParsePrefix("10.0.1.0/24"),
+		netip.MustParsePrefix("10.0.2.0/25"),
+	}
+	g := NewIterator(opts)
+
+	for i := 0; i < 2000; i++ {
+		batch, err := g.NextBatch()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, ip := range batch {
+			for _, ex := range opts.ExcludeList {
+				if ex.Contains(ip) {
+					t.Fatalf("generated excluded address %s", ip)
+				}
+			}
+		}
+	}
+}
+
+func TestRecordBiasesSampling(t *testing.T) {
+	good := netip.MustParsePrefix("10.0.0.0/24")
+	g := NewIterator(testOptions("10.0.0.0/24", "10.0.1.0/24", "10.0.2.0/24", "10.0.3.0/24"))
+
+	counts := make(map[bool]int)
+	for i := 0; i < 500; i++ {
+		batch, err := g.NextBatch()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, ip := range batch {
+			ok := good.Contains(ip)
+			g.Record(ip, ok)
+			if i >= 100 {
+				counts[ok]++
+			}
+		}
+	}
+
+	// Three dead subnets against one working one: without feedback the
+	// working subnet would get a quarter of the draws.
+	if share := float64(counts[true]) / float64(counts[true]+counts[false]); share < 0.7 {
+		t.Errorf("working subnet got %.2f of the draws after learning", share)
+	}
+}
+
+func TestNoRanges(t *testing.T) {
+	opts := testOptions("2606:4700:d0::/48")
+	opts.UseIPv6 = false
+	if _, err := NewIterator(opts).NextBatch(); err == nil {
+		t.Error("expected an error without ranges to scan")
+	}
+}
@@ -1,6 +1,7 @@
 package ping
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"net/netip"
@@ -15,7 +16,9 @@ type Ping struct {
 	Options *statute.ScannerOptions
 }
 
-// DoPing performs a ping on the given IP address using the selected ping operation(s).
+// DoPing performs a ping on the given IP address and port using the selected
+// ping operation(s). A zero port picks one from the options. The ping is
+// abandoned once ctx is done.
 // It returns IPInfo and error.
 // The function first checks if the HTTP ping operation is selected by performing a bitwise AND
 // operation with the SelectedOps field and the statute.HTTPPing constant.
@@ -25,10 +28,123 @@ type Ping struct {
 // by performing a bitwise AND operation with the SelectedOps field and the statute.TLSPing constant.
 // If the result is greater than 0, it means that the TLS ping operation is selected.
 // The function then calls the tlsPing method and returns the result and any error encountered.
-func (p *Ping) DoPing(ip netip.Addr) (statute.IPInfo, error) {
+func (p *Ping) DoPing(ctx context.Context, ip netip.Addr, port uint16) (statute.IPInfo, error) {
+	if port == 0 {
+		port = p.port()
+	}
+
 	// Check if HTTP ping operation is selected.
 	if p.Options.SelectedOps&statute.HTTPPing > 0 {
-		res, err := p.httpPing(ip)
+		res, err := p.httpPing(ctx, ip, port)
+		if err != nil {
+			return statute.IPInfo{}, err
+		}
+
+		return res, nil
+	}
+	// Check if TLS ping operation is selected.
+	if p.Options.SelectedOps&statute.TLSPing > 0 {
+		res, err := p.tlsPing(ctx, ip, port)
 		if err != nil {
 			return statute.IPInfo{}, err
-	
+		}
+
+		return res, nil
+	}
+	// Check if TCP ping operation is selected.
+	if p.Options.SelectedOps&statute.TCPPing > 0 {
+		res, err := p.tcpPing(ctx, ip, port)
+		if err != nil {
+			return statute.IPInfo{}, err
+		}
+
+		return res, nil
+	}
+	// Check if QUIC ping operation is selected.
+	if p.Options.SelectedOps&statute.QUICPing > 0 {
+		res, err := p.quicPing(ctx, ip, port)
+		if err != nil {
+			return statute.IPInfo{}, err
+		}
+
+		return res, nil
+	}
+	// Check if WARP ping operation is selected.
+	if p.Options.SelectedOps&statute.WARPPing > 0 {
+		res, err := p.warpPing(ctx, ip, port)
+		if err != nil {
+			return statute.IPInfo{}, err
+		}
+
+		return res, nil
+	}
+
+	return statute.IPInfo{}, errors.New("no ping operation selected")
+}
+
+// port returns a port to probe, picked from Options.Ports if any are set.
+// For WARP pings without Ports it returns zero, so each probe picks a
+// random WARP port.
+func (p *Ping) port() uint16 {
+	if len(p.Options.Ports) > 0 {
+		return p.Options.Ports[randomInt(0, len(p.Options.Ports)-1)]
+	}
+	if p.Options.SelectedOps == statute.WARPPing {
+		return 0
+	}
+	return p.Options.Port
+}
+
+func (p *Ping) httpPing(ctx context.Context, ip netip.Addr, port uint16) (statute.IPInfo, error) {
+	return p.calc(
+		ctx,
+		NewHttpPing(
+			ip,
+			"GET",
+			fmt.Sprintf(
+				"https://%s:%d%s",
+				p.Options.Hostname,
+				port,
+				p.Options.HTTPPath,
+			),
+			p.Options,
+		),
+	)
+}
+
+func (p *Ping) warpPing(ctx context.Context, ip netip.Addr, port uint16) (statute.IPInfo, error) {
+	wp := NewWarpPing(ip, p.Options)
+	wp.Port = port
+	return p.calc(ctx, wp)
+}
+
+func (p *Ping) tlsPing(ctx context.Context, ip netip.Addr, port uint16) (statute.IPInfo, error) {
+	return p.calc(
+		ctx,
+		NewTlsPing(ip, p.Options.Hostname, port, p.Options),
+	)
+}
+
+func (p *Ping) tcpPing(ctx context.Context, ip netip.Addr, port uint16) (statute.IPInfo, error) {
+	return p.calc(
+		ctx,
+		NewTcpPing(ip, p.Options.Hostname, port, p.Options),
+	)
+}
+
+func (p *Ping) quicPing(ctx context.Context, ip netip.Addr, port uint16) (statute.IPInfo, error) {
+	return p.calc(
+		ctx,
+		NewQuicPing(ip, p.Options.Hostname, port, p.Options),
+	)
+}
+
+// calc runs a single ping within ctx and converts its result.
+func (p *Ping) calc(ctx context.Context, tp statute.IPing) (statute.IPInfo, error) {
+	pr := tp.PingContext(ctx)
+	err := pr.Error()
+	if err != nil {
+		return statute.IPInfo{}, err
+	}
+	return pr.Result(), nil
+}
@@ -11,6 +11,7 @@ import (
 	"math/big"
 	"net"
 	"net/netip"
+	"os"
 	"time"
 
 	"github.com/bepass-org/warp-plus/ipscanner/internal/statute"
@@ -46,7 +47,13 @@ type WarpPing struct {
 	PrivateKey    string
 	PeerPublicKey string
 	PresharedKey  string
+	Reserved      [3]byte // reserved header bytes, as assigned to the client
 	IP            netip.Addr
+	Port          uint16 // zero picks a random WARP port
+
+	Junk    statute.WarpJunk // random packets sent ahead of the handshake
+	Timeout time.Duration    // how long to wait for the response, zero for 5s
+	Confirm bool             // also require a reply through the session
 
 	opts statute.ScannerOptions
 }
@@ -55,14 +62,13 @@ func (h *WarpPing) Ping() statute.IPingResult {
 	return h.PingContext(context.Background())
 }
 
-func (h *WarpPing) PingContext(_ context.Context) statute.IPingResult {
-	addr := netip.AddrPortFrom(h.IP, warp.RandomWarpPort())
-	rtt, err := initiateHandshake(
-		addr,
-		h.PrivateKey,
-		h.PeerPublicKey,
-		h.PresharedKey,
-	)
+func (h *WarpPing) PingContext(ctx context.Context) statute.IPingResult {
+	port := h.Port
+	if port == 0 {
+		port = warp.RandomWarpPort()
+	}
+	addr := netip.AddrPortFrom(h.IP, port)
+	rtt, err := initiateHandshake(ctx, addr, h)
 	if err != nil {
 		return h.errorResult(err)
 	}
@@ -118,6 +124,9 @@ func ephemeralKeypair() (noise.DHKey, error) {
 }
 
 func randomInt(min, max int) int {
+	if max <= min {
+		return min
+	}
 	nBig, err := rand.Int(rand.Reader, big.NewInt(int64(max-min+1)))
 	if err != nil {
 		panic(err)
@@ -125,23 +134,72 @@ func randomInt(min, max int) int {
 	return int(nBig.Int64()) + min
 }
 
-func initiateHandshake(serverAddr netip.AddrPort, privateKeyBase64, peerPublicKeyBase64, presharedKeyBase64 string) (time.Duration, error) {
-	staticKeyPair, err := staticKeypair(privateKeyBase64)
+func randomDuration(min, max time.Duration) time.Duration {
+	if max <= min {
+		return min
+	}
+	nBig, err := rand.Int(rand.Reader, big.NewInt(int64(max-min)+1))
+	if err != nil {
+		panic(err)
+	}
+	return time.Duration(nBig.Int64()) + min
+}
+
+// randomIndex returns a random sender index, as WireGuard peers pick them.
+func randomIndex() (uint32, error) {
+	var b [4]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint32(b[:]), nil
+}
+
+// sendJunk writes the configured random packets to conn, waiting the
+// configured delay after each one.
+func sendJunk(ctx context.Context, conn net.Conn, junk statute.WarpJunk) error {
+	numPackets := randomInt(junk.MinCount, junk.MaxCount)
+	for i := 0; i < numPackets; i++ {
+		randomPacket := make([]byte, randomInt(max(junk.MinSize, 1), max(junk.MaxSize, 1)))
+		_, err := rand.Read(randomPacket)
+		if err != nil {
+			return fmt.Errorf("error generating random packet: %w", err)
+		}
+
+		// Send the random packet
+		_, err = conn.Write(randomPacket)
+		if err != nil {
+			return fmt.Errorf("error sending random packet: %w", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(randomDuration(junk.MinDelay, junk.MaxDelay)):
+		}
+	}
+	return nil
+}
+
+// initiateHandshake performs a WireGuard handshake with serverAddr and
+// returns the time between sending the initiation and receiving the
+// response. It gives up when ctx is done or after h.Timeout.
+func initiateHandshake(ctx context.Context, serverAddr netip.AddrPort, h *WarpPing) (time.Duration, error) {
+	staticKeyPair, err := staticKeypair(h.PrivateKey)
 	if err != nil {
 		return 0, err
 	}
 
-	peerPublicKey, err := base64.StdEncoding.DecodeString(peerPublicKeyBase64)
+	peerPublicKey, err := base64.StdEncoding.DecodeString(h.PeerPublicKey)
 	if err != nil {
 		return 0, err
 	}
 
-	presharedKey, err := base64.StdEncoding.DecodeString(presharedKeyBase64)
+	presharedKey, err := base64.StdEncoding.DecodeString(h.PresharedKey)
 	if err != nil {
 		return 0, err
 	}
 
-	if presharedKeyBase64 == "" {
+	if h.PresharedKey == "" {
 		presharedKey = make([]byte, 32)
 	}
 
@@ -167,6 +225,11 @@ func initiateHandshake(serverAddr netip.AddrPort, privateKeyBase64, peerPublicKe
 		return 0, err
 	}
 
+	senderIndex, err := randomIndex()
+	if err != nil {
+		return 0, err
+	}
+
 	// Prepare handshake initiation packet
 
 	// TAI64N timestamp calculation
@@ -182,8 +245,8 @@ func initiateHandshake(serverAddr netip.AddrPort, privateKeyBase64, peerPublicKe
 	}
 
 	initiationPacket := new(bytes.Buffer)
-	binary.Write(initiationPacket, binary.BigEndian, []byte{0x01, 0x00, 0x00, 0x00})
-	binary.Write(initiationPacket, binary.BigEndian, uint32ToBytes(28))
+	binary.Write(initiationPacket, binary.BigEndian, []byte{0x01, h.Reserved[0], h.Reserved[1], h.Reserved[2]})
+	binary.Write(initiationPacket, binary.BigEndian, uint32ToBytes(senderIndex))
 	binary.Write(initiationPacket, binary.BigEndian, msg)
 
 	macKey := blake2s.Sum256(append([]byte("mac1----"), peerPublicKey...))
@@ -201,31 +264,21 @@ func initiateHandshake(serverAddr netip.AddrPort, privateKeyBase64, peerPublicKe
 	binary.Write(initiationPacket, binary.BigEndian, initiationPacketMAC[:16])
 	binary.Write(initiationPacket, binary.BigEndian, [16]byte{})
 
-	conn, err := net.Dial("udp", serverAddr.String())
+	dialer := net.Dialer{}
+	conn, err := dialer.DialContext(ctx, "udp", serverAddr.String())
 	if err != nil {
 		return 0, err
 	}
 	defer conn.Close()
 
-	// Generate a random number of packets between 5 and 10
-	numPackets := randomInt(1, 2)
-	for i := 0; i < numPackets; i++ {
-		// Generate a random packet size between 10 and 40 bytes
-		packetSize := randomInt(1, 100)
-		randomPacket := make([]byte, packetSize)
-		_, err := rand.Read(randomPacket)
-		if err != nil {
-			return 0, fmt.Errorf("error generating random packet: %w", err)
-		}
-
-		// Send the random packet
-		_, err = conn.Write(randomPacket)
-		if err != nil {
-			return 0, fmt.Errorf("error sending random packet: %w", err)
-		}
+	// Unblock reads as soon as the caller gives up.
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetDeadline(time.Now())
+	})
+	defer stop()
 
-		// Wait for a random duration between 200 and 500 milliseconds
-		time.Sleep(time.Duration(randomInt(200, 500)) * time.Millisecond)
+	if err := sendJunk(ctx, conn, h.Junk); err != nil {
+		return 0, err
 	}
 
 	_, err = initiationPacket.WriteTo(conn)
@@ -234,10 +287,18 @@ func initiateHandshake(serverAddr netip.AddrPort, privateKeyBase64, peerPublicKe
 	}
 	t0 := time.Now()
 
+	timeout := h.Timeout
+	if timeout <= 0 {
+		timeout = 5 * time.Second
+	}
+
 	response := make([]byte, 92)
-	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	conn.SetReadDeadline(time.Now().Add(timeout))
 	i, err := conn.Read(response)
 	if err != nil {
+		if ctx.Err() != nil {
+			return 0, ctx.Err()
+		}
 		return 0, err
 	}
 	rtt := time.Since(t0)
@@ -252,15 +313,13 @@ func initiateHandshake(serverAddr netip.AddrPort, privateKeyBase64, peerPublicKe
 	}
 
 	// Extract sender and receiver index from the response
-	// peer index
-	_ = binary.LittleEndian.Uint32(response[4:8])
-	// our index(we set it to 28)
+	peerIndex := binary.LittleEndian.Uint32(response[4:8])
 	ourIndex := binary.LittleEndian.Uint32(response[8:12])
-	if ourIndex != 28 { // Check if the response corresponds to our sender index
+	if ourIndex != senderIndex { // Check if the response corresponds to our sender index
 		return 0, errors.New("invalid sender index in response")
 	}
 
-	payload, _, _, err := hs.ReadMessage(nil, response[12:60])
+	payload, sendCS, recvCS, err := hs.ReadMessage(nil, response[12:60])
 	if err != nil {
 		return 0, err
 	}
@@ -270,15 +329,122 @@ func initiateHandshake(serverAddr netip.AddrPort, privateKeyBase64, peerPublicKe
 		return 0, errors.New("unexpected payload in response")
 	}
 
+	if h.Confirm {
+		if err := confirmSession(ctx, conn, sendCS, recvCS, peerIndex, senderIndex, h.Reserved, timeout); err != nil {
+			return 0, fmt.Errorf("data plane: %w", err)
+		}
+	}
+
 	return rtt, nil
 }
 
+// The tunnel addresses of the echo that confirms the data plane. WARP
+// gives every client 172.16.0.2 as its IPv4 tunnel address.
+var (
+	confirmSrc = netip.MustParseAddr("172.16.0.2")
+	confirmDst = netip.MustParseAddr("1.1.1.1")
+)
+
+// confirmSession sends an ICMP echo request to 1.1.1.1 through the session
+// of the handshake, and waits up to timeout for a transport packet of the
+// session that decrypts with its keys. This catches endpoints, or
+// middleboxes, that let handshakes through but drop or refuse transport
+// packets.
+func confirmSession(ctx context.Context, conn net.Conn, send, recv *noise.CipherState, peerIndex, ourIndex uint32, reserved [3]byte, timeout time.Duration) error {
+	echo := echoRequest(uint16(ourIndex))
+
+	header := make([]byte, 16, 16+len(echo)+16)
+	header[0] = 4 // 4 is the message type for transport data
+	copy(header[1:4], reserved[:])
+	binary.LittleEndian.PutUint32(header[4:8], peerIndex)
+	binary.LittleEndian.PutUint64(header[8:16], send.Nonce())
+
+	packet, err := send.Encrypt(header, nil, echo)
+	if err != nil {
+		return err
+	}
+
+	if _, err := conn.Write(packet); err != nil {
+		return err
+	}
+
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	buf := make([]byte, 1500)
+	for {
+		n, err := conn.Read(buf)
+		switch {
+		case ctx.Err() != nil:
+			return ctx.Err()
+		case errors.Is(err, os.ErrDeadlineExceeded):
+			return errors.New("no reply through the session")
+		case err != nil:
+			return err
+		}
+
+		// Skip anything but transport packets of this session, such as
+		// a retransmitted handshake response.
+		if n < 32 || buf[0] != 4 || binary.LittleEndian.Uint32(buf[4:8]) != ourIndex {
+			continue
+		}
+		recv.SetNonce(binary.LittleEndian.Uint64(buf[8:16]))
+		if _, err := recv.Decrypt(nil, nil, buf[16:n]); err != nil {
+			continue
+		}
+		return nil
+	}
+}
+
+// echoRequest returns an IPv4 ICMP echo request from confirmSrc to
+// confirmDst. It is 32 bytes long, so it needs no padding to be sent as a
+// transport packet.
+func echoRequest(id uint16) []byte {
+	b := make([]byte, 32)
+
+	// IPv4 header
+	b[0] = 0x45 // Version 4, 20 byte header
+	binary.BigEndian.PutUint16(b[2:4], uint16(len(b)))
+	b[8] = 64 // TTL
+	b[9] = 1  // ICMP
+	src, dst := confirmSrc.As4(), confirmDst.As4()
+	copy(b[12:16], src[:])
+	copy(b[16:20], dst[:])
+	binary.BigEndian.PutUint16(b[10:12], checksum(b[:20]))
+
+	// ICMP echo request, with 4 bytes of data
+	b[20] = 8
+	binary.BigEndian.PutUint16(b[24:26], id)
+	binary.BigEndian.PutUint16(b[26:28], 1) // Sequence number
+	copy(b[28:], "warp")
+	binary.BigEndian.PutUint16(b[22:24], checksum(b[20:]))
+
+	return b
+}
+
+// checksum returns the internet checksum of b.
+func checksum(b []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(b[i:]))
+	}
+	if len(b)%2 == 1 {
+		sum += uint32(b[len(b)-1]) << 8
+	}
+	for sum>>16 != 0 {
+		sum = sum&0xffff + sum>>16
+	}
+	return ^uint16(sum)
+}
+
 func NewWarpPing(ip netip.Addr, opts *statute.ScannerOptions) *WarpPing {
 	return &WarpPing{
 		PrivateKey:    opts.WarpPrivateKey,
 		PeerPublicKey: opts.WarpPeerPublicKey,
 		PresharedKey:  opts.WarpPresharedKey,
+		Reserved:      opts.WarpReserved,
 		IP:            ip,
+		Junk:          opts.WarpJunk,
+		Timeout:       opts.WarpHandshakeTimeout,
+		Confirm:       opts.WarpConfirm,
 
 		opts: *opts,
 	}
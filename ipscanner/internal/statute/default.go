@@ -4,19 +4,22 @@ import (
 	// ... (import statements)
 )
 
-// FinalOptions is a global variable that holds the configuration for the scanner.
-// This variable is used throughout the package to configure various components.
-var FinalOptions *ScannerOptions
+// DefaultHTTPClientFunc returns a function that creates an HTTP client with custom dialers and the options of opts.
+// The clients have a custom RoundTripper based on the user's preferences.
+func DefaultHTTPClientFunc(opts *ScannerOptions) THTTPClientFunc {
+	return func(rawDialer TDialerFunc, tlsDialer TDialerFunc, quicDialer TQuicDialerFunc, targetAddr ...string) *http.Client {
+		return defaultHTTPClient(opts, rawDialer, tlsDialer, quicDialer, targetAddr...)
+	}
+}
 
-// DefaultHTTPClientFunc creates an HTTP client with custom dialers and options.
-// It returns a new *http.Client instance with a custom RoundTripper based on the user's preferences.
-func DefaultHTTPClientFunc(rawDialer TDialerFunc, tlsDialer TDialerFunc, quicDialer TQuicDialerFunc, targetAddr ...string) *http.Client {
+// defaultHTTPClient creates an HTTP client with custom dialers and the options of opts.
+func defaultHTTPClient(opts *ScannerOptions, rawDialer TDialerFunc, tlsDialer TDialerFunc, quicDialer TQuicDialerFunc, targetAddr ...string) *http.Client {
 	// ... (code)
 
 	// Create a new http.RoundTripper based on the user's preferences.
 	// If HTTP/3 is enabled, create a new http3.RoundTripper, otherwise create a new http.Transport.
 	var transport http.RoundTripper
-	if FinalOptions.UseHTTP3 {
+	if opts.UseHTTP3 {
 		// Create a new http3.RoundTripper if HTTP/3 is enabled.
 		transport = &http3.RoundTripper{
 			// ... (configuration)
@@ -32,24 +35,26 @@ func DefaultHTTPClientFunc(rawDialer TDialerFunc, tlsDialer TDialerFunc, quicDia
 	// Return a new http.Client with the custom RoundTripper.
 	return &http.Client{
 		Transport: transport,
-		Timeout:   FinalOptions.ConnectionTimeout,
+		Timeout:   opts.ConnectionTimeout,
 		CheckRedirect: func(req *http.Request, via []*http.Request) error {
 			return http.ErrUseLastResponse
 		},
 	}
 }
 
-// DefaultDialerFunc creates a new dialer with a custom connection timeout.
-// It returns a new Dialer instance with the custom connection timeout.
-func DefaultDialerFunc(ctx context.Context, network, addr string) (net.Conn, error) {
-	// ... (code)
+// DefaultDialerFunc returns a dial function with the connection timeout of opts.
+// It dials through a new Dialer instance with the custom connection timeout.
+func DefaultDialerFunc(opts *ScannerOptions) TDialerFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		// ... (code)
 
-	// Create a new Dialer with the custom connection timeout.
-	d := &net.Dialer{
-		Timeout: FinalOptions.ConnectionTimeout, // Connection timeout
-		// ... (other custom settings)
+		// Create a new Dialer with the custom connection timeout.
+		d := &net.Dialer{
+			Timeout: opts.ConnectionTimeout, // Connection timeout
+			// ... (other custom settings)
+		}
+		return d.DialContext(ctx, network, addr)
 	}
-	return d.DialContext(ctx, network, addr)
 }
 
 // getServerName extracts the server name from the given address.
@@ -58,31 +63,38 @@ func getServerName(address string) (string, error) {
 	// ... (code)
 }
 
-// defaultTLSConfig creates a new TLS config based on the user's preferences.
+// defaultTLSConfig creates a new TLS config based on the user's preferences in opts.
 // It returns a new *tls.Config instance with the user's preferences.
-func defaultTLSConfig(addr string) *tls.Config {
+func defaultTLSConfig(opts *ScannerOptions, addr string) *tls.Config {
 	// ... (code)
 
 	// Create a new TLS config with the user's preferences.
 	return &tls.Config{
-		InsecureSkipVerify: allowInsecure || FinalOptions.InsecureSkipVerify,
+		InsecureSkipVerify: allowInsecure || opts.InsecureSkipVerify,
 		ServerName:         sni,
-		MinVersion:         FinalOptions.TlsVersion,
-		MaxVersion:         FinalOptions.TlsVersion,
+		MinVersion:         opts.TlsVersion,
+		MaxVersion:         opts.TlsVersion,
 		NextProtos:         alpnProtocols,
 	}
 }
 
-// DefaultTLSDialerFunc creates a new TLS dialer with a custom handshake timeout.
-// It returns a new net.Conn instance with the custom TLS config and handshake timeout.
-func DefaultTLSDialerFunc(ctx context.Context, network, addr string) (net.Conn, error) {
+// DefaultTLSDialerFunc returns a TLS dial function with the handshake timeout of opts.
+// It returns new net.Conn instances with the custom TLS config and handshake timeout.
+func DefaultTLSDialerFunc(opts *ScannerOptions) TDialerFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return defaultTLSDial(ctx, opts, network, addr)
+	}
+}
+
+// defaultTLSDial dials addr over TLS as the options in opts say.
+func defaultTLSDial(ctx context.Context, opts *ScannerOptions, network, addr string) (net.Conn, error) {
 	// ... (code)
 
 	// Create a new TLS client connection with the custom TLS config.
-	tlsClientConn := tls.Client(rawConn, defaultTLSConfig(addr))
+	tlsClientConn := tls.Client(rawConn, defaultTLSConfig(opts, addr))
 
 	// Perform the handshake with a timeout.
-	err = tlsClientConn.SetDeadline(time.Now().Add(FinalOptions.HandshakeTimeout))
+	err = tlsClientConn.SetDeadline(time.Now().Add(opts.HandshakeTimeout))
 	if err != nil {
 		// ... (error handling)
 	}
@@ -103,19 +115,21 @@ func DefaultTLSDialerFunc(ctx context.Context, network, addr string) (net.Conn,
 	return tlsClientConn, nil
 }
 
-// DefaultQuicDialerFunc creates a new QUIC dialer with custom timeout options.
-// It returns a new quic.EarlyConnection instance with the custom QUIC config and timeout options.
-func DefaultQuicDialerFunc(ctx context.Context, addr string, _ *tls.Config, _ *quic.Config) (quic.EarlyConnection, error) {
-	// ... (code)
+// DefaultQuicDialerFunc returns a QUIC dial function with the timeout options of opts.
+// It returns new quic.EarlyConnection instances with the custom QUIC config and timeout options.
+func DefaultQuicDialerFunc(opts *ScannerOptions) TQuicDialerFunc {
+	return func(ctx context.Context, addr string, _ *tls.Config, _ *quic.Config) (quic.EarlyConnection, error) {
+		// ... (code)
 
-	// Create a new QUIC config with the user's preferences.
-	quicConfig := &quic.Config{
-		MaxIdleTimeout:       FinalOptions.ConnectionTimeout,
-		HandshakeIdleTimeout: FinalOptions.HandshakeTimeout,
-	}
+		// Create a new QUIC config with the user's preferences.
+		quicConfig := &quic.Config{
+			MaxIdleTimeout:       opts.ConnectionTimeout,
+			HandshakeIdleTimeout: opts.HandshakeTimeout,
+		}
 
-	// Dial the QUIC address with the custom QUIC config.
-	return quic.DialAddrEarly(ctx, addr, defaultTLSConfig(addr), quicConfig)
+		// Dial the QUIC address with the custom QUIC config.
+		return quic.DialAddrEarly(ctx, addr, defaultTLSConfig(opts, addr), quicConfig)
+	}
 }
 
 // DefaultCFRanges returns the default Cloudflare IP ranges.
@@ -0,0 +1,45 @@
+package statute
+
+import "net/netip"
+
+// EventType identifies what an Event reports.
+type EventType int
+
+const (
+	EventProbeStarted   EventType = iota // A probe is about to be sent
+	EventProbeSucceeded                  // An endpoint answered, Info holds its figures
+	EventProbeFailed                     // An endpoint didn't answer, Err says why
+	EventQueueChanged                    // The best endpoints changed, Queue holds them
+	EventFinished                        // The scan is over, no more events follow
+)
+
+// String returns the name of the event type.
+func (t EventType) String() string {
+	switch t {
+	case EventProbeStarted:
+		return "probe started"
+	case EventProbeSucceeded:
+		return "probe succeeded"
+	case EventProbeFailed:
+		return "probe failed"
+	case EventQueueChanged:
+		return "queue changed"
+	case EventFinished:
+		return "finished"
+	default:
+		return "unknown"
+	}
+}
+
+// Event struct reports progress of a scan. Only the fields that apply to
+// its Type are set.
+type Event struct {
+	Type EventType
+
+	// AddrPort is the probed endpoint. Its port is zero when the probe
+	// picks a random WARP port.
+	AddrPort netip.AddrPort
+	Info     IPInfo   // Result of a successful probe
+	Err      error    // Error of a failed probe
+	Queue    []IPInfo // Best endpoints, best score first
+}
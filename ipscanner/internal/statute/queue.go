@@ -6,29 +6,59 @@ import (
 )
 
 // IPInfQueue struct represents a priority queue of IPInfo structs,
-// where the priority is determined by the RTT field.
+// where the priority is determined by the Score method.
 type IPInfQueue struct {
 	items []IPInfo // Slice of IPInfo structs.
 }
 
 // Enqueue adds an item to the IPInfQueue and sorts the queue based on
-// the RTT field of each IPInfo struct. This allows for efficient retrieval
-// of the IPInfo struct with the lowest RTT value.
+// the score of each IPInfo struct. This allows for efficient retrieval
+// of the IPInfo struct with the lowest score.
 func (q *IPInfQueue) Enqueue(item IPInfo) {
 	// Add the item to the end of the queue.
 	q.items = append(q.items, item)
 
-	// Sort the queue based on the RTT field.
+	// Sort the queue based on the score.
 	sort.Slice(q.items, func(i, j int) bool {
-		return q.items[i].RTT < q.items[j].RTT
+		return q.items[i].Score() < q.items[j].Score()
 	})
 }
 
-// Dequeue removes and returns the IPInfo struct with the lowest RTT value
+// Dequeue removes and returns the IPInfo struct with the lowest score
 // from the IPInfQueue. If the queue is empty, an empty IPInfo struct is returned.
 // This operation has a time complexity of O(1) as the first item in the sorted
-// slice is always the one with the lowest RTT value.
+// slice is always the one with the lowest score.
 func (q *IPInfQueue) Dequeue() IPInfo {
 	// Check if the queue is empty.
 	if len(q.items) == 0 {
-	
+		return IPInfo{}
+	}
+
+	// Remove and return the first item in the queue.
+	item := q.items[0]
+	q.items = q.items[1:]
+
+	return item
+}
+
+// Expire removes items from the IPInfQueue that were created more than
+// ttl ago.
+func (q *IPInfQueue) Expire(ttl time.Duration) {
+	var validItems []IPInfo
+	for _, item := range q.items {
+		if time.Since(item.CreatedAt) <= ttl {
+			validItems = append(validItems, item)
+		}
+	}
+	q.items = validItems
+}
+
+// Size returns the number of items in the IPInfQueue.
+func (q *IPInfQueue) Size() int {
+	return len(q.items)
+}
+
+// IsEmpty reports whether the IPInfQueue has no items.
+func (q *IPInfQueue) IsEmpty() bool {
+	return len(q.items) == 0
+}
@@ -0,0 +1,57 @@
+package statute
+
+import (
+	"net/netip"
+	"slices"
+	"time"
+)
+
+// lossPenalty is what a fully lossy endpoint adds to its score. An endpoint
+// that drops one probe in ten scores as if it were 100ms slower.
+const lossPenalty = time.Second
+
+// Score returns the composite quality of an endpoint, lower is better. It
+// adds twice the jitter and a penalty for loss to the median RTT, so that
+// a steady endpoint wins over a slightly faster but erratic one.
+func (i IPInfo) Score() time.Duration {
+	return i.RTT + 2*i.Jitter + time.Duration(i.Loss*float64(lossPenalty))
+}
+
+// SuccessRatio returns the share of probes that got an answer.
+func (i IPInfo) SuccessRatio() float64 {
+	return 1 - i.Loss
+}
+
+// NewIPInfoFromSamples summarizes a probe window. rtts holds the answered
+// probes in the order they were sent, sent the number of probes in total.
+func NewIPInfoFromSamples(addr netip.AddrPort, rtts []time.Duration, sent int) IPInfo {
+	info := IPInfo{
+		AddrPort:  addr,
+		Samples:   sent,
+		CreatedAt: time.Now(),
+	}
+	if sent > 0 {
+		info.Loss = float64(sent-len(rtts)) / float64(sent)
+	}
+	if len(rtts) == 0 {
+		return info
+	}
+
+	var diff time.Duration
+	for i := 1; i < len(rtts); i++ {
+		d := rtts[i] - rtts[i-1]
+		if d < 0 {
+			d = -d
+		}
+		diff += d
+	}
+	if len(rtts) > 1 {
+		info.Jitter = diff / time.Duration(len(rtts)-1)
+	}
+
+	sorted := slices.Clone(rtts)
+	slices.Sort(sorted)
+	info.RTT = sorted[len(sorted)/2]
+
+	return info
+}
@@ -0,0 +1,106 @@
+package statute
+
+import (
+	"cmp"
+	"net/netip"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestNewIPInfoFromSamples(t *testing.T) {
+	ms := time.Millisecond
+
+	tests := []struct {
+		name   string
+		rtts   []time.Duration
+		sent   int
+		rtt    time.Duration
+		jitter time.Duration
+		loss   float64
+	}{
+		{name: "nothing sent"},
+		{name: "nothing answered", sent: 4, loss: 1},
+		{name: "single sample", rtts: []time.Duration{80 * ms}, sent: 1, rtt: 80 * ms},
+		{
+			name:   "median of odd count",
+			rtts:   []time.Duration{90 * ms, 70 * ms, 80 * ms},
+			sent:   3,
+			rtt:    80 * ms,
+			jitter: 15 * ms, // (20 + 10) / 2
+		},
+		{
+			name:   "upper median of even count",
+			rtts:   []time.Duration{60 * ms, 100 * ms, 80 * ms, 80 * ms},
+			sent:   4,
+			rtt:    80 * ms,
+			jitter: 20 * ms, // (40 + 20 + 0) / 3
+		},
+		{
+			name: "loss",
+			rtts: []time.Duration{50 * ms, 50 * ms, 50 * ms},
+			sent: 4,
+			rtt:  50 * ms,
+			loss: 0.25,
+		},
+	}
+
+	addr := netip.MustParseAddrPort("162.159.192.1:2408")
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := NewIPInfoFromSamples(addr, tt.rtts, tt.sent)
+			if got.AddrPort != addr || got.Samples != tt.sent {
+				t.Errorf("got %v with %d samples, want %v with %d", got.AddrPort, got.Samples, addr, tt.sent)
+			}
+			if got.RTT != tt.rtt || got.Jitter != tt.jitter || got.Loss != tt.loss {
+				t.Errorf("got rtt %v, jitter %v, loss %v, want %v, %v, %v", got.RTT, got.Jitter, got.Loss, tt.rtt, tt.jitter, tt.loss)
+			}
+		})
+	}
+}
+
+func TestScore(t *testing.T) {
+	ms := time.Millisecond
+
+	tests := []struct {
+		name string
+		info IPInfo
+		want time.Duration
+	}{
+		{name: "rtt only", info: IPInfo{RTT: 80 * ms}, want: 80 * ms},
+		{name: "jitter counts twice", info: IPInfo{RTT: 80 * ms, Jitter: 10 * ms}, want: 100 * ms},
+		{name: "a tenth lost", info: IPInfo{RTT: 80 * ms, Loss: 0.1}, want: 180 * ms},
+		{name: "everything lost", info: IPInfo{Loss: 1}, want: time.Second},
+		{name: "all of it", info: IPInfo{RTT: 50 * ms, Jitter: 5 * ms, Loss: 0.5}, want: 560 * ms},
+	}
+
+	for _, tt := range tests {
+		if got := tt.info.Score(); got != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestScoreRanking(t *testing.T) {
+	ms := time.Millisecond
+	addr := func(s string) netip.AddrPort { return netip.MustParseAddrPort(s) }
+
+	// From best to worst.
+	infos := []IPInfo{
+		NewIPInfoFromSamples(addr("162.159.192.1:2408"), []time.Duration{70 * ms, 72 * ms, 71 * ms, 70 * ms}, 4),          // Steady
+		NewIPInfoFromSamples(addr("162.159.192.2:2408"), []time.Duration{40 * ms, 90 * ms, 45 * ms, 60 * ms, 50 * ms}, 5), // Faster median, erratic
+		NewIPInfoFromSamples(addr("162.159.192.3:2408"), []time.Duration{200 * ms, 210 * ms, 205 * ms, 200 * ms}, 4),      // Slow
+		NewIPInfoFromSamples(addr("162.159.192.4:2408"), []time.Duration{30 * ms, 30 * ms, 30 * ms}, 4),                   // Fastest, a quarter lost
+	}
+
+	got := slices.Clone(infos)
+	slices.Reverse(got)
+	slices.SortStableFunc(got, func(a, b IPInfo) int {
+		return cmp.Compare(a.Score(), b.Score())
+	})
+	for i := range got {
+		if got[i].AddrPort != infos[i].AddrPort {
+			t.Errorf("rank %d: got %v (score %v), want %v (score %v)", i, got[i].AddrPort, got[i].Score(), infos[i].AddrPort, infos[i].Score())
+		}
+	}
+}
@@ -19,6 +19,9 @@ import (
 // TIPQueueChangeCallback is a type for a function that handles changes in the IP queue
 type TIPQueueChangeCallback func(ips []IPInfo)
 
+// TEventCallback is a type for a function that handles scanner events
+type TEventCallback func(ev Event)
+
 // Type definitions
 type (
 	TDialerFunc     func(ctx context.Context, network, addr string) (net.Conn, error)
@@ -38,8 +41,44 @@ const (
 // IPInfo struct contains information about an IP address
 type IPInfo struct {
 	AddrPort  netip.AddrPort // Combination of IP address and port number
-	RTT       time.Duration  // Round-trip time
+	RTT       time.Duration  // Round-trip time, the median over all samples
+	Jitter    time.Duration  // Mean difference between consecutive RTT samples
+	Loss      float64        // Share of probes that got no answer, from 0 to 1
+	Samples   int            // Number of probes sent
 	CreatedAt time.Time      // Timestamp when the IP was added to the queue
+	Colo      string         // Cloudflare data center that served the edge test, if any
+	Download  float64        // Download throughput in bytes per second, zero if not measured
+	Upload    float64        // Upload throughput in bytes per second, zero if not measured
+}
+
+// PortStat struct counts the probes sent to a port and how many succeeded
+type PortStat struct {
+	Port      uint16 // Probed port
+	Attempts  int    // Number of probes sent to the port
+	Successes int    // Number of probes that got an answer
+}
+
+// WarpJunk struct configures the random packets sent ahead of a WARP
+// handshake to throw off DPI. Each probe sends between MinCount and
+// MaxCount packets of MinSize to MaxSize bytes, waiting MinDelay to
+// MaxDelay after each one. A zero MaxCount sends none.
+type WarpJunk struct {
+	MinCount int
+	MaxCount int
+	MinSize  int
+	MaxSize  int
+	MinDelay time.Duration
+	MaxDelay time.Duration
+}
+
+// DefaultWarpJunk is the junk sent when the scanner options don't say otherwise
+var DefaultWarpJunk = WarpJunk{
+	MinCount: 1,
+	MaxCount: 2,
+	MinSize:  1,
+	MaxSize:  100,
+	MinDelay: 200 * time.Millisecond,
+	MaxDelay: 500 * time.Millisecond,
 }
 
 // ScannerOptions struct holds configuration options for the network scanner
@@ -48,6 +87,8 @@ type ScannerOptions struct {
 	UseIPv4               bool
 	UseIPv6               bool
 	CidrList              []netip.Prefix // List of CIDR ranges to scan
+	ExcludeList           []netip.Prefix // List of CIDR ranges never to scan
+	Seed                  int64          // Seed for address and port sampling, zero for a random one
 	SelectedOps           int
 	Logger                *slog.Logger
 	InsecureSkipVerify    bool
@@ -65,7 +106,22 @@ type ScannerOptions struct {
 	WarpPrivateKey        string
 	WarpPeerPublicKey     string
 	WarpPresharedKey      string
+	WarpReserved          [3]byte       // Reserved header bytes of WARP handshake and transport packets
+	WarpJunk              WarpJunk      // Random packets sent ahead of each WARP handshake
+	WarpConfirm           bool          // Require a reply through the session after each WARP handshake
+	WarpHandshakeTimeout  time.Duration // How long WARP probes wait for the response, zero for 5s
 	Port                  uint16
+	Ports                 []uint16 // Ports to pick from for each probe, overrides Port
 	IPQueueSize           int
 	IPQueueTTL            time.Duration
-	MaxDes
+	MaxDesirableRTT       time.Duration
+	IPQueueChangeCallback TIPQueueChangeCallback
+	EventCallback         TEventCallback // Called for every probe and queue change, from the scanning goroutines
+	ConnectionTimeout     time.Duration
+	HandshakeTimeout      time.Duration
+	TlsVersion            uint16
+	Concurrency           int // Number of probes in flight at once
+	RateLimit             int // Maximum probes started per second, zero for no limit
+	StopAfter             int // Stop once this many endpoints within MaxDesirableRTT are found, zero to keep scanning
+	Samples               int // Probes sent to each responsive endpoint to measure its quality
+}
@@ -1,30 +1,438 @@
-ctx := context.Background()
-
-scanner := ipscanner.NewScanner(
-	ipscanner.WithUseIPv4(false),
-	ipscanner.WithUseIPv6(true),
-	ipscanner.WithCidrList([]netip.Prefix{netip.ParsePrefix("2001:db8::/64")}),
-	ipscanner.WithHttpPath("/some-path"),
-	ipscanner.WithUserAgent("MyCustomUserAgent"),
-	ipscanner.WithLogger(&slog.Logger{
-		Handler: slog.NewJSONHandler(os.Stdout),
-		Level:   slog.LevelInfo,
-	}),
-	ipscanner.WithInsecureSkipVerify(false),
-	ipscanner.WithHostname("example.com"),
-	ipscanner.WithPort(80),
-	ipscanner.WithHTTPPing(),
-	ipscanner.WithQUICPing(),
-	ipscanner.WithTCPPing(),
-	ipscanner.WithTLSPing(),
-	ipscanner.WithConnectionTimeout(5*time.Second),
-	ipscanner.WithHandshakeTimeout(3*time.Second),
-	ipscanner.WithTlsVersion(tls.VersionTLS12),
+package ipscanner
+
+import (
+	"context"
+	"crypto/tls"
+	"log/slog"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/bepass-org/warp-plus/ipscanner/internal/engine"
+	"github.com/bepass-org/warp-plus/ipscanner/internal/statute"
 )
 
-scanner.Run(ctx)
+// IPScanner scans IP ranges and keeps the addresses that answered fastest.
+type IPScanner struct {
+	options statute.ScannerOptions
+	log     *slog.Logger
+	engine  *engine.Engine
+	events  statute.TEventCallback // Event callback set through WithEventCallback
+	done    chan struct{}          // Closed once the scan finished
+	mu      sync.Mutex             // Protects subs
+	subs    []chan Event           // Channels handed out by Subscribe
+}
+
+// NewScanner creates a new IPScanner with the given options applied on top
+// of the defaults.
+func NewScanner(options ...Option) *IPScanner {
+	p := &IPScanner{
+		options: statute.ScannerOptions{
+			UseIPv4:            true,
+			UseIPv6:            true,
+			CidrList:           statute.DefaultCFRanges(),
+			SelectedOps:        0,
+			Logger:             slog.Default(),
+			InsecureSkipVerify: true,
+			UseHTTP3:           false,
+			UseHTTP2:           false,
+			DisableCompression: false,
+			HTTPPath:           "/",
+			Referrer:           "",
+			UserAgent:          "Chrome/80.0.3987.149",
+			Hostname:           "www.cloudflare.com",
+			WarpPresharedKey:   "",
+			WarpPeerPublicKey:  "",
+			WarpPrivateKey:     "",
+			WarpJunk:           statute.DefaultWarpJunk,
+			Port:               443,
+			IPQueueSize:        8,
+			MaxDesirableRTT:    400 * time.Millisecond,
+			IPQueueTTL:         30 * time.Second,
+			ConnectionTimeout:  1 * time.Second,
+			HandshakeTimeout:   1 * time.Second,
+			TlsVersion:         tls.VersionTLS13,
+			Concurrency:        16,
+			Samples:            3,
+		},
+		log:  slog.Default(),
+		done: make(chan struct{}),
+	}
+	// The default dialers read the options of this scanner when they dial,
+	// so they follow the options applied below.
+	p.options.RawDialerFunc = statute.DefaultDialerFunc(&p.options)
+	p.options.TLSDialerFunc = statute.DefaultTLSDialerFunc(&p.options)
+	p.options.QuicDialerFunc = statute.DefaultQuicDialerFunc(&p.options)
+	p.options.HttpClientFunc = statute.DefaultHTTPClientFunc(&p.options)
+
+	for _, option := range options {
+		option(p)
+	}
+
+	return p
+}
+
+// Option configures an IPScanner.
+type Option func(*IPScanner)
+
+func WithUseIPv4(useIPv4 bool) Option {
+	return func(i *IPScanner) {
+		i.options.UseIPv4 = useIPv4
+	}
+}
+
+func WithUseIPv6(useIPv6 bool) Option {
+	return func(i *IPScanner) {
+		i.options.UseIPv6 = useIPv6
+	}
+}
+
+func WithDialer(d statute.TDialerFunc) Option {
+	return func(i *IPScanner) {
+		i.options.RawDialerFunc = d
+	}
+}
+
+func WithTLSDialer(t statute.TDialerFunc) Option {
+	return func(i *IPScanner) {
+		i.options.TLSDialerFunc = t
+	}
+}
+
+func WithHttpClientFunc(h statute.THTTPClientFunc) Option {
+	return func(i *IPScanner) {
+		i.options.HttpClientFunc = h
+	}
+}
+
+func WithUseHTTP3(useHTTP3 bool) Option {
+	return func(i *IPScanner) {
+		i.options.UseHTTP3 = useHTTP3
+	}
+}
+
+func WithUseHTTP2(useHTTP2 bool) Option {
+	return func(i *IPScanner) {
+		i.options.UseHTTP2 = useHTTP2
+	}
+}
+
+func WithDisableCompression(disableCompression bool) Option {
+	return func(i *IPScanner) {
+		i.options.DisableCompression = disableCompression
+	}
+}
+
+func WithHttpPath(path string) Option {
+	return func(i *IPScanner) {
+		i.options.HTTPPath = path
+	}
+}
+
+func WithReferrer(referrer string) Option {
+	return func(i *IPScanner) {
+		i.options.Referrer = referrer
+	}
+}
 
-availableIPs := scanner.GetAvailableIPs()
-for _, ipInfo := range availableIPs {
-	fmt.Println(ipInfo)
+func WithUserAgent(userAgent string) Option {
+	return func(i *IPScanner) {
+		i.options.UserAgent = userAgent
+	}
 }
+
+func WithLogger(logger *slog.Logger) Option {
+	return func(i *IPScanner) {
+		i.log = logger
+		i.options.Logger = logger
+	}
+}
+
+func WithInsecureSkipVerify(insecureSkipVerify bool) Option {
+	return func(i *IPScanner) {
+		i.options.InsecureSkipVerify = insecureSkipVerify
+	}
+}
+
+func WithHostname(hostname string) Option {
+	return func(i *IPScanner) {
+		i.options.Hostname = hostname
+	}
+}
+
+func WithPort(port uint16) Option {
+	return func(i *IPScanner) {
+		i.options.Port = port
+	}
+}
+
+// WithPorts spreads probes over ports instead of the single Port. The scan
+// learns which of them answer and sends most probes there. For WARP pings
+// an empty list means every WARP port.
+func WithPorts(ports []uint16) Option {
+	return func(i *IPScanner) {
+		i.options.Ports = ports
+	}
+}
+
+func WithCidrList(cidrList []netip.Prefix) Option {
+	return func(i *IPScanner) {
+		i.options.CidrList = cidrList
+	}
+}
+
+// WithExcludeList keeps the scan away from the given prefixes, even where
+// they overlap the CIDR list.
+func WithExcludeList(excludeList []netip.Prefix) Option {
+	return func(i *IPScanner) {
+		i.options.ExcludeList = excludeList
+	}
+}
+
+// WithSeed makes the order in which addresses and ports are sampled
+// reproducible. Zero picks a random seed.
+func WithSeed(seed int64) Option {
+	return func(i *IPScanner) {
+		i.options.Seed = seed
+	}
+}
+
+func WithHTTPPing() Option {
+	return func(i *IPScanner) {
+		i.options.SelectedOps |= statute.HTTPPing
+	}
+}
+
+func WithWarpPing() Option {
+	return func(i *IPScanner) {
+		i.options.SelectedOps |= statute.WARPPing
+	}
+}
+
+func WithQUICPing() Option {
+	return func(i *IPScanner) {
+		i.options.SelectedOps |= statute.QUICPing
+	}
+}
+
+func WithTCPPing() Option {
+	return func(i *IPScanner) {
+		i.options.SelectedOps |= statute.TCPPing
+	}
+}
+
+func WithTLSPing() Option {
+	return func(i *IPScanner) {
+		i.options.SelectedOps |= statute.TLSPing
+	}
+}
+
+func WithWarpPrivateKey(privateKey string) Option {
+	return func(i *IPScanner) {
+		i.options.WarpPrivateKey = privateKey
+	}
+}
+
+func WithWarpPeerPublicKey(peerPublicKey string) Option {
+	return func(i *IPScanner) {
+		i.options.WarpPeerPublicKey = peerPublicKey
+	}
+}
+
+func WithWarpPreSharedKey(presharedKey string) Option {
+	return func(i *IPScanner) {
+		i.options.WarpPresharedKey = presharedKey
+	}
+}
+
+// WithWarpReserved sets the reserved header bytes sent in WARP packets,
+// as assigned to the client by the WARP API.
+func WithWarpReserved(reserved [3]byte) Option {
+	return func(i *IPScanner) {
+		i.options.WarpReserved = reserved
+	}
+}
+
+// WithWarpJunk sets the random packets sent ahead of each WARP handshake.
+// A zero WarpJunk sends none.
+func WithWarpJunk(junk WarpJunk) Option {
+	return func(i *IPScanner) {
+		i.options.WarpJunk = junk
+	}
+}
+
+// WithWarpConfirm makes WARP probes send an ICMP echo through the session
+// after the handshake, and fail unless a reply comes back through it.
+func WithWarpConfirm(confirm bool) Option {
+	return func(i *IPScanner) {
+		i.options.WarpConfirm = confirm
+	}
+}
+
+// WithWarpHandshakeTimeout sets how long WARP probes wait for the
+// handshake response, 5s by default. The handshake timeout only bounds
+// TLS and QUIC probes.
+func WithWarpHandshakeTimeout(timeout time.Duration) Option {
+	return func(i *IPScanner) {
+		i.options.WarpHandshakeTimeout = timeout
+	}
+}
+
+// WithEventCallback sets a function called for every scan event. It is
+// called from the scanning goroutines and should return quickly.
+func WithEventCallback(cb func(Event)) Option {
+	return func(i *IPScanner) {
+		i.events = cb
+	}
+}
+
+// WithIPQueueChangeCallback sets a function called with the best endpoints,
+// best score first, whenever they change.
+func WithIPQueueChangeCallback(cb func([]IPInfo)) Option {
+	return func(i *IPScanner) {
+		i.options.IPQueueChangeCallback = cb
+	}
+}
+
+func WithMaxDesirableRTT(threshold time.Duration) Option {
+	return func(i *IPScanner) {
+		i.options.MaxDesirableRTT = threshold
+	}
+}
+
+func WithIPQueueSize(size int) Option {
+	return func(i *IPScanner) {
+		i.options.IPQueueSize = size
+	}
+}
+
+func WithIPQueueTTL(ttl time.Duration) Option {
+	return func(i *IPScanner) {
+		i.options.IPQueueTTL = ttl
+	}
+}
+
+func WithConnectionTimeout(timeout time.Duration) Option {
+	return func(i *IPScanner) {
+		i.options.ConnectionTimeout = timeout
+	}
+}
+
+func WithHandshakeTimeout(timeout time.Duration) Option {
+	return func(i *IPScanner) {
+		i.options.HandshakeTimeout = timeout
+	}
+}
+
+func WithTlsVersion(version uint16) Option {
+	return func(i *IPScanner) {
+		i.options.TlsVersion = version
+	}
+}
+
+// WithConcurrency sets how many probes are in flight at once.
+func WithConcurrency(n int) Option {
+	return func(i *IPScanner) {
+		i.options.Concurrency = n
+	}
+}
+
+// WithRateLimit caps the number of probes started per second. Zero means
+// no limit.
+func WithRateLimit(pps int) Option {
+	return func(i *IPScanner) {
+		i.options.RateLimit = pps
+	}
+}
+
+// WithStopAfter stops the scan once n endpoints within the desirable RTT
+// were found. Zero keeps scanning until the context is done.
+func WithStopAfter(n int) Option {
+	return func(i *IPScanner) {
+		i.options.StopAfter = n
+	}
+}
+
+// WithSamples sets how many probes each responsive endpoint gets. Its RTT
+// is the median over these, and jitter and loss are measured across them.
+func WithSamples(n int) Option {
+	return func(i *IPScanner) {
+		i.options.Samples = n
+	}
+}
+
+// Run starts the scan in the background. It stops when ctx is done, or
+// once StopAfter good endpoints were found. Use Wait or Done to learn when
+// it finished. A scanner runs only once.
+func (i *IPScanner) Run(ctx context.Context) {
+	i.options.EventCallback = i.emit
+	if !i.options.UseIPv4 && !i.options.UseIPv6 {
+		i.log.Error("Fatal: both IPv4 and IPv6 are disabled, nothing to do")
+		i.finish()
+		return
+	}
+	i.engine = engine.NewScannerEngine(&i.options)
+	go func() {
+		i.engine.Run(ctx)
+		i.finish()
+	}()
+}
+
+// GetAvailableIPs returns the addresses found so far, best score first.
+func (i *IPScanner) GetAvailableIPs() []statute.IPInfo {
+	if i.engine != nil {
+		return i.engine.GetAvailableIPs(false)
+	}
+	return nil
+}
+
+// PortStats returns, for each port the scan spreads probes over, how many
+// probes were sent and how many succeeded. Ports without successes are
+// likely blocked on this network.
+func (i *IPScanner) PortStats() []statute.PortStat {
+	if i.engine != nil {
+		return i.engine.PortStats()
+	}
+	return nil
+}
+
+// ReachablePorts returns the ports that answered at least one probe.
+func (i *IPScanner) ReachablePorts() []uint16 {
+	var ports []uint16
+	for _, st := range i.PortStats() {
+		if st.Successes > 0 {
+			ports = append(ports, st.Port)
+		}
+	}
+	return ports
+}
+
+// IPInfo describes a scanned address and the quality of its answers.
+type IPInfo = statute.IPInfo
+
+// NewIPInfoFromSamples summarizes the probes sent to addr: rtts holds the
+// answered ones in the order they were sent, sent counts all of them.
+func NewIPInfoFromSamples(addr netip.AddrPort, rtts []time.Duration, sent int) IPInfo {
+	return statute.NewIPInfoFromSamples(addr, rtts, sent)
+}
+
+// PortStat counts the probes sent to a port and how many succeeded.
+type PortStat = statute.PortStat
+
+// Event reports progress of a scan.
+type Event = statute.Event
+
+// EventType identifies what an Event reports.
+type EventType = statute.EventType
+
+// Event types.
+const (
+	EventProbeStarted   = statute.EventProbeStarted
+	EventProbeSucceeded = statute.EventProbeSucceeded
+	EventProbeFailed    = statute.EventProbeFailed
+	EventQueueChanged   = statute.EventQueueChanged
+	EventFinished       = statute.EventFinished
+)
+
+// WarpJunk configures the random packets sent ahead of a WARP handshake.
+type WarpJunk = statute.WarpJunk
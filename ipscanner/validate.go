@@ -0,0 +1,28 @@
+package ipscanner
+
+import (
+	"context"
+	"net/netip"
+	"time"
+
+	"github.com/bepass-org/warp-plus/ipscanner/internal/ping"
+	"github.com/bepass-org/warp-plus/ipscanner/internal/statute"
+)
+
+// ValidateWarpEndpoint performs a single WARP handshake with addr and
+// returns its round-trip time. It is meant for re-checking endpoints that
+// are already known, without running a scan.
+func ValidateWarpEndpoint(ctx context.Context, addr netip.AddrPort, privateKey, peerPublicKey string) (time.Duration, error) {
+	p := ping.NewWarpPing(addr.Addr(), &statute.ScannerOptions{
+		WarpPrivateKey:    privateKey,
+		WarpPeerPublicKey: peerPublicKey,
+		WarpJunk:          statute.DefaultWarpJunk,
+	})
+	p.Port = addr.Port()
+
+	res := p.PingContext(ctx)
+	if err := res.Error(); err != nil {
+		return 0, err
+	}
+	return res.Result().RTT, nil
+}
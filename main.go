@@ -69,24 +69,64 @@ func main() {
 		country  = fs.StringEnumLong("country", fmt.Sprintf("psiphon country code (valid values: %s)", psiphonCountries), psiphonCountries...)
 		scan     = fs.BoolLong("scan", "enable warp scanning")
 		rtt      = fs.DurationLong("rtt", 1000*time.Millisecond, "scanner rtt limit")
+		rescan   = fs.DurationLong("rescan", 0, "check the endpoint this often and switch to a better one when it degrades, 0 to disable")
+		identity = fs.StringLong("import", "", "import a wgcf account, official client registration or wg-quick profile")
+		team     = fs.StringLong("team", "", "zero trust team name")
+		teamJWT  = fs.StringLong("team-jwt", "", "zero trust enrollment token from the team login flow")
+		clientID = fs.StringLong("team-client-id", "", "zero trust service token client id")
+		secret   = fs.StringLong("team-client-secret", "", "zero trust service token client secret")
+		edpFile  = fs.StringLong("endpoints", "", "file with extra warp prefixes and ports, one per line")
+		apiProxy = fs.StringLong("api-proxy", "", "register through this proxy (socks5://host:port or http://host:port)")
+		apiTLS   = fs.StringListLong("api-tls", "api tls strategy fingerprint[,sni=name][,host=addr], repeatable (fingerprints: sni-curve chrome firefox safari ios edge android randomized)")
+		wgConf   = fs.StringLong("wg-config", "", "run this wg-quick profile instead of warp (no warp account, scanning or noise unless asked for)")
+		trick    = fs.BoolLong("trick", "send the default warp noise in wg-config mode")
+		uapi     = fs.BoolLong("uapi", "serve the wireguard uapi as interface warp<bind port> for wg show and wg set")
+		awg      = fs.StringLong("awg", "", "amneziawg parameters such as jc=4,jmin=40,jmax=70 (s1, s2 and h1-h4 need an amneziawg server)")
+		noise    = fs.StringLong("noise", "", "noise sent before handshakes, such as count=2,size=10-60,delay=10ms-50ms,pattern=quic,when=first,port=443 (count=0 disables)")
+		hop      = fs.DurationLong("hop", 0, "move the tunnel to fresh udp ports this often, 0 to disable")
+		hopDrop  = fs.BoolLong("hop-on-collapse", "also move the tunnel to fresh udp ports when its throughput collapses")
+		hopMode  = fs.StringEnumLong("hop-mode", "udp ports to change when hopping, the local (src) or remote (dst) one (valid values: [both src dst])", "both", "src", "dst")
+		mtu      = fs.IntLong("mtu", 0, "tunnel mtu, 0 to discover it by probing the path")
+		capture  = fs.StringLong("capture", "", "append the decrypted tunnel traffic to this pcapng file")
+		capFilt  = fs.StringLong("capture-filter", "", "only capture packets matching this tcpdump-like filter, such as 'udp port 53 or icmp'")
+		capSize  = fs.IntLong("capture-size", 0, "rotate the capture file after this many MiB, 0 to never rotate")
+		capFiles = fs.IntLong("capture-files", 4, "rotated capture files to keep")
+		capPause = fs.BoolLong("capture-paused", "only start capturing once started with SIGUSR1, which pauses and resumes captures, or --capture-control")
+		capCtl   = fs.StringLong("capture-control", "", "serve http on this address, such as 127.0.0.1:8087, to start and stop captures with POST /capture/start and /capture/stop")
 		_        = fs.String('c', "config", "", "path to config file")
 	)
 
-	err := ff.Parse(
-		fs,
+	scanCmd := newScanCommand()
+	root := &ff.Command{
+		Name:        "warp-plus",
+		Usage:       "warp-plus [FLAGS] [SUBCOMMAND]",
+		Flags:       fs,
+		Subcommands: []*ff.Command{scanCmd},
+	}
+
+	err := root.Parse(
 		os.Args[1:],
 		ff.WithConfigFileFlag("config"),
 		ff.WithConfigFileParser(ffjson.Parse),
 	)
 	switch {
 	case errors.Is(err, ff.ErrHelp):
-		fmt.Fprintf(os.Stderr, "%s\n", ffhelp.Flags(fs))
+		fmt.Fprintf(os.Stderr, "%s\n", ffhelp.Command(root.GetSelected()))
 		os.Exit(0)
 	case err != nil:
 		fmt.Fprintf(os.Stderr, "error: %v\n", err)
 		os.Exit(1)
 	}
 
+	if root.GetSelected() == scanCmd {
+		ctx, _ := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		if err := root.Run(ctx); err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	l := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelInfo}))
 
 	if *verbose {
@@ -115,6 +155,69 @@ func main() {
 		Endpoint: *endpoint,
 		License:  *key,
 		Gool:     *gool,
+		Import:   *identity,
+		MTU:      *mtu,
+	}
+
+	if *wgConf != "" {
+		l.Info("wireguard mode enabled", "profile", *wgConf, "trick", *trick)
+		opts.Wireguard = &app.WireguardOptions{Config: *wgConf}
+	} else if *trick {
+		fatal(l, errors.New("trick only applies to wg-config mode"))
+	}
+
+	switch {
+	case *trick && *noise != "":
+		fatal(l, errors.New("can't use trick and noise at the same time"))
+	case *trick:
+		n := wiresocks.DefaultNoise
+		opts.Noise = &n
+	case *noise != "":
+		n, err := wiresocks.ParseNoise(*noise)
+		if err != nil {
+			fatal(l, fmt.Errorf("invalid noise: %w", err))
+		}
+		opts.Noise = &n
+	}
+
+	if *awg != "" {
+		o, err := wiresocks.ParseObfuscation(*awg)
+		if err != nil {
+			fatal(l, fmt.Errorf("invalid awg parameters: %w", err))
+		}
+		opts.Obfuscation = &o
+	}
+
+	if *hop > 0 || *hopDrop {
+		l.Info("port hopping enabled", "interval", *hop, "on-collapse", *hopDrop, "mode", *hopMode)
+		opts.Hop = &app.HopOptions{
+			Interval:    *hop,
+			OnCollapse:  *hopDrop,
+			Source:      *hopMode != "dst",
+			Destination: *hopMode != "src",
+		}
+	}
+
+	if *capture != "" {
+		c := &app.CaptureOptions{Paused: *capPause}
+		c.Path, c.Filter = *capture, *capFilt
+		c.MaxSize, c.MaxFiles = int64(*capSize)<<20, *capFiles
+		if err := c.Validate(); err != nil {
+			fatal(l, fmt.Errorf("invalid capture: %w", err))
+		}
+		if *capCtl != "" {
+			c.Control, err = netip.ParseAddrPort(*capCtl)
+			if err != nil {
+				fatal(l, fmt.Errorf("invalid capture control address: %w", err))
+			}
+		}
+		opts.Capture = c
+	} else if *capFilt != "" || *capPause || *capCtl != "" {
+		fatal(l, errors.New("capture options need --capture"))
+	}
+
+	if *uapi {
+		opts.UAPI = fmt.Sprintf("warp%d", bindAddrPort.Port())
 	}
 
 	if *psiphon {
@@ -122,13 +225,62 @@ func main() {
 		opts.Psiphon = &app.PsiphonOptions{Country: *country}
 	}
 
+	switch {
+	case (*clientID != "") != (*secret != ""):
+		fatal(l, errors.New("service token needs both --team-client-id and --team-client-secret"))
+	case *clientID != "" && *team == "":
+		fatal(l, errors.New("service token needs --team"))
+	}
+	if *team != "" || *teamJWT != "" {
+		l.Info("teams mode enabled", "team", *team)
+		opts.Teams = &warp.TeamsOptions{Team: *team, JWT: *teamJWT, ClientID: *clientID, ClientSecret: *secret}
+	}
+
 	if *scan {
 		l.Info("scanner mode enabled", "max-rtt", rtt)
 		opts.Scan = &wiresocks.ScanOptions{V4: *v4, V6: *v6, MaxRTT: *rtt}
 	}
 
-	// If the endpoint is not set, choose a random warp endpoint
-	if opts.Endpoint == "" {
+	if *rescan > 0 {
+		opts.Rescan = &wiresocks.RescanOptions{
+			ScanOptions: wiresocks.ScanOptions{V4: *v4, V6: *v6, MaxRTT: *rtt},
+			Interval:    *rescan,
+		}
+	}
+
+	strategies := make([]warp.TLSStrategy, 0, len(*apiTLS))
+	for _, v := range *apiTLS {
+		s, err := warp.ParseTLSStrategy(v)
+		if err != nil {
+			fatal(l, err)
+		}
+		strategies = append(strategies, s)
+	}
+	if err := warp.ConfigureTLS(strategies, "stuff/tls-strategy"); err != nil {
+		fatal(l, err)
+	}
+
+	if *apiProxy != "" {
+		dial, err := warp.ProxyDialContext(*apiProxy)
+		if err != nil {
+			fatal(l, err)
+		}
+		l.Info("using proxy for warp api", "proxy", *apiProxy)
+		warp.SetDialContext(dial)
+	}
+
+	// Scanning and random endpoints use the endpoint catalog, refreshed the
+	// first time they need it.
+	if err := os.MkdirAll("stuff", 0o755); err != nil {
+		fatal(l, err)
+	}
+	if err := warp.SetEndpointCatalog(l.With("subsystem", "warp/catalog"), "stuff/endpoints.json", *edpFile); err != nil {
+		fatal(l, err)
+	}
+
+	// If the endpoint is not set, choose a random warp endpoint. WireGuard
+	// profiles bring their own.
+	if opts.Endpoint == "" && opts.Wireguard == nil {
 		addrPort, err := warp.RandomWarpEndpoint(*v4, *v6)
 		if err != nil {
 			fatal(l, err)
@@ -0,0 +1,687 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net/netip"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bepass-org/warp-plus/ipscanner"
+	"github.com/bepass-org/warp-plus/warp"
+	"github.com/fatih/color"
+	"github.com/go-ini/ini"
+	"github.com/peterbourgon/ff/v4"
+	"github.com/rodaine/table"
+)
+
+var scanPingTypes = []string{"warp", "tcp", "tls", "http", "quic"}
+
+var scanOutputFormats = []string{"table", "json", "csv", "list"}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// scanConfig holds the flags of the scan command.
+type scanConfig struct {
+	v4, v6           bool
+	verbose          bool
+	pings            []string
+	cidrs            []string
+	excludes         []string
+	ports            []string
+	profile          string
+	privateKey       string
+	publicKey        string
+	presharedKey     string
+	reserved         string
+	junkCount        string
+	junkSize         string
+	junkDelay        string
+	confirm          bool
+	warpTimeout      time.Duration
+	hostname         string
+	httpPath         string
+	userAgent        string
+	referrer         string
+	insecure         bool
+	http2            bool
+	http3            bool
+	noCompression    bool
+	tlsVersion       string
+	connTimeout      time.Duration
+	handshakeTimeout time.Duration
+	rtt              time.Duration
+	queueSize        int
+	queueTTL         time.Duration
+	timeout          time.Duration
+	concurrency      int
+	rate             int
+	stopAfter        int
+	samples          int
+	seed             int
+	speedTest        int
+	speedURL         string
+	uploadURL        string
+	uploadBytes      int
+	sni              string
+	colos            []string
+	output           string
+	top              int
+}
+
+func newScanCommand() *ff.Command {
+	var cfg scanConfig
+
+	fs := ff.NewFlagSet("scan")
+	fs.BoolVar(&cfg.v4, '4', "", "only scan IPv4 addresses")
+	fs.BoolVar(&cfg.v6, '6', "", "only scan IPv6 addresses")
+	fs.BoolVar(&cfg.verbose, 'v', "verbose", "enable verbose logging")
+	fs.StringListVar(&cfg.pings, 0, "ping", fmt.Sprintf("ping type, repeatable (valid values: %s)", scanPingTypes))
+	fs.StringListVar(&cfg.cidrs, 0, "cidr", "prefix to scan, repeatable (default: warp prefixes for warp pings, cloudflare ranges otherwise)")
+	fs.StringListVar(&cfg.excludes, 0, "exclude", "prefix never to scan, repeatable")
+	fs.StringListVar(&cfg.ports, 0, "port", "port to probe, repeatable (default: any warp port for warp pings, 443 otherwise)")
+	fs.StringVar(&cfg.profile, 0, "profile", "stuff/primary/wgcf-profile.ini", "wireguard profile to take warp ping keys from")
+	fs.StringVar(&cfg.privateKey, 0, "private-key", "", "warp ping private key (default: from profile, or a random key)")
+	fs.StringVar(&cfg.publicKey, 0, "public-key", "", "warp ping peer public key (default: from profile, or the warp peer key)")
+	fs.StringVar(&cfg.presharedKey, 0, "preshared-key", "", "warp ping preshared key")
+	fs.StringVar(&cfg.reserved, 0, "reserved", "0,0,0", "warp ping reserved header bytes")
+	fs.StringVar(&cfg.junkCount, 0, "junk-count", "1-2", "range of junk packets sent ahead of each warp handshake")
+	fs.StringVar(&cfg.junkSize, 0, "junk-size", "1-100", "range of junk packet sizes in bytes")
+	fs.StringVar(&cfg.junkDelay, 0, "junk-delay", "200ms-500ms", "range of delays after each junk packet")
+	fs.BoolVar(&cfg.confirm, 0, "confirm", "confirm warp endpoints with an echo through the session after the handshake")
+	fs.DurationVar(&cfg.warpTimeout, 0, "warp-timeout", 5*time.Second, "how long warp pings wait for the handshake response")
+	fs.StringVar(&cfg.hostname, 0, "hostname", "www.cloudflare.com", "tls sni and http host")
+	fs.StringVar(&cfg.httpPath, 0, "http-path", "/", "http ping path")
+	fs.StringVar(&cfg.userAgent, 0, "user-agent", "Chrome/80.0.3987.149", "http ping user agent")
+	fs.StringVar(&cfg.referrer, 0, "referrer", "", "http ping referrer")
+	fs.BoolVar(&cfg.insecure, 0, "insecure", "skip tls certificate verification")
+	fs.BoolVar(&cfg.http2, 0, "http2", "use http/2 for http pings")
+	fs.BoolVar(&cfg.http3, 0, "http3", "use http/3 for http pings")
+	fs.BoolVar(&cfg.noCompression, 0, "no-compression", "disable http compression")
+	fs.StringEnumVar(&cfg.tlsVersion, 0, "tls-version", "tls version for tls, http and quic pings (valid values: [1.3 1.2 1.1 1.0])", "1.3", "1.2", "1.1", "1.0")
+	fs.DurationVar(&cfg.connTimeout, 0, "conn-timeout", time.Second, "connection timeout")
+	fs.DurationVar(&cfg.handshakeTimeout, 0, "handshake-timeout", time.Second, "tls and quic handshake timeout")
+	fs.DurationVar(&cfg.rtt, 0, "rtt", 1000*time.Millisecond, "scanner rtt limit")
+	fs.IntVar(&cfg.queueSize, 0, "queue-size", 8, "number of best results the scanner keeps")
+	fs.DurationVar(&cfg.queueTTL, 0, "queue-ttl", 30*time.Second, "how long a result stays in the queue")
+	fs.DurationVar(&cfg.timeout, 0, "timeout", 2*time.Minute, "stop scanning after this long")
+	fs.IntVar(&cfg.concurrency, 0, "concurrency", 16, "number of probes in flight at once")
+	fs.IntVar(&cfg.rate, 0, "rate", 0, "maximum probes per second, 0 for no limit")
+	fs.IntVar(&cfg.stopAfter, 0, "stop-after", 0, "stop once this many endpoints within the rtt limit are found, 0 to scan until timeout")
+	fs.IntVar(&cfg.samples, 0, "samples", 3, "probes per responsive endpoint to measure rtt, jitter and loss")
+	fs.IntVar(&cfg.seed, 0, "seed", 0, "seed for address and port sampling, 0 for a random one")
+	fs.IntVar(&cfg.speedTest, 0, "speed-test", 0, "measure throughput of this many best endpoints after the scan, 0 to skip")
+	fs.StringVar(&cfg.speedURL, 0, "speed-url", "https://speed.cloudflare.com/__down?bytes=10000000", "url downloaded to measure throughput, empty to skip")
+	fs.StringVar(&cfg.uploadURL, 0, "upload-url", "https://speed.cloudflare.com/__up", "url posted to to measure upload throughput, empty to skip")
+	fs.IntVar(&cfg.uploadBytes, 0, "upload-bytes", 5<<20, "size of the upload in bytes")
+	fs.StringVar(&cfg.sni, 0, "sni", "", "tls sni for the speed test and trace (default: host of the speed url)")
+	fs.StringListVar(&cfg.colos, 0, "colo", "only keep endpoints served by this colo after the speed test, repeatable")
+	fs.StringEnumVar(&cfg.output, 'o', "output", fmt.Sprintf("output format (valid values: %s)", scanOutputFormats), scanOutputFormats...)
+	fs.IntVar(&cfg.top, 0, "top", 10, "number of endpoints in the final summary")
+
+	return &ff.Command{
+		Name:      "scan",
+		Usage:     "warp-plus scan [FLAGS]",
+		ShortHelp: "scan for working endpoints without starting the proxy",
+		Flags:     fs,
+		Exec: func(ctx context.Context, _ []string) error {
+			return runScan(ctx, cfg)
+		},
+	}
+}
+
+func runScan(ctx context.Context, cfg scanConfig) error {
+	level := slog.LevelInfo
+	if cfg.verbose {
+		level = slog.LevelDebug
+	}
+	// Results go to stdout, keep the log out of the way.
+	l := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level}))
+
+	if cfg.v4 && cfg.v6 {
+		return errors.New("can't force v4 and v6 at the same time")
+	}
+	if !cfg.v4 && !cfg.v6 {
+		cfg.v4, cfg.v6 = true, true
+	}
+
+	if len(cfg.pings) == 0 {
+		cfg.pings = []string{"warp"}
+	}
+
+	if len(cfg.colos) > 0 && cfg.speedTest <= 0 {
+		return errors.New("filtering by colo needs --speed-test")
+	}
+
+	opts := []ipscanner.Option{
+		ipscanner.WithLogger(l.With("subsystem", "scanner")),
+		ipscanner.WithUseIPv4(cfg.v4),
+		ipscanner.WithUseIPv6(cfg.v6),
+		ipscanner.WithHostname(cfg.hostname),
+		ipscanner.WithHttpPath(cfg.httpPath),
+		ipscanner.WithUserAgent(cfg.userAgent),
+		ipscanner.WithReferrer(cfg.referrer),
+		ipscanner.WithInsecureSkipVerify(cfg.insecure),
+		ipscanner.WithUseHTTP2(cfg.http2),
+		ipscanner.WithUseHTTP3(cfg.http3),
+		ipscanner.WithDisableCompression(cfg.noCompression),
+		ipscanner.WithTlsVersion(tlsVersions[cfg.tlsVersion]),
+		ipscanner.WithConnectionTimeout(cfg.connTimeout),
+		ipscanner.WithHandshakeTimeout(cfg.handshakeTimeout),
+		ipscanner.WithMaxDesirableRTT(cfg.rtt),
+		ipscanner.WithIPQueueSize(cfg.queueSize),
+		ipscanner.WithIPQueueTTL(cfg.queueTTL),
+		ipscanner.WithConcurrency(cfg.concurrency),
+		ipscanner.WithRateLimit(cfg.rate),
+		ipscanner.WithStopAfter(cfg.stopAfter),
+		ipscanner.WithSamples(cfg.samples),
+		ipscanner.WithSeed(int64(cfg.seed)),
+	}
+
+	warpPing := false
+	for _, p := range cfg.pings {
+		switch p {
+		case "warp":
+			warpPing = true
+			opts = append(opts, ipscanner.WithWarpPing())
+		case "tcp":
+			opts = append(opts, ipscanner.WithTCPPing())
+		case "tls":
+			opts = append(opts, ipscanner.WithTLSPing())
+		case "http":
+			opts = append(opts, ipscanner.WithHTTPPing())
+		case "quic":
+			opts = append(opts, ipscanner.WithQUICPing())
+		default:
+			return fmt.Errorf("invalid ping type %q (valid values: %s)", p, scanPingTypes)
+		}
+	}
+
+	if warpPing {
+		privateKey, publicKey, err := scanKeys(l, cfg)
+		if err != nil {
+			return err
+		}
+		opts = append(opts,
+			ipscanner.WithWarpPrivateKey(privateKey),
+			ipscanner.WithWarpPeerPublicKey(publicKey),
+			ipscanner.WithWarpPreSharedKey(cfg.presharedKey),
+			ipscanner.WithWarpConfirm(cfg.confirm),
+			ipscanner.WithWarpHandshakeTimeout(cfg.warpTimeout),
+		)
+
+		reserved, err := parseReserved(cfg.reserved)
+		if err != nil {
+			return err
+		}
+		junk, err := parseJunk(cfg)
+		if err != nil {
+			return err
+		}
+		opts = append(opts,
+			ipscanner.WithWarpReserved(reserved),
+			ipscanner.WithWarpJunk(junk),
+		)
+	}
+
+	switch {
+	case len(cfg.cidrs) > 0:
+		prefixes := make([]netip.Prefix, 0, len(cfg.cidrs))
+		for _, c := range cfg.cidrs {
+			prefix, err := netip.ParsePrefix(c)
+			if err != nil {
+				return fmt.Errorf("invalid cidr: %w", err)
+			}
+			prefixes = append(prefixes, prefix.Masked())
+		}
+		opts = append(opts, ipscanner.WithCidrList(prefixes))
+	case warpPing:
+		opts = append(opts, ipscanner.WithCidrList(warp.WarpPrefixes()))
+	}
+
+	if len(cfg.excludes) > 0 {
+		prefixes := make([]netip.Prefix, 0, len(cfg.excludes))
+		for _, c := range cfg.excludes {
+			prefix, err := netip.ParsePrefix(c)
+			if err != nil {
+				return fmt.Errorf("invalid exclude: %w", err)
+			}
+			prefixes = append(prefixes, prefix.Masked())
+		}
+		opts = append(opts, ipscanner.WithExcludeList(prefixes))
+	}
+
+	if len(cfg.ports) > 0 {
+		ports := make([]uint16, 0, len(cfg.ports))
+		for _, p := range cfg.ports {
+			port, err := strconv.ParseUint(p, 10, 16)
+			if err != nil || port == 0 {
+				return fmt.Errorf("invalid port %q", p)
+			}
+			ports = append(ports, uint16(port))
+		}
+		opts = append(opts, ipscanner.WithPorts(ports))
+	}
+
+	w, err := newResultWriter(os.Stdout, cfg.output)
+	if err != nil {
+		return err
+	}
+
+	scanCtx, cancel := context.WithTimeout(ctx, cfg.timeout)
+	defer cancel()
+
+	scanner := ipscanner.NewScanner(opts...)
+	events := scanner.Subscribe(64)
+	scanner.Run(scanCtx)
+
+	best := make(map[netip.AddrPort]ipscanner.IPInfo)
+
+	for ev := range events {
+		if ev.Type != ipscanner.EventQueueChanged {
+			continue
+		}
+
+		for _, ip := range ev.Queue {
+			prev, seen := best[ip.AddrPort]
+			if seen && prev.Score() <= ip.Score() {
+				continue
+			}
+			best[ip.AddrPort] = ip
+			if err := w.Write(ip); err != nil {
+				return err
+			}
+		}
+		if err := w.Flush(); err != nil {
+			return err
+		}
+
+		if cfg.stopAfter > 0 && len(best) >= cfg.stopAfter {
+			break
+		}
+	}
+
+	l.Info("reachable ports", "ports", scanner.ReachablePorts())
+
+	if cfg.top <= 0 || len(best) == 0 {
+		return nil
+	}
+
+	res := make([]ipscanner.IPInfo, 0, len(best))
+	for _, ip := range best {
+		res = append(res, ip)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Score() < res[j].Score()
+	})
+
+	if cfg.speedTest > 0 {
+		res = speedTest(ctx, l, res, cfg)
+	}
+
+	if len(res) > cfg.top {
+		res = res[:cfg.top]
+	}
+
+	return w.Summary(res)
+}
+
+// speedTest measures the throughput of the first cfg.speedTest endpoints
+// of res, one at a time so they don't compete for bandwidth. It returns the
+// ones that passed and are served by one of cfg.colos, if set, fastest
+// download first.
+func speedTest(ctx context.Context, l *slog.Logger, res []ipscanner.IPInfo, cfg scanConfig) []ipscanner.IPInfo {
+	if len(res) > cfg.speedTest {
+		res = res[:cfg.speedTest]
+	}
+
+	opts := ipscanner.EdgeOptions{
+		DownloadURL: cfg.speedURL,
+		UploadURL:   cfg.uploadURL,
+		UploadBytes: cfg.uploadBytes,
+		SNI:         cfg.sni,
+		Insecure:    cfg.insecure,
+	}
+
+	measured := make([]ipscanner.IPInfo, 0, len(res))
+	for _, ip := range res {
+		if ctx.Err() != nil {
+			break
+		}
+
+		ip, err := ipscanner.MeasureEdge(ctx, ip, opts)
+		if err != nil {
+			l.Warn("speed test failed", "address", ip.AddrPort, "error", err)
+			continue
+		}
+		l.Info("speed test", "address", ip.AddrPort, "colo", ip.Colo, "download", mbps(ip.Download), "upload", mbps(ip.Upload))
+
+		if len(cfg.colos) > 0 && !slices.ContainsFunc(cfg.colos, func(c string) bool { return strings.EqualFold(c, ip.Colo) }) {
+			continue
+		}
+		measured = append(measured, ip)
+	}
+
+	sort.SliceStable(measured, func(i, j int) bool {
+		return measured[i].Download > measured[j].Download
+	})
+	return measured
+}
+
+// scanKeys returns the keys for warp pings: the flags if set, otherwise the
+// keys of the profile, otherwise a fresh private key and the warp peer key.
+func scanKeys(l *slog.Logger, cfg scanConfig) (privateKey, publicKey string, err error) {
+	privateKey, publicKey = cfg.privateKey, cfg.publicKey
+
+	if privateKey == "" || publicKey == "" {
+		if p, err := ini.Load(cfg.profile); err == nil {
+			if privateKey == "" {
+				privateKey = p.Section("Interface").Key("PrivateKey").String()
+			}
+			if publicKey == "" {
+				publicKey = p.Section("Peer").Key("PublicKey").String()
+			}
+		} else {
+			l.Debug("not using profile keys", "profile", cfg.profile, "error", err)
+		}
+	}
+
+	if privateKey == "" {
+		k, err := warp.GeneratePrivateKey()
+		if err != nil {
+			return "", "", err
+		}
+		privateKey = k.String()
+	}
+
+	if publicKey == "" {
+		publicKey = warp.WarpPeerPublicKey
+	}
+
+	return privateKey, publicKey, nil
+}
+
+// scanRecord is a scan result as written in the json and csv formats.
+type scanRecord struct {
+	Address  string    `json:"address"`
+	RTT      float64   `json:"rtt_ms"`
+	Jitter   float64   `json:"jitter_ms"`
+	Loss     float64   `json:"loss"`
+	Samples  int       `json:"samples"`
+	Score    float64   `json:"score_ms"`
+	Colo     string    `json:"colo,omitempty"`
+	Download float64   `json:"download_mbps,omitempty"`
+	Upload   float64   `json:"upload_mbps,omitempty"`
+	Time     time.Time `json:"time"`
+}
+
+func newScanRecord(ip ipscanner.IPInfo) scanRecord {
+	return scanRecord{
+		Address:  ip.AddrPort.String(),
+		RTT:      milliseconds(ip.RTT),
+		Jitter:   milliseconds(ip.Jitter),
+		Loss:     ip.Loss,
+		Samples:  ip.Samples,
+		Score:    milliseconds(ip.Score()),
+		Colo:     ip.Colo,
+		Download: mbps(ip.Download),
+		Upload:   mbps(ip.Upload),
+		Time:     ip.CreatedAt,
+	}
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+// mbps converts bytes per second to megabits per second.
+func mbps(bps float64) float64 {
+	return math.Round(bps*8/1e4) / 100
+}
+
+// resultWriter streams scan results as they arrive and writes a summary of
+// the best ones at the end.
+type resultWriter interface {
+	Write(ip ipscanner.IPInfo) error
+	Flush() error
+	Summary(best []ipscanner.IPInfo) error
+}
+
+// parseReserved parses reserved header bytes given as three comma
+// separated numbers.
+func parseReserved(s string) ([3]byte, error) {
+	var reserved [3]byte
+	parts := strings.Split(s, ",")
+	if len(parts) != len(reserved) {
+		return reserved, fmt.Errorf("invalid reserved %q: want three comma separated bytes", s)
+	}
+	for i, p := range parts {
+		b, err := strconv.ParseUint(strings.TrimSpace(p), 10, 8)
+		if err != nil {
+			return reserved, fmt.Errorf("invalid reserved %q: %w", s, err)
+		}
+		reserved[i] = byte(b)
+	}
+	return reserved, nil
+}
+
+// splitRange splits a "min-max" range. A single value is both bounds.
+func splitRange(s string) (string, string) {
+	lo, hi, found := strings.Cut(s, "-")
+	if !found {
+		return s, s
+	}
+	return lo, hi
+}
+
+// parseIntRange parses a "min-max" range of non-negative integers.
+func parseIntRange(name, s string) (int, int, error) {
+	lo, hi := splitRange(s)
+	from, err := strconv.Atoi(lo)
+	if err != nil || from < 0 {
+		return 0, 0, fmt.Errorf("invalid %s %q", name, s)
+	}
+	to, err := strconv.Atoi(hi)
+	if err != nil || to < from {
+		return 0, 0, fmt.Errorf("invalid %s %q", name, s)
+	}
+	return from, to, nil
+}
+
+// parseJunk builds the warp ping junk settings from the junk flags.
+func parseJunk(cfg scanConfig) (ipscanner.WarpJunk, error) {
+	var junk ipscanner.WarpJunk
+	var err error
+
+	junk.MinCount, junk.MaxCount, err = parseIntRange("junk-count", cfg.junkCount)
+	if err != nil {
+		return junk, err
+	}
+	junk.MinSize, junk.MaxSize, err = parseIntRange("junk-size", cfg.junkSize)
+	if err != nil {
+		return junk, err
+	}
+
+	lo, hi := splitRange(cfg.junkDelay)
+	if junk.MinDelay, err = time.ParseDuration(lo); err != nil {
+		return junk, fmt.Errorf("invalid junk-delay %q: %w", cfg.junkDelay, err)
+	}
+	if junk.MaxDelay, err = time.ParseDuration(hi); err != nil {
+		return junk, fmt.Errorf("invalid junk-delay %q: %w", cfg.junkDelay, err)
+	}
+	if junk.MinDelay < 0 || junk.MaxDelay < junk.MinDelay {
+		return junk, fmt.Errorf("invalid junk-delay %q", cfg.junkDelay)
+	}
+
+	return junk, nil
+}
+
+func newResultWriter(w io.Writer, format string) (resultWriter, error) {
+	switch format {
+	case "table":
+		return &tableWriter{w: w}, nil
+	case "json":
+		return &jsonWriter{enc: json.NewEncoder(w)}, nil
+	case "csv":
+		cw := csv.NewWriter(w)
+		if err := cw.Write([]string{"address", "rtt_ms", "jitter_ms", "loss", "samples", "score_ms", "colo", "download_mbps", "upload_mbps", "time"}); err != nil {
+			return nil, err
+		}
+		return &csvWriter{w: cw}, nil
+	case "list":
+		return &listWriter{w: w}, nil
+	default:
+		return nil, fmt.Errorf("invalid output format %q (valid values: %s)", format, scanOutputFormats)
+	}
+}
+
+type tableWriter struct {
+	w io.Writer
+}
+
+func (t *tableWriter) Write(ip ipscanner.IPInfo) error {
+	_, err := fmt.Fprintf(
+		t.w,
+		"%-48s rtt=%-8s jitter=%-8s loss=%-5s %s\n",
+		ip.AddrPort,
+		ip.RTT.Round(time.Millisecond),
+		ip.Jitter.Round(time.Millisecond),
+		fmt.Sprintf("%.0f%%", ip.Loss*100),
+		ip.CreatedAt.Format(time.TimeOnly),
+	)
+	return err
+}
+
+func (t *tableWriter) Flush() error { return nil }
+
+func (t *tableWriter) Summary(best []ipscanner.IPInfo) error {
+	headerFmt := color.New(color.FgGreen, color.Underline).SprintfFunc()
+	columnFmt := color.New(color.FgYellow).SprintfFunc()
+
+	// Speed tested endpoints all have a colo.
+	speed := slices.ContainsFunc(best, func(ip ipscanner.IPInfo) bool { return ip.Colo != "" })
+
+	tbl := table.New("Address", "RTT (median)", "Jitter", "Loss", "Score", "Time")
+	if speed {
+		tbl = table.New("Address", "RTT (median)", "Jitter", "Loss", "Score", "Colo", "Download", "Upload", "Time")
+	}
+	tbl.WithWriter(t.w)
+	tbl.WithHeaderFormatter(headerFmt).WithFirstColumnFormatter(columnFmt)
+
+	for _, ip := range best {
+		loss := fmt.Sprintf("%.0f%%", ip.Loss*100)
+		if speed {
+			tbl.AddRow(ip.AddrPort, ip.RTT, ip.Jitter, loss, ip.Score(), ip.Colo, fmt.Sprintf("%.2f Mbps", mbps(ip.Download)), fmt.Sprintf("%.2f Mbps", mbps(ip.Upload)), ip.CreatedAt)
+			continue
+		}
+		tbl.AddRow(ip.AddrPort, ip.RTT, ip.Jitter, loss, ip.Score(), ip.CreatedAt)
+	}
+
+	fmt.Fprintln(t.w)
+	tbl.Print()
+	return nil
+}
+
+// jsonWriter writes one JSON object per line. The summary is a single line
+// holding the best results.
+type jsonWriter struct {
+	enc *json.Encoder
+}
+
+func (j *jsonWriter) Write(ip ipscanner.IPInfo) error {
+	return j.enc.Encode(newScanRecord(ip))
+}
+
+func (j *jsonWriter) Flush() error { return nil }
+
+func (j *jsonWriter) Summary(best []ipscanner.IPInfo) error {
+	records := make([]scanRecord, 0, len(best))
+	for _, ip := range best {
+		records = append(records, newScanRecord(ip))
+	}
+	return j.enc.Encode(struct {
+		Top []scanRecord `json:"top"`
+	}{records})
+}
+
+// csvWriter writes results as CSV rows. The summary repeats the best results
+// after a blank line so the stream stays easy to split.
+type csvWriter struct {
+	w *csv.Writer
+}
+
+func (c *csvWriter) Write(ip ipscanner.IPInfo) error {
+	r := newScanRecord(ip)
+	return c.w.Write([]string{
+		r.Address,
+		strconv.FormatFloat(r.RTT, 'f', 3, 64),
+		strconv.FormatFloat(r.Jitter, 'f', 3, 64),
+		strconv.FormatFloat(r.Loss, 'f', 3, 64),
+		strconv.Itoa(r.Samples),
+		strconv.FormatFloat(r.Score, 'f', 3, 64),
+		r.Colo,
+		formatMbps(r.Download),
+		formatMbps(r.Upload),
+		r.Time.Format(time.RFC3339),
+	})
+}
+
+func (c *csvWriter) Flush() error {
+	c.w.Flush()
+	return c.w.Error()
+}
+
+func (c *csvWriter) Summary(best []ipscanner.IPInfo) error {
+	if err := c.w.Write(nil); err != nil {
+		return err
+	}
+	for _, ip := range best {
+		if err := c.Write(ip); err != nil {
+			return err
+		}
+	}
+	return c.Flush()
+}
+
+// formatMbps formats a throughput for csv, empty if it wasn't measured.
+func formatMbps(v float64) string {
+	if v == 0 {
+		return ""
+	}
+	return strconv.FormatFloat(v, 'f', 2, 64)
+}
+
+// listWriter writes only the best endpoints, one per line, in the form
+// tools that take endpoint lists expect.
+type listWriter struct {
+	w io.Writer
+}
+
+func (l *listWriter) Write(ipscanner.IPInfo) error { return nil }
+
+func (l *listWriter) Flush() error { return nil }
+
+func (l *listWriter) Summary(best []ipscanner.IPInfo) error {
+	for _, ip := range best {
+		if _, err := fmt.Fprintln(l.w, ip.AddrPort); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -29,6 +29,7 @@ var (
 
 var (
 	defaultHeaders = makeDefaultHeaders()
+	tlsDialer      = &Dialer{}
 	client         = makeClient()
 )
 
@@ -60,16 +61,10 @@ func makeDefaultHeaders() map[string]string {
 }
 
 func makeClient() *http.Client {
-	// Create a custom dialer using the TLS config
-	plainDialer := &net.Dialer{
-		Timeout:   5 * time.Second,
-		KeepAlive: 5 * time.Second,
-	}
-	tlsDialer := Dialer{}
-	// Create a custom HTTP transport
+	// Create a custom HTTP transport, dialing through whatever SetDialContext chose
 	transport := &http.Transport{
 		DialTLSContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
-			return tlsDialer.TLSDial(plainDialer, network, addr)
+			return tlsDialer.TLSDialContext(ctx, currentDialContext(), network, addr)
 		},
 	}
 
@@ -125,6 +120,12 @@ func genKeyPair() (string, string, error) {
 }
 
 func doRegister() (*AccountData, error) {
+	return register(nil)
+}
+
+// register registers a new device, sending extraHeaders along with the
+// request. Team enrollments carry their Access token this way.
+func register(extraHeaders map[string]string) (*AccountData, error) {
 	timestamp := getTimestamp()
 	privateKey, publicKey, err := genKeyPair()
 	if err != nil {
@@ -152,7 +153,7 @@ func doRegister() (*AccountData, error) {
 	}
 
 	// Set headers
-	for k, v := range MergeMaps(defaultHeaders, headers) {
+	for k, v := range MergeMaps(defaultHeaders, headers, extraHeaders) {
 		req.Header.Set(k, v)
 	}
 
@@ -161,6 +162,11 @@ func doRegister() (*AccountData, error) {
 	if err != nil {
 		return nil, err
 	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("error registering device, status %d", response.StatusCode)
+	}
 
 	// convert response to byte array
 	responseData, err := io.ReadAll(response.Body)
@@ -177,11 +183,15 @@ func doRegister() (*AccountData, error) {
 
 	m := rspData.(map[string]interface{})
 
+	// Team accounts don't have a license.
+	account, _ := m["account"].(map[string]interface{})
+	license, _ := account["license"].(string)
+
 	return &AccountData{
 		AccountID:   m["id"].(string),
 		AccessToken: m["token"].(string),
 		PrivateKey:  privateKey,
-		LicenseKey:  m["account"].(map[string]interface{})["license"].(string),
+		LicenseKey:  license,
 	}, nil
 }
 
@@ -315,6 +325,8 @@ func getServerConf(accountData *AccountData) (*ConfigurationData, error) {
 	}
 
 	warpEnabled := response["warp_enabled"].(bool)
+	accountType, _ := account["account_type"].(string)
+	warpPlus, _ := account["warp_plus"].(bool)
 
 	return &ConfigurationData{
 		LocalAddressIPv4:    lv4,
@@ -324,8 +336,8 @@ func getServerConf(accountData *AccountData) (*ConfigurationData, error) {
 		EndpointAddressIPv6: v6,
 		EndpointPublicKey:   publicKey,
 		WarpEnabled:         warpEnabled,
-		AccountType:         account["account_type"].(string),
-		WarpPlusEnabled:     account["warp_plus"].(bool),
+		AccountType:         accountType,
+		WarpPlusEnabled:     warpPlus,
 		LicenseKeyUpdated:   false, // omit for brevity
 	}, nil
 }
@@ -511,11 +523,21 @@ func LoadOrCreateIdentity(l *slog.Logger, license string) error {
 		}
 	}
 
+	// Static identities imported from a wg-quick profile have no account to query.
+	if accountData.AccountID == "" {
+		if !fileExist(profileFile) {
+			return errors.New("static identity has no wireguard profile")
+		}
+		l.Info("using static identity")
+		return nil
+	}
+
 	l.Info("getting server configuration")
 	confData, err := getServerConf(accountData)
 	if err != nil {
 		return err
 	}
+	updateCatalog(l, confData)
 
 	// updating license key
 	l.Info("updating account license key")
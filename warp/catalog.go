@@ -0,0 +1,336 @@
+package warp
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// engageHost is the hostname the official client resolves to find the edge.
+const engageHost = "engage.cloudflareclient.com"
+
+// reachablePortsMaxAge is how long the ports a scan found reachable are
+// trusted. Networks change, after that every port is a candidate again.
+const reachablePortsMaxAge = 24 * time.Hour
+
+// EndpointCatalog is the set of WARP prefixes and ports known to work. It is
+// built from the compiled-in defaults, the account configuration, DNS and an
+// optional user file, and persisted so that later runs start from current data.
+type EndpointCatalog struct {
+	// Prefixes and Ports are the defaults merged with every source.
+	Prefixes  []netip.Prefix `json:"prefixes"`
+	Ports     []uint16       `json:"ports"`
+	UpdatedAt time.Time      `json:"updated_at"`
+
+	// Sources holds what each source last contributed, so that prefixes
+	// and ports a source no longer lists drop out of the catalog.
+	Sources map[string]catalogSource `json:"sources,omitempty"`
+
+	// ReachablePorts are the ports the last scan got answers on, as of
+	// ReachableAt.
+	ReachablePorts []uint16  `json:"reachable_ports,omitempty"`
+	ReachableAt    time.Time `json:"reachable_at,omitempty"`
+
+	path string
+}
+
+// catalogSource is what one source contributes to the catalog.
+type catalogSource struct {
+	Prefixes []netip.Prefix `json:"prefixes,omitempty"`
+	Ports    []uint16       `json:"ports,omitempty"`
+}
+
+// Catalog sources. DNS and account entries are kept from the saved catalog
+// until a lookup or account configuration replaces them, user entries
+// always come from the current user file.
+const (
+	sourceDNS     = "dns"
+	sourceAccount = "account"
+	sourceUser    = "user"
+)
+
+var (
+	catalogMu sync.RWMutex
+	catalog   *EndpointCatalog
+
+	// catalogInit loads the catalog set with SetEndpointCatalog on first use.
+	catalogInit struct {
+		once sync.Once
+		load func()
+	}
+)
+
+// currentCatalog returns the catalog, loading it first if it was set but not
+// loaded yet, or nil if none was set.
+func currentCatalog() *EndpointCatalog {
+	if catalogInit.load != nil {
+		catalogInit.once.Do(catalogInit.load)
+	}
+
+	catalogMu.RLock()
+	defer catalogMu.RUnlock()
+	return catalog
+}
+
+// SetEndpointCatalog makes the catalog persisted at path, refreshed from DNS
+// and the optional user file, the source for WarpPrefixes, WarpPorts and
+// RandomWarpEndpoint. It is loaded the first time one of them needs it, so
+// runs that never pick or scan WARP endpoints don't wait on DNS. The user
+// file is checked right away; loading errors later fall back to the
+// defaults. Relative paths are resolved now, as the working directory may
+// have changed by the time the catalog is loaded.
+func SetEndpointCatalog(l *slog.Logger, path, userFile string) error {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	if userFile != "" {
+		if userFile, err = filepath.Abs(userFile); err != nil {
+			return err
+		}
+		if _, err := parseUserFile(userFile); err != nil {
+			return err
+		}
+	}
+
+	catalogInit.load = func() {
+		if _, err := LoadEndpointCatalog(l, path, userFile); err != nil {
+			l.Warn("unable to load endpoint catalog, using the defaults", "error", err)
+		}
+	}
+	return nil
+}
+
+// LoadEndpointCatalog loads the catalog persisted at path, refreshes it from
+// DNS and the optional user file, saves it and makes it the source for
+// WarpPrefixes, WarpPorts and RandomWarpEndpoint.
+//
+// The user file lists one CIDR prefix or port per line; lines starting with
+// '#' are ignored.
+func LoadEndpointCatalog(l *slog.Logger, path, userFile string) (*EndpointCatalog, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &EndpointCatalog{path: path}
+
+	b, err := os.ReadFile(path)
+	switch {
+	case err == nil:
+		saved := EndpointCatalog{}
+		if err := json.Unmarshal(b, &saved); err != nil {
+			return nil, fmt.Errorf("invalid endpoint catalog %s: %w", path, err)
+		}
+		for _, name := range []string{sourceDNS, sourceAccount} {
+			if src, ok := saved.Sources[name]; ok {
+				c.setSource(name, src)
+			}
+		}
+		if time.Since(saved.ReachableAt) < reachablePortsMaxAge {
+			c.ReachablePorts, c.ReachableAt = saved.ReachablePorts, saved.ReachableAt
+		}
+	case !os.IsNotExist(err):
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupNetIP(ctx, "ip", engageHost)
+	if err != nil {
+		l.Warn("unable to resolve warp endpoints", "host", engageHost, "error", err)
+	} else {
+		var dns catalogSource
+		for _, addr := range addrs {
+			dns.Prefixes = append(dns.Prefixes, edgePrefix(addr.Unmap()))
+		}
+		c.setSource(sourceDNS, dns)
+	}
+
+	var user catalogSource
+	if userFile != "" {
+		if user, err = parseUserFile(userFile); err != nil {
+			return nil, err
+		}
+	}
+	c.setSource(sourceUser, user)
+
+	if err := c.Save(); err != nil {
+		return nil, err
+	}
+
+	catalogMu.Lock()
+	catalog = c
+	catalogMu.Unlock()
+
+	l.Debug("loaded endpoint catalog", "prefixes", len(c.Prefixes), "ports", len(c.Ports))
+	return c, nil
+}
+
+// MergeServerConf replaces the edge addresses and ports from the previous
+// account configuration with those of confData.
+func (c *EndpointCatalog) MergeServerConf(confData *ConfigurationData) {
+	var account catalogSource
+	for _, endpoint := range []string{confData.EndpointAddressIPv4, confData.EndpointAddressIPv6} {
+		if addrPort, err := netip.ParseAddrPort(endpoint); err == nil {
+			account.Prefixes = append(account.Prefixes, edgePrefix(addrPort.Addr()))
+			if addrPort.Port() != 0 {
+				account.Ports = append(account.Ports, addrPort.Port())
+			}
+		} else if addr, err := netip.ParseAddr(endpoint); err == nil {
+			account.Prefixes = append(account.Prefixes, edgePrefix(addr))
+		}
+	}
+
+	if _, port, err := net.SplitHostPort(confData.EndpointAddressHost); err == nil {
+		if p, err := strconv.ParseUint(port, 10, 16); err == nil && p != 0 {
+			account.Ports = append(account.Ports, uint16(p))
+		}
+	}
+
+	c.setSource(sourceAccount, account)
+}
+
+// Save persists the catalog to the path it was loaded from.
+func (c *EndpointCatalog) Save() error {
+	if c.path == "" {
+		return errors.New("endpoint catalog has no path")
+	}
+
+	catalogMu.Lock()
+	c.UpdatedAt = time.Now()
+	b, err := json.MarshalIndent(c, "", "    ")
+	catalogMu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(c.path, b, 0o644)
+}
+
+// setSource replaces what the source name contributes with src, and
+// rebuilds the merged prefixes and ports.
+func (c *EndpointCatalog) setSource(name string, src catalogSource) {
+	catalogMu.Lock()
+	defer catalogMu.Unlock()
+
+	if c.Sources == nil {
+		c.Sources = make(map[string]catalogSource)
+	}
+	c.Sources[name] = src
+
+	c.Prefixes, c.Ports = defaultWarpPrefixes(), defaultWarpPorts()
+	for _, name := range []string{sourceAccount, sourceDNS, sourceUser} {
+		for _, prefix := range c.Sources[name].Prefixes {
+			if prefix.IsValid() && !slices.Contains(c.Prefixes, prefix) {
+				c.Prefixes = append(c.Prefixes, prefix)
+			}
+		}
+		for _, port := range c.Sources[name].Ports {
+			if !slices.Contains(c.Ports, port) {
+				c.Ports = append(c.Ports, port)
+			}
+		}
+	}
+	slices.Sort(c.Ports)
+}
+
+// parseUserFile returns the prefixes and ports listed in the user file at
+// path.
+func parseUserFile(path string) (catalogSource, error) {
+	var src catalogSource
+
+	file, err := os.Open(path)
+	if err != nil {
+		return src, err
+	}
+	defer file.Close()
+
+	s := bufio.NewScanner(file)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		if prefix, err := netip.ParsePrefix(line); err == nil {
+			src.Prefixes = append(src.Prefixes, prefix.Masked())
+			continue
+		}
+
+		port, err := strconv.ParseUint(line, 10, 16)
+		if err != nil || port == 0 {
+			return src, fmt.Errorf("%s:%d: expected a CIDR prefix or a port, got %q", path, n, line)
+		}
+		src.Ports = append(src.Ports, uint16(port))
+	}
+
+	return src, s.Err()
+}
+
+// edgePrefix returns the prefix an edge address is announced in, which is
+// what the static tables list as well.
+func edgePrefix(addr netip.Addr) netip.Prefix {
+	if addr.Is4() {
+		return netip.PrefixFrom(addr, 24).Masked()
+	}
+	return netip.PrefixFrom(addr, 64).Masked()
+}
+
+// SetReachablePorts records the ports a scan got answers on, so that
+// RandomWarpEndpoint prefers them. It does nothing if no catalog is loaded.
+func SetReachablePorts(ports []uint16) error {
+	c := currentCatalog()
+	if c == nil || len(ports) == 0 {
+		return nil
+	}
+
+	catalogMu.Lock()
+	c.ReachablePorts = slices.Clone(ports)
+	slices.Sort(c.ReachablePorts)
+	c.ReachableAt = time.Now()
+	catalogMu.Unlock()
+
+	return c.Save()
+}
+
+// reachablePorts returns the ports recently found reachable, if any.
+func reachablePorts() []uint16 {
+	c := currentCatalog()
+	if c == nil {
+		return nil
+	}
+
+	catalogMu.RLock()
+	defer catalogMu.RUnlock()
+
+	if time.Since(c.ReachableAt) >= reachablePortsMaxAge {
+		return nil
+	}
+	return slices.Clone(c.ReachablePorts)
+}
+
+// updateCatalog merges an account configuration into the loaded catalog.
+func updateCatalog(l *slog.Logger, confData *ConfigurationData) {
+	c := currentCatalog()
+	if c == nil {
+		return
+	}
+
+	c.MergeServerConf(confData)
+	if err := c.Save(); err != nil {
+		l.Warn("unable to save endpoint catalog", "error", err)
+	}
+}
@@ -0,0 +1,249 @@
+package warp
+
+import (
+	"log/slog"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+)
+
+// catalogExtras returns the prefixes and ports of c that aren't defaults.
+func catalogExtras(c *EndpointCatalog) ([]netip.Prefix, []uint16) {
+	var prefixes []netip.Prefix
+	for _, prefix := range c.Prefixes {
+		if !slices.Contains(defaultWarpPrefixes(), prefix) {
+			prefixes = append(prefixes, prefix)
+		}
+	}
+	var ports []uint16
+	for _, port := range c.Ports {
+		if !slices.Contains(defaultWarpPorts(), port) {
+			ports = append(ports, port)
+		}
+	}
+	return prefixes, ports
+}
+
+func TestMergeServerConf(t *testing.T) {
+	tests := []struct {
+		name     string
+		conf     ConfigurationData
+		prefixes []netip.Prefix
+		ports    []uint16
+	}{
+		{
+			name: "addresses with ports",
+			conf: ConfigurationData{
+				EndpointAddressIPv4: "203.0.113.7:7000",
+				EndpointAddressIPv6: "[2001:db8:1::7]:7001",
+			},
+			prefixes: []netip.Prefix{
+				netip.MustParsePrefix("203.0.113.0/24"),
+				netip.MustParsePrefix("2001:db8:1::/64"),
+			},
+			ports: []uint16{7000, 7001},
+		},
+		{
+			name: "bare addresses and the host port",
+			conf: ConfigurationData{
+				EndpointAddressHost: "engage.cloudflareclient.com:7002",
+				EndpointAddressIPv4: "203.0.113.7",
+				EndpointAddressIPv6: "2001:db8:1::7",
+			},
+			prefixes: []netip.Prefix{
+				netip.MustParsePrefix("203.0.113.0/24"),
+				netip.MustParsePrefix("2001:db8:1::/64"),
+			},
+			ports: []uint16{7002},
+		},
+		{
+			name: "defaults and garbage",
+			conf: ConfigurationData{
+				EndpointAddressHost: "engage.cloudflareclient.com",
+				EndpointAddressIPv4: "162.159.192.1:2408",
+				EndpointAddressIPv6: "not an address",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &EndpointCatalog{}
+			c.MergeServerConf(&tt.conf)
+
+			prefixes, ports := catalogExtras(c)
+			if !slices.Equal(prefixes, tt.prefixes) {
+				t.Errorf("got prefixes %v, want %v", prefixes, tt.prefixes)
+			}
+			if !slices.Equal(ports, tt.ports) {
+				t.Errorf("got ports %v, want %v", ports, tt.ports)
+			}
+		})
+	}
+}
+
+func TestCatalogSourcesPrune(t *testing.T) {
+	c := &EndpointCatalog{}
+	c.setSource(sourceDNS, catalogSource{Prefixes: []netip.Prefix{netip.MustParsePrefix("203.0.113.0/24")}})
+	c.setSource(sourceUser, catalogSource{
+		Prefixes: []netip.Prefix{netip.MustParsePrefix("198.51.100.0/24"), netip.MustParsePrefix("203.0.113.0/24")},
+		Ports:    []uint16{7000},
+	})
+	c.MergeServerConf(&ConfigurationData{EndpointAddressIPv4: "192.0.2.1:7001"})
+
+	steps := []struct {
+		name     string
+		source   string
+		src      catalogSource
+		prefixes []string
+		ports    []uint16
+	}{
+		{
+			name:     "dns moved",
+			source:   sourceDNS,
+			src:      catalogSource{Prefixes: []netip.Prefix{netip.MustParsePrefix("2001:db8:1::/64")}},
+			prefixes: []string{"192.0.2.0/24", "2001:db8:1::/64", "198.51.100.0/24", "203.0.113.0/24"},
+			ports:    []uint16{7000, 7001},
+		},
+		{
+			name:     "user file emptied",
+			source:   sourceUser,
+			prefixes: []string{"192.0.2.0/24", "2001:db8:1::/64"},
+			ports:    []uint16{7001},
+		},
+		{
+			name:     "account without extras",
+			source:   sourceAccount,
+			prefixes: []string{"2001:db8:1::/64"},
+		},
+	}
+
+	for _, step := range steps {
+		c.setSource(step.source, step.src)
+
+		var want []netip.Prefix
+		for _, s := range step.prefixes {
+			want = append(want, netip.MustParsePrefix(s))
+		}
+		prefixes, ports := catalogExtras(c)
+		if !slices.Equal(prefixes, want) {
+			t.Errorf("%s: got prefixes %v, want %v", step.name, prefixes, want)
+		}
+		if !slices.Equal(ports, step.ports) {
+			t.Errorf("%s: got ports %v, want %v", step.name, ports, step.ports)
+		}
+		if !slices.IsSorted(c.Ports) {
+			t.Errorf("%s: ports %v not sorted", step.name, c.Ports)
+		}
+	}
+}
+
+func TestParseUserFile(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      string
+		want    catalogSource
+		wantErr bool
+	}{
+		{
+			name: "prefixes and ports",
+			in:   "# extra edges\n203.0.113.0/24\n\n  2001:db8:1::/64  \n7000\n",
+			want: catalogSource{
+				Prefixes: []netip.Prefix{netip.MustParsePrefix("203.0.113.0/24"), netip.MustParsePrefix("2001:db8:1::/64")},
+				Ports:    []uint16{7000},
+			},
+		},
+		{
+			name: "prefixes masked",
+			in:   "203.0.113.7/24\n",
+			want: catalogSource{Prefixes: []netip.Prefix{netip.MustParsePrefix("203.0.113.0/24")}},
+		},
+		{
+			name: "empty",
+			in:   "# nothing yet\n",
+		},
+		{
+			name:    "bare address",
+			in:      "203.0.113.7\n",
+			wantErr: true,
+		},
+		{
+			name:    "port zero",
+			in:      "0\n",
+			wantErr: true,
+		},
+		{
+			name:    "port out of range",
+			in:      "65536\n",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "endpoints.txt")
+			if err := os.WriteFile(path, []byte(tt.in), 0o644); err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := parseUserFile(path)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("got %+v, want error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(got.Prefixes, tt.want.Prefixes) || !slices.Equal(got.Ports, tt.want.Ports) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSetEndpointCatalogAfterChdir(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, "stuff"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "endpoints.txt"), []byte("203.0.113.0/24\n7000\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		os.Chdir(wd)
+		catalogMu.Lock()
+		catalog = nil
+		catalogMu.Unlock()
+		catalogInit.once, catalogInit.load = sync.Once{}, nil
+	})
+
+	if err := SetEndpointCatalog(slog.Default(), "stuff/endpoints.json", "endpoints.txt"); err != nil {
+		t.Fatal(err)
+	}
+	// The app moves into stuff before anything needs the catalog.
+	if err := os.Chdir("stuff"); err != nil {
+		t.Fatal(err)
+	}
+
+	if prefixes := WarpPrefixes(); !slices.Contains(prefixes, netip.MustParsePrefix("203.0.113.0/24")) {
+		t.Errorf("got prefixes %v, want the user prefix among them", prefixes)
+	}
+	if ports := WarpPorts(); !slices.Contains(ports, 7000) {
+		t.Errorf("got ports %v, want the user port among them", ports)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "stuff", "endpoints.json")); err != nil {
+		t.Errorf("catalog not saved: %v", err)
+	}
+}
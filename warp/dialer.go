@@ -0,0 +1,143 @@
+package warp
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// DialContextFunc dials the plain connections the API client runs TLS over.
+type DialContextFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+var (
+	dialMu      sync.RWMutex
+	dialContext DialContextFunc
+)
+
+// SetDialContext routes API connections through dial, for example an
+// upstream proxy from ProxyDialContext or a running tunnel's
+// netstack.Net.DialContext. A nil dial restores direct connections.
+// Idle connections dialed the previous way are closed, so that later
+// requests don't reuse them.
+func SetDialContext(dial DialContextFunc) {
+	dialMu.Lock()
+	dialContext = dial
+	dialMu.Unlock()
+
+	client.CloseIdleConnections()
+}
+
+// WithDialContext runs f with API connections routed through dial, then
+// restores the dial function set before.
+func WithDialContext(dial DialContextFunc, f func() error) error {
+	dialMu.Lock()
+	prev := dialContext
+	dialContext = dial
+	dialMu.Unlock()
+	client.CloseIdleConnections()
+
+	defer SetDialContext(prev)
+	return f()
+}
+
+// currentDialContext returns the dial function API connections use.
+func currentDialContext() DialContextFunc {
+	dialMu.RLock()
+	defer dialMu.RUnlock()
+
+	if dialContext != nil {
+		return dialContext
+	}
+
+	plainDialer := &net.Dialer{
+		Timeout:   5 * time.Second,
+		KeepAlive: 5 * time.Second,
+	}
+	return plainDialer.DialContext
+}
+
+// ProxyDialContext returns a dial function that connects through the proxy
+// at rawURL. The socks5, socks5h and http schemes are supported.
+func ProxyDialContext(rawURL string) (DialContextFunc, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy url: %w", err)
+	}
+
+	switch u.Scheme {
+	case "socks5", "socks5h":
+		d, err := proxy.FromURL(u, &net.Dialer{Timeout: 5 * time.Second})
+		if err != nil {
+			return nil, err
+		}
+		cd, ok := d.(proxy.ContextDialer)
+		if !ok {
+			return nil, fmt.Errorf("proxy %s does not support contexts", u.Redacted())
+		}
+		return cd.DialContext, nil
+	case "http":
+		return (*httpConnectDialer)(u).DialContext, nil
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme %q", u.Scheme)
+	}
+}
+
+// httpConnectDialer tunnels connections through an HTTP proxy with CONNECT.
+type httpConnectDialer url.URL
+
+func (p *httpConnectDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	d := &net.Dialer{Timeout: 5 * time.Second}
+	conn, err := d.DialContext(ctx, network, p.Host)
+	if err != nil {
+		return nil, err
+	}
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if p.User != nil {
+		password, _ := p.User.Password()
+		auth := base64.StdEncoding.EncodeToString([]byte(p.User.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+auth)
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{})
+	}
+
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("proxy refused CONNECT to %s, status %d", addr, resp.StatusCode)
+	}
+	if br.Buffered() > 0 {
+		conn.Close()
+		return nil, fmt.Errorf("proxy sent data before the tunnel was established")
+	}
+
+	return conn, nil
+}
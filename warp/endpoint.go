@@ -3,12 +3,27 @@ package warp
 import (
 	"math/rand"
 	"net/netip"
+	"slices"
 	"time"
 
 	"github.com/bepass-org/warp-plus/iputils"
 )
 
+// WarpPeerPublicKey is the public key of the Cloudflare WARP peer.
+const WarpPeerPublicKey = "bmXOC+F1FxEMF9dyiK2H5/1SUtzH0JuVo51h2wPfgyo="
+
+// WarpPrefixes returns the WARP prefixes from the loaded endpoint catalog,
+// or the compiled-in defaults if no catalog was loaded.
 func WarpPrefixes() []netip.Prefix {
+	if c := currentCatalog(); c != nil {
+		catalogMu.RLock()
+		defer catalogMu.RUnlock()
+		return slices.Clone(c.Prefixes)
+	}
+	return defaultWarpPrefixes()
+}
+
+func defaultWarpPrefixes() []netip.Prefix {
 	return []netip.Prefix{
 		netip.MustParsePrefix("162.159.192.0/24"),
 		netip.MustParsePrefix("162.159.193.0/24"),
@@ -42,7 +57,18 @@ func RandomWarpPrefix(v4, v6 bool) netip.Prefix {
 	}
 }
 
+// WarpPorts returns the WARP ports from the loaded endpoint catalog, or the
+// compiled-in defaults if no catalog was loaded.
 func WarpPorts() []uint16 {
+	if c := currentCatalog(); c != nil {
+		catalogMu.RLock()
+		defer catalogMu.RUnlock()
+		return slices.Clone(c.Ports)
+	}
+	return defaultWarpPorts()
+}
+
+func defaultWarpPorts() []uint16 {
 	return []uint16{
 		500,
 		854,
@@ -101,8 +127,13 @@ func WarpPorts() []uint16 {
 	}
 }
 
+// RandomWarpPort returns a random WARP port, chosen among the ports a recent
+// scan found reachable if there are any.
 func RandomWarpPort() uint16 {
-	ports := WarpPorts()
+	ports := reachablePorts()
+	if len(ports) == 0 {
+		ports = WarpPorts()
+	}
 	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
 	return ports[rng.Intn(len(ports))]
 }
@@ -0,0 +1,281 @@
+package warp
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/netip"
+	"os"
+	"strings"
+
+	"github.com/go-ini/ini"
+)
+
+// wgcfAccount mirrors the keys of a wgcf-account.toml file.
+type wgcfAccount struct {
+	DeviceID    string
+	AccessToken string
+	PrivateKey  string
+	LicenseKey  string
+}
+
+// officialRegistration mirrors the registration data written by the official
+// client (reg.json on desktop, the registration preferences on Android).
+type officialRegistration struct {
+	RegistrationID string `json:"registration_id"`
+	ID             string `json:"id"`
+	APIToken       string `json:"api_token"`
+	Token          string `json:"token"`
+	SecretKey      string `json:"secret_key"`
+	PrivateKey     string `json:"private_key"`
+	Account        struct {
+		License string `json:"license"`
+	} `json:"account"`
+}
+
+// ImportIdentity converts an existing WARP identity into our identity format
+// and writes it, together with a WireGuard profile, to the current identity
+// path. The source may be a wgcf-account.toml file, the official client's
+// registration JSON, or a wg-quick profile whose peer is WARP.
+//
+// Identities with account credentials are validated against the API before
+// they are kept. A wg-quick profile has no credentials, so it is stored as a
+// static identity that is used as is.
+func ImportIdentity(l *slog.Logger, src, license string) (*AccountData, error) {
+	b, err := os.ReadFile(src)
+	if err != nil {
+		return nil, err
+	}
+
+	switch trimmed := bytes.TrimSpace(b); {
+	case bytes.HasPrefix(trimmed, []byte("{")):
+		l.Info("importing official client registration", "path", src)
+		accountData, err := parseOfficialRegistration(trimmed)
+		if err != nil {
+			return nil, err
+		}
+		return importAccount(l, accountData, license)
+	case bytes.Contains(bytes.ToLower(trimmed), []byte("[interface]")):
+		l.Info("importing wg-quick profile", "path", src)
+		return importWireguardProfile(trimmed, license)
+	default:
+		l.Info("importing wgcf account", "path", src)
+		accountData, err := parseWgcfAccount(trimmed)
+		if err != nil {
+			return nil, err
+		}
+		return importAccount(l, accountData, license)
+	}
+}
+
+// importAccount validates accountData against the API and generates the
+// profile for it. Both are staged next to the current identity, which is
+// only replaced once validation succeeds.
+func importAccount(l *slog.Logger, accountData *AccountData, license string) (*AccountData, error) {
+	if _, err := ParseKey(accountData.PrivateKey); err != nil {
+		return nil, fmt.Errorf("invalid private key: %w", err)
+	}
+
+	if license != "" {
+		accountData.LicenseKey = license
+	}
+
+	if existing, ok := alreadyImported(accountData); ok {
+		l.Info("identity already imported")
+		return existing, nil
+	}
+
+	err := stageImport(func() error {
+		if err := saveIdentity(accountData, identityFile); err != nil {
+			return err
+		}
+		if err := LoadOrCreateIdentity(l, accountData.LicenseKey); err != nil {
+			return fmt.Errorf("unable to validate imported identity: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return accountData, nil
+}
+
+// alreadyImported returns the current identity if it has the private key
+// and license of accountData and a profile, so that keeping --import set
+// doesn't import it again on every start.
+func alreadyImported(accountData *AccountData) (*AccountData, bool) {
+	existing, err := loadIdentity(identityFile)
+	if err != nil || !fileExist(profileFile) {
+		return nil, false
+	}
+	if existing.PrivateKey != accountData.PrivateKey || existing.LicenseKey != accountData.LicenseKey {
+		return nil, false
+	}
+	return existing, true
+}
+
+// stageImport runs write with the identity and profile paths pointing to
+// staging files, and moves them over the current identity if it succeeds.
+// The current identity is left alone otherwise.
+func stageImport(write func() error) error {
+	identity, profile := identityFile, profileFile
+	identityFile, profileFile = identity+".import", profile+".import"
+	defer func() {
+		removeFile(identityFile)
+		removeFile(profileFile)
+		identityFile, profileFile = identity, profile
+	}()
+
+	if err := write(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(profileFile, profile); err != nil {
+		return err
+	}
+	return os.Rename(identityFile, identity)
+}
+
+// importWireguardProfile stores a wg-quick profile with a WARP peer as a
+// static identity.
+func importWireguardProfile(b []byte, license string) (*AccountData, error) {
+	cfg, err := ini.LoadSources(ini.LoadOptions{
+		Insensitive:            true,
+		AllowShadows:           true,
+		AllowNonUniqueSections: true,
+	}, b)
+	if err != nil {
+		return nil, err
+	}
+
+	iface := cfg.Section("Interface")
+	peer := cfg.Section("Peer")
+
+	privateKey := iface.Key("PrivateKey").String()
+	if _, err := ParseKey(privateKey); err != nil {
+		return nil, fmt.Errorf("invalid private key: %w", err)
+	}
+
+	if publicKey := peer.Key("PublicKey").String(); publicKey != WarpPeerPublicKey {
+		return nil, fmt.Errorf("peer %q is not a WARP peer", publicKey)
+	}
+
+	var v4, v6 netip.Addr
+	for _, str := range iface.Key("Address").StringsWithShadows(",") {
+		prefix, err := netip.ParsePrefix(str)
+		if err != nil {
+			return nil, err
+		}
+		if prefix.Addr().Is4() {
+			v4 = prefix.Addr()
+		} else {
+			v6 = prefix.Addr()
+		}
+	}
+	if !v4.IsValid() || !v6.IsValid() {
+		return nil, errors.New("profile must have an IPv4 and an IPv6 address")
+	}
+
+	endpoint := peer.Key("Endpoint").String()
+	if endpoint == "" {
+		endpoint = "engage.cloudflareclient.com:2408"
+	}
+
+	accountData := &AccountData{
+		PrivateKey: privateKey,
+		LicenseKey: license,
+	}
+	if existing, ok := alreadyImported(accountData); ok {
+		return existing, nil
+	}
+
+	config := getWireguardConfig(privateKey, v4.String(), v6.String(), WarpPeerPublicKey, endpoint)
+	err = stageImport(func() error {
+		if err := saveIdentity(accountData, identityFile); err != nil {
+			return err
+		}
+		return os.WriteFile(profileFile, []byte(config), 0o600)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return accountData, nil
+}
+
+// parseWgcfAccount parses the flat key/value TOML written by wgcf.
+func parseWgcfAccount(b []byte) (*AccountData, error) {
+	var acc wgcfAccount
+
+	s := bufio.NewScanner(bytes.NewReader(b))
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, fmt.Errorf("line %d: expected key = value", n)
+		}
+		value = strings.Trim(strings.TrimSpace(value), `'"`)
+
+		switch strings.TrimSpace(key) {
+		case "device_id":
+			acc.DeviceID = value
+		case "access_token":
+			acc.AccessToken = value
+		case "private_key":
+			acc.PrivateKey = value
+		case "license_key":
+			acc.LicenseKey = value
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+
+	if acc.DeviceID == "" || acc.AccessToken == "" || acc.PrivateKey == "" {
+		return nil, errors.New("wgcf account must have device_id, access_token and private_key")
+	}
+
+	return &AccountData{
+		AccountID:   acc.DeviceID,
+		AccessToken: acc.AccessToken,
+		PrivateKey:  acc.PrivateKey,
+		LicenseKey:  acc.LicenseKey,
+	}, nil
+}
+
+// parseOfficialRegistration parses the official client's registration JSON.
+func parseOfficialRegistration(b []byte) (*AccountData, error) {
+	var reg officialRegistration
+	if err := json.Unmarshal(b, &reg); err != nil {
+		return nil, err
+	}
+
+	accountData := &AccountData{
+		AccountID:   firstNonEmpty(reg.RegistrationID, reg.ID),
+		AccessToken: firstNonEmpty(reg.APIToken, reg.Token),
+		PrivateKey:  firstNonEmpty(reg.SecretKey, reg.PrivateKey),
+		LicenseKey:  reg.Account.License,
+	}
+	if accountData.AccountID == "" || accountData.AccessToken == "" || accountData.PrivateKey == "" {
+		return nil, errors.New("registration must have a device id, token and private key")
+	}
+
+	return accountData, nil
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
@@ -0,0 +1,216 @@
+package warp
+
+import (
+	"os"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// testPrivateKey is a valid WireGuard private key.
+const testPrivateKey = "yAnz5TF+lXXJte14tji3zlMNq+hd2rYUIgJBgB3fBmk="
+
+func TestParseWgcfAccount(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      string
+		want    AccountData
+		wantErr bool
+	}{
+		{
+			name: "double quotes",
+			in: `device_id = "device"
+access_token = "token"
+private_key = "` + testPrivateKey + `"
+license_key = "license"
+`,
+			want: AccountData{AccountID: "device", AccessToken: "token", PrivateKey: testPrivateKey, LicenseKey: "license"},
+		},
+		{
+			name: "single quotes, comments and unknown keys",
+			in: `# written by wgcf
+device_id = 'device'
+
+access_token='token'
+private_key = '` + testPrivateKey + `'
+unknown = 'ignored'
+`,
+			want: AccountData{AccountID: "device", AccessToken: "token", PrivateKey: testPrivateKey},
+		},
+		{
+			name:    "missing access token",
+			in:      "device_id = 'device'\nprivate_key = '" + testPrivateKey + "'\n",
+			wantErr: true,
+		},
+		{
+			name:    "not key value",
+			in:      "device_id = 'device'\n[account]\n",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseWgcfAccount([]byte(tt.in))
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("got %+v, want error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if *got != tt.want {
+				t.Errorf("got %+v, want %+v", *got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseOfficialRegistration(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      string
+		want    AccountData
+		wantErr bool
+	}{
+		{
+			name: "desktop reg.json",
+			in: `{"registration_id": "device", "api_token": "token", "secret_key": "` + testPrivateKey + `",
+				"account": {"license": "license"}}`,
+			want: AccountData{AccountID: "device", AccessToken: "token", PrivateKey: testPrivateKey, LicenseKey: "license"},
+		},
+		{
+			name: "android preferences",
+			in:   `{"id": "device", "token": "token", "private_key": "` + testPrivateKey + `"}`,
+			want: AccountData{AccountID: "device", AccessToken: "token", PrivateKey: testPrivateKey},
+		},
+		{
+			name: "desktop names win",
+			in:   `{"registration_id": "device", "id": "other", "api_token": "token", "token": "other", "secret_key": "` + testPrivateKey + `", "private_key": "other"}`,
+			want: AccountData{AccountID: "device", AccessToken: "token", PrivateKey: testPrivateKey},
+		},
+		{
+			name:    "missing private key",
+			in:      `{"registration_id": "device", "api_token": "token"}`,
+			wantErr: true,
+		},
+		{
+			name:    "invalid json",
+			in:      `{"registration_id": `,
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseOfficialRegistration([]byte(tt.in))
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("got %+v, want error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if *got != tt.want {
+				t.Errorf("got %+v, want %+v", *got, tt.want)
+			}
+		})
+	}
+}
+
+func TestImportWireguardProfile(t *testing.T) {
+	profile := func(peer, address, endpoint string) string {
+		s := "[Interface]\nPrivateKey = " + testPrivateKey + "\nAddress = " + address + "\n" +
+			"[Peer]\nPublicKey = " + peer + "\nAllowedIPs = 0.0.0.0/0, ::/0\n"
+		if endpoint != "" {
+			s += "Endpoint = " + endpoint + "\n"
+		}
+		return s
+	}
+
+	tests := []struct {
+		name    string
+		in      string
+		want    []string // Lines of the stored profile
+		wantErr bool
+	}{
+		{
+			name: "endpoint kept",
+			in:   profile(WarpPeerPublicKey, "172.16.0.2/32, 2606:4700:110:8a36::1/128", "162.159.192.1:2408"),
+			want: []string{
+				"Address = 172.16.0.2/24",
+				"Address = 2606:4700:110:8a36::1/128",
+				"Endpoint = 162.159.192.1:2408",
+			},
+		},
+		{
+			name: "lower case and shadowed addresses, default endpoint",
+			in: "[interface]\nprivatekey = " + testPrivateKey + "\n" +
+				"address = 172.16.0.2/32\naddress = 2606:4700:110:8a36::1/128\n" +
+				"[peer]\npublickey = " + WarpPeerPublicKey + "\n",
+			want: []string{
+				"Address = 172.16.0.2/24",
+				"Address = 2606:4700:110:8a36::1/128",
+				"Endpoint = engage.cloudflareclient.com:2408",
+			},
+		},
+		{
+			name:    "not a warp peer",
+			in:      profile("xTIBA5rboUvnH4htodjb6e697QjLERt1NAB4mZqp8Dg=", "172.16.0.2/32, 2606:4700:110:8a36::1/128", ""),
+			wantErr: true,
+		},
+		{
+			name:    "no ipv6 address",
+			in:      profile(WarpPeerPublicKey, "172.16.0.2/32", ""),
+			wantErr: true,
+		},
+		{
+			name:    "invalid address",
+			in:      profile(WarpPeerPublicKey, "172.16.0.2, 2606:4700:110:8a36::1/128", ""),
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			UpdatePath(t.TempDir())
+
+			got, err := importWireguardProfile([]byte(tt.in), "license")
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("got %+v, want error", got)
+				}
+				if fileExist(identityFile) || fileExist(profileFile) {
+					t.Error("failed import left an identity behind")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			want := AccountData{PrivateKey: testPrivateKey, LicenseKey: "license"}
+			if *got != want {
+				t.Errorf("got %+v, want %+v", *got, want)
+			}
+			if stored, err := loadIdentity(identityFile); err != nil || *stored != want {
+				t.Errorf("stored identity %+v, %v, want %+v", stored, err, want)
+			}
+
+			b, err := os.ReadFile(profileFile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			lines := strings.Split(string(b), "\n")
+			for _, line := range append(tt.want, "PrivateKey = "+testPrivateKey, "PublicKey = "+WarpPeerPublicKey) {
+				if !slices.Contains(lines, line) {
+					t.Errorf("profile has no line %q:\n%s", line, b)
+				}
+			}
+		})
+	}
+}
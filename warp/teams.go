@@ -0,0 +1,121 @@
+package warp
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+)
+
+// teamsAuthCookie is the Access cookie that carries the enrollment JWT.
+const teamsAuthCookie = "CF_Authorization"
+
+// TeamsOptions holds the credentials used to enroll a device in a
+// Cloudflare Zero Trust organization.
+type TeamsOptions struct {
+	// Team is the organization name, as in <team>.cloudflareaccess.com.
+	Team string
+	// JWT is the token obtained from the team login flow.
+	JWT string
+	// ClientID and ClientSecret are a service token used instead of JWT.
+	ClientID     string
+	ClientSecret string
+}
+
+func getTeamsAuthURL(team string) string {
+	return fmt.Sprintf("https://%s.cloudflareaccess.com/warp", team)
+}
+
+// teamsToken returns the enrollment JWT, exchanging the service token for
+// one if no JWT was given.
+func teamsToken(opts TeamsOptions) (string, error) {
+	if opts.JWT != "" {
+		return opts.JWT, nil
+	}
+
+	if opts.Team == "" || opts.ClientID == "" || opts.ClientSecret == "" {
+		return "", errors.New("teams enrollment needs a JWT or a team name with a service token")
+	}
+
+	req, err := http.NewRequest("GET", getTeamsAuthURL(opts.Team), nil)
+	if err != nil {
+		return "", err
+	}
+
+	// Set headers
+	headers := map[string]string{
+		"CF-Access-Client-Id":     opts.ClientID,
+		"CF-Access-Client-Secret": opts.ClientSecret,
+	}
+
+	for k, v := range MergeMaps(defaultHeaders, headers) {
+		req.Header.Set(k, v)
+	}
+
+	// Access answers with a redirect that sets the cookie, so don't follow it.
+	noRedirect := *client
+	noRedirect.CheckRedirect = func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+
+	resp, err := noRedirect.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	for _, c := range resp.Cookies() {
+		if c.Name == teamsAuthCookie {
+			return c.Value, nil
+		}
+	}
+
+	return "", fmt.Errorf("service token rejected by team %s, status %d", opts.Team, resp.StatusCode)
+}
+
+// LoadOrCreateTeamsIdentity enrolls a new device in the organization unless
+// an identity already exists at the current path, then writes the profile
+// with the addresses and peer assigned by the organization.
+//
+// A new enrollment is kept aside until its profile is written. Enrollment
+// tokens are usually single use, so if writing the profile fails, the next
+// start picks the enrollment up again rather than enrolling anew.
+func LoadOrCreateTeamsIdentity(l *slog.Logger, opts TeamsOptions) error {
+	// Team accounts are not licensed, the organization decides what they get.
+	if fileExist(identityFile) {
+		return LoadOrCreateIdentity(l, "")
+	}
+
+	identity := identityFile
+	pending := identity + ".pending"
+	if fileExist(pending) {
+		l.Info("resuming zero trust enrollment", "team", opts.Team)
+	} else {
+		l.Info("enrolling device in zero trust organization", "team", opts.Team)
+
+		token, err := teamsToken(opts)
+		if err != nil {
+			return err
+		}
+
+		accountData, err := register(map[string]string{
+			"CF-Access-Jwt-Assertion": token,
+		})
+		if err != nil {
+			return fmt.Errorf("teams enrollment failed: %w", err)
+		}
+
+		if err := saveIdentity(accountData, pending); err != nil {
+			return err
+		}
+	}
+
+	identityFile = pending
+	err := LoadOrCreateIdentity(l, "")
+	identityFile = identity
+	if err != nil {
+		return err
+	}
+	return os.Rename(pending, identity)
+}
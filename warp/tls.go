@@ -1,18 +1,125 @@
 package warp
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 
 	"github.com/bepass-org/warp-plus/iputils"
 
 	tls "github.com/refraction-networking/utls"
 )
 
+// defaultFrontPrefix is the Cloudflare prefix dialed when a strategy has no host.
+var defaultFrontPrefix = netip.MustParsePrefix("141.101.113.0/24")
+
+// TLSStrategy describes the ClientHello and addressing used to reach the API.
+type TLSStrategy struct {
+	// Fingerprint names a uTLS ClientHello preset (see TLSFingerprints).
+	// The empty string selects the custom hello with the SNI-curve extension.
+	Fingerprint string
+	// SNI overrides the server name sent in the ClientHello, for fronting.
+	SNI string
+	// Host overrides the address dialed. It may be an IP, a host name or a
+	// CIDR prefix to pick a random IP from.
+	Host string
+}
+
+// String returns a short name for the strategy, used to remember it.
+func (s TLSStrategy) String() string {
+	fp := s.Fingerprint
+	if fp == "" {
+		fp = "sni-curve"
+	}
+	return strings.Join([]string{fp, s.SNI, s.Host}, "|")
+}
+
+// TLSFingerprints maps the accepted fingerprint names to uTLS presets.
+var TLSFingerprints = map[string]tls.ClientHelloID{
+	"chrome":     tls.HelloChrome_Auto,
+	"firefox":    tls.HelloFirefox_Auto,
+	"safari":     tls.HelloSafari_Auto,
+	"ios":        tls.HelloIOS_Auto,
+	"edge":       tls.HelloEdge_Auto,
+	"android":    tls.HelloAndroid_11_OkHttp,
+	"randomized": tls.HelloRandomizedNoALPN,
+}
+
+// DefaultTLSStrategies returns the strategies tried when none are configured,
+// starting with the custom hello the client has always used.
+func DefaultTLSStrategies() []TLSStrategy {
+	return []TLSStrategy{
+		{},
+		{Fingerprint: "chrome"},
+		{Fingerprint: "firefox"},
+		{Fingerprint: "randomized"},
+	}
+}
+
+// ParseTLSStrategy parses a strategy of the form "fingerprint[,sni=name][,host=addr]".
+// The fingerprint "sni-curve" selects the custom hello.
+func ParseTLSStrategy(v string) (TLSStrategy, error) {
+	fields := strings.Split(v, ",")
+
+	s := TLSStrategy{Fingerprint: strings.TrimSpace(fields[0])}
+	if s.Fingerprint == "sni-curve" {
+		s.Fingerprint = ""
+	} else if _, ok := TLSFingerprints[s.Fingerprint]; !ok {
+		return TLSStrategy{}, fmt.Errorf("unknown tls fingerprint %q", s.Fingerprint)
+	}
+
+	for _, field := range fields[1:] {
+		key, value, _ := strings.Cut(strings.TrimSpace(field), "=")
+		switch key {
+		case "sni":
+			s.SNI = value
+		case "host":
+			s.Host = value
+		default:
+			return TLSStrategy{}, fmt.Errorf("unknown tls strategy option %q", key)
+		}
+	}
+
+	return s, nil
+}
+
+// ConfigureTLS sets the strategies used to reach the API and the file the
+// working one is remembered in. An empty list keeps the defaults.
+func ConfigureTLS(strategies []TLSStrategy, stateFile string) error {
+	if stateFile != "" {
+		path, err := filepath.Abs(stateFile)
+		if err != nil {
+			return err
+		}
+		stateFile = path
+	}
+
+	tlsDialer.mu.Lock()
+	defer tlsDialer.mu.Unlock()
+
+	tlsDialer.Strategies = strategies
+	tlsDialer.StateFile = stateFile
+	tlsDialer.preferred = ""
+	return nil
+}
+
 // Dialer is a struct that holds various options for custom dialing.
-type Dialer struct{}
+type Dialer struct {
+	// Strategies are tried in order, starting with the one that last worked.
+	Strategies []TLSStrategy
+	// StateFile, if set, persists the strategy that worked across runs.
+	StateFile string
+
+	mu        sync.Mutex
+	preferred string
+}
 
 const (
 	extensionServerName   uint16 = 0x0
@@ -165,17 +272,72 @@ func (d *Dialer) makeTLSHelloPacketWithSNICurve(plainConn net.Conn, config *tls.
 	return utlsConn, nil
 }
 
-// TLSDial dials a TLS connection.
-func (d *Dialer) TLSDial(plainDialer *net.Dialer, network, addr string) (net.Conn, error) {
+// makeTLSHelloPacketWithPreset creates a TLS hello packet from a uTLS preset.
+// The preset's ALPN is limited to HTTP/1.1, which is all the client speaks.
+func (d *Dialer) makeTLSHelloPacketWithPreset(plainConn net.Conn, config *tls.Config, id tls.ClientHelloID) (*tls.UConn, error) {
+	var utlsConn *tls.UConn
+	if id == tls.HelloRandomizedNoALPN {
+		utlsConn = tls.UClient(plainConn, config, id)
+	} else {
+		spec, err := tls.UTLSIdToSpec(id)
+		if err != nil {
+			return nil, err
+		}
+		for _, ext := range spec.Extensions {
+			if alpn, ok := ext.(*tls.ALPNExtension); ok {
+				alpn.AlpnProtocols = []string{"http/1.1"}
+			}
+		}
+
+		utlsConn = tls.UClient(plainConn, config, tls.HelloCustom)
+		if err := utlsConn.ApplyPreset(&spec); err != nil {
+			return nil, fmt.Errorf("apply preset: %w", err)
+		}
+	}
+
+	if err := utlsConn.Handshake(); err != nil {
+		return nil, fmt.Errorf("uTlsConn.Handshake() error: %w", err)
+	}
+
+	return utlsConn, nil
+}
+
+// strategyHost returns the address to dial for a strategy.
+func strategyHost(s TLSStrategy) (string, error) {
+	if s.Host == "" {
+		ip, err := iputils.RandomIPFromPrefix(defaultFrontPrefix)
+		if err != nil {
+			return "", err
+		}
+		return ip.String(), nil
+	}
+
+	if prefix, err := netip.ParsePrefix(s.Host); err == nil {
+		ip, err := iputils.RandomIPFromPrefix(prefix)
+		if err != nil {
+			return "", err
+		}
+		return ip.String(), nil
+	}
+
+	return s.Host, nil
+}
+
+// dialStrategy dials addr using a single strategy.
+func (d *Dialer) dialStrategy(ctx context.Context, dial DialContextFunc, network, addr string, s TLSStrategy) (net.Conn, error) {
 	sni, _, err := net.SplitHostPort(addr)
 	if err != nil {
 		return nil, err
 	}
-	ip, err := iputils.RandomIPFromPrefix(netip.MustParsePrefix("141.101.113.0/24"))
+	if s.SNI != "" {
+		sni = s.SNI
+	}
+
+	host, err := strategyHost(s)
 	if err != nil {
 		return nil, err
 	}
-	plainConn, err := plainDialer.Dial(network, ip.String()+":443")
+	plainConn, err := dial(ctx, network, net.JoinHostPort(host, "443"))
 	if err != nil {
 		return nil, err
 	}
@@ -187,10 +349,91 @@ func (d *Dialer) TLSDial(plainDialer *net.Dialer, network, addr string) (net.Con
 		MinVersion:         tls.VersionTLS10,
 	}
 
-	utlsConn, handshakeErr := d.makeTLSHelloPacketWithSNICurve(plainConn, &config, sni)
+	var utlsConn *tls.UConn
+	var handshakeErr error
+	if s.Fingerprint == "" {
+		utlsConn, handshakeErr = d.makeTLSHelloPacketWithSNICurve(plainConn, &config, sni)
+	} else if id, ok := TLSFingerprints[s.Fingerprint]; ok {
+		utlsConn, handshakeErr = d.makeTLSHelloPacketWithPreset(plainConn, &config, id)
+	} else {
+		handshakeErr = fmt.Errorf("unknown tls fingerprint %q", s.Fingerprint)
+	}
 	if handshakeErr != nil {
 		_ = plainConn.Close()
 		return nil, handshakeErr
 	}
 	return utlsConn, nil
 }
+
+// strategies returns the configured strategies, the preferred one first.
+func (d *Dialer) strategies() []TLSStrategy {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	strategies := d.Strategies
+	if len(strategies) == 0 {
+		strategies = DefaultTLSStrategies()
+	}
+
+	if d.preferred == "" && d.StateFile != "" {
+		if b, err := os.ReadFile(d.StateFile); err == nil {
+			d.preferred = strings.TrimSpace(string(b))
+		}
+	}
+
+	ordered := make([]TLSStrategy, 0, len(strategies))
+	for _, s := range strategies {
+		if s.String() == d.preferred {
+			ordered = append(ordered, s)
+		}
+	}
+	for _, s := range strategies {
+		if s.String() != d.preferred {
+			ordered = append(ordered, s)
+		}
+	}
+	return ordered
+}
+
+// remember records the strategy that worked so later dials start with it.
+func (d *Dialer) remember(s TLSStrategy) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.preferred == s.String() {
+		return
+	}
+	d.preferred = s.String()
+
+	if d.StateFile != "" {
+		_ = os.WriteFile(d.StateFile, []byte(d.preferred+"\n"), 0o644)
+	}
+}
+
+// Preferred returns the strategy that last completed a handshake, if any.
+func (d *Dialer) Preferred() string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.preferred
+}
+
+// TLSDial dials a TLS connection.
+func (d *Dialer) TLSDial(plainDialer *net.Dialer, network, addr string) (net.Conn, error) {
+	return d.TLSDialContext(context.Background(), plainDialer.DialContext, network, addr)
+}
+
+// TLSDialContext dials a TLS connection over connections made by dial,
+// falling back to the next strategy when a handshake fails.
+func (d *Dialer) TLSDialContext(ctx context.Context, dial DialContextFunc, network, addr string) (net.Conn, error) {
+	var errs []error
+	for _, s := range d.strategies() {
+		conn, err := d.dialStrategy(ctx, dial, network, addr, s)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", s, err))
+			continue
+		}
+		d.remember(s)
+		return conn, nil
+	}
+	return nil, errors.Join(errs...)
+}
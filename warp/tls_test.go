@@ -0,0 +1,44 @@
+package warp
+
+import "testing"
+
+func TestParseTLSStrategy(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    TLSStrategy
+		wantErr bool
+	}{
+		{in: "sni-curve", want: TLSStrategy{}},
+		{in: "chrome", want: TLSStrategy{Fingerprint: "chrome"}},
+		{in: " firefox ", want: TLSStrategy{Fingerprint: "firefox"}},
+		{in: "randomized,sni=example.com", want: TLSStrategy{Fingerprint: "randomized", SNI: "example.com"}},
+		{in: "sni-curve,host=141.101.113.0/24", want: TLSStrategy{Host: "141.101.113.0/24"}},
+		{
+			in:   "safari, sni=example.com, host=api.example.com",
+			want: TLSStrategy{Fingerprint: "safari", SNI: "example.com", Host: "api.example.com"},
+		},
+		{in: "chrome,sni=", want: TLSStrategy{Fingerprint: "chrome"}},
+		{in: "", wantErr: true},
+		{in: "opera", wantErr: true},
+		{in: "Chrome", wantErr: true},
+		{in: "chrome,port=443", wantErr: true},
+		{in: "chrome,example.com", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseTLSStrategy(tt.in)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("ParseTLSStrategy(%q) = %+v, want error", tt.in, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseTLSStrategy(%q): %v", tt.in, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("ParseTLSStrategy(%q) = %+v, want %+v", tt.in, got, tt.want)
+		}
+	}
+}
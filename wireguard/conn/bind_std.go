@@ -46,6 +46,8 @@ type StdNetBind struct {
 
 	blackhole4 bool
 	blackhole6 bool
+
+	dontFragment bool // kept when the bind is reopened
 }
 
 func NewStdNetBind() Bind {
@@ -194,10 +196,38 @@ again:
 	if len(fns) == 0 {
 		return nil, 0, syscall.EAFNOSUPPORT
 	}
+	if s.dontFragment {
+		// Failures were reported when it was turned on.
+		_ = s.setDontFragmentLocked()
+	}
 
 	return fns, uint16(port), nil
 }
 
+// SetDontFragment sets or clears the don't fragment bit on the packets s
+// sends, on the open sockets and the ones opened later.
+func (s *StdNetBind) SetDontFragment(on bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.dontFragment = on
+	return s.setDontFragmentLocked()
+}
+
+func (s *StdNetBind) setDontFragmentLocked() error {
+	if s.ipv4 != nil {
+		if err := setDontFragment(s.ipv4, false, s.dontFragment); err != nil {
+			return err
+		}
+	}
+	if s.ipv6 != nil {
+		if err := setDontFragment(s.ipv6, true, s.dontFragment); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (s *StdNetBind) putMessages(msgs *[]ipv6.Message) {
 	for i := range *msgs {
 		(*msgs)[i].OOB = (*msgs)[i].OOB[:0]
@@ -72,9 +72,10 @@ type afWinRingBind struct {
 
 // WinRingBind uses Windows registered I/O for fast ring buffered networking.
 type WinRingBind struct {
-	v4, v6 afWinRingBind
-	mu     sync.RWMutex
-	isOpen atomic.Uint32 // 0, 1, or 2
+	v4, v6       afWinRingBind
+	mu           sync.RWMutex
+	isOpen       atomic.Uint32 // 0, 1, or 2
+	dontFragment bool          // Guarded by mu
 }
 
 func NewDefaultBind() Bind { return NewWinRingBind() }
@@ -92,8 +93,9 @@ type WinRingEndpoint struct {
 }
 
 var (
-	_ Bind     = (*WinRingBind)(nil)
-	_ Endpoint = (*WinRingEndpoint)(nil)
+	_ Bind           = (*WinRingBind)(nil)
+	_ DontFragmenter = (*WinRingBind)(nil)
+	_ Endpoint       = (*WinRingEndpoint)(nil)
 )
 
 func (*WinRingBind) ParseEndpoint(s string) (Endpoint, error) {
@@ -299,10 +301,34 @@ func (bind *WinRingBind) Open(port uint16) (recvFns []ReceiveFunc, selectedPort
 			return nil, 0, err
 		}
 	}
+	if bind.dontFragment {
+		// Failures were reported when it was turned on.
+		_ = bind.setDontFragmentLocked()
+	}
 	bind.isOpen.Store(1)
 	return []ReceiveFunc{bind.receiveIPv4, bind.receiveIPv6}, selectedPort, err
 }
 
+// SetDontFragment sets or clears the don't fragment bit on the packets
+// bind sends, on the open sockets and the ones opened later.
+func (bind *WinRingBind) SetDontFragment(on bool) error {
+	bind.mu.Lock()
+	defer bind.mu.Unlock()
+
+	bind.dontFragment = on
+	if bind.isOpen.Load() != 1 {
+		return nil
+	}
+	return bind.setDontFragmentLocked()
+}
+
+func (bind *WinRingBind) setDontFragmentLocked() error {
+	if err := setSocketDontFragment(bind.v4.sock, false, bind.dontFragment); err != nil {
+		return err
+	}
+	return setSocketDontFragment(bind.v6.sock, true, bind.dontFragment)
+}
+
 func (bind *WinRingBind) Close() error {
 	bind.mu.RLock()
 	if bind.isOpen.Load() != 1 {
@@ -71,6 +71,13 @@ type PeekLookAtSocketFd interface {
 	PeekLookAtSocketFd6() (fd int, err error)
 }
 
+// DontFragmenter is implemented by Bind objects that can send with the
+// don't fragment bit set, so packets too large for the path are dropped
+// rather than fragmented. Used for path MTU discovery.
+type DontFragmenter interface {
+	SetDontFragment(on bool) error
+}
+
 // An Endpoint maintains the source/destination caching for a peer.
 //
 //	dst: the remote address of a peer ("endpoint" in uapi terminology)
@@ -0,0 +1,39 @@
+//go:build darwin || freebsd
+
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package conn
+
+import (
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+// setDontFragment sets or clears the don't fragment bit on conn.
+func setDontFragment(conn *net.UDPConn, v6, on bool) error {
+	level, opt := unix.IPPROTO_IP, unix.IP_DONTFRAG
+	if v6 {
+		level, opt = unix.IPPROTO_IPV6, unix.IPV6_DONTFRAG
+	}
+	value := 0
+	if on {
+		value = 1
+	}
+
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var operr error
+	err = rc.Control(func(fd uintptr) {
+		operr = unix.SetsockoptInt(int(fd), level, opt, value)
+	})
+	if err != nil {
+		return err
+	}
+	return operr
+}
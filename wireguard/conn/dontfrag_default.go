@@ -0,0 +1,20 @@
+//go:build !linux && !darwin && !freebsd && !windows
+
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package conn
+
+import (
+	"errors"
+	"net"
+)
+
+func setDontFragment(conn *net.UDPConn, v6, on bool) error {
+	if !on {
+		return nil
+	}
+	return errors.New("don't fragment is not supported on this platform")
+}
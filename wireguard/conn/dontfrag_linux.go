@@ -0,0 +1,37 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package conn
+
+import (
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+// setDontFragment switches conn between probing, which sets the don't
+// fragment bit and ignores the cached path MTU, and the system default.
+func setDontFragment(conn *net.UDPConn, v6, on bool) error {
+	level, opt, value := unix.IPPROTO_IP, unix.IP_MTU_DISCOVER, unix.IP_PMTUDISC_WANT
+	if v6 {
+		level, opt, value = unix.IPPROTO_IPV6, unix.IPV6_MTU_DISCOVER, unix.IPV6_PMTUDISC_WANT
+	}
+	if on {
+		value = unix.IP_PMTUDISC_PROBE // Same value for IPv6
+	}
+
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var operr error
+	err = rc.Control(func(fd uintptr) {
+		operr = unix.SetsockoptInt(int(fd), level, opt, value)
+	})
+	if err != nil {
+		return err
+	}
+	return operr
+}
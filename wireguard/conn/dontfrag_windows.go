@@ -0,0 +1,48 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package conn
+
+import (
+	"net"
+
+	"golang.org/x/sys/windows"
+)
+
+// Socket options missing from x/sys/windows, from ws2ipdef.h.
+const (
+	IP_DONTFRAGMENT = 14
+	IPV6_DONTFRAG   = 14
+)
+
+// setDontFragment sets or clears the don't fragment bit on conn.
+func setDontFragment(conn *net.UDPConn, v6, on bool) error {
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var operr error
+	err = rc.Control(func(fd uintptr) {
+		operr = setSocketDontFragment(windows.Handle(fd), v6, on)
+	})
+	if err != nil {
+		return err
+	}
+	return operr
+}
+
+// setSocketDontFragment sets or clears the don't fragment bit on the
+// socket handle.
+func setSocketDontFragment(handle windows.Handle, v6, on bool) error {
+	level, opt := windows.IPPROTO_IP, IP_DONTFRAGMENT
+	if v6 {
+		level, opt = windows.IPPROTO_IPV6, IPV6_DONTFRAG
+	}
+	value := 0
+	if on {
+		value = 1
+	}
+	return windows.SetsockoptInt(handle, level, opt, value)
+}
@@ -0,0 +1,359 @@
+package device
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	mrand "math/rand"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/bepass-org/warp-plus/wireguard/conn"
+)
+
+// DecoyPattern is what the noise packets sent ahead of a handshake look like.
+type DecoyPattern int
+
+const (
+	// DecoyRandom packets are random bytes.
+	DecoyRandom DecoyPattern = iota
+	// DecoyQUIC packets look like QUIC Initial packets, with a long header
+	// and a random payload. They are at least quicDecoyMinSize bytes.
+	DecoyQUIC
+	// DecoyDNS packets are well formed DNS queries for random names. They
+	// are dnsDecoyMinSize to dnsDecoyMaxSize bytes.
+	DecoyDNS
+)
+
+func (p DecoyPattern) String() string {
+	switch p {
+	case DecoyRandom:
+		return "random"
+	case DecoyQUIC:
+		return "quic"
+	case DecoyDNS:
+		return "dns"
+	default:
+		return "unknown"
+	}
+}
+
+// ParseDecoyPattern returns the pattern named s, as written by String.
+func ParseDecoyPattern(s string) (DecoyPattern, error) {
+	for _, p := range []DecoyPattern{DecoyRandom, DecoyQUIC, DecoyDNS} {
+		if s == p.String() {
+			return p, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown noise pattern %s", s)
+}
+
+// Decoy is the profile of the packets sent to a peer ahead of handshake
+// initiations, to throw off DPI boxes that look for a WireGuard handshake
+// as the first packet of a flow. Unlike AmneziaWG junk, the peer needs no
+// support for it. The zero value sends nothing.
+type Decoy struct {
+	Count     int           // Packets sent ahead of each initiation
+	MinSize   int           // Smallest packet, in bytes
+	MaxSize   int           // Largest packet
+	MinDelay  time.Duration // Shortest wait after each packet
+	MaxDelay  time.Duration // Longest wait after each packet
+	Pattern   DecoyPattern
+	FirstOnly bool   // Only send noise ahead of the first initiation to the peer
+	Port      uint16 // Destination port of the noise, zero for the peer's own
+}
+
+// DefaultDecoy is the noise sent to WARP, which throttles or drops flows
+// that start with a bare handshake on some networks.
+var DefaultDecoy = Decoy{
+	Count:    2,
+	MinSize:  1,
+	MaxSize:  100,
+	MinDelay: 200 * time.Millisecond,
+	MaxDelay: 500 * time.Millisecond,
+	Pattern:  DecoyRandom,
+}
+
+const (
+	quicDecoyMinSize = 32
+	dnsDecoyMinSize  = 19
+	dnsDecoyMaxSize  = 271 // Longest name that fits in a query
+)
+
+// IsZero reports whether d sends nothing.
+func (d Decoy) IsZero() bool {
+	return d.Count == 0
+}
+
+// Validate checks that d is usable.
+func (d Decoy) Validate() error {
+	switch {
+	case d.Count < 0 || d.Count > MaxJunkCount:
+		return fmt.Errorf("noise count must be between 0 and %d", MaxJunkCount)
+	case d.Count == 0:
+		return nil
+	case d.MinSize < 1 || d.MaxSize > MaxJunkSize || d.MinSize > d.MaxSize:
+		return fmt.Errorf("noise size must satisfy 1 <= min <= max <= %d", MaxJunkSize)
+	case d.MinDelay < 0 || d.MinDelay > d.MaxDelay:
+		return errors.New("noise delay must satisfy 0 <= min <= max")
+	case time.Duration(d.Count)*d.MaxDelay >= RekeyTimeout:
+		// Otherwise the initiation is retransmitted before it is even sent.
+		return fmt.Errorf("noise count times the longest delay must stay under %v", RekeyTimeout)
+	}
+	return nil
+}
+
+// Set sets the field of d named by key, one of count, size, delay,
+// pattern, when and port, to value. Sizes and delays are a single value or
+// a min-max range, such as 10-60 or 10ms-50ms.
+func (d *Decoy) Set(key, value string) error {
+	var err error
+	switch key {
+	case "count":
+		var v uint64
+		v, err = strconv.ParseUint(value, 10, 16)
+		d.Count = int(v)
+	case "size":
+		min, max, _ := strings.Cut(value, "-")
+		if d.MinSize, err = strconv.Atoi(min); err == nil {
+			d.MaxSize = d.MinSize
+			if max != "" {
+				d.MaxSize, err = strconv.Atoi(max)
+			}
+		}
+	case "delay":
+		min, max, _ := strings.Cut(value, "-")
+		if d.MinDelay, err = time.ParseDuration(min); err == nil {
+			d.MaxDelay = d.MinDelay
+			if max != "" {
+				d.MaxDelay, err = time.ParseDuration(max)
+			}
+		}
+	case "pattern":
+		d.Pattern, err = ParseDecoyPattern(value)
+	case "when":
+		switch value {
+		case "every":
+			d.FirstOnly = false
+		case "first":
+			d.FirstOnly = true
+		default:
+			err = fmt.Errorf("expected every or first, got %s", value)
+		}
+	case "port":
+		var v uint64
+		v, err = strconv.ParseUint(value, 10, 16)
+		d.Port = uint16(v)
+	default:
+		return fmt.Errorf("unknown noise key %s", key)
+	}
+	return err
+}
+
+// UAPI returns d as UAPI lines, whose keys are those of Set with a noise_
+// prefix. A zero d has none.
+func (d Decoy) UAPI() string {
+	if d.IsZero() {
+		return ""
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "noise_count=%d\n", d.Count)
+	fmt.Fprintf(&b, "noise_size=%d-%d\n", d.MinSize, d.MaxSize)
+	fmt.Fprintf(&b, "noise_delay=%v-%v\n", d.MinDelay, d.MaxDelay)
+	fmt.Fprintf(&b, "noise_pattern=%v\n", d.Pattern)
+	if d.FirstOnly {
+		b.WriteString("noise_when=first\n")
+	}
+	if d.Port != 0 {
+		fmt.Fprintf(&b, "noise_port=%d\n", d.Port)
+	}
+	return b.String()
+}
+
+// packets returns the noise packets to send ahead of an initiation.
+func (d *Decoy) packets() [][]byte {
+	bufs := make([][]byte, d.Count)
+	for i := range bufs {
+		size := d.MinSize + mrand.Intn(d.MaxSize-d.MinSize+1)
+		switch d.Pattern {
+		case DecoyQUIC:
+			bufs[i] = quicDecoy(size)
+		case DecoyDNS:
+			bufs[i] = dnsDecoy(size)
+		default:
+			bufs[i] = make([]byte, size)
+			rand.Read(bufs[i])
+		}
+	}
+	return bufs
+}
+
+// delay returns how long to wait after a noise packet.
+func (d *Decoy) delay() time.Duration {
+	return d.MinDelay + time.Duration(mrand.Int63n(int64(d.MaxDelay-d.MinDelay)+1))
+}
+
+// quicDecoy returns a packet of size bytes, or quicDecoyMinSize if that is
+// more, laid out as a QUIC v1 Initial with random connection IDs.
+func quicDecoy(size int) []byte {
+	size = max(size, quicDecoyMinSize)
+	buf := make([]byte, size)
+	rand.Read(buf)
+
+	// Long header, fixed bit, Initial type, and protected low bits.
+	buf[0] = 0xc0 | buf[0]&0x0f
+	binary.BigEndian.PutUint32(buf[1:], 1)
+	buf[5] = 8 // Destination connection ID length, the ID follows
+	buf[14] = 8
+	buf[23] = 0 // No token
+	// Length of the rest as a two byte varint.
+	binary.BigEndian.PutUint16(buf[24:], 0x4000|uint16(size-26))
+	return buf
+}
+
+// dnsDecoy returns a DNS query of size bytes, clamped to the sizes a
+// query can have, for a name made of random letters.
+func dnsDecoy(size int) []byte {
+	size = min(max(size, dnsDecoyMinSize), dnsDecoyMaxSize)
+	buf := make([]byte, size)
+
+	rand.Read(buf[:2])                          // ID
+	binary.BigEndian.PutUint16(buf[2:], 0x0100) // Recursion desired
+	binary.BigEndian.PutUint16(buf[4:], 1)      // One question
+
+	// The name takes what the header, the terminating zero and the type
+	// and class leave, split in labels of up to 63 letters.
+	name := buf[12 : size-5]
+	for len(name) > 0 {
+		n := min(63, len(name)-1)
+		if len(name)-n-1 == 1 {
+			n-- // A single byte can't hold a label
+		}
+		name[0] = byte(n)
+		for i := 1; i <= n; i++ {
+			name[i] = 'a' + byte(mrand.Intn(26))
+		}
+		name = name[n+1:]
+	}
+
+	qtypes := []uint16{1, 28, 65} // A, AAAA, HTTPS
+	binary.BigEndian.PutUint16(buf[size-4:], qtypes[mrand.Intn(len(qtypes))])
+	binary.BigEndian.PutUint16(buf[size-2:], 1) // IN
+	return buf
+}
+
+// decoyState is the noise of a peer, and whether it was sent already.
+type decoyState struct {
+	Decoy
+	sent atomic.Bool
+}
+
+// peerDecoys holds the noise of every peer that has one. The map is
+// replaced, never changed, so it can be read after unlocking.
+type peerDecoys struct {
+	sync.Mutex
+	peers map[NoisePublicKey]*decoyState
+}
+
+// PeerDecoy returns the noise of the peer with the given key.
+func (device *Device) PeerDecoy(pk NoisePublicKey) Decoy {
+	device.decoys.Lock()
+	defer device.decoys.Unlock()
+	if s := device.decoys.peers[pk]; s != nil {
+		return s.Decoy
+	}
+	return Decoy{}
+}
+
+// setPeerDecoy changes the noise of the peer with the given key, which
+// then counts as not sent yet. A zero d removes it.
+func (device *Device) setPeerDecoy(pk NoisePublicKey, d Decoy) error {
+	if err := d.Validate(); err != nil {
+		return err
+	}
+
+	device.decoys.Lock()
+	defer device.decoys.Unlock()
+
+	peers := make(map[NoisePublicKey]*decoyState, len(device.decoys.peers)+1)
+	for k, v := range device.decoys.peers {
+		if k != pk {
+			peers[k] = v
+		}
+	}
+	if !d.IsZero() {
+		peers[pk] = &decoyState{Decoy: d}
+	}
+	device.decoys.peers = peers
+	device.sendStates.invalidate()
+	return nil
+}
+
+// removePeerDecoy forgets the noise of a removed peer.
+func (device *Device) removePeerDecoy(pk NoisePublicKey) {
+	device.decoys.Lock()
+	defer device.decoys.Unlock()
+
+	if _, ok := device.decoys.peers[pk]; !ok {
+		return
+	}
+	peers := make(map[NoisePublicKey]*decoyState, len(device.decoys.peers))
+	for k, v := range device.decoys.peers {
+		if k != pk {
+			peers[k] = v
+		}
+	}
+	device.decoys.peers = peers
+	device.sendStates.invalidate()
+}
+
+// sendDecoys sends the noise of s to ep, then calls send for the
+// initiation. Without delays everything is sent before it returns;
+// otherwise it returns at once and the rest happens in the background,
+// so the handshake routine isn't held up.
+func (b *obfuscatingBind) sendDecoys(s *decoyState, ep conn.Endpoint, send func() error) error {
+	if s.sent.Swap(true) && s.FirstOnly {
+		return send()
+	}
+
+	target := ep
+	if s.Port != 0 {
+		addr := netip.AddrPortFrom(ep.DstIP(), s.Port)
+		var err error
+		if target, err = b.Bind.ParseEndpoint(addr.String()); err != nil {
+			b.device.log.Verbosef("Failed to send noise to %v: %v", addr, err)
+			return send()
+		}
+	}
+
+	packets := s.packets()
+	if s.MaxDelay == 0 {
+		if err := b.Bind.Send(packets, target); err != nil {
+			b.device.log.Verbosef("Failed to send noise packets: %v", err)
+		}
+		return send()
+	}
+
+	go func() {
+		for _, p := range packets {
+			if err := b.Bind.Send([][]byte{p}, target); err != nil {
+				b.device.log.Verbosef("Failed to send noise packets: %v", err)
+				break
+			}
+			select {
+			case <-b.device.closed:
+				return
+			case <-time.After(s.delay()):
+			}
+		}
+		if err := send(); err != nil {
+			b.device.log.Verbosef("Failed to send handshake initiation after noise: %v", err)
+		}
+	}()
+	return nil
+}
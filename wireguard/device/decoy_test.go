@@ -0,0 +1,114 @@
+package device
+
+import (
+	"encoding/binary"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDecoyPackets(t *testing.T) {
+	for _, pattern := range []DecoyPattern{DecoyRandom, DecoyQUIC, DecoyDNS} {
+		d := Decoy{Count: 5, MinSize: 40, MaxSize: 120, Pattern: pattern}
+		packets := d.packets()
+		if len(packets) != d.Count {
+			t.Fatalf("%v: got %d packets, want %d", pattern, len(packets), d.Count)
+		}
+		for _, p := range packets {
+			if len(p) < d.MinSize || len(p) > d.MaxSize {
+				t.Errorf("%v: packet of %d bytes, want %d to %d", pattern, len(p), d.MinSize, d.MaxSize)
+			}
+		}
+	}
+}
+
+func TestDecoyQUIC(t *testing.T) {
+	p := quicDecoy(1)
+	if len(p) != quicDecoyMinSize {
+		t.Fatalf("got %d bytes, want the minimum of %d", len(p), quicDecoyMinSize)
+	}
+
+	p = quicDecoy(1200)
+	if p[0]&0xf0 != 0xc0 {
+		t.Errorf("first byte %#x is not an Initial long header", p[0])
+	}
+	if v := binary.BigEndian.Uint32(p[1:]); v != 1 {
+		t.Errorf("version %d, want 1", v)
+	}
+	if l := binary.BigEndian.Uint16(p[24:]) &^ 0x4000; int(l) != len(p)-26 {
+		t.Errorf("length field %d, want %d", l, len(p)-26)
+	}
+}
+
+func TestDecoyDNS(t *testing.T) {
+	for _, size := range []int{1, dnsDecoyMinSize, 20, 64, 81, 82, 200, 1000} {
+		p := dnsDecoy(size)
+		want := min(max(size, dnsDecoyMinSize), dnsDecoyMaxSize)
+		if len(p) != want {
+			t.Errorf("size %d: got %d bytes, want %d", size, len(p), want)
+			continue
+		}
+		if qd := binary.BigEndian.Uint16(p[4:]); qd != 1 {
+			t.Errorf("size %d: %d questions, want 1", size, qd)
+		}
+
+		// Walk the labels, which must end right before the type and class.
+		i := 12
+		for p[i] != 0 {
+			if p[i] > 63 {
+				t.Fatalf("size %d: label of %d bytes", size, p[i])
+			}
+			i += int(p[i]) + 1
+		}
+		if i != len(p)-5 {
+			t.Errorf("size %d: name ends at %d, want %d", size, i, len(p)-5)
+		}
+	}
+}
+
+func TestDecoyValidate(t *testing.T) {
+	tests := []struct {
+		name string
+		d    Decoy
+		ok   bool
+	}{
+		{"zero", Decoy{}, true},
+		{"default", DefaultDecoy, true},
+		{"no size", Decoy{Count: 2}, false},
+		{"min above max", Decoy{Count: 2, MinSize: 50, MaxSize: 10}, false},
+		{"too large", Decoy{Count: 2, MinSize: 10, MaxSize: MaxJunkSize + 1}, false},
+		{"delays past rekey", Decoy{Count: 10, MinSize: 10, MaxSize: 10, MaxDelay: time.Second}, false},
+	}
+	for _, tt := range tests {
+		if err := tt.d.Validate(); (err == nil) != tt.ok {
+			t.Errorf("%s: got error %v, want ok %t", tt.name, err, tt.ok)
+		}
+	}
+}
+
+func TestDecoyUAPI(t *testing.T) {
+	want := Decoy{
+		Count:     3,
+		MinSize:   20,
+		MaxSize:   80,
+		MinDelay:  10 * time.Millisecond,
+		MaxDelay:  50 * time.Millisecond,
+		Pattern:   DecoyDNS,
+		FirstOnly: true,
+		Port:      53,
+	}
+
+	var d Decoy
+	for _, line := range strings.Split(want.UAPI(), "\n") {
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			continue
+		}
+		if err := d.Set(strings.TrimPrefix(key, "noise_"), value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if d != want {
+		t.Errorf("got %+v after a UAPI round trip, want %+v", d, want)
+	}
+}
@@ -86,6 +86,11 @@ type Device struct {
 		mtu    atomic.Int32
 	}
 
+	events      peerEvents
+	obfuscation peerObfuscation
+	decoys      peerDecoys
+	sendStates  sendStates
+
 	ipcMutex sync.RWMutex
 	closed   chan struct{}
 	log      *Logger
@@ -133,6 +138,8 @@ func removePeerLocked(device *Device, peer *Peer, key NoisePublicKey) {
 
 	// remove from peer map
 	delete(device.peers.keyMap, key)
+	device.removePeerObfuscation(key)
+	device.removePeerDecoy(key)
 }
 
 // changeState attempts to change the device state to match want.
@@ -286,7 +293,7 @@ func NewDevice(tunDevice tun.Device, bind conn.Bind, logger *Logger) *Device {
 	device.state.state.Store(uint32(deviceStateDown))
 	device.closed = make(chan struct{})
 	device.log = logger
-	device.net.bind = bind
+	device.net.bind = &obfuscatingBind{Bind: bind, device: device}
 	device.tun.device = tunDevice
 	mtu, err := device.tun.device.MTU()
 	if err != nil {
@@ -438,7 +445,14 @@ func closeBindLocked(device *Device) error {
 func (device *Device) Bind() conn.Bind {
 	device.net.Lock()
 	defer device.net.Unlock()
-	return device.net.bind
+	return unwrapBind(device.net.bind)
+}
+
+// ListenPort returns the local UDP port of the device, zero while it is down.
+func (device *Device) ListenPort() uint16 {
+	device.net.Lock()
+	defer device.net.Unlock()
+	return device.net.port
 }
 
 func (device *Device) BindSetMark(mark uint32) error {
@@ -493,7 +507,7 @@ func (device *Device) BindUpdate() error {
 		return err
 	}
 
-	netc.netlinkCancel, err = device.startRouteListener(netc.bind)
+	netc.netlinkCancel, err = device.startRouteListener(unwrapBind(netc.bind))
 	if err != nil {
 		netc.bind.Close()
 		netc.port = 0
@@ -203,6 +203,67 @@ func TestTwoDevicePing(t *testing.T) {
 	})
 }
 
+func TestPeerStatsAndEvents(t *testing.T) {
+	goroutineLeakCheck(t)
+	pair := genTestPair(t, false)
+
+	events := make(chan PeerEvent, 16)
+	pair[0].dev.OnPeerEvent(func(e PeerEvent) { events <- e })
+
+	pair.Send(t, Ping, nil)
+	pair.Send(t, Pong, nil)
+
+	select {
+	case e := <-events:
+		if e.Type != PeerHandshakeComplete {
+			t.Fatalf("got %v event, want %v", e.Type, PeerHandshakeComplete)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no handshake event")
+	}
+
+	stats := pair[0].dev.PeerStats()
+	if len(stats) != 1 {
+		t.Fatalf("got %d peers, want 1", len(stats))
+	}
+	st := stats[0]
+	if st.LastHandshake.IsZero() {
+		t.Error("last handshake is zero after a ping")
+	}
+	if st.RxBytes == 0 || st.TxBytes == 0 {
+		t.Errorf("got rx %d tx %d bytes, want both non-zero", st.RxBytes, st.TxBytes)
+	}
+	if want := []netip.Prefix{netip.PrefixFrom(pair[1].ip, 32)}; len(st.AllowedIPs) != 1 || st.AllowedIPs[0] != want[0] {
+		t.Errorf("got allowed ips %v, want %v", st.AllowedIPs, want)
+	}
+	if got, ok := pair[0].dev.PeerStatsFor(st.PublicKey); !ok || got.PublicKey != st.PublicKey {
+		t.Error("PeerStatsFor did not find the peer")
+	}
+
+	err := pair[0].dev.IpcSet(uapiCfg(
+		"public_key", hex.EncodeToString(st.PublicKey[:]),
+		"update_only", "true",
+		"endpoint", st.Endpoint,
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for {
+		select {
+		case e := <-events:
+			if e.Type != PeerEndpointChanged {
+				continue
+			}
+			if e.PublicKey != st.PublicKey || e.Endpoint != st.Endpoint {
+				t.Errorf("got endpoint event %+v, want %s at %s", e, st.PublicKey, st.Endpoint)
+			}
+			return
+		case <-time.After(5 * time.Second):
+			t.Fatal("no endpoint event")
+		}
+	}
+}
+
 func TestUpDown(t *testing.T) {
 	goroutineLeakCheck(t)
 	const itrials = 50
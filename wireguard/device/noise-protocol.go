@@ -602,6 +602,12 @@ func (peer *Peer) BeginSymmetricSession() error {
 		device.DeleteKeypair(previous)
 	}
 
+	// The responder only knows the session works once data arrives with
+	// it, see ReceivedWithKeypair.
+	if isInitiator {
+		peer.firePeerEvent(PeerHandshakeComplete, "")
+	}
+
 	return nil
 }
 
@@ -621,5 +627,6 @@ func (peer *Peer) ReceivedWithKeypair(receivedKeypair *Keypair) bool {
 	peer.device.DeleteKeypair(old)
 	keypairs.current = keypairs.next.Load()
 	keypairs.next.Store(nil)
+	peer.firePeerEvent(PeerHandshakeComplete, "")
 	return true
 }
@@ -0,0 +1,532 @@
+package device
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	mrand "math/rand"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/bepass-org/warp-plus/wireguard/conn"
+)
+
+// Limits of the AmneziaWG parameters, so padded handshakes still fit in a
+// minimal MTU.
+const (
+	MaxJunkCount       = 128
+	MaxJunkSize        = 1280
+	MaxInitPadding     = 1280 - MessageInitiationSize
+	MaxResponsePadding = 1280 - MessageResponseSize
+)
+
+// Obfuscation holds the AmneziaWG parameters of a peer. They hide the fixed
+// message types and sizes DPI boxes fingerprint WireGuard by. Both sides
+// must use the same values, except for the junk packets, which any peer
+// ignores. The zero value is plain WireGuard.
+type Obfuscation struct {
+	JunkCount       int    // Jc: junk packets sent before each handshake initiation
+	JunkMin         int    // Jmin: smallest junk packet
+	JunkMax         int    // Jmax: largest junk packet
+	InitPadding     int    // S1: random bytes before handshake initiations
+	ResponsePadding int    // S2: random bytes before handshake responses
+	InitHeader      uint32 // H1: message type of handshake initiations, zero for the standard one
+	ResponseHeader  uint32 // H2: message type of handshake responses
+	CookieHeader    uint32 // H3: message type of cookie replies
+	TransportHeader uint32 // H4: message type of transport data
+}
+
+// IsZero reports whether o leaves packets untouched.
+func (o Obfuscation) IsZero() bool {
+	return o == Obfuscation{}
+}
+
+// Validate checks that o is usable on its own.
+func (o Obfuscation) Validate() error {
+	switch {
+	case o.JunkCount < 0 || o.JunkCount > MaxJunkCount:
+		return fmt.Errorf("jc must be between 0 and %d", MaxJunkCount)
+	case o.JunkMin < 0 || o.JunkMax > MaxJunkSize || o.JunkMin > o.JunkMax:
+		return fmt.Errorf("jmin and jmax must satisfy 0 <= jmin <= jmax <= %d", MaxJunkSize)
+	case o.JunkCount > 0 && o.JunkMax == 0:
+		return errors.New("jc needs a non-zero jmax")
+	case o.InitPadding < 0 || o.InitPadding > MaxInitPadding:
+		return fmt.Errorf("s1 must be between 0 and %d", MaxInitPadding)
+	case o.ResponsePadding < 0 || o.ResponsePadding > MaxResponsePadding:
+		return fmt.Errorf("s2 must be between 0 and %d", MaxResponsePadding)
+	case MessageInitiationSize+o.InitPadding == MessageResponseSize+o.ResponsePadding:
+		return errors.New("s1 + 56 must differ from s2, or initiations and responses have the same size")
+	}
+
+	headers := []uint32{o.InitHeader, o.ResponseHeader, o.CookieHeader, o.TransportHeader}
+	for i, h := range headers {
+		if h != 0 && h <= MessageTransportType {
+			return fmt.Errorf("h%d must be above %d to differ from plain WireGuard", i+1, MessageTransportType)
+		}
+		for _, other := range headers[:i] {
+			if h != 0 && h == other {
+				return fmt.Errorf("h1 to h4 must be distinct, %d is repeated", h)
+			}
+		}
+	}
+	return nil
+}
+
+// Set sets the field of o named by the lower case UAPI key, such as jc or
+// h1, to value.
+func (o *Obfuscation) Set(key, value string) error {
+	n, err := strconv.ParseUint(value, 10, 32)
+	if err != nil {
+		return err
+	}
+	switch key {
+	case "jc":
+		o.JunkCount = int(n)
+	case "jmin":
+		o.JunkMin = int(n)
+	case "jmax":
+		o.JunkMax = int(n)
+	case "s1":
+		o.InitPadding = int(n)
+	case "s2":
+		o.ResponsePadding = int(n)
+	case "h1":
+		o.InitHeader = uint32(n)
+	case "h2":
+		o.ResponseHeader = uint32(n)
+	case "h3":
+		o.CookieHeader = uint32(n)
+	case "h4":
+		o.TransportHeader = uint32(n)
+	default:
+		return fmt.Errorf("unknown obfuscation key %s", key)
+	}
+	return nil
+}
+
+// UAPI returns the non-zero fields of o as UAPI lines.
+func (o Obfuscation) UAPI() string {
+	var b strings.Builder
+	for _, f := range []struct {
+		key   string
+		value uint64
+	}{
+		{"jc", uint64(o.JunkCount)},
+		{"jmin", uint64(o.JunkMin)},
+		{"jmax", uint64(o.JunkMax)},
+		{"s1", uint64(o.InitPadding)},
+		{"s2", uint64(o.ResponsePadding)},
+		{"h1", uint64(o.InitHeader)},
+		{"h2", uint64(o.ResponseHeader)},
+		{"h3", uint64(o.CookieHeader)},
+		{"h4", uint64(o.TransportHeader)},
+	} {
+		if f.value != 0 {
+			fmt.Fprintf(&b, "%s=%d\n", f.key, f.value)
+		}
+	}
+	return b.String()
+}
+
+// header returns the header o sends for messages of msgType.
+func (o *Obfuscation) header(msgType uint32) uint32 {
+	var h uint32
+	switch msgType {
+	case MessageInitiationType:
+		h = o.InitHeader
+	case MessageResponseType:
+		h = o.ResponseHeader
+	case MessageCookieReplyType:
+		h = o.CookieHeader
+	case MessageTransportType:
+		h = o.TransportHeader
+	}
+	if h == 0 {
+		return msgType
+	}
+	return h
+}
+
+// padding returns the random bytes o puts before messages of msgType.
+func (o *Obfuscation) padding(msgType uint32) int {
+	switch msgType {
+	case MessageInitiationType:
+		return o.InitPadding
+	case MessageResponseType:
+		return o.ResponsePadding
+	default:
+		return 0
+	}
+}
+
+// junk returns the junk packets to send before a handshake initiation.
+func (o *Obfuscation) junk() [][]byte {
+	bufs := make([][]byte, o.JunkCount)
+	for i := range bufs {
+		bufs[i] = make([]byte, o.JunkMin+mrand.Intn(o.JunkMax-o.JunkMin+1))
+		rand.Read(bufs[i])
+	}
+	return bufs
+}
+
+// obfuscate returns the message in buf as o sends it. Transport messages
+// are changed in place, handshakes are copied behind their padding.
+func (o *Obfuscation) obfuscate(buf []byte) []byte {
+	if len(buf) < 4 {
+		return buf
+	}
+	msgType := binary.LittleEndian.Uint32(buf)
+
+	if pad := o.padding(msgType); pad > 0 {
+		padded := make([]byte, pad+len(buf))
+		rand.Read(padded[:pad])
+		copy(padded[pad:], buf)
+		binary.LittleEndian.PutUint32(padded[pad:], o.header(msgType))
+		return padded
+	}
+	binary.LittleEndian.PutUint32(buf, o.header(msgType))
+	return buf
+}
+
+// obfuscationEntry is how one obfuscated message type is recognized.
+type obfuscationEntry struct {
+	msgType uint32
+	padding int
+}
+
+// obfuscationTable recognizes the messages of every peer's obfuscation.
+// It is rebuilt after each UAPI set and read without locks.
+type obfuscationTable struct {
+	byHeader map[uint32]obfuscationEntry
+	offsets  []int // distinct paddings, so header offsets, ending with 0
+}
+
+// deobfuscate turns the obfuscated message in packet back into a plain
+// one in place, and returns its new size. Packets that match no peer are
+// left alone, so plain WireGuard keeps working next to obfuscated peers.
+func (t *obfuscationTable) deobfuscate(packet []byte) int {
+	for _, pad := range t.offsets {
+		if len(packet) < pad+4 {
+			continue
+		}
+		e, ok := t.byHeader[binary.LittleEndian.Uint32(packet[pad:])]
+		if !ok || e.padding != pad {
+			continue
+		}
+
+		size := len(packet) - pad
+		switch e.msgType {
+		case MessageInitiationType:
+			ok = size == MessageInitiationSize
+		case MessageResponseType:
+			ok = size == MessageResponseSize
+		case MessageCookieReplyType:
+			ok = size == MessageCookieReplySize
+		case MessageTransportType:
+			ok = size >= MessageTransportSize
+		}
+		if !ok {
+			continue
+		}
+
+		copy(packet, packet[pad:])
+		binary.LittleEndian.PutUint32(packet, e.msgType)
+		return size
+	}
+	return len(packet)
+}
+
+// peerObfuscation holds the obfuscation of every peer that has one. The
+// map is replaced, never changed, so it can be read after unlocking.
+type peerObfuscation struct {
+	sync.Mutex
+	peers map[NoisePublicKey]Obfuscation
+	table atomic.Pointer[obfuscationTable] // nil while no peer changes headers or sizes
+}
+
+// PeerObfuscation returns the obfuscation of the peer with the given key.
+func (device *Device) PeerObfuscation(pk NoisePublicKey) Obfuscation {
+	device.obfuscation.Lock()
+	defer device.obfuscation.Unlock()
+	return device.obfuscation.peers[pk]
+}
+
+// setPeerObfuscation changes the obfuscation of the peer with the given key
+// and rebuilds the receive table. It fails, changing nothing, if o is
+// invalid or can't be told apart from another peer's.
+func (device *Device) setPeerObfuscation(pk NoisePublicKey, o Obfuscation) error {
+	if err := o.Validate(); err != nil {
+		return err
+	}
+
+	device.obfuscation.Lock()
+	defer device.obfuscation.Unlock()
+
+	peers := make(map[NoisePublicKey]Obfuscation, len(device.obfuscation.peers)+1)
+	for k, v := range device.obfuscation.peers {
+		peers[k] = v
+	}
+	if o.IsZero() {
+		delete(peers, pk)
+	} else {
+		peers[pk] = o
+	}
+
+	table, err := newObfuscationTable(peers)
+	if err != nil {
+		return err
+	}
+	device.obfuscation.peers = peers
+	device.obfuscation.table.Store(table)
+	device.sendStates.invalidate()
+	return nil
+}
+
+// removePeerObfuscation forgets the obfuscation of a removed peer.
+func (device *Device) removePeerObfuscation(pk NoisePublicKey) {
+	device.obfuscation.Lock()
+	defer device.obfuscation.Unlock()
+
+	if _, ok := device.obfuscation.peers[pk]; !ok {
+		return
+	}
+	peers := make(map[NoisePublicKey]Obfuscation, len(device.obfuscation.peers))
+	for k, v := range device.obfuscation.peers {
+		if k != pk {
+			peers[k] = v
+		}
+	}
+	table, _ := newObfuscationTable(peers) // Removing can't conflict
+	device.obfuscation.peers = peers
+	device.obfuscation.table.Store(table)
+	device.sendStates.invalidate()
+}
+
+// newObfuscationTable returns the receive table for peers, or nil if no
+// peer changes headers or sizes.
+func newObfuscationTable(peers map[NoisePublicKey]Obfuscation) (*obfuscationTable, error) {
+	t := &obfuscationTable{byHeader: make(map[uint32]obfuscationEntry)}
+	for _, o := range peers {
+		for msgType := uint32(MessageInitiationType); msgType <= MessageTransportType; msgType++ {
+			h, e := o.header(msgType), obfuscationEntry{msgType: msgType, padding: o.padding(msgType)}
+			if h == msgType && e.padding == 0 {
+				continue
+			}
+			if old, ok := t.byHeader[h]; ok && old != e {
+				return nil, fmt.Errorf("header %d is used by two peers for different messages", h)
+			}
+			t.byHeader[h] = e
+			if e.padding > 0 && !slices.Contains(t.offsets, e.padding) {
+				t.offsets = append(t.offsets, e.padding)
+			}
+		}
+	}
+	if len(t.byHeader) == 0 {
+		return nil, nil
+	}
+	t.offsets = append(t.offsets, 0)
+	return t, nil
+}
+
+// obfuscatingBind applies the obfuscation of each peer to the packets the
+// device sends and receives through the wrapped Bind, and sends their noise
+// ahead of handshake initiations.
+type obfuscatingBind struct {
+	conn.Bind
+	device *Device
+}
+
+// unwrapBind returns the Bind the device was created with.
+func unwrapBind(bind conn.Bind) conn.Bind {
+	if b, ok := bind.(*obfuscatingBind); ok {
+		return b.Bind
+	}
+	return bind
+}
+
+func (b *obfuscatingBind) Open(port uint16) ([]conn.ReceiveFunc, uint16, error) {
+	fns, actualPort, err := b.Bind.Open(port)
+	if err != nil {
+		return nil, 0, err
+	}
+	for i, fn := range fns {
+		fns[i] = b.receive(fn)
+	}
+	return fns, actualPort, nil
+}
+
+// receive wraps fn to turn obfuscated messages back into plain ones.
+func (b *obfuscatingBind) receive(fn conn.ReceiveFunc) conn.ReceiveFunc {
+	return func(packets [][]byte, sizes []int, eps []conn.Endpoint) (int, error) {
+		n, err := fn(packets, sizes, eps)
+		table := b.device.obfuscation.table.Load()
+		if table == nil {
+			return n, err
+		}
+		for i := 0; i < n; i++ {
+			sizes[i] = table.deobfuscate(packets[i][:sizes[i]])
+		}
+		return n, err
+	}
+}
+
+func (b *obfuscatingBind) Send(bufs [][]byte, ep conn.Endpoint) error {
+	state := b.device.sendStateFor(ep)
+	o, obfuscated := state.obfuscation, state.obfuscation != nil
+	var decoy *decoyState
+	initiation := slices.ContainsFunc(bufs, isInitiation)
+	if initiation {
+		decoy = state.decoy
+	}
+	if !obfuscated && decoy == nil {
+		return b.Bind.Send(bufs, ep)
+	}
+
+	out := make([][]byte, len(bufs))
+	for i, buf := range bufs {
+		if decoy != nil {
+			// The initiation may go out after Send returns and the
+			// caller reuses bufs.
+			buf = slices.Clone(buf)
+		}
+		if obfuscated {
+			buf = o.obfuscate(buf)
+		}
+		out[i] = buf
+	}
+
+	send := func() error {
+		if initiation && obfuscated && o.JunkCount > 0 {
+			if err := b.Bind.Send(o.junk(), ep); err != nil {
+				b.device.log.Verbosef("Failed to send junk packets: %v", err)
+			}
+		}
+		return b.Bind.Send(out, ep)
+	}
+	if decoy != nil {
+		return b.sendDecoys(decoy, ep, send)
+	}
+	return send()
+}
+
+// isInitiation reports whether buf is a plain handshake initiation.
+func isInitiation(buf []byte) bool {
+	return len(buf) == MessageInitiationSize && binary.LittleEndian.Uint32(buf) == MessageInitiationType
+}
+
+// sendState is what obfuscatingBind does to the packets sent to one
+// address: apply the obfuscation and send the noise of the peer there.
+type sendState struct {
+	obfuscation *Obfuscation // Nil to send packets unchanged
+	decoy       *decoyState  // Nil for no noise
+}
+
+// maxSendStates bounds the addresses a generation of sendStates learns,
+// as it also keeps those of peers that moved on.
+const maxSendStates = 64
+
+// sendStates caches the sendState of each address the device sends to, so
+// the peer at an endpoint is looked up once rather than for every packet.
+// Changing the obfuscation, noise or endpoint of a peer starts a new
+// generation, which leaves the states learned before unused.
+type sendStates struct {
+	gen    atomic.Uint64
+	states atomic.Pointer[sendStateMap]
+}
+
+// sendStateMap holds the states learned during generation gen. It is
+// replaced, never changed.
+type sendStateMap struct {
+	gen uint64
+	m   map[netip.AddrPort]sendState
+}
+
+// invalidate starts a new generation. It takes no locks, so it can be
+// called with any held.
+func (s *sendStates) invalidate() {
+	s.gen.Add(1)
+}
+
+// sendStateFor returns what to do with the packets sent to ep.
+func (device *Device) sendStateFor(ep conn.Endpoint) sendState {
+	addr := endpointAddr(ep)
+	gen := device.sendStates.gen.Load()
+	cur := device.sendStates.states.Load()
+	if cur != nil && cur.gen == gen {
+		if s, ok := cur.m[addr]; ok {
+			return s
+		}
+	}
+
+	s := device.lookupSendState(ep)
+
+	m := make(map[netip.AddrPort]sendState)
+	if cur != nil && cur.gen == gen && len(cur.m) < maxSendStates {
+		for k, v := range cur.m {
+			m[k] = v
+		}
+	}
+	m[addr] = s
+	// If the generation changed during the lookup, s is stored under the
+	// old one and only used for this send. Losing the swap to another
+	// lookup only costs a lookup later.
+	device.sendStates.states.CompareAndSwap(cur, &sendStateMap{gen: gen, m: m})
+	return s
+}
+
+// lookupSendState finds the peer at ep and returns its sendState.
+func (device *Device) lookupSendState(ep conn.Endpoint) sendState {
+	device.obfuscation.Lock()
+	obfuscations := device.obfuscation.peers
+	device.obfuscation.Unlock()
+	device.decoys.Lock()
+	decoys := device.decoys.peers
+	device.decoys.Unlock()
+
+	var s sendState
+	if len(obfuscations) == 0 && len(decoys) == 0 {
+		return s
+	}
+
+	device.peers.RLock()
+	defer device.peers.RUnlock()
+	for pk, o := range obfuscations {
+		if device.isPeerEndpoint(pk, ep) {
+			s.obfuscation = &o
+			break
+		}
+	}
+	for pk, d := range decoys {
+		if device.isPeerEndpoint(pk, ep) {
+			s.decoy = d
+			break
+		}
+	}
+	return s
+}
+
+// endpointAddr returns the address packets to ep are sent to.
+func endpointAddr(ep conn.Endpoint) netip.AddrPort {
+	if e, ok := ep.(*conn.StdNetEndpoint); ok {
+		return e.AddrPort
+	}
+	addr, _ := netip.ParseAddrPort(ep.DstToString())
+	return addr
+}
+
+// isPeerEndpoint reports whether the peer with key pk sends to ep. The
+// caller must hold device.peers.
+func (device *Device) isPeerEndpoint(pk NoisePublicKey, ep conn.Endpoint) bool {
+	peer := device.peers.keyMap[pk]
+	if peer == nil {
+		return false
+	}
+	peer.endpoint.Lock()
+	defer peer.endpoint.Unlock()
+	return peer.endpoint.val == ep
+}
@@ -0,0 +1,143 @@
+package device
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+var testObfuscation = Obfuscation{
+	JunkCount:       3,
+	JunkMin:         40,
+	JunkMax:         70,
+	InitPadding:     15,
+	ResponsePadding: 18,
+	InitHeader:      1234567,
+	ResponseHeader:  2345678,
+	CookieHeader:    3456789,
+	TransportHeader: 4567890,
+}
+
+func testMessage(msgType uint32, size int) []byte {
+	msg := make([]byte, size)
+	for i := range msg {
+		msg[i] = byte(i)
+	}
+	binary.LittleEndian.PutUint32(msg, msgType)
+	return msg
+}
+
+func TestObfuscationRoundTrip(t *testing.T) {
+	table, err := newObfuscationTable(map[NoisePublicKey]Obfuscation{{1}: testObfuscation})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		msgType uint32
+		size    int
+		header  uint32
+		padding int
+	}{
+		{MessageInitiationType, MessageInitiationSize, testObfuscation.InitHeader, testObfuscation.InitPadding},
+		{MessageResponseType, MessageResponseSize, testObfuscation.ResponseHeader, testObfuscation.ResponsePadding},
+		{MessageCookieReplyType, MessageCookieReplySize, testObfuscation.CookieHeader, 0},
+		{MessageTransportType, 200, testObfuscation.TransportHeader, 0},
+	}
+	for _, tt := range tests {
+		want := testMessage(tt.msgType, tt.size)
+		o := testObfuscation
+		sent := o.obfuscate(bytes.Clone(want))
+
+		if len(sent) != tt.size+tt.padding {
+			t.Errorf("type %d: sent %d bytes, want %d", tt.msgType, len(sent), tt.size+tt.padding)
+			continue
+		}
+		if h := binary.LittleEndian.Uint32(sent[tt.padding:]); h != tt.header {
+			t.Errorf("type %d: sent header %d, want %d", tt.msgType, h, tt.header)
+		}
+
+		n := table.deobfuscate(sent)
+		if !bytes.Equal(sent[:n], want) {
+			t.Errorf("type %d: received %x, want %x", tt.msgType, sent[:n], want)
+		}
+	}
+}
+
+func TestObfuscationPlainPassesThrough(t *testing.T) {
+	table, err := newObfuscationTable(map[NoisePublicKey]Obfuscation{{1}: testObfuscation})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, msg := range [][]byte{
+		testMessage(MessageInitiationType, MessageInitiationSize),
+		testMessage(MessageTransportType, 100),
+		{1, 2},
+	} {
+		want := bytes.Clone(msg)
+		if n := table.deobfuscate(msg); !bytes.Equal(msg[:n], want) {
+			t.Errorf("plain message changed to %x", msg[:n])
+		}
+	}
+}
+
+func TestObfuscationJunk(t *testing.T) {
+	o := testObfuscation
+	junk := o.junk()
+	if len(junk) != o.JunkCount {
+		t.Fatalf("got %d junk packets, want %d", len(junk), o.JunkCount)
+	}
+	for _, p := range junk {
+		if len(p) < o.JunkMin || len(p) > o.JunkMax {
+			t.Errorf("junk packet of %d bytes, want %d to %d", len(p), o.JunkMin, o.JunkMax)
+		}
+	}
+}
+
+func TestObfuscationValidate(t *testing.T) {
+	tests := []struct {
+		name string
+		o    Obfuscation
+		ok   bool
+	}{
+		{"zero", Obfuscation{}, true},
+		{"full", testObfuscation, true},
+		{"junk only", Obfuscation{JunkCount: 4, JunkMin: 40, JunkMax: 70}, true},
+		{"jmin above jmax", Obfuscation{JunkCount: 4, JunkMin: 70, JunkMax: 40}, false},
+		{"junk without size", Obfuscation{JunkCount: 4}, false},
+		{"same handshake sizes", Obfuscation{InitPadding: 10, ResponsePadding: 66}, false},
+		{"standard header", Obfuscation{InitHeader: 2}, false},
+		{"repeated header", Obfuscation{InitHeader: 100, TransportHeader: 100}, false},
+	}
+	for _, tt := range tests {
+		if err := tt.o.Validate(); (err == nil) != tt.ok {
+			t.Errorf("%s: got error %v, want ok %t", tt.name, err, tt.ok)
+		}
+	}
+}
+
+func TestObfuscationTableConflict(t *testing.T) {
+	other := testObfuscation
+	other.InitHeader, other.TransportHeader = testObfuscation.TransportHeader, testObfuscation.InitHeader
+	_, err := newObfuscationTable(map[NoisePublicKey]Obfuscation{{1}: testObfuscation, {2}: other})
+	if err == nil {
+		t.Fatal("swapped headers across peers should conflict")
+	}
+}
+
+func TestObfuscationUAPI(t *testing.T) {
+	var o Obfuscation
+	for _, line := range bytes.Split([]byte(testObfuscation.UAPI()), []byte("\n")) {
+		key, value, ok := bytes.Cut(line, []byte("="))
+		if !ok {
+			continue
+		}
+		if err := o.Set(string(key), string(value)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if o != testObfuscation {
+		t.Errorf("got %+v after a UAPI round trip, want %+v", o, testObfuscation)
+	}
+}
@@ -0,0 +1,173 @@
+package device
+
+import (
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// PeerStats is the state of a peer, as reported by the UAPI get operation.
+type PeerStats struct {
+	PublicKey           NoisePublicKey
+	Endpoint            string    // Empty if the peer has no endpoint yet
+	LastHandshake       time.Time // Zero if no handshake completed yet
+	RxBytes             uint64
+	TxBytes             uint64
+	PersistentKeepalive time.Duration // Zero if disabled
+	AllowedIPs          []netip.Prefix
+}
+
+// PeerStats returns the state of every peer of the device.
+func (device *Device) PeerStats() []PeerStats {
+	device.peers.RLock()
+	defer device.peers.RUnlock()
+
+	stats := make([]PeerStats, 0, len(device.peers.keyMap))
+	for _, peer := range device.peers.keyMap {
+		stats = append(stats, peer.stats())
+	}
+	return stats
+}
+
+// PeerStatsFor returns the state of the peer with the given public key, and
+// false if the device has no such peer.
+func (device *Device) PeerStatsFor(pk NoisePublicKey) (PeerStats, bool) {
+	peer := device.LookupPeer(pk)
+	if peer == nil {
+		return PeerStats{}, false
+	}
+	return peer.stats(), true
+}
+
+// stats returns the state of peer.
+func (peer *Peer) stats() PeerStats {
+	var s PeerStats
+
+	peer.handshake.mutex.RLock()
+	s.PublicKey = peer.handshake.remoteStatic
+	peer.handshake.mutex.RUnlock()
+
+	peer.endpoint.Lock()
+	if peer.endpoint.val != nil {
+		s.Endpoint = peer.endpoint.val.DstToString()
+	}
+	peer.endpoint.Unlock()
+
+	if nano := peer.lastHandshakeNano.Load(); nano != 0 {
+		s.LastHandshake = time.Unix(0, nano)
+	}
+	s.RxBytes = peer.rxBytes.Load()
+	s.TxBytes = peer.txBytes.Load()
+	s.PersistentKeepalive = time.Duration(peer.persistentKeepaliveInterval.Load()) * time.Second
+
+	peer.device.allowedips.EntriesForPeer(peer, func(prefix netip.Prefix) bool {
+		s.AllowedIPs = append(s.AllowedIPs, prefix)
+		return true
+	})
+
+	return s
+}
+
+// PeerEventType is the kind of a PeerEvent.
+type PeerEventType int
+
+const (
+	// PeerHandshakeComplete fires when a session with the peer is established.
+	PeerHandshakeComplete PeerEventType = iota
+	// PeerHandshakeFailed fires when the device gives up on a handshake
+	// after MaxTimerHandshakes retries.
+	PeerHandshakeFailed
+	// PeerEndpointChanged fires when an endpoint is set through the UAPI.
+	// Roaming to the source of an authenticated packet doesn't fire it.
+	PeerEndpointChanged
+)
+
+func (t PeerEventType) String() string {
+	switch t {
+	case PeerHandshakeComplete:
+		return "handshake-complete"
+	case PeerHandshakeFailed:
+		return "handshake-failed"
+	case PeerEndpointChanged:
+		return "endpoint-changed"
+	default:
+		return "unknown"
+	}
+}
+
+// PeerEvent is a change in the state of a peer.
+type PeerEvent struct {
+	Type      PeerEventType
+	PublicKey NoisePublicKey
+	Time      time.Time
+	Endpoint  string // New endpoint for PeerEndpointChanged
+}
+
+// peerEventQueueSize bounds the events waiting for handlers. Events are
+// dropped rather than stalling the data path once it fills.
+const peerEventQueueSize = 64
+
+// peerEvents dispatches peer events to the registered handlers.
+type peerEvents struct {
+	sync.Mutex
+	handlers []func(PeerEvent)
+	queue    chan PeerEvent // nil until the first handler is added
+}
+
+// OnPeerEvent registers h to be called for every peer event. Handlers are
+// called in order from a single goroutine, so they may call back into the
+// device, but a slow handler delays the ones after it.
+func (device *Device) OnPeerEvent(h func(PeerEvent)) {
+	device.events.Lock()
+	defer device.events.Unlock()
+
+	device.events.handlers = append(device.events.handlers, h)
+	if device.events.queue == nil {
+		device.events.queue = make(chan PeerEvent, peerEventQueueSize)
+		go device.routinePeerEvents(device.events.queue)
+	}
+}
+
+// routinePeerEvents calls the handlers for each queued event until the
+// device closes.
+func (device *Device) routinePeerEvents(queue <-chan PeerEvent) {
+	for {
+		select {
+		case <-device.closed:
+			return
+		case e := <-queue:
+			device.events.Lock()
+			handlers := device.events.handlers
+			device.events.Unlock()
+
+			for _, h := range handlers {
+				h(e)
+			}
+		}
+	}
+}
+
+// firePeerEvent queues an event of type t for peer. It never blocks, so it
+// is safe to call with the peer's locks held.
+func (peer *Peer) firePeerEvent(t PeerEventType, endpoint string) {
+	device := peer.device
+
+	device.events.Lock()
+	queue := device.events.queue
+	device.events.Unlock()
+	if queue == nil {
+		return
+	}
+
+	e := PeerEvent{
+		Type:      t,
+		PublicKey: peer.handshake.remoteStatic,
+		Time:      time.Now(),
+		Endpoint:  endpoint,
+	}
+	select {
+	case queue <- e:
+	default:
+		device.log.Verbosef("%v - Dropping %v event, queue full", peer, t)
+	}
+}
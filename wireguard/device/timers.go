@@ -71,7 +71,34 @@ func (peer *Peer) timersActive() bool {
 
 // expiredRetransmitHandshake handles the expiration of the retransmitHandshake timer.
 func expiredRetransmitHandshake(peer *Peer) {
-	// ... (rest of the code)
+	if peer.timers.handshakeAttempts.Load() > MaxTimerHandshakes {
+		peer.device.log.Verbosef("%s - Handshake did not complete after %d attempts, giving up", peer, MaxTimerHandshakes+2)
+		peer.firePeerEvent(PeerHandshakeFailed, "")
+
+		if peer.timersActive() {
+			peer.timers.sendKeepalive.Del()
+		}
+
+		/* We drop all packets without a keypair and don't try again,
+		 * if we try unsuccessfully for too long to make a handshake.
+		 */
+		peer.FlushStagedPackets()
+
+		/* We set a timer for destroying any residue that might be left
+		 * of a partial exchange.
+		 */
+		if peer.timersActive() && !peer.timers.zeroKeyMaterial.IsPending() {
+			peer.timers.zeroKeyMaterial.Mod(RejectAfterTime * 3)
+		}
+	} else {
+		peer.timers.handshakeAttempts.Add(1)
+		peer.device.log.Verbosef("%s - Handshake did not complete after %d seconds, retrying (try %d)", peer, int(RekeyTimeout.Seconds()), peer.timers.handshakeAttempts.Load()+1)
+
+		/* We clear the endpoint address src address, in case this is the cause of trouble. */
+		peer.markEndpointSrcForClearing()
+
+		peer.SendHandshakeInitiation(true)
+	}
 }
 
 // expiredSendKeepalive handles the expiration of the sendKeepalive timer.
@@ -119,7 +119,8 @@ func (device *Device) IpcGetOperation(w io.Writer) error {
 			sendf("tx_bytes=%d", peer.txBytes.Load())
 			sendf("rx_bytes=%d", peer.rxBytes.Load())
 			sendf("persistent_keepalive_interval=%d", peer.persistentKeepaliveInterval.Load())
-			sendf("trick=%t", peer.trick)
+			buf.WriteString(device.PeerObfuscation(peer.handshake.remoteStatic).UAPI())
+			buf.WriteString(device.PeerDecoy(peer.handshake.remoteStatic).UAPI())
 
 			device.allowedips.EntriesForPeer(peer, func(prefix netip.Prefix) bool {
 				sendf("allowed_ip=%s", prefix.String())
@@ -156,8 +157,7 @@ func (device *Device) IpcSetOperation(r io.Reader) (err error) {
 		line := scanner.Text()
 		if line == "" {
 			// Blank line means terminate operation.
-			peer.handlePostConfig()
-			return nil
+			return peer.handlePostConfig()
 		}
 		key, value, ok := strings.Cut(line, "=")
 		if !ok {
@@ -168,7 +168,9 @@ func (device *Device) IpcSetOperation(r io.Reader) (err error) {
 			if deviceConfig {
 				deviceConfig = false
 			}
-			peer.handlePostConfig()
+			if err := peer.handlePostConfig(); err != nil {
+				return err
+			}
 			// Load/create the peer we are now configuring.
 			err := device.handlePublicKeyLine(peer, value)
 			if err != nil {
@@ -187,7 +189,9 @@ func (device *Device) IpcSetOperation(r io.Reader) (err error) {
 			return err
 		}
 	}
-	peer.handlePostConfig()
+	if err := peer.handlePostConfig(); err != nil {
+		return err
+	}
 
 	if err := scanner.Err(); err != nil {
 		return ipcErrorf(ipc.IpcErrorIO, "failed to read input: %w", err)
@@ -254,11 +258,28 @@ type ipcSetPeer struct {
 	dummy   bool // dummy reports whether this peer is a temporary, placeholder peer
 	created bool // new reports whether this is a newly created peer
 	pkaOn   bool // pkaOn reports whether the peer had the persistent keepalive turn on
+
+	obfuscation *Obfuscation // obfuscation is the peer's changed obfuscation, nil if unchanged
+	decoy       *Decoy       // decoy is the peer's changed noise, nil if unchanged
 }
 
-func (peer *ipcSetPeer) handlePostConfig() {
+func (peer *ipcSetPeer) handlePostConfig() error {
 	if peer.Peer == nil || peer.dummy {
-		return
+		return nil
+	}
+	if peer.obfuscation != nil {
+		err := peer.device.setPeerObfuscation(peer.handshake.remoteStatic, *peer.obfuscation)
+		peer.obfuscation = nil
+		if err != nil {
+			return ipcErrorf(ipc.IpcErrorInvalid, "failed to set obfuscation: %w", err)
+		}
+	}
+	if peer.decoy != nil {
+		err := peer.device.setPeerDecoy(peer.handshake.remoteStatic, *peer.decoy)
+		peer.decoy = nil
+		if err != nil {
+			return ipcErrorf(ipc.IpcErrorInvalid, "failed to set noise: %w", err)
+		}
 	}
 	if peer.created {
 		peer.endpoint.disableRoaming = peer.device.net.brokenRoaming && peer.endpoint.val != nil
@@ -270,6 +291,7 @@ func (peer *ipcSetPeer) handlePostConfig() {
 		}
 		peer.SendStagedPackets()
 	}
+	return nil
 }
 
 func (device *Device) handlePublicKeyLine(peer *ipcSetPeer, value string) error {
@@ -347,6 +369,10 @@ func (device *Device) handlePeerLine(peer *ipcSetPeer, key, value string) error
 		peer.endpoint.Lock()
 		defer peer.endpoint.Unlock()
 		peer.endpoint.val = endpoint
+		device.sendStates.invalidate()
+		if !peer.created && !peer.dummy {
+			peer.firePeerEvent(PeerEndpointChanged, endpoint.DstToString())
+		}
 
 	case "persistent_keepalive_interval":
 		device.log.Verbosef("%v - UAPI: Updating persistent keepalive interval", peer.Peer)
@@ -388,12 +414,42 @@ func (device *Device) handlePeerLine(peer *ipcSetPeer, key, value string) error
 		}
 
 	case "trick":
+		// Kept for older callers, it stands for the default noise.
 		device.log.Verbosef("%v - UAPI: Setting trick: %s", peer.Peer, value)
 		parsedBool, err := strconv.ParseBool(value)
 		if err != nil {
 			return ipcErrorf(ipc.IpcErrorInvalid, "invalid trick value: %v", value)
 		}
-		peer.trick = parsedBool
+		peer.decoy = new(Decoy)
+		if parsedBool {
+			*peer.decoy = DefaultDecoy
+		}
+
+	case "noise_count", "noise_size", "noise_delay", "noise_pattern", "noise_when", "noise_port":
+		device.log.Verbosef("%v - UAPI: Setting %s: %s", peer.Peer, key, value)
+		if peer.dummy {
+			return nil
+		}
+		if peer.decoy == nil {
+			d := device.PeerDecoy(peer.handshake.remoteStatic)
+			peer.decoy = &d
+		}
+		if err := peer.decoy.Set(strings.TrimPrefix(key, "noise_"), value); err != nil {
+			return ipcErrorf(ipc.IpcErrorInvalid, "invalid %s value: %v", key, value)
+		}
+
+	case "jc", "jmin", "jmax", "s1", "s2", "h1", "h2", "h3", "h4":
+		device.log.Verbosef("%v - UAPI: Setting %s: %s", peer.Peer, key, value)
+		if peer.dummy {
+			return nil
+		}
+		if peer.obfuscation == nil {
+			o := device.PeerObfuscation(peer.handshake.remoteStatic)
+			peer.obfuscation = &o
+		}
+		if err := peer.obfuscation.Set(key, value); err != nil {
+			return ipcErrorf(ipc.IpcErrorInvalid, "invalid %s value: %v", key, value)
+		}
 
 	default:
 		return ipcErrorf(ipc.IpcErrorInvalid, "invalid UAPI peer key: %v", key)
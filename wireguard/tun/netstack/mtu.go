@@ -0,0 +1,63 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2023 WireGuard LLC. All Rights Reserved.
+ */
+
+package netstack
+
+import (
+	"errors"
+	"sync/atomic"
+
+	"github.com/bepass-org/warp-plus/wireguard/tun"
+	"gvisor.dev/gvisor/pkg/buffer"
+	"gvisor.dev/gvisor/pkg/tcpip/link/channel"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+)
+
+// mtuEndpoint is a channel endpoint whose MTU can change while the stack
+// runs. The network endpoints ask the NIC for its MTU on every packet they
+// send, and TCP connections when they are opened.
+type mtuEndpoint struct {
+	*channel.Endpoint
+	mtu atomic.Uint32
+}
+
+func newMTUEndpoint(size int, mtu uint32) *mtuEndpoint {
+	ep := &mtuEndpoint{Endpoint: channel.New(size, mtu, "")}
+	ep.mtu.Store(mtu)
+	return ep
+}
+
+// MTU implements stack.LinkEndpoint.MTU.
+func (e *mtuEndpoint) MTU() uint32 {
+	return e.mtu.Load()
+}
+
+// SetMTU changes the MTU of the device. Packets the stack sends from now on
+// fit it, as do the segments of TCP connections opened from now on.
+func (net *Net) SetMTU(mtu int) {
+	net.ep.mtu.Store(uint32(mtu))
+	select {
+	case net.events <- tun.EventMTUUpdate:
+	default:
+	}
+}
+
+// WriteRaw sends the IP packet pkt out of the device as if the stack had
+// sent it, regardless of the MTU. Replies to it reach the stack as usual.
+func (net *Net) WriteRaw(pkt []byte) error {
+	pb := stack.NewPacketBuffer(stack.PacketBufferOptions{Payload: buffer.MakeWithData(pkt)})
+	defer pb.DecRef()
+
+	var pkts stack.PacketBufferList
+	pkts.PushBack(pb)
+	n, err := net.ep.WritePackets(pkts)
+	if err != nil {
+		return errors.New(err.String())
+	}
+	if n == 0 {
+		return errors.New("outbound queue full")
+	}
+	return nil
+}
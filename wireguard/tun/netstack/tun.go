@@ -10,11 +10,10 @@ import (
 
 // netTun represents a network TUN device.
 type netTun struct {
-	ep             *channel.Endpoint
+	ep             *mtuEndpoint
 	stack          *stack.Stack
 	events         chan tun.Event
 	incomingPacket chan *buffer.View
-	mtu            int
 	dnsServers     []netip.Addr
 	hasV4, hasV6   bool // hasV4 and hasV6 indicate whether the device has IPv4 and IPv6 support, respectively.
 }
@@ -23,8 +22,60 @@ type netTun struct {
 type Net netTun
 
 // CreateNetTUN creates a new netTun device with the given localAddresses and dnsServers.
+// Its MTU can be changed later with SetMTU.
 func CreateNetTUN(localAddresses, dnsServers []netip.Addr, mtu int) (tun.Device, *Net, error) {
-	// ... (function body)
+	opts := stack.Options{
+		NetworkProtocols:   []stack.NetworkProtocolFactory{ipv4.NewProtocol, ipv6.NewProtocol},
+		TransportProtocols: []stack.TransportProtocolFactory{tcp.NewProtocol, udp.NewProtocol, icmp.NewProtocol6, icmp.NewProtocol4},
+		HandleLocal:        true,
+	}
+	dev := &netTun{
+		ep:             newMTUEndpoint(1024, uint32(mtu)),
+		stack:          stack.New(opts),
+		events:         make(chan tun.Event, 10),
+		incomingPacket: make(chan *buffer.View),
+		dnsServers:     dnsServers,
+	}
+	sackEnabledOpt := tcpip.TCPSACKEnabled(true) // TCP SACK is disabled by default
+	tcpipErr := dev.stack.SetTransportProtocolOption(tcp.ProtocolNumber, &sackEnabledOpt)
+	if tcpipErr != nil {
+		return nil, nil, fmt.Errorf("could not enable TCP SACK: %v", tcpipErr)
+	}
+	dev.ep.AddNotify(dev)
+	tcpipErr = dev.stack.CreateNIC(1, dev.ep)
+	if tcpipErr != nil {
+		return nil, nil, fmt.Errorf("CreateNIC: %v", tcpipErr)
+	}
+	for _, ip := range localAddresses {
+		var protoNumber tcpip.NetworkProtocolNumber
+		if ip.Is4() {
+			protoNumber = ipv4.ProtocolNumber
+		} else if ip.Is6() {
+			protoNumber = ipv6.ProtocolNumber
+		}
+		protoAddr := tcpip.ProtocolAddress{
+			Protocol:          protoNumber,
+			AddressWithPrefix: tcpip.AddrFromSlice(ip.AsSlice()).WithPrefix(),
+		}
+		tcpipErr := dev.stack.AddProtocolAddress(1, protoAddr, stack.AddressProperties{})
+		if tcpipErr != nil {
+			return nil, nil, fmt.Errorf("AddProtocolAddress(%v): %v", ip, tcpipErr)
+		}
+		if ip.Is4() {
+			dev.hasV4 = true
+		} else if ip.Is6() {
+			dev.hasV6 = true
+		}
+	}
+	if dev.hasV4 {
+		dev.stack.AddRoute(tcpip.Route{Destination: header.IPv4EmptySubnet, NIC: 1})
+	}
+	if dev.hasV6 {
+		dev.stack.AddRoute(tcpip.Route{Destination: header.IPv6EmptySubnet, NIC: 1})
+	}
+
+	dev.events <- tun.EventUp
+	return dev, (*Net)(dev), nil
 }
 
 // Name returns the name of the device.
@@ -64,7 +115,7 @@ func (tun *netTun) Close() error {
 
 // MTU returns the MTU of the device.
 func (tun *netTun) MTU() (int, error) {
-	// ... (function body)
+	return int(tun.ep.MTU()), nil
 }
 
 // BatchSize returns the batch size of the device.
@@ -82,6 +133,13 @@ func (net *Net) DialContextTCPAddrPort(ctx context.Context, addr netip.AddrPort)
 	// ... (function body)
 }
 
+// DialContextTCPAddrPortFrom dials a TCP connection to the given addr from the local address laddr.
+func (net *Net) DialContextTCPAddrPortFrom(ctx context.Context, laddr, addr netip.AddrPort) (*gonet.TCPConn, error) {
+	lfa, _ := convertToFullAddr(laddr)
+	fa, pn := convertToFullAddr(addr)
+	return gonet.DialTCPWithBind(ctx, net.stack, lfa, fa, pn)
+}
+
 // DialContextTCP dials a TCP connection to the given *net.TCPAddr.
 func (net *Net) DialContextTCP(ctx context.Context, addr *net.TCPAddr) (*gonet.TCPConn, error) {
 	// ... (function body)
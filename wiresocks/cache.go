@@ -0,0 +1,278 @@
+package wiresocks
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/netip"
+	"os"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/bepass-org/warp-plus/ipscanner"
+	"github.com/go-ini/ini"
+)
+
+// rttHistorySize is the number of RTT samples kept per cached endpoint.
+const rttHistorySize = 10
+
+// CachedEndpoint is the scan history of a single endpoint.
+type CachedEndpoint struct {
+	AddrPort  netip.AddrPort  `json:"addr_port"`
+	RTTs      []time.Duration `json:"rtts"`
+	Failures  int             `json:"failures"`
+	FirstSeen time.Time       `json:"first_seen"`
+	LastSeen  time.Time       `json:"last_seen"`
+}
+
+// MedianRTT returns the median of the recorded RTT samples.
+func (e *CachedEndpoint) MedianRTT() time.Duration {
+	if len(e.RTTs) == 0 {
+		return 0
+	}
+	rtts := slices.Clone(e.RTTs)
+	slices.Sort(rtts)
+	return rtts[len(rtts)/2]
+}
+
+// score orders endpoints for reuse, lower is better. It is the scanner's
+// score of the RTT history, with the failures since the last success as
+// lost probes.
+func (e *CachedEndpoint) score() time.Duration {
+	return ipscanner.NewIPInfoFromSamples(e.AddrPort, e.RTTs, len(e.RTTs)+e.Failures).Score()
+}
+
+// ScanCache persists scan results so later runs can start from endpoints
+// that worked before instead of a full scan.
+type ScanCache struct {
+	Endpoints map[netip.AddrPort]*CachedEndpoint `json:"endpoints"`
+
+	path string
+	mu   sync.Mutex
+}
+
+// LoadScanCache reads the cache at path. A missing file yields an empty cache.
+func LoadScanCache(path string) (*ScanCache, error) {
+	c := &ScanCache{
+		Endpoints: make(map[netip.AddrPort]*CachedEndpoint),
+		path:      path,
+	}
+
+	b, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(b, c); err != nil {
+		return nil, err
+	}
+	if c.Endpoints == nil {
+		c.Endpoints = make(map[netip.AddrPort]*CachedEndpoint)
+	}
+
+	return c, nil
+}
+
+// Save writes the cache back to the path it was loaded from.
+func (c *ScanCache) Save() error {
+	c.mu.Lock()
+	b, err := json.MarshalIndent(c, "", "    ")
+	c.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(c.path, b, 0o644)
+}
+
+// RecordSuccess adds an RTT sample for addr.
+func (c *ScanCache) RecordSuccess(addr netip.AddrPort, rtt time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e := c.entry(addr)
+	e.RTTs = append(e.RTTs, rtt)
+	if len(e.RTTs) > rttHistorySize {
+		e.RTTs = e.RTTs[len(e.RTTs)-rttHistorySize:]
+	}
+	e.Failures = 0
+	e.LastSeen = time.Now()
+}
+
+// RecordFailure counts a failed probe of addr, if it is cached. Endpoints
+// that never answered aren't worth remembering.
+func (c *ScanCache) RecordFailure(addr netip.AddrPort) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.Endpoints[addr]; ok {
+		e.Failures++
+	}
+}
+
+// Best returns up to n endpoints seen within maxAge, best first.
+func (c *ScanCache) Best(n int, maxAge time.Duration) []CachedEndpoint {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var res []CachedEndpoint
+	for _, e := range c.Endpoints {
+		if len(e.RTTs) == 0 || time.Since(e.LastSeen) > maxAge {
+			continue
+		}
+		res = append(res, *e)
+	}
+
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].score() < res[j].score()
+	})
+
+	if len(res) > n {
+		res = res[:n]
+	}
+	return res
+}
+
+// Prune drops endpoints that failed maxFailures times in a row.
+func (c *ScanCache) Prune(maxFailures int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for addr, e := range c.Endpoints {
+		if e.Failures >= maxFailures {
+			delete(c.Endpoints, addr)
+		}
+	}
+}
+
+// entry returns the entry for addr, creating it if needed. c.mu must be held.
+func (c *ScanCache) entry(addr netip.AddrPort) *CachedEndpoint {
+	e, ok := c.Endpoints[addr]
+	if !ok {
+		e = &CachedEndpoint{AddrPort: addr, FirstSeen: time.Now()}
+		c.Endpoints[addr] = e
+	}
+	return e
+}
+
+// cacheMaxAge is how long a cached endpoint stays a candidate for reuse.
+const cacheMaxAge = 24 * time.Hour
+
+// RunCachedScan returns endpoints from the scan cache at opts.Cache if enough
+// of them still answer a quick handshake, and refreshes the cache with a full
+// scan in the background. Without usable cached endpoints it falls back to a
+// regular RunScan and stores its results.
+func RunCachedScan(ctx context.Context, l *slog.Logger, opts ScanOptions) ([]ipscanner.IPInfo, error) {
+	if opts.Cache == "" {
+		return RunScan(ctx, l, opts)
+	}
+
+	cache, err := LoadScanCache(opts.Cache)
+	if err != nil {
+		l.Warn("ignoring unreadable scan cache", "path", opts.Cache, "error", err)
+		cache = &ScanCache{Endpoints: make(map[netip.AddrPort]*CachedEndpoint), path: opts.Cache}
+	}
+
+	privateKey, publicKey, err := profileKeys(opts.profile())
+	if err != nil {
+		return nil, err
+	}
+
+	res := validateCached(ctx, cache, opts, privateKey, publicKey)
+	if len(res) > 1 {
+		l.Info("using cached scan results", "endpoints", len(res))
+		go func() {
+			if _, err := scanAndCache(ctx, l, opts, cache); err != nil {
+				l.Warn("background scan failed", "error", err)
+			}
+		}()
+		return res, nil
+	}
+
+	l.Info("no usable cached endpoints, running full scan")
+	return scanAndCache(ctx, l, opts, cache)
+}
+
+// validateCached re-checks the best cached endpoints concurrently and
+// returns the ones that are still within opts.MaxRTT, fastest first.
+func validateCached(ctx context.Context, cache *ScanCache, opts ScanOptions, privateKey, publicKey string) []ipscanner.IPInfo {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	candidates := cache.Best(10, cacheMaxAge)
+
+	var (
+		mu  sync.Mutex
+		wg  sync.WaitGroup
+		res []ipscanner.IPInfo
+	)
+	for _, c := range candidates {
+		addr := c.AddrPort
+		if (addr.Addr().Is4() && !opts.V4) || (addr.Addr().Is6() && !opts.V6) {
+			continue
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			rtt, err := ipscanner.ValidateWarpEndpoint(ctx, addr, privateKey, publicKey)
+			if err != nil || rtt > opts.MaxRTT {
+				cache.RecordFailure(addr)
+				return
+			}
+			cache.RecordSuccess(addr, rtt)
+
+			mu.Lock()
+			res = append(res, ipscanner.IPInfo{AddrPort: addr, RTT: rtt, CreatedAt: time.Now()})
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].RTT < res[j].RTT
+	})
+
+	return res
+}
+
+// scanAndCache runs a full scan and stores its results in cache, counting
+// the failed probes of cached endpoints so those that stopped answering
+// are pruned.
+func scanAndCache(ctx context.Context, l *slog.Logger, opts ScanOptions, cache *ScanCache) ([]ipscanner.IPInfo, error) {
+	res, err := runScan(ctx, l, opts, cache.RecordFailure)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, r := range res {
+		cache.RecordSuccess(r.AddrPort, r.RTT)
+	}
+	cache.Prune(3)
+
+	if err := cache.Save(); err != nil {
+		l.Warn("unable to save scan cache", "path", opts.Cache, "error", err)
+	}
+
+	return res, nil
+}
+
+// profileKeys reads the interface private key and peer public key from a
+// WireGuard profile.
+func profileKeys(profile string) (privateKey, publicKey string, err error) {
+	cfg, err := ini.Load(profile)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to read file: %w", err)
+	}
+
+	privateKey = cfg.Section("Interface").Key("PrivateKey").String()
+	publicKey = cfg.Section("Peer").Key("PublicKey").String()
+	return privateKey, publicKey, nil
+}
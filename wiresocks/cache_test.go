@@ -0,0 +1,67 @@
+package wiresocks
+
+import (
+	"net/netip"
+	"path/filepath"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestScanCacheBest(t *testing.T) {
+	cache, err := LoadScanCache(filepath.Join(t.TempDir(), "scan-cache.json"))
+	qt.Assert(t, err, qt.IsNil)
+
+	fast := netip.MustParseAddrPort("162.159.192.1:2408")
+	slow := netip.MustParseAddrPort("162.159.192.2:2408")
+	flaky := netip.MustParseAddrPort("162.159.192.3:2408")
+
+	cache.RecordSuccess(fast, 50*time.Millisecond)
+	cache.RecordSuccess(slow, 300*time.Millisecond)
+	cache.RecordSuccess(flaky, 10*time.Millisecond)
+	cache.RecordFailure(flaky)
+
+	best := cache.Best(2, time.Hour)
+	qt.Assert(t, best, qt.HasLen, 2)
+	qt.Assert(t, best[0].AddrPort, qt.Equals, fast)
+	qt.Assert(t, best[1].AddrPort, qt.Equals, slow)
+}
+
+func TestScanCacheSaveLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "scan-cache.json")
+	cache, err := LoadScanCache(path)
+	qt.Assert(t, err, qt.IsNil)
+
+	addr := netip.MustParseAddrPort("[2606:4700:d0::1]:500")
+	for _, rtt := range []time.Duration{30, 10, 20} {
+		cache.RecordSuccess(addr, rtt*time.Millisecond)
+	}
+	qt.Assert(t, cache.Save(), qt.IsNil)
+
+	loaded, err := LoadScanCache(path)
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, loaded.Endpoints, qt.HasLen, 1)
+	qt.Assert(t, loaded.Endpoints[addr].MedianRTT(), qt.Equals, 20*time.Millisecond)
+}
+
+func TestScanCachePrune(t *testing.T) {
+	cache, err := LoadScanCache(filepath.Join(t.TempDir(), "scan-cache.json"))
+	qt.Assert(t, err, qt.IsNil)
+
+	good := netip.MustParseAddrPort("162.159.192.1:2408")
+	gone := netip.MustParseAddrPort("162.159.192.2:2408")
+	unknown := netip.MustParseAddrPort("162.159.192.3:2408")
+
+	cache.RecordSuccess(good, 50*time.Millisecond)
+	cache.RecordSuccess(gone, 50*time.Millisecond)
+	for i := 0; i < 3; i++ {
+		cache.RecordFailure(gone)
+		cache.RecordFailure(unknown)
+	}
+	cache.RecordFailure(good)
+
+	cache.Prune(3)
+	qt.Assert(t, cache.Endpoints, qt.HasLen, 1)
+	qt.Assert(t, cache.Endpoints[good].Failures, qt.Equals, 1)
+}
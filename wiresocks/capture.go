@@ -0,0 +1,323 @@
+package wiresocks
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/bepass-org/warp-plus/wireguard/tun"
+)
+
+// CaptureOptions configures a capture of the packets inside the tunnel,
+// decrypted, as netstack sends and receives them.
+type CaptureOptions struct {
+	Path     string // pcapng file the capture is appended to
+	Filter   string // Filter expression, empty to capture every packet
+	MaxSize  int64  // Bytes after which the file is rotated, zero to never rotate
+	MaxFiles int    // Rotated files kept besides the current one
+}
+
+// Validate reports whether o describes a capture that can start.
+func (o CaptureOptions) Validate() error {
+	if o.Path == "" {
+		return errors.New("no capture file")
+	}
+	if o.MaxSize < 0 || o.MaxFiles < 0 {
+		return errors.New("capture rotation limits must not be negative")
+	}
+	if _, err := parseFilter(o.Filter); err != nil {
+		return fmt.Errorf("capture filter: %w", err)
+	}
+	return nil
+}
+
+// pcapng block types and options, from the pcapng specification.
+const (
+	pcapngSectionHeader  = 0x0a0d0d0a
+	pcapngInterface      = 0x00000001
+	pcapngEnhancedPacket = 0x00000006
+	pcapngByteOrder      = 0x1a2b3c4d
+
+	pcapngOptEnd     = 0
+	pcapngOptIfName  = 2 // In interface blocks
+	pcapngOptEPBFlag = 2 // In enhanced packet blocks
+
+	linkTypeRaw = 101 // Packets start with the IPv4 or IPv6 header
+)
+
+// captureDirection tells packets that came out of the tunnel from those
+// that go into it, as the inbound and outbound flags of pcapng.
+type captureDirection uint32
+
+const (
+	captureInbound  captureDirection = 1 // Received from peers, written to netstack
+	captureOutbound captureDirection = 2 // Read from netstack, sent to peers
+)
+
+// pcapngBlock returns a block of type typ around body, padded to 32 bits.
+func pcapngBlock(typ uint32, body []byte) []byte {
+	body = pcapngPad(body)
+	b := make([]byte, 0, len(body)+12)
+	b = binary.LittleEndian.AppendUint32(b, typ)
+	b = binary.LittleEndian.AppendUint32(b, uint32(len(body)+12))
+	b = append(b, body...)
+	return binary.LittleEndian.AppendUint32(b, uint32(len(body)+12))
+}
+
+// pcapngOption appends the option code with value to b, padded to 32 bits.
+func pcapngOption(b []byte, code uint16, value []byte) []byte {
+	b = binary.LittleEndian.AppendUint16(b, code)
+	b = binary.LittleEndian.AppendUint16(b, uint16(len(value)))
+	return pcapngPad(append(b, value...))
+}
+
+func pcapngPad(b []byte) []byte {
+	for len(b)%4 != 0 {
+		b = append(b, 0)
+	}
+	return b
+}
+
+// pcapngHeader returns the section header and the description of the
+// tunnel interface that start every capture.
+func pcapngHeader() []byte {
+	var shb []byte
+	shb = binary.LittleEndian.AppendUint32(shb, pcapngByteOrder)
+	shb = binary.LittleEndian.AppendUint16(shb, 1) // Version 1.0
+	shb = binary.LittleEndian.AppendUint16(shb, 0)
+	shb = binary.LittleEndian.AppendUint64(shb, ^uint64(0)) // Section length not given
+
+	var idb []byte
+	idb = binary.LittleEndian.AppendUint16(idb, linkTypeRaw)
+	idb = binary.LittleEndian.AppendUint16(idb, 0)
+	idb = binary.LittleEndian.AppendUint32(idb, 0) // No snap length
+	idb = pcapngOption(idb, pcapngOptIfName, []byte("tunnel"))
+	idb = pcapngOption(idb, pcapngOptEnd, nil)
+
+	return append(pcapngBlock(pcapngSectionHeader, shb), pcapngBlock(pcapngInterface, idb)...)
+}
+
+// pcapngPacket returns the enhanced packet block of pkt, captured at t
+// going dir, with a timestamp in microseconds.
+func pcapngPacket(t time.Time, dir captureDirection, pkt []byte) []byte {
+	ts := uint64(t.UnixMicro())
+	body := make([]byte, 0, len(pkt)+32)
+	body = binary.LittleEndian.AppendUint32(body, 0) // Interface
+	body = binary.LittleEndian.AppendUint32(body, uint32(ts>>32))
+	body = binary.LittleEndian.AppendUint32(body, uint32(ts))
+	body = binary.LittleEndian.AppendUint32(body, uint32(len(pkt))) // Captured
+	body = binary.LittleEndian.AppendUint32(body, uint32(len(pkt))) // Original
+	body = pcapngPad(append(body, pkt...))
+	body = pcapngOption(body, pcapngOptEPBFlag, binary.LittleEndian.AppendUint32(nil, uint32(dir)))
+	body = pcapngOption(body, pcapngOptEnd, nil)
+	return pcapngBlock(pcapngEnhancedPacket, body)
+}
+
+// captureWriter writes the packets that pass its filter to a pcapng file,
+// rotating it as its options say. A write error stops the capture.
+type captureWriter struct {
+	l      *slog.Logger
+	opts   CaptureOptions
+	filter packetFilter
+
+	mu   sync.Mutex
+	f    *os.File // Nil once closed
+	w    *bufio.Writer
+	size int64
+}
+
+func newCaptureWriter(l *slog.Logger, opts CaptureOptions) (*captureWriter, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+	filter, _ := parseFilter(opts.Filter)
+
+	c := &captureWriter{l: l, opts: opts, filter: filter}
+	if err := c.open(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// open appends a new section to the capture file. c.mu must be held, or
+// c not shared yet.
+func (c *captureWriter) open() error {
+	f, err := os.OpenFile(c.opts.Path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	c.f, c.w, c.size = f, bufio.NewWriter(f), fi.Size()
+
+	header := pcapngHeader()
+	if _, err := c.w.Write(header); err != nil {
+		f.Close()
+		return err
+	}
+	c.size += int64(len(header))
+	return c.w.Flush()
+}
+
+// capture writes the packets of bufs past offset that pass the filter.
+func (c *captureWriter) capture(dir captureDirection, bufs [][]byte, sizes []int, offset int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.f == nil {
+		return
+	}
+
+	now := time.Now()
+	err := func() error {
+		for i, buf := range bufs {
+			pkt := buf[offset:]
+			if sizes != nil {
+				pkt = pkt[:sizes[i]]
+			}
+			if p, ok := parsePacket(pkt); !ok || !c.filter(p) {
+				continue
+			}
+			b := pcapngPacket(now, dir, pkt)
+			if _, err := c.w.Write(b); err != nil {
+				return err
+			}
+			c.size += int64(len(b))
+
+			if c.opts.MaxSize > 0 && c.size >= c.opts.MaxSize {
+				if err := c.rotate(); err != nil {
+					return err
+				}
+			}
+		}
+		// Flush every batch, so the file can be followed while it grows.
+		return c.w.Flush()
+	}()
+	if err != nil {
+		c.l.Warn("capture stopped", "path", c.opts.Path, "error", err)
+		c.closeLocked()
+	}
+}
+
+// rotate moves the capture file aside, keeping opts.MaxFiles of those
+// moved before, and starts a new one. c.mu must be held.
+func (c *captureWriter) rotate() error {
+	if err := c.closeLocked(); err != nil {
+		return err
+	}
+
+	if err := os.Remove(rotatedPath(c.opts.Path, c.opts.MaxFiles)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	for i := c.opts.MaxFiles - 1; i >= 0; i-- {
+		err := os.Rename(rotatedPath(c.opts.Path, i), rotatedPath(c.opts.Path, i+1))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return c.open()
+}
+
+// rotatedPath returns the path of the capture file rotated n times, with
+// the number ahead of the extension so the file still opens as pcapng.
+func rotatedPath(path string, n int) string {
+	if n == 0 {
+		return path
+	}
+	ext := filepath.Ext(path)
+	return fmt.Sprintf("%s.%d%s", strings.TrimSuffix(path, ext), n, ext)
+}
+
+// Close flushes and closes the capture file.
+func (c *captureWriter) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.closeLocked()
+}
+
+func (c *captureWriter) closeLocked() error {
+	if c.f == nil {
+		return nil
+	}
+	err := c.w.Flush()
+	if cerr := c.f.Close(); err == nil {
+		err = cerr
+	}
+	c.f, c.w = nil, nil
+	return err
+}
+
+// captureTun wraps the netstack tun to capture the packets passing through
+// it while a capture runs.
+type captureTun struct {
+	tun.Device
+	writer atomic.Pointer[captureWriter]
+}
+
+// Read reads the packets netstack sends, capturing them as outbound.
+func (t *captureTun) Read(bufs [][]byte, sizes []int, offset int) (int, error) {
+	n, err := t.Device.Read(bufs, sizes, offset)
+	if c := t.writer.Load(); c != nil && n > 0 {
+		c.capture(captureOutbound, bufs[:n], sizes[:n], offset)
+	}
+	return n, err
+}
+
+// Write captures the packets passed to netstack as inbound.
+func (t *captureTun) Write(bufs [][]byte, offset int) (int, error) {
+	if c := t.writer.Load(); c != nil {
+		c.capture(captureInbound, bufs, nil, offset)
+	}
+	return t.Device.Write(bufs, offset)
+}
+
+// StartCapture starts capturing the packets inside the tunnel as opts
+// says, replacing the running capture if there is one.
+func (vt *VirtualTun) StartCapture(opts CaptureOptions) error {
+	if vt.capture == nil {
+		return errors.New("tunnel can't be captured")
+	}
+	c, err := newCaptureWriter(vt.Logger, opts)
+	if err != nil {
+		return err
+	}
+	if old := vt.capture.writer.Swap(c); old != nil {
+		return old.Close()
+	}
+	return nil
+}
+
+// StopCapture stops the running capture, if there is one.
+func (vt *VirtualTun) StopCapture() error {
+	if vt.capture == nil {
+		return nil
+	}
+	if c := vt.capture.writer.Swap(nil); c != nil {
+		return c.Close()
+	}
+	return nil
+}
+
+// Capturing reports whether a capture is running.
+func (vt *VirtualTun) Capturing() bool {
+	if vt.capture == nil {
+		return false
+	}
+	c := vt.capture.writer.Load()
+	if c == nil {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.f != nil
+}
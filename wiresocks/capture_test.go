@@ -0,0 +1,120 @@
+package wiresocks
+
+import (
+	"bytes"
+	"encoding/binary"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+)
+
+// pcapngBlocks splits the pcapng data b into the types and bodies of its
+// blocks.
+func pcapngBlocks(t *testing.T, b []byte) (types []uint32, bodies [][]byte) {
+	for len(b) > 0 {
+		qt.Assert(t, len(b) >= 12, qt.IsTrue)
+		typ := binary.LittleEndian.Uint32(b)
+		n := int(binary.LittleEndian.Uint32(b[4:]))
+		qt.Assert(t, n%4, qt.Equals, 0)
+		qt.Assert(t, n <= len(b), qt.IsTrue)
+		qt.Assert(t, binary.LittleEndian.Uint32(b[n-4:]), qt.Equals, uint32(n))
+		types = append(types, typ)
+		bodies = append(bodies, b[8:n-4])
+		b = b[n:]
+	}
+	return types, bodies
+}
+
+func TestPcapngPacket(t *testing.T) {
+	pkt := testPacket(17, "172.16.0.2", "1.1.1.1", 40000, 53)[:27] // Odd length, to pad
+	at := time.UnixMicro(1700000000123456)
+
+	types, bodies := pcapngBlocks(t, pcapngPacket(at, captureOutbound, pkt))
+	qt.Assert(t, types, qt.DeepEquals, []uint32{pcapngEnhancedPacket})
+	body := bodies[0]
+
+	ts := uint64(binary.LittleEndian.Uint32(body[4:]))<<32 | uint64(binary.LittleEndian.Uint32(body[8:]))
+	qt.Assert(t, ts, qt.Equals, uint64(at.UnixMicro()))
+	qt.Assert(t, binary.LittleEndian.Uint32(body[12:]), qt.Equals, uint32(len(pkt)))
+	qt.Assert(t, body[20:20+len(pkt)], qt.DeepEquals, pkt)
+
+	opts := body[20+28:]
+	qt.Assert(t, binary.LittleEndian.Uint16(opts), qt.Equals, uint16(pcapngOptEPBFlag))
+	qt.Assert(t, binary.LittleEndian.Uint32(opts[4:]), qt.Equals, uint32(captureOutbound))
+}
+
+func TestPcapngHeader(t *testing.T) {
+	types, bodies := pcapngBlocks(t, pcapngHeader())
+	qt.Assert(t, types, qt.DeepEquals, []uint32{pcapngSectionHeader, pcapngInterface})
+	qt.Assert(t, binary.LittleEndian.Uint32(bodies[0]), qt.Equals, uint32(pcapngByteOrder))
+	qt.Assert(t, binary.LittleEndian.Uint16(bodies[1]), qt.Equals, uint16(linkTypeRaw))
+}
+
+func TestCaptureWriter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tunnel.pcapng")
+	c, err := newCaptureWriter(slog.Default(), CaptureOptions{Path: path, Filter: "udp"})
+	qt.Assert(t, err, qt.IsNil)
+
+	dns := testPacket(17, "172.16.0.2", "1.1.1.1", 40000, 53)
+	https := testPacket(6, "172.16.0.2", "1.1.1.1", 40000, 443)
+	c.capture(captureOutbound, [][]byte{append([]byte{0, 0}, dns...), append([]byte{0, 0}, https...)}, []int{len(dns), len(https)}, 2)
+	c.capture(captureInbound, [][]byte{https}, nil, 0)
+	qt.Assert(t, c.Close(), qt.IsNil)
+
+	b, err := os.ReadFile(path)
+	qt.Assert(t, err, qt.IsNil)
+	types, bodies := pcapngBlocks(t, b)
+	qt.Assert(t, types, qt.DeepEquals, []uint32{pcapngSectionHeader, pcapngInterface, pcapngEnhancedPacket})
+	qt.Assert(t, bytes.Contains(bodies[2], dns), qt.IsTrue)
+
+	// A new capture is appended as a section of its own.
+	c, err = newCaptureWriter(slog.Default(), CaptureOptions{Path: path})
+	qt.Assert(t, err, qt.IsNil)
+	c.capture(captureInbound, [][]byte{https}, nil, 0)
+	qt.Assert(t, c.Close(), qt.IsNil)
+
+	b, err = os.ReadFile(path)
+	qt.Assert(t, err, qt.IsNil)
+	types, _ = pcapngBlocks(t, b)
+	qt.Assert(t, types, qt.HasLen, 6)
+	qt.Assert(t, types[3], qt.Equals, uint32(pcapngSectionHeader))
+}
+
+func TestCaptureRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tunnel.pcapng")
+	c, err := newCaptureWriter(slog.Default(), CaptureOptions{Path: path, MaxSize: 200, MaxFiles: 2})
+	qt.Assert(t, err, qt.IsNil)
+
+	// Each packet fills a file past MaxSize on its own.
+	pkt := append(testPacket(17, "172.16.0.2", "1.1.1.1", 40000, 53), make([]byte, 200)...)
+	for i := 0; i < 5; i++ {
+		c.capture(captureOutbound, [][]byte{pkt}, nil, 0)
+	}
+	qt.Assert(t, c.Close(), qt.IsNil)
+
+	for n, want := range []int{2, 3, 3} {
+		b, err := os.ReadFile(rotatedPath(path, n))
+		qt.Assert(t, err, qt.IsNil)
+		types, _ := pcapngBlocks(t, b)
+		qt.Assert(t, types, qt.HasLen, want, qt.Commentf("file %d", n))
+	}
+	_, err = os.Stat(rotatedPath(path, 3))
+	qt.Assert(t, os.IsNotExist(err), qt.IsTrue)
+}
+
+func TestRotatedPath(t *testing.T) {
+	qt.Assert(t, rotatedPath("dir/tunnel.pcapng", 0), qt.Equals, "dir/tunnel.pcapng")
+	qt.Assert(t, rotatedPath("dir/tunnel.pcapng", 2), qt.Equals, "dir/tunnel.2.pcapng")
+	qt.Assert(t, rotatedPath("tunnel", 1), qt.Equals, "tunnel.1")
+}
+
+func TestCaptureOptionsValidate(t *testing.T) {
+	qt.Assert(t, CaptureOptions{Path: "a.pcapng", Filter: "tcp port 443"}.Validate(), qt.IsNil)
+	qt.Assert(t, CaptureOptions{}.Validate(), qt.IsNotNil)
+	qt.Assert(t, CaptureOptions{Path: "a.pcapng", MaxSize: -1}.Validate(), qt.IsNotNil)
+	qt.Assert(t, CaptureOptions{Path: "a.pcapng", Filter: "tcp port"}.Validate(), qt.IsNotNil)
+}
@@ -1,41 +1,70 @@
 package wiresocks
 
 import (
+	"bufio"
+	"context"
 	"encoding/base64"
 	"encoding/hex"
 	"errors"
 	"fmt"
+	"io"
+	"log/slog"
+	"net"
 	"net/netip"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 
-	"github.com/go-ini/ini"
+	"github.com/bepass-org/warp-plus/wireguard/device"
 )
 
 // PeerConfig struct represents the configuration for a peer in the WireGuard network.
 type PeerConfig struct {
-	// PublicKey is the base64-encoded public key of the peer.
-	PublicKey    string `ini:"PublicKey"`
-	// PreSharedKey is the base64-encoded pre-shared key of the peer.
-	PreSharedKey string `ini:"PreSharedKey"`
-	// Endpoint is the endpoint (IP address and port) of the peer.
-	Endpoint     string `ini:"Endpoint"`
-	// KeepAlive is the persistent keepalive interval for the peer.
-	KeepAlive    int    `ini:"KeepAlive"`
+	// PublicKey is the hex-encoded public key of the peer.
+	PublicKey string
+	// PreSharedKey is the hex-encoded pre-shared key of the peer.
+	PreSharedKey string
+	// Endpoint is the endpoint of the peer as host:port. Host names are
+	// resolved when the device starts, and again while it runs.
+	Endpoint string
+	// PersistentKeepalive is the persistent keepalive interval for the peer in seconds.
+	PersistentKeepalive int
 	// AllowedIPs are the allowed IP addresses for the peer.
-	AllowedIPs   []netip.Prefix `ini:"AllowedIPs"`
-	// Trick is a flag indicating if the peer should be treated as a local peer.
-	Trick        bool   `ini:"Trick"`
+	AllowedIPs []netip.Prefix
+	// Noise is sent to the peer ahead of handshake initiations.
+	Noise Noise
+	// Hopping moves the peer's UDP flow to fresh ports.
+	Hopping PortHopping
+	// Obfuscation holds the AmneziaWG parameters used with the peer.
+	Obfuscation Obfuscation
 }
 
+// Obfuscation holds AmneziaWG junk, padding and header parameters.
+type Obfuscation = device.Obfuscation
+
+// Noise is the profile of the packets sent ahead of handshakes.
+type Noise = device.Decoy
+
+// DefaultNoise is the noise WARP peers get unless told otherwise.
+var DefaultNoise = device.DefaultDecoy
+
 // InterfaceConfig struct represents the configuration for a WireGuard interface.
 type InterfaceConfig struct {
-	// PrivateKey is the base64-encoded private key of the interface.
-	PrivateKey string `ini:"PrivateKey"`
-	// Addresses are the IP addresses assigned to the interface.
-	Addresses  []netip.Addr `ini:"Address"`
+	// PrivateKey is the hex-encoded private key of the interface.
+	PrivateKey string
+	// Addresses are the IP addresses assigned to the interface, with their prefix lengths.
+	Addresses []netip.Prefix
 	// DNS are the DNS servers assigned to the interface.
-	DNS        []netip.Addr `ini:"DNS"`
+	DNS []netip.Addr
 	// MTU is the Maximum Transmission Unit for the interface.
-	MTU        int    `ini:"MTU"`
+	MTU int
+	// ListenPort is the local UDP port, zero for a random one.
+	ListenPort uint16
+	// Obfuscation holds the AmneziaWG parameters peers use unless they set
+	// their own, as AmneziaWG profiles put them under [Interface].
+	Obfuscation Obfuscation
 }
 
 // Configuration struct represents the overall configuration for the WireGuard network.
@@ -43,7 +72,466 @@ type Configuration struct {
 	// Interface is the configuration for the WireGuard interface.
 	Interface *InterfaceConfig
 	// Peers are the configurations for the peers in the WireGuard network.
-	Peers     []PeerConfig
+	Peers []PeerConfig
+}
+
+// errUnknownKey is returned for keys wg-quick doesn't know either.
+var errUnknownKey = errors.New("unknown key")
+
+// ignoredKeys are wg-quick keys that only make sense for a kernel
+// interface. They are skipped with a warning.
+var ignoredKeys = map[string]bool{
+	"preup":      true,
+	"postup":     true,
+	"predown":    true,
+	"postdown":   true,
+	"table":      true,
+	"saveconfig": true,
+	"fwmark":     true,
+}
+
+// obfuscationKeys are the AmneziaWG keys, accepted in both sections.
+var obfuscationKeys = map[string]bool{
+	"jc":   true,
+	"jmin": true,
+	"jmax": true,
+	"s1":   true,
+	"s2":   true,
+	"h1":   true,
+	"h2":   true,
+	"h3":   true,
+	"h4":   true,
+}
+
+// noiseKeys are the [Peer] keys of the noise profile, and the keys
+// ParseNoise takes them by.
+var noiseKeys = map[string]string{
+	"noisecount":   "count",
+	"noisesize":    "size",
+	"noisedelay":   "delay",
+	"noisepattern": "pattern",
+	"noisewhen":    "when",
+	"noiseport":    "port",
+}
+
+// encodeBase64ToHex decodes a base64-encoded key and returns it hex-encoded.
+func encodeBase64ToHex(key string) (string, error) {
+	decoded, err := base64.StdEncoding.DecodeString(key)
+	if err != nil {
+		return "", fmt.Errorf("invalid base64 string: %s", key)
+	}
+	if len(decoded) != 32 {
+		return "", fmt.Errorf("key should be 32 bytes: %s", key)
+	}
+	return hex.EncodeToString(decoded), nil
+}
+
+// ParseConfig parses the wg-quick profile at path. Keys that only apply to
+// kernel interfaces, such as PostUp, are ignored with a warning on l.
+func ParseConfig(l *slog.Logger, path string) (*Configuration, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return parseConfig(l, path, f)
+}
+
+// parseConfig parses a wg-quick profile read from r. name is used in error
+// messages, which carry the line they refer to.
+func parseConfig(l *slog.Logger, name string, r io.Reader) (*Configuration, error) {
+	var (
+		iface     *InterfaceConfig
+		peer      *PeerConfig
+		peers     []PeerConfig
+		peerLines []int  // Header line of each peer
+		peerNoise bool   // Whether the current peer set a noise key
+		section   string // Lower case name of the current section
+		header    string // Current section header as written
+		sectionAt int    // Line of the current section header
+	)
+
+	// endSection checks the section that just ended.
+	endSection := func() error {
+		switch section {
+		case "interface":
+			if iface.PrivateKey == "" {
+				return fmt.Errorf("%s:%d: [Interface] has no PrivateKey", name, sectionAt)
+			}
+		case "peer":
+			if peer.PublicKey == "" {
+				return fmt.Errorf("%s:%d: [Peer] has no PublicKey", name, sectionAt)
+			}
+			peers = append(peers, *peer)
+			peerLines = append(peerLines, sectionAt)
+		}
+		return nil
+	}
+
+	s := bufio.NewScanner(r)
+	for n := 1; s.Scan(); n++ {
+		line, _, _ := strings.Cut(s.Text(), "#")
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			if err := endSection(); err != nil {
+				return nil, err
+			}
+
+			header, sectionAt = line, n
+			section = strings.ToLower(strings.TrimSpace(line[1 : len(line)-1]))
+			switch section {
+			case "interface":
+				if iface != nil {
+					return nil, fmt.Errorf("%s:%d: only one [Interface] is expected", name, n)
+				}
+				iface = &InterfaceConfig{}
+			case "peer":
+				peer = &PeerConfig{PreSharedKey: strings.Repeat("0", 64)}
+				peerNoise = false
+			default:
+				return nil, fmt.Errorf("%s:%d: unknown section %s", name, n, line)
+			}
+			continue
+		}
+
+		rawKey, value, found := strings.Cut(line, "=")
+		if !found {
+			return nil, fmt.Errorf("%s:%d: expected key = value, got %q", name, n, line)
+		}
+		rawKey, value = strings.TrimSpace(rawKey), strings.TrimSpace(value)
+		key := strings.ToLower(rawKey)
+
+		var err error
+		switch {
+		case ignoredKeys[key]:
+			l.Warn("ignoring wg-quick key", "file", name, "line", n, "key", rawKey)
+		case obfuscationKeys[key] && section == "interface":
+			err = parseObfuscationKey(&iface.Obfuscation, rawKey, key, value)
+		case obfuscationKeys[key] && section == "peer":
+			err = parseObfuscationKey(&peer.Obfuscation, rawKey, key, value)
+		case noiseKeys[key] != "" && section == "peer":
+			// Keys left out keep their DefaultNoise values, as with ParseNoise.
+			if !peerNoise {
+				peer.Noise, peerNoise = DefaultNoise, true
+			}
+			err = parseNoiseKey(&peer.Noise, rawKey, noiseKeys[key], value)
+		case section == "interface":
+			err = parseInterfaceKey(l, iface, key, value)
+		case section == "peer":
+			err = parsePeerKey(peer, key, value)
+		default:
+			err = errors.New("key outside of a section")
+		}
+		if errors.Is(err, errUnknownKey) {
+			return nil, fmt.Errorf("%s:%d: unknown %s key %s", name, n, header, rawKey)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", name, n, err)
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	if err := endSection(); err != nil {
+		return nil, err
+	}
+
+	if iface == nil {
+		return nil, fmt.Errorf("%s: no [Interface] section", name)
+	}
+	if len(peers) == 0 {
+		return nil, fmt.Errorf("%s: no [Peer] section", name)
+	}
+
+	for i := range peers {
+		peers[i].Obfuscation = mergeObfuscation(peers[i].Obfuscation, iface.Obfuscation)
+		if err := peers[i].Obfuscation.Validate(); err != nil {
+			return nil, fmt.Errorf("%s:%d: [Peer] obfuscation: %w", name, peerLines[i], err)
+		}
+		if err := peers[i].Noise.Validate(); err != nil {
+			return nil, fmt.Errorf("%s:%d: [Peer] %w", name, peerLines[i], err)
+		}
+	}
+
+	return &Configuration{Interface: iface, Peers: peers}, nil
 }
 
-// encodeBase6
+// parseInterfaceKey sets the [Interface] key to value in iface.
+func parseInterfaceKey(l *slog.Logger, iface *InterfaceConfig, key, value string) error {
+	switch key {
+	case "privatekey":
+		k, err := encodeBase64ToHex(value)
+		if err != nil {
+			return err
+		}
+		iface.PrivateKey = k
+	case "address":
+		for _, v := range splitList(value) {
+			prefix, err := parseAddress(v)
+			if err != nil {
+				return err
+			}
+			iface.Addresses = append(iface.Addresses, prefix)
+		}
+	case "dns":
+		for _, v := range splitList(value) {
+			addr, err := netip.ParseAddr(v)
+			if err != nil {
+				// wg-quick takes names as search domains, which netstack has no use for.
+				l.Warn("ignoring dns search domain", "domain", v)
+				continue
+			}
+			iface.DNS = append(iface.DNS, addr)
+		}
+	case "mtu":
+		mtu, err := strconv.Atoi(value)
+		if err != nil || mtu <= 0 {
+			return fmt.Errorf("invalid MTU %q", value)
+		}
+		iface.MTU = mtu
+	case "listenport":
+		port, err := strconv.ParseUint(value, 10, 16)
+		if err != nil {
+			return fmt.Errorf("invalid ListenPort %q", value)
+		}
+		iface.ListenPort = uint16(port)
+	default:
+		return errUnknownKey
+	}
+	return nil
+}
+
+// parsePeerKey sets the [Peer] key to value in peer.
+func parsePeerKey(peer *PeerConfig, key, value string) error {
+	switch key {
+	case "publickey":
+		k, err := encodeBase64ToHex(value)
+		if err != nil {
+			return err
+		}
+		peer.PublicKey = k
+	case "presharedkey":
+		k, err := encodeBase64ToHex(value)
+		if err != nil {
+			return err
+		}
+		peer.PreSharedKey = k
+	case "allowedips":
+		for _, v := range splitList(value) {
+			prefix, err := parseAddress(v)
+			if err != nil {
+				return err
+			}
+			peer.AllowedIPs = append(peer.AllowedIPs, prefix.Masked())
+		}
+	case "endpoint":
+		if _, _, err := net.SplitHostPort(value); err != nil {
+			return fmt.Errorf("invalid Endpoint %q: %w", value, err)
+		}
+		peer.Endpoint = value
+	case "persistentkeepalive":
+		if value == "off" {
+			peer.PersistentKeepalive = 0
+			return nil
+		}
+		interval, err := strconv.ParseUint(value, 10, 16)
+		if err != nil {
+			return fmt.Errorf("invalid PersistentKeepalive %q", value)
+		}
+		peer.PersistentKeepalive = int(interval)
+	case "hopinterval":
+		d, err := time.ParseDuration(value)
+		if err != nil || d < 0 {
+			return fmt.Errorf("invalid HopInterval %q", value)
+		}
+		peer.Hopping.Interval = d
+	case "hoponcollapse":
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("invalid HopOnCollapse %q", value)
+		}
+		peer.Hopping.OnCollapse = b
+	case "hopsource":
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("invalid HopSource %q", value)
+		}
+		peer.Hopping.Source = b
+	case "hopports":
+		for _, v := range splitList(value) {
+			port, err := strconv.ParseUint(v, 10, 16)
+			if err != nil || port == 0 {
+				return fmt.Errorf("invalid HopPorts %q", value)
+			}
+			peer.Hopping.Ports = append(peer.Hopping.Ports, uint16(port))
+		}
+	default:
+		return errUnknownKey
+	}
+	return nil
+}
+
+// parseObfuscationKey sets the AmneziaWG key to value in o.
+func parseObfuscationKey(o *Obfuscation, rawKey, key, value string) error {
+	if err := o.Set(key, value); err != nil {
+		return fmt.Errorf("invalid %s %q", rawKey, value)
+	}
+	return nil
+}
+
+// mergeObfuscation returns o with its zero fields taken from defaults.
+func mergeObfuscation(o, defaults Obfuscation) Obfuscation {
+	pick := func(v, d int) int {
+		if v == 0 {
+			return d
+		}
+		return v
+	}
+	pickHeader := func(v, d uint32) uint32 {
+		if v == 0 {
+			return d
+		}
+		return v
+	}
+	return Obfuscation{
+		JunkCount:       pick(o.JunkCount, defaults.JunkCount),
+		JunkMin:         pick(o.JunkMin, defaults.JunkMin),
+		JunkMax:         pick(o.JunkMax, defaults.JunkMax),
+		InitPadding:     pick(o.InitPadding, defaults.InitPadding),
+		ResponsePadding: pick(o.ResponsePadding, defaults.ResponsePadding),
+		InitHeader:      pickHeader(o.InitHeader, defaults.InitHeader),
+		ResponseHeader:  pickHeader(o.ResponseHeader, defaults.ResponseHeader),
+		CookieHeader:    pickHeader(o.CookieHeader, defaults.CookieHeader),
+		TransportHeader: pickHeader(o.TransportHeader, defaults.TransportHeader),
+	}
+}
+
+// ParseObfuscation parses AmneziaWG parameters written as a comma separated
+// list of key=value pairs, such as "jc=4,jmin=40,jmax=70". Keys are the
+// wg-quick ones, in any case.
+func ParseObfuscation(s string) (Obfuscation, error) {
+	var o Obfuscation
+	for _, kv := range splitList(s) {
+		key, value, found := strings.Cut(kv, "=")
+		if !found {
+			return Obfuscation{}, fmt.Errorf("expected key=value, got %q", kv)
+		}
+		key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+		if !obfuscationKeys[strings.ToLower(key)] {
+			return Obfuscation{}, fmt.Errorf("unknown obfuscation key %s", key)
+		}
+		if err := parseObfuscationKey(&o, key, strings.ToLower(key), value); err != nil {
+			return Obfuscation{}, err
+		}
+	}
+	return o, o.Validate()
+}
+
+// parseNoiseKey sets the noise key, as the device names it, to value in n.
+func parseNoiseKey(n *Noise, rawKey, key, value string) error {
+	if err := n.Set(key, value); err != nil {
+		return fmt.Errorf("invalid %s %q", rawKey, value)
+	}
+	return nil
+}
+
+// ParseNoise parses a noise profile written as a comma separated list of
+// key=value pairs, such as "count=2,size=10-60,delay=10ms-50ms,pattern=quic".
+// The keys are count, size, delay, pattern (random, quic or dns), when
+// (every or first handshake) and port. Unset keys keep their DefaultNoise
+// values.
+func ParseNoise(s string) (Noise, error) {
+	n := DefaultNoise
+	for _, kv := range splitList(s) {
+		key, value, found := strings.Cut(kv, "=")
+		if !found {
+			return Noise{}, fmt.Errorf("expected key=value, got %q", kv)
+		}
+		key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+		if _, ok := noiseKeys["noise"+strings.ToLower(key)]; !ok {
+			return Noise{}, fmt.Errorf("unknown noise key %s", key)
+		}
+		if err := parseNoiseKey(&n, key, strings.ToLower(key), value); err != nil {
+			return Noise{}, err
+		}
+	}
+	return n, n.Validate()
+}
+
+// splitList splits a comma separated list, dropping empty entries.
+func splitList(value string) []string {
+	var res []string
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			res = append(res, v)
+		}
+	}
+	return res
+}
+
+// parseAddress parses an address with an optional prefix length. A bare
+// address is taken as a single host.
+func parseAddress(value string) (netip.Prefix, error) {
+	if strings.Contains(value, "/") {
+		prefix, err := netip.ParsePrefix(value)
+		if err != nil {
+			return netip.Prefix{}, fmt.Errorf("invalid address %q: %w", value, err)
+		}
+		return prefix, nil
+	}
+
+	addr, err := netip.ParseAddr(value)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("invalid address %q: %w", value, err)
+	}
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+// resolveEndpoint returns the address of a host:port endpoint, looking the
+// host up if it is a name.
+func resolveEndpoint(ctx context.Context, endpoint string) (netip.AddrPort, error) {
+	addrs, err := lookupEndpoint(ctx, endpoint)
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	return addrs[0], nil
+}
+
+// lookupEndpoint returns every address of a host:port endpoint, IPv4 ones
+// first since they work on more networks.
+func lookupEndpoint(ctx context.Context, endpoint string) ([]netip.AddrPort, error) {
+	if addrPort, err := netip.ParseAddrPort(endpoint); err == nil {
+		return []netip.AddrPort{addrPort}, nil
+	}
+
+	host, port, err := net.SplitHostPort(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port in endpoint %q", endpoint)
+	}
+
+	addrs, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		return nil, err
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("no addresses for %s", host)
+	}
+
+	res := make([]netip.AddrPort, 0, len(addrs))
+	for _, addr := range addrs {
+		res = append(res, netip.AddrPortFrom(addr.Unmap(), uint16(p)))
+	}
+	sort.SliceStable(res, func(i, j int) bool {
+		return res[i].Addr().Is4() && !res[j].Addr().Is4()
+	})
+	return res, nil
+}
@@ -1,11 +1,15 @@
 package wiresocks
 
 import (
+	"io"
+	"log/slog"
 	"net/netip"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/bepass-org/warp-plus/wireguard/device"
 	qt "github.com/frankban/quicktest"
-	"github.com/go-ini/ini"
 	"github.com/google/go-cmp/cmp/cmpopts"
 )
 
@@ -21,62 +25,292 @@ AllowedIPs = 0.0.0.0/0
 AllowedIPs = ::/0
 Endpoint = engage.cloudflareclient.com:2408
 `
+
+const wgQuickConfig = `
+# Exported from a self-hosted server
+[Interface]
+PrivateKey = aK8FWhiV1CtKFbKUPssL13P+Tv+c5owmYcU5PCP6yFw=
+Address = 10.8.0.2/24, fd00::2
+ListenPort = 51820
+DNS = 10.8.0.1, home.lan
+MTU = 1420
+PostUp = iptables -A FORWARD -i %i -j ACCEPT
+Table = off
+
+[Peer] # the server
+PublicKey = bmXOC+F1FxEMF9dyiK2H5/1SUtzH0JuVo51h2wPfgyo=
+PresharedKey = AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAE=
+allowedips = 10.8.0.0/24, 192.168.1.1
+Endpoint = vpn.example.com:51820
+PersistentKeepalive = 25
+
+[Peer]
+PublicKey = aK8FWhiV1CtKFbKUPssL13P+Tv+c5owmYcU5PCP6yFw=
+AllowedIPs = 0.0.0.0/0
+Endpoint = [2001:db8::1]:51820
+PersistentKeepalive = off
+`
+
 const (
 	privateKeyBase64   = "68af055a1895d42b4a15b2943ecb0bd773fe4eff9ce68c2661c5393c23fac85c"
 	publicKeyBase64    = "6e65ce0be17517110c17d77288ad87e7fd5252dcc7d09b95a39d61db03df832a"
 	presharedKeyBase64 = "0000000000000000000000000000000000000000000000000000000000000000"
 )
 
-func TestParseInterface(t *testing.T) {
-	opts := ini.LoadOptions{
-		Insensitive:            true,
-		AllowShadows:           true,
-		AllowNonUniqueSections: true,
-	}
+var testLogger = slog.New(slog.NewTextHandler(io.Discard, nil))
 
-	cfg, err := ini.LoadSources(opts, []byte(testConfig))
-	qt.Assert(t, err, qt.IsNil)
+var cmpNetip = cmpopts.EquateComparable(netip.Addr{}, netip.Prefix{})
 
-	device, err := ParseInterface(cfg)
+func TestParseInterface(t *testing.T) {
+	conf, err := parseConfig(testLogger, "test.conf", strings.NewReader(testConfig))
 	qt.Assert(t, err, qt.IsNil)
 
 	want := InterfaceConfig{
 		PrivateKey: privateKeyBase64,
-		Addresses: []netip.Addr{
-			netip.MustParseAddr("172.16.0.2"),
-			netip.MustParseAddr("2606:4700:110:8cc0:1ad3:9155:6742:ea8d"),
+		Addresses: []netip.Prefix{
+			netip.MustParsePrefix("172.16.0.2/24"),
+			netip.MustParsePrefix("2606:4700:110:8cc0:1ad3:9155:6742:ea8d/128"),
 		},
 		DNS: []netip.Addr{netip.MustParseAddr("8.8.8.8")},
 		MTU: 0,
 	}
-	qt.Assert(t, device, qt.CmpEquals(cmpopts.EquateComparable(netip.Addr{})), want)
-	t.Logf("%+v", device)
+	qt.Assert(t, *conf.Interface, qt.CmpEquals(cmpNetip), want)
+	t.Logf("%+v", conf.Interface)
 }
 
 func TestParsePeers(t *testing.T) {
-	opts := ini.LoadOptions{
-		Insensitive:            true,
-		AllowShadows:           true,
-		AllowNonUniqueSections: true,
-	}
-
-	cfg, err := ini.LoadSources(opts, []byte(testConfig))
-	qt.Assert(t, err, qt.IsNil)
-
-	peers, err := ParsePeers(cfg)
+	conf, err := parseConfig(testLogger, "test.conf", strings.NewReader(testConfig))
 	qt.Assert(t, err, qt.IsNil)
 
 	want := []PeerConfig{{
-		PublicKey:    publicKeyBase64,
-		PreSharedKey: presharedKeyBase64,
-		Endpoint:     "engage.cloudflareclient.com:2408",
-		KeepAlive:    0,
+		PublicKey:           publicKeyBase64,
+		PreSharedKey:        presharedKeyBase64,
+		Endpoint:            "engage.cloudflareclient.com:2408",
+		PersistentKeepalive: 0,
 		AllowedIPs: []netip.Prefix{
 			netip.MustParsePrefix("0.0.0.0/0"),
 			netip.MustParsePrefix("::/0"),
 		},
-		Trick: false,
 	}}
-	qt.Assert(t, peers, qt.CmpEquals(cmpopts.EquateComparable(netip.Prefix{})), want)
-	t.Logf("%+v", peers)
+	qt.Assert(t, conf.Peers, qt.CmpEquals(cmpNetip), want)
+	t.Logf("%+v", conf.Peers)
+}
+
+func TestParseWgQuick(t *testing.T) {
+	conf, err := parseConfig(testLogger, "wg0.conf", strings.NewReader(wgQuickConfig))
+	qt.Assert(t, err, qt.IsNil)
+
+	wantInterface := InterfaceConfig{
+		PrivateKey: privateKeyBase64,
+		Addresses: []netip.Prefix{
+			netip.MustParsePrefix("10.8.0.2/24"),
+			netip.MustParsePrefix("fd00::2/128"),
+		},
+		DNS:        []netip.Addr{netip.MustParseAddr("10.8.0.1")},
+		MTU:        1420,
+		ListenPort: 51820,
+	}
+	qt.Assert(t, *conf.Interface, qt.CmpEquals(cmpNetip), wantInterface)
+
+	wantPeers := []PeerConfig{{
+		PublicKey:           publicKeyBase64,
+		PreSharedKey:        "0000000000000000000000000000000000000000000000000000000000000001",
+		Endpoint:            "vpn.example.com:51820",
+		PersistentKeepalive: 25,
+		AllowedIPs: []netip.Prefix{
+			netip.MustParsePrefix("10.8.0.0/24"),
+			netip.MustParsePrefix("192.168.1.1/32"),
+		},
+	}, {
+		PublicKey:    privateKeyBase64,
+		PreSharedKey: presharedKeyBase64,
+		Endpoint:     "[2001:db8::1]:51820",
+		AllowedIPs:   []netip.Prefix{netip.MustParsePrefix("0.0.0.0/0")},
+	}}
+	qt.Assert(t, conf.Peers, qt.CmpEquals(cmpNetip), wantPeers)
+}
+
+const amneziaConfig = `
+[Interface]
+PrivateKey = aK8FWhiV1CtKFbKUPssL13P+Tv+c5owmYcU5PCP6yFw=
+Address = 10.8.0.2/24
+Jc = 4
+Jmin = 40
+Jmax = 70
+S1 = 15
+S2 = 18
+H1 = 1234567
+H2 = 2345678
+H3 = 3456789
+H4 = 4567890
+
+[Peer]
+PublicKey = bmXOC+F1FxEMF9dyiK2H5/1SUtzH0JuVo51h2wPfgyo=
+AllowedIPs = 0.0.0.0/0
+
+[Peer]
+PublicKey = aK8FWhiV1CtKFbKUPssL13P+Tv+c5owmYcU5PCP6yFw=
+AllowedIPs = 10.0.0.0/8
+Jc = 8
+`
+
+func TestParseAmnezia(t *testing.T) {
+	conf, err := parseConfig(testLogger, "awg0.conf", strings.NewReader(amneziaConfig))
+	qt.Assert(t, err, qt.IsNil)
+
+	want := Obfuscation{
+		JunkCount:       4,
+		JunkMin:         40,
+		JunkMax:         70,
+		InitPadding:     15,
+		ResponsePadding: 18,
+		InitHeader:      1234567,
+		ResponseHeader:  2345678,
+		CookieHeader:    3456789,
+		TransportHeader: 4567890,
+	}
+	qt.Assert(t, conf.Peers[0].Obfuscation, qt.Equals, want)
+
+	want.JunkCount = 8
+	qt.Assert(t, conf.Peers[1].Obfuscation, qt.Equals, want)
+}
+
+func TestParseObfuscation(t *testing.T) {
+	o, err := ParseObfuscation("jc=4, Jmin=40,JMAX=70")
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, o, qt.Equals, Obfuscation{JunkCount: 4, JunkMin: 40, JunkMax: 70})
+
+	_, err = ParseObfuscation("jc=4,jmin=70,jmax=40")
+	qt.Assert(t, err, qt.ErrorMatches, "jmin and jmax must .*")
+
+	_, err = ParseObfuscation("junk=4")
+	qt.Assert(t, err, qt.ErrorMatches, "unknown obfuscation key junk")
+}
+
+func TestParseNoiseKeys(t *testing.T) {
+	conf, err := parseConfig(testLogger, "wg0.conf", strings.NewReader(`
+[Interface]
+PrivateKey = aK8FWhiV1CtKFbKUPssL13P+Tv+c5owmYcU5PCP6yFw=
+
+[Peer]
+PublicKey = bmXOC+F1FxEMF9dyiK2H5/1SUtzH0JuVo51h2wPfgyo=
+NoisePattern = dns
+NoiseWhen = first
+NoisePort = 53
+
+[Peer]
+PublicKey = aK8FWhiV1CtKFbKUPssL13P+Tv+c5owmYcU5PCP6yFw=
+`))
+	qt.Assert(t, err, qt.IsNil)
+
+	want := DefaultNoise
+	want.Pattern, want.FirstOnly, want.Port = device.DecoyDNS, true, 53
+	qt.Assert(t, conf.Peers[0].Noise, qt.Equals, want)
+	qt.Assert(t, conf.Peers[1].Noise, qt.Equals, Noise{})
+}
+
+func TestParseNoise(t *testing.T) {
+	n, err := ParseNoise("count=3, size=20-80,Delay=10ms-50ms,pattern=quic")
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, n, qt.Equals, Noise{
+		Count:    3,
+		MinSize:  20,
+		MaxSize:  80,
+		MinDelay: 10 * time.Millisecond,
+		MaxDelay: 50 * time.Millisecond,
+		Pattern:  device.DecoyQUIC,
+	})
+
+	n, err = ParseNoise("count=0")
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, n.IsZero(), qt.IsTrue)
+
+	_, err = ParseNoise("pattern=http")
+	qt.Assert(t, err, qt.ErrorMatches, `invalid pattern "http"`)
+
+	_, err = ParseNoise("bursts=4")
+	qt.Assert(t, err, qt.ErrorMatches, "unknown noise key bursts")
+}
+
+func TestParseHopKeys(t *testing.T) {
+	conf, err := parseConfig(testLogger, "wg0.conf", strings.NewReader(`
+[Interface]
+PrivateKey = aK8FWhiV1CtKFbKUPssL13P+Tv+c5owmYcU5PCP6yFw=
+
+[Peer]
+PublicKey = bmXOC+F1FxEMF9dyiK2H5/1SUtzH0JuVo51h2wPfgyo=
+HopInterval = 5m
+HopOnCollapse = true
+HopPorts = 51820, 51821
+HopSource = false
+`))
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, conf.Peers[0].Hopping, qt.DeepEquals, PortHopping{
+		Interval:   5 * time.Minute,
+		OnCollapse: true,
+		Ports:      []uint16{51820, 51821},
+	})
+}
+
+func TestParseConfigErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+		err    string
+	}{{
+		name:   "bad key",
+		config: "[Interface]\nPrivateKey = aK8FWhiV1CtKFbKUPssL13P+Tv+c5owmYcU5PCP6yFw=\n\n[Peer]\nPublicKey = not-a-key\n",
+		err:    "wg0.conf:5: invalid base64 string: not-a-key",
+	}, {
+		name:   "unknown key",
+		config: "[Interface]\nPrivateKey = aK8FWhiV1CtKFbKUPssL13P+Tv+c5owmYcU5PCP6yFw=\nColour = blue\n",
+		err:    "wg0.conf:3: unknown \\[Interface\\] key Colour",
+	}, {
+		name:   "bad address",
+		config: "[Interface]\nPrivateKey = aK8FWhiV1CtKFbKUPssL13P+Tv+c5owmYcU5PCP6yFw=\nAddress = 10.0.0.300/24\n",
+		err:    `wg0.conf:3: invalid address "10.0.0.300/24": .*`,
+	}, {
+		name:   "missing public key",
+		config: "[Interface]\nPrivateKey = aK8FWhiV1CtKFbKUPssL13P+Tv+c5owmYcU5PCP6yFw=\n# no key below\n[Peer]\nAllowedIPs = 0.0.0.0/0\n",
+		err:    "wg0.conf:4: \\[Peer\\] has no PublicKey",
+	}, {
+		name:   "two interfaces",
+		config: "[Interface]\nPrivateKey = aK8FWhiV1CtKFbKUPssL13P+Tv+c5owmYcU5PCP6yFw=\n[Interface]\n",
+		err:    "wg0.conf:3: only one \\[Interface\\] is expected",
+	}, {
+		name:   "key outside section",
+		config: "PrivateKey = aK8FWhiV1CtKFbKUPssL13P+Tv+c5owmYcU5PCP6yFw=\n",
+		err:    "wg0.conf:1: key outside of a section",
+	}, {
+		name:   "bad endpoint",
+		config: "[Interface]\nPrivateKey = aK8FWhiV1CtKFbKUPssL13P+Tv+c5owmYcU5PCP6yFw=\n[Peer]\nPublicKey = bmXOC+F1FxEMF9dyiK2H5/1SUtzH0JuVo51h2wPfgyo=\nEndpoint = vpn.example.com\n",
+		err:    `wg0.conf:5: invalid Endpoint "vpn.example.com": .*`,
+	}, {
+		name:   "bad obfuscation value",
+		config: "[Interface]\nPrivateKey = aK8FWhiV1CtKFbKUPssL13P+Tv+c5owmYcU5PCP6yFw=\nJc = many\n",
+		err:    `wg0.conf:3: invalid Jc "many"`,
+	}, {
+		name:   "invalid obfuscation",
+		config: "[Interface]\nPrivateKey = aK8FWhiV1CtKFbKUPssL13P+Tv+c5owmYcU5PCP6yFw=\nH1 = 2\n\n[Peer]\nPublicKey = bmXOC+F1FxEMF9dyiK2H5/1SUtzH0JuVo51h2wPfgyo=\n",
+		err:    "wg0.conf:5: \\[Peer\\] obfuscation: h1 must be above 4 .*",
+	}, {
+		name:   "invalid noise",
+		config: "[Interface]\nPrivateKey = aK8FWhiV1CtKFbKUPssL13P+Tv+c5owmYcU5PCP6yFw=\n\n[Peer]\nPublicKey = bmXOC+F1FxEMF9dyiK2H5/1SUtzH0JuVo51h2wPfgyo=\nNoiseSize = 90-10\n",
+		err:    "wg0.conf:4: \\[Peer\\] noise size must .*",
+	}, {
+		name:   "bad hop port",
+		config: "[Interface]\nPrivateKey = aK8FWhiV1CtKFbKUPssL13P+Tv+c5owmYcU5PCP6yFw=\n\n[Peer]\nPublicKey = bmXOC+F1FxEMF9dyiK2H5/1SUtzH0JuVo51h2wPfgyo=\nHopPorts = 500, 0\n",
+		err:    `wg0.conf:6: invalid HopPorts "500, 0"`,
+	}, {
+		name:   "no peers",
+		config: "[Interface]\nPrivateKey = aK8FWhiV1CtKFbKUPssL13P+Tv+c5owmYcU5PCP6yFw=\n",
+		err:    "wg0.conf: no \\[Peer\\] section",
+	}}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseConfig(testLogger, "wg0.conf", strings.NewReader(tt.config))
+			qt.Assert(t, err, qt.ErrorMatches, tt.err)
+		})
+	}
 }
@@ -0,0 +1,252 @@
+package wiresocks
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+// packetFilter reports whether a captured packet is kept.
+type packetFilter func(p packetInfo) bool
+
+// packetInfo holds the fields of an IP packet that filters match on.
+type packetInfo struct {
+	src, dst     netip.Addr
+	proto        uint8
+	sport, dport uint16
+	ports        bool // Whether sport and dport are set
+}
+
+// IP protocol numbers filters know by name.
+var filterProtos = map[string]uint8{
+	"icmp":  1,
+	"tcp":   6,
+	"udp":   17,
+	"icmp6": 58,
+}
+
+// parsePacket returns the fields of the IP packet pkt, or false if it
+// isn't one. Ports are read from the first fragment of TCP and UDP
+// packets. IPv6 extension headers aren't looked into.
+func parsePacket(pkt []byte) (packetInfo, bool) {
+	var p packetInfo
+	var l4 []byte
+	if len(pkt) < 1 {
+		return p, false
+	}
+	switch pkt[0] >> 4 {
+	case 4:
+		ihl := int(pkt[0]&0x0f) * 4
+		if len(pkt) < 20 || ihl < 20 || len(pkt) < ihl {
+			return p, false
+		}
+		p.src = netip.AddrFrom4([4]byte(pkt[12:16]))
+		p.dst = netip.AddrFrom4([4]byte(pkt[16:20]))
+		p.proto = pkt[9]
+		if binary.BigEndian.Uint16(pkt[6:])&0x1fff == 0 {
+			l4 = pkt[ihl:]
+		}
+	case 6:
+		if len(pkt) < 40 {
+			return p, false
+		}
+		p.src = netip.AddrFrom16([16]byte(pkt[8:24]))
+		p.dst = netip.AddrFrom16([16]byte(pkt[24:40]))
+		p.proto = pkt[6]
+		l4 = pkt[40:]
+	default:
+		return p, false
+	}
+	if (p.proto == 6 || p.proto == 17) && len(l4) >= 4 {
+		p.sport = binary.BigEndian.Uint16(l4[0:])
+		p.dport = binary.BigEndian.Uint16(l4[2:])
+		p.ports = true
+	}
+	return p, true
+}
+
+// parseFilter parses a filter expression in a subset of the tcpdump
+// syntax: the primitives ip, ip6, tcp, udp, icmp and icmp6, and
+// host ADDR, net PREFIX and port N, optionally preceded by src or dst,
+// combined with and (&&), or (||), not (!) and parentheses. Primitives
+// side by side are joined by and, so a protocol can qualify a port as in
+// tcp port 443.
+func parseFilter(expr string) (packetFilter, error) {
+	expr = strings.NewReplacer("(", " ( ", ")", " ) ", "!", " ! ").Replace(expr)
+	p := filterParser{tokens: strings.Fields(expr)}
+	if len(p.tokens) == 0 {
+		return func(packetInfo) bool { return true }, nil
+	}
+
+	f, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if tok, ok := p.peek(); ok {
+		return nil, fmt.Errorf("unexpected %q", tok)
+	}
+	return f, nil
+}
+
+// filterParser is a recursive descent parser of filter expressions.
+type filterParser struct {
+	tokens []string
+	pos    int
+}
+
+func (p *filterParser) peek() (string, bool) {
+	if p.pos >= len(p.tokens) {
+		return "", false
+	}
+	return p.tokens[p.pos], true
+}
+
+func (p *filterParser) next() (string, error) {
+	tok, ok := p.peek()
+	if !ok {
+		return "", errors.New("unexpected end of filter")
+	}
+	p.pos++
+	return tok, nil
+}
+
+// or parses terms joined by or, which binds looser than and.
+func (p *filterParser) or() (packetFilter, error) {
+	f, err := p.and()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		if tok, _ := p.peek(); tok != "or" && tok != "||" {
+			return f, nil
+		}
+		p.pos++
+		g, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+		f = orFilter(f, g)
+	}
+}
+
+func (p *filterParser) and() (packetFilter, error) {
+	f, err := p.not()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		switch tok, ok := p.peek(); {
+		case tok == "and" || tok == "&&":
+			p.pos++
+		case !ok || tok == "or" || tok == "||" || tok == ")":
+			return f, nil
+		}
+		g, err := p.not()
+		if err != nil {
+			return nil, err
+		}
+		f = andFilter(f, g)
+	}
+}
+
+func (p *filterParser) not() (packetFilter, error) {
+	tok, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+	switch tok {
+	case "not", "!":
+		f, err := p.not()
+		if err != nil {
+			return nil, err
+		}
+		return func(pi packetInfo) bool { return !f(pi) }, nil
+	case "(":
+		f, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if tok, err := p.next(); err != nil || tok != ")" {
+			return nil, errors.New("missing )")
+		}
+		return f, nil
+	}
+	p.pos--
+	return p.primitive()
+}
+
+// primitive parses a single test on a packet.
+func (p *filterParser) primitive() (packetFilter, error) {
+	tok, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+
+	switch tok {
+	case "ip":
+		return func(pi packetInfo) bool { return pi.src.Is4() }, nil
+	case "ip6":
+		return func(pi packetInfo) bool { return pi.src.Is6() }, nil
+	}
+	if proto, ok := filterProtos[tok]; ok {
+		return func(pi packetInfo) bool { return pi.proto == proto }, nil
+	}
+
+	src, dst := true, true
+	switch tok {
+	case "src":
+		dst = false
+	case "dst":
+		src = false
+	}
+	if !src || !dst {
+		if tok, err = p.next(); err != nil {
+			return nil, err
+		}
+	}
+	if tok != "host" && tok != "net" && tok != "port" {
+		return nil, fmt.Errorf("unknown filter primitive %q", tok)
+	}
+	value, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+
+	switch tok {
+	case "host":
+		addr, err := netip.ParseAddr(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid host %q", value)
+		}
+		return func(pi packetInfo) bool {
+			return src && pi.src == addr || dst && pi.dst == addr
+		}, nil
+	case "net":
+		prefix, err := netip.ParsePrefix(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid net %q", value)
+		}
+		return func(pi packetInfo) bool {
+			return src && prefix.Contains(pi.src) || dst && prefix.Contains(pi.dst)
+		}, nil
+	default: // port
+		port, err := strconv.ParseUint(value, 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid port %q", value)
+		}
+		return func(pi packetInfo) bool {
+			return pi.ports && (src && pi.sport == uint16(port) || dst && pi.dport == uint16(port))
+		}, nil
+	}
+}
+
+func andFilter(f, g packetFilter) packetFilter {
+	return func(pi packetInfo) bool { return f(pi) && g(pi) }
+}
+
+func orFilter(f, g packetFilter) packetFilter {
+	return func(pi packetInfo) bool { return f(pi) || g(pi) }
+}
@@ -0,0 +1,98 @@
+package wiresocks
+
+import (
+	"encoding/binary"
+	"net/netip"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+)
+
+// testPacket returns an IP packet of proto from src to dst, with the ports
+// in front of its payload.
+func testPacket(proto uint8, src, dst string, sport, dport uint16) []byte {
+	s, d := netip.MustParseAddr(src), netip.MustParseAddr(dst)
+	var pkt []byte
+	if s.Is4() {
+		pkt = make([]byte, 20+8)
+		pkt[0] = 4<<4 | 5
+		binary.BigEndian.PutUint16(pkt[2:], uint16(len(pkt)))
+		pkt[9] = proto
+		copy(pkt[12:], s.AsSlice())
+		copy(pkt[16:], d.AsSlice())
+	} else {
+		pkt = make([]byte, 40+8)
+		pkt[0] = 6 << 4
+		pkt[6] = proto
+		copy(pkt[8:], s.AsSlice())
+		copy(pkt[24:], d.AsSlice())
+	}
+	l4 := pkt[len(pkt)-8:]
+	binary.BigEndian.PutUint16(l4[0:], sport)
+	binary.BigEndian.PutUint16(l4[2:], dport)
+	return pkt
+}
+
+func TestFilter(t *testing.T) {
+	dns := testPacket(17, "172.16.0.2", "1.1.1.1", 40000, 53)
+	https := testPacket(6, "fd00::2", "2606:4700::1", 40000, 443)
+	ping := testPacket(1, "1.1.1.1", "172.16.0.2", 0, 0)
+
+	tests := []struct {
+		expr string
+		want [3]bool // dns, https, ping
+	}{
+		{"", [3]bool{true, true, true}},
+		{"udp", [3]bool{true, false, false}},
+		{"ip6", [3]bool{false, true, false}},
+		{"port 53", [3]bool{true, false, false}},
+		{"src port 53", [3]bool{false, false, false}},
+		{"dst port 443 or icmp", [3]bool{false, true, true}},
+		{"host 1.1.1.1", [3]bool{true, false, true}},
+		{"dst host 1.1.1.1", [3]bool{true, false, false}},
+		{"net 2606:4700::/32", [3]bool{false, true, false}},
+		{"src net 172.16.0.0/12", [3]bool{true, false, false}},
+		{"not tcp", [3]bool{true, false, true}},
+		{"!tcp && !icmp", [3]bool{true, false, false}},
+		{"ip and (udp or icmp) and not port 53", [3]bool{false, false, true}},
+		{"icmp or udp and port 443", [3]bool{false, false, true}},
+		{"tcp port 443 or udp dst port 53", [3]bool{true, true, false}},
+	}
+	for _, tt := range tests {
+		f, err := parseFilter(tt.expr)
+		qt.Assert(t, err, qt.IsNil, qt.Commentf("%q", tt.expr))
+
+		for i, pkt := range [][]byte{dns, https, ping} {
+			p, ok := parsePacket(pkt)
+			qt.Assert(t, ok, qt.IsTrue)
+			qt.Check(t, f(p), qt.Equals, tt.want[i], qt.Commentf("%q on packet %d", tt.expr, i))
+		}
+	}
+}
+
+func TestFilterErrors(t *testing.T) {
+	for _, expr := range []string{
+		"arp",
+		"port",
+		"port http",
+		"host example.com",
+		"net 10.0.0.1",
+		"src tcp",
+		"(udp",
+		"udp)",
+		"udp and",
+		"udp or",
+	} {
+		_, err := parseFilter(expr)
+		qt.Check(t, err, qt.IsNotNil, qt.Commentf("%q", expr))
+	}
+}
+
+func TestParsePacketFragment(t *testing.T) {
+	pkt := testPacket(17, "172.16.0.2", "1.1.1.1", 40000, 53)
+	binary.BigEndian.PutUint16(pkt[6:], 100) // Not the first fragment
+
+	p, ok := parsePacket(pkt)
+	qt.Assert(t, ok, qt.IsTrue)
+	qt.Assert(t, p.ports, qt.IsFalse)
+}
@@ -0,0 +1,169 @@
+package wiresocks
+
+import (
+	"fmt"
+	"math/rand"
+	"net/netip"
+	"time"
+
+	"github.com/bepass-org/warp-plus/wireguard/device"
+)
+
+// PortHopping moves the UDP flow of a peer to fresh ports, for networks
+// that throttle long-lived flows. The WireGuard session is kept: the peer
+// roams to the new flow with the next packet.
+type PortHopping struct {
+	Interval   time.Duration // Hop this often, zero to only hop on collapse
+	OnCollapse bool          // Also hop when the receive rate collapses
+	Ports      []uint16      // Destination ports to hop between, empty to keep the peer's
+	Source     bool          // Also move to a new local port, which moves every peer
+}
+
+// Enabled reports whether h ever hops.
+func (h PortHopping) Enabled() bool {
+	return h.Interval > 0 || h.OnCollapse
+}
+
+// Throughput collapse detection. The receive rate of a peer is checked
+// every collapseCheckInterval, and counts as collapsed once it falls below
+// collapseRatio of its average while data is still being sent, which rules
+// out the tunnel simply going idle.
+const (
+	collapseCheckInterval = 10 * time.Second
+	collapseRatio         = 0.1
+	collapseMinRate       = 16 << 10 // bytes per second, below which there's nothing to collapse
+	collapseMinSent       = 4 << 10  // bytes per check, well above keepalives
+)
+
+// throughput tracks the receive rate of a peer to tell when it collapses.
+type throughput struct {
+	avg    float64 // bytes per second, smoothed over the checks that didn't collapse
+	rx, tx uint64  // counters at the last check
+}
+
+// update records the counters of a peer after a check interval of d, and
+// reports whether its receive rate collapsed during it.
+func (t *throughput) update(rx, tx uint64, d time.Duration) bool {
+	if rx < t.rx || tx < t.tx {
+		// The peer was recreated, start over.
+		*t = throughput{rx: rx, tx: tx}
+		return false
+	}
+	rate := float64(rx-t.rx) / d.Seconds()
+	sent := tx - t.tx
+	t.rx, t.tx = rx, tx
+
+	if t.avg >= collapseMinRate && sent >= collapseMinSent && rate < t.avg*collapseRatio {
+		// Build the average up again after hopping, rather than hop
+		// on every check while the new flow ramps up.
+		t.avg = 0
+		return true
+	}
+	t.avg = 0.7*t.avg + 0.3*rate
+	return false
+}
+
+// hopPorts moves the peer with the given hex encoded public key to fresh
+// ports as h says, until vt.Ctx is done.
+func (vt *VirtualTun) hopPorts(peerKey string, h PortHopping) {
+	var pk device.NoisePublicKey
+	if err := pk.FromHex(peerKey); err != nil {
+		vt.Logger.Warn("port hopping disabled", "peer", peerKey, "error", err)
+		return
+	}
+
+	var schedule, check <-chan time.Time
+	if h.Interval > 0 {
+		t := time.NewTicker(h.Interval)
+		defer t.Stop()
+		schedule = t.C
+	}
+	if h.OnCollapse {
+		t := time.NewTicker(collapseCheckInterval)
+		defer t.Stop()
+		check = t.C
+	}
+
+	var tp throughput
+	for {
+		var reason string
+		select {
+		case <-vt.Ctx.Done():
+			return
+		case <-schedule:
+			reason = "schedule"
+		case <-check:
+			st, ok := vt.Dev.PeerStatsFor(pk)
+			if !ok || !tp.update(st.RxBytes, st.TxBytes, collapseCheckInterval) {
+				continue
+			}
+			reason = "throughput collapsed"
+		}
+
+		if err := vt.hop(pk, peerKey, h, reason); err != nil {
+			vt.Logger.Warn("unable to hop ports", "peer", peerKey, "error", err)
+		}
+	}
+}
+
+// hop moves the peer with public key pk to a new destination port from
+// h.Ports and, with h.Source, the device to a new local port.
+func (vt *VirtualTun) hop(pk device.NoisePublicKey, peerKey string, h PortHopping, reason string) error {
+	args := []any{"peer", peerKey, "reason", reason}
+
+	if h.Source {
+		if err := vt.Dev.IpcSet("listen_port=0\n"); err != nil {
+			return err
+		}
+		args = append(args, "listen-port", vt.Dev.ListenPort())
+	}
+
+	if len(h.Ports) > 0 {
+		st, ok := vt.Dev.PeerStatsFor(pk)
+		if !ok {
+			return fmt.Errorf("no peer %s", peerKey)
+		}
+		from, err := netip.ParseAddrPort(st.Endpoint)
+		if err != nil {
+			return fmt.Errorf("peer endpoint %q: %w", st.Endpoint, err)
+		}
+		to := netip.AddrPortFrom(from.Addr(), nextPort(h.Ports, from.Port()))
+
+		err = vt.Dev.IpcSet(fmt.Sprintf("public_key=%s\nupdate_only=true\nendpoint=%s\n", peerKey, to))
+		if err != nil {
+			return err
+		}
+		args = append(args, "from", from, "to", to)
+	}
+
+	// Move the session to the new flow now rather than with the next
+	// keepalive, which may be off.
+	if peer := vt.Dev.LookupPeer(pk); peer != nil {
+		peer.SendKeepalive()
+	}
+
+	if vt.router != nil {
+		if r, ok := vt.router.peers[peerKey]; ok {
+			r.hops.Add(1)
+			r.lastHop.Store(time.Now().UnixNano())
+		}
+	}
+
+	vt.Logger.Info("hopped ports", args...)
+	return nil
+}
+
+// nextPort returns a random port of ports other than current, or current
+// if there is no other.
+func nextPort(ports []uint16, current uint16) uint16 {
+	others := make([]uint16, 0, len(ports))
+	for _, p := range ports {
+		if p != current {
+			others = append(others, p)
+		}
+	}
+	if len(others) == 0 {
+		return current
+	}
+	return others[rand.Intn(len(others))]
+}
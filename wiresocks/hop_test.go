@@ -0,0 +1,53 @@
+package wiresocks
+
+import (
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestThroughputCollapse(t *testing.T) {
+	const d = collapseCheckInterval
+	perCheck := func(rate float64) uint64 { return uint64(rate * d.Seconds()) }
+
+	var tp throughput
+	var rx, tx uint64
+	step := func(rxRate float64, sent uint64) bool {
+		rx += perCheck(rxRate)
+		tx += sent
+		return tp.update(rx, tx, d)
+	}
+
+	// A steady download builds the average up.
+	for i := 0; i < 10; i++ {
+		qt.Assert(t, step(1<<20, 64<<10), qt.IsFalse)
+	}
+
+	// Going idle isn't a collapse: nothing is being sent either.
+	qt.Assert(t, step(0, 100), qt.IsFalse)
+
+	for i := 0; i < 10; i++ {
+		step(1<<20, 64<<10)
+	}
+
+	// Still sending, but hardly anything comes back.
+	qt.Assert(t, step(8<<10, 64<<10), qt.IsTrue)
+
+	// The average starts over, so the next slow check doesn't hop again.
+	qt.Assert(t, step(8<<10, 64<<10), qt.IsFalse)
+
+	// Counters going back means the peer was recreated.
+	qt.Assert(t, tp.update(0, 0, d), qt.IsFalse)
+	qt.Assert(t, tp.avg, qt.Equals, 0.0)
+}
+
+func TestNextPort(t *testing.T) {
+	ports := []uint16{500, 854, 2408}
+	for i := 0; i < 20; i++ {
+		p := nextPort(ports, 854)
+		qt.Assert(t, p, qt.Not(qt.Equals), uint16(854))
+		qt.Assert(t, ports, qt.Any(qt.Equals), p)
+	}
+
+	qt.Assert(t, nextPort([]uint16{2408}, 2408), qt.Equals, uint16(2408))
+}
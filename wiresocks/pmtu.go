@@ -0,0 +1,442 @@
+package wiresocks
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/netip"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+
+	"github.com/bepass-org/warp-plus/wireguard/conn"
+	"github.com/bepass-org/warp-plus/wireguard/device"
+	"github.com/bepass-org/warp-plus/wireguard/tun"
+)
+
+// MinMTU is the smallest tunnel MTU, the IPv6 minimum.
+const MinMTU = 1280
+
+// Path MTU probing. Each probe is a ping through the tunnel that fills the
+// MTU under test, handed to the device past netstack so that netstack's MTU
+// doesn't split it, and sent with the don't fragment bit set on the
+// WireGuard packets so that a path too small for them drops them. The first
+// probe also waits for the handshake.
+const (
+	probeTimeout          = time.Second
+	probeAttempts         = 2
+	probeHandshakeTimeout = 10 * time.Second
+)
+
+// Path MTU watching. Every mtuCheckInterval, the TCP segments received in
+// the interval are checked for signs of a shrunken path: plenty of large
+// segments but none that fill the MTU, which is what senders that detected
+// a black hole fall back to. Failed handshakes count as well. The path is
+// probed again at most once per mtuReprobeCooldown.
+const (
+	mtuCheckInterval   = 30 * time.Second
+	mtuReprobeCooldown = 5 * time.Minute
+	mtuLargeSegment    = 576 // bytes, the IPv4 default MSS plus headers
+	mtuMinSegments     = 64  // large segments per check to judge the path by
+	tcpMaxOptions      = 40  // bytes, so segments with options still count as full
+)
+
+// wireguardOverhead is what carrying a packet through a WireGuard tunnel
+// adds to it: IPv6 and UDP headers, and the transport header and tag.
+const wireguardOverhead = 40 + 8 + 32
+
+// ProbeTarget returns the address path MTU probes are sent to: the first
+// DNS server of conf in a family the interface has an address of.
+func ProbeTarget(conf *Configuration) (netip.Addr, error) {
+	for _, dns := range conf.Interface.DNS {
+		for _, prefix := range conf.Interface.Addresses {
+			if prefix.Addr().Is4() == dns.Is4() {
+				return dns, nil
+			}
+		}
+	}
+	return netip.Addr{}, errors.New("no dns server to probe the path mtu with")
+}
+
+// SetCarrier tells vt that its packets are carried by the tunnel outer,
+// as in warp in warp. From now on the MTU of vt follows that of outer, less
+// the WireGuard overhead, so only outer needs probing.
+func (vt *VirtualTun) SetCarrier(outer *VirtualTun) {
+	outer.carried.Store(vt)
+	vt.SetMTU(outer.MTU() - wireguardOverhead)
+}
+
+// MTU returns the MTU of the tunnel.
+func (vt *VirtualTun) MTU() int {
+	mtu, _ := vt.path.MTU()
+	return mtu
+}
+
+// SetMTU changes the MTU of the tunnel, and that of the tunnel it carries.
+// Everything sent from now on fits it, but TCP connections keep the MSS
+// they were opened with.
+func (vt *VirtualTun) SetMTU(mtu int) {
+	vt.Tnet.SetMTU(mtu)
+	if inner := vt.carried.Load(); inner != nil {
+		inner.SetMTU(mtu - wireguardOverhead)
+	}
+}
+
+// DiscoverMTU probes the path to target for the largest MTU up to max,
+// applies it to the tunnel, and then watches the path as WatchMTU does,
+// until vt.Ctx is done. The tunnel keeps its MTU while probing, and if
+// probing fails.
+func (vt *VirtualTun) DiscoverMTU(target netip.Addr, max int) {
+	found, err := vt.ProbeMTU(vt.Ctx, target, MinMTU, max)
+	if err != nil {
+		vt.Logger.Warn("unable to discover the path mtu", "mtu", vt.MTU(), "error", err)
+		return
+	}
+	vt.SetMTU(found)
+	vt.Logger.Info("discovered path mtu", "mtu", found, "target", target)
+
+	vt.WatchMTU(target, max)
+}
+
+// ProbeMTU returns the largest tunnel MTU from min to max that carries
+// packets to target and back, and an error if even min doesn't.
+func (vt *VirtualTun) ProbeMTU(ctx context.Context, target netip.Addr, min, max int) (int, error) {
+	src, ok := vt.path.source(target)
+	if !ok {
+		return 0, fmt.Errorf("no tunnel address to probe %s from", target)
+	}
+
+	df, ok := vt.Dev.Bind().(conn.DontFragmenter)
+	if !ok {
+		return 0, errors.New("bind can't set don't fragment")
+	}
+	if err := df.SetDontFragment(true); err != nil {
+		return 0, err
+	}
+	defer func() {
+		if err := df.SetDontFragment(false); err != nil {
+			vt.Logger.Warn("unable to clear don't fragment", "error", err)
+		}
+	}()
+
+	p := &prober{
+		send:    vt.Tnet.WriteRaw,
+		src:     src,
+		dst:     target,
+		id:      uint16(rand.Intn(1 << 16)),
+		seq:     uint16(rand.Intn(1 << 16)),
+		replies: make(chan probeReply, 16),
+	}
+	vt.path.probe.Store(p)
+	defer vt.path.probe.Store(nil)
+
+	if !p.ping(ctx, min, probeHandshakeTimeout) {
+		return 0, fmt.Errorf("no reply from %s to a %d byte probe", target, min)
+	}
+	if p.ping(ctx, max, probeTimeout) {
+		return max, nil
+	}
+
+	// min works and max doesn't.
+	for max-min > 1 {
+		mid := (min + max) / 2
+		if p.ping(ctx, mid, probeTimeout) {
+			min = mid
+		} else {
+			max = mid
+		}
+	}
+	return min, ctx.Err()
+}
+
+// prober sends pings of a given size through the tunnel, as raw packets
+// from src to dst, and learns of the replies from the pathWatcher.
+type prober struct {
+	send     func(pkt []byte) error
+	src, dst netip.Addr
+	id, seq  uint16
+	replies  chan probeReply
+}
+
+// probeReply is an echo reply to a probe.
+type probeReply struct {
+	seq  uint16
+	size int
+}
+
+// ping reports whether a ping filling an IP packet of size bytes got a
+// reply, trying probeAttempts times or, with a timeout past probeTimeout,
+// until the timeout.
+func (p *prober) ping(ctx context.Context, size int, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for attempt := 0; attempt < probeAttempts || time.Now().Before(deadline); attempt++ {
+		p.seq++
+		req, err := p.request(size)
+		if err != nil {
+			return false
+		}
+		if err := p.send(req); err != nil {
+			return false
+		}
+
+		t := time.NewTimer(probeTimeout)
+	wait:
+		for {
+			select {
+			case <-ctx.Done():
+				t.Stop()
+				return false
+			case <-t.C:
+				break wait // Timed out, try again
+			case r := <-p.replies:
+				// Replies to earlier probes may still arrive.
+				if r.seq == p.seq && r.size == size {
+					t.Stop()
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// request returns an echo request of size bytes, IP header included.
+func (p *prober) request(size int) ([]byte, error) {
+	var typ icmp.Type = ipv4.ICMPTypeEcho
+	header := 20
+	if p.dst.Is6() {
+		typ, header = ipv6.ICMPTypeEchoRequest, 40
+	}
+	if size < header+8 {
+		return nil, fmt.Errorf("probe of %d bytes too small", size)
+	}
+	data := make([]byte, size-header-8)
+	for i := range data {
+		data[i] = byte(i)
+	}
+
+	msg := &icmp.Message{Type: typ, Body: &icmp.Echo{ID: int(p.id), Seq: int(p.seq), Data: data}}
+	if p.dst.Is6() {
+		body, err := msg.Marshal(icmp.IPv6PseudoHeader(p.src.AsSlice(), p.dst.AsSlice()))
+		if err != nil {
+			return nil, err
+		}
+		pkt := make([]byte, header, size)
+		pkt[0] = 6 << 4
+		binary.BigEndian.PutUint16(pkt[4:], uint16(len(body)))
+		pkt[6] = 58 // ICMPv6
+		pkt[7] = 64 // Hop limit
+		copy(pkt[8:24], p.src.AsSlice())
+		copy(pkt[24:40], p.dst.AsSlice())
+		return append(pkt, body...), nil
+	}
+
+	body, err := msg.Marshal(nil)
+	if err != nil {
+		return nil, err
+	}
+	pkt := make([]byte, header, size)
+	pkt[0] = 4<<4 | 5
+	binary.BigEndian.PutUint16(pkt[2:], uint16(size))
+	binary.BigEndian.PutUint16(pkt[6:], 0x4000) // Don't fragment
+	pkt[8] = 64                                 // TTL
+	pkt[9] = 1                                  // ICMP
+	copy(pkt[12:16], p.src.AsSlice())
+	copy(pkt[16:20], p.dst.AsSlice())
+	binary.BigEndian.PutUint16(pkt[10:], ipChecksum(pkt))
+	return append(pkt, body...), nil
+}
+
+// observe hands pkt, a packet from the tunnel, to ping if it is a reply to
+// one of the probes.
+func (p *prober) observe(pkt []byte) {
+	var src netip.Addr
+	var size int
+	var echo []byte
+	switch {
+	case p.dst.Is4() && len(pkt) >= 28 && pkt[0]>>4 == 4 && pkt[9] == 1:
+		ipLen := int(pkt[0]&0x0f) * 4
+		if len(pkt) < ipLen+8 || pkt[ipLen] != byte(ipv4.ICMPTypeEchoReply) {
+			return
+		}
+		src = netip.AddrFrom4([4]byte(pkt[12:16]))
+		size, echo = int(binary.BigEndian.Uint16(pkt[2:])), pkt[ipLen:]
+	case p.dst.Is6() && len(pkt) >= 48 && pkt[0]>>4 == 6 && pkt[6] == 58:
+		if pkt[40] != byte(ipv6.ICMPTypeEchoReply) {
+			return
+		}
+		src = netip.AddrFrom16([16]byte(pkt[8:24]))
+		size, echo = 40+int(binary.BigEndian.Uint16(pkt[4:])), pkt[40:]
+	default:
+		return
+	}
+	if src != p.dst || binary.BigEndian.Uint16(echo[4:]) != p.id {
+		return
+	}
+
+	select {
+	case p.replies <- probeReply{seq: binary.BigEndian.Uint16(echo[6:]), size: size}:
+	default:
+	}
+}
+
+// WatchMTU probes the path to target again, for the largest MTU up to
+// max, when the tunnel shows signs of the path changing, and applies what
+// it finds, until vt.Ctx is done.
+func (vt *VirtualTun) WatchMTU(target netip.Addr, max int) {
+	failed := make(chan struct{}, 1)
+	vt.Dev.OnPeerEvent(func(e device.PeerEvent) {
+		if e.Type == device.PeerHandshakeFailed {
+			select {
+			case failed <- struct{}{}:
+			default:
+			}
+		}
+	})
+
+	t := time.NewTicker(mtuCheckInterval)
+	defer t.Stop()
+
+	var last time.Time
+	for {
+		var reason string
+		select {
+		case <-vt.Ctx.Done():
+			return
+		case <-failed:
+			reason = "handshake failed"
+		case <-t.C:
+			if !vt.path.shrunk() {
+				continue
+			}
+			reason = "no full size segments"
+		}
+		if time.Since(last) < mtuReprobeCooldown {
+			continue
+		}
+		last = time.Now()
+
+		found, err := vt.ProbeMTU(vt.Ctx, target, MinMTU, max)
+		if err != nil {
+			vt.Logger.Warn("unable to probe the path mtu", "reason", reason, "error", err)
+			continue
+		}
+		if found == vt.MTU() {
+			vt.Logger.Debug("path mtu unchanged", "reason", reason, "mtu", found)
+			continue
+		}
+		vt.SetMTU(found)
+		vt.Logger.Info("path mtu changed", "reason", reason, "mtu", found)
+	}
+}
+
+// pathWatcher wraps the netstack tun to watch the TCP segments it receives,
+// and to pass the replies to MTU probes on to the prober.
+type pathWatcher struct {
+	tun.Device
+	addrs []netip.Addr           // Addresses of the tun, to send probes from
+	probe atomic.Pointer[prober] // Prober waiting for replies, if any
+
+	large, full atomic.Uint64 // Large segments received since the last check, and those filling the MTU
+}
+
+func newPathWatcher(dev tun.Device, addrs []netip.Addr) *pathWatcher {
+	return &pathWatcher{Device: dev, addrs: addrs}
+}
+
+// source returns the address of the tun to send probes to target from.
+func (w *pathWatcher) source(target netip.Addr) (netip.Addr, bool) {
+	for _, addr := range w.addrs {
+		if addr.Is4() == target.Is4() {
+			return addr, true
+		}
+	}
+	return netip.Addr{}, false
+}
+
+// shrunk reports whether the segments received since the last call
+// suggest the path no longer carries packets of the MTU.
+func (w *pathWatcher) shrunk() bool {
+	large, full := w.large.Swap(0), w.full.Swap(0)
+	return large >= mtuMinSegments && full == 0
+}
+
+// Write counts the TCP segments passed to netstack, and hands the packets
+// to the prober, if any.
+func (w *pathWatcher) Write(bufs [][]byte, offset int) (int, error) {
+	mtu, _ := w.Device.MTU()
+	full := mtu - tcpMaxOptions
+	p := w.probe.Load()
+	for _, buf := range bufs {
+		if p != nil {
+			p.observe(buf[offset:])
+		}
+		size, ok := tcpSegmentSize(buf[offset:])
+		if !ok || size < mtuLargeSegment {
+			continue
+		}
+		w.large.Add(1)
+		if size >= full {
+			w.full.Add(1)
+		}
+	}
+	return w.Device.Write(bufs, offset)
+}
+
+// tcpHeader returns the TCP header of the TCP packet pkt, or false if pkt
+// isn't one. IPv6 extension headers and fragments aren't looked into.
+func tcpHeader(pkt []byte) (tcp []byte, ok bool) {
+	if len(pkt) < 1 {
+		return nil, false
+	}
+	var ipLen int
+	switch pkt[0] >> 4 {
+	case 4:
+		if len(pkt) < 20 || pkt[9] != 6 || binary.BigEndian.Uint16(pkt[6:])&0x1fff != 0 {
+			return nil, false
+		}
+		ipLen = int(pkt[0]&0x0f) * 4
+	case 6:
+		if len(pkt) < 40 || pkt[6] != 6 {
+			return nil, false
+		}
+		ipLen = 40
+	default:
+		return nil, false
+	}
+	if len(pkt) < ipLen+20 {
+		return nil, false
+	}
+	tcp = pkt[ipLen:]
+	if off := int(tcp[12]>>4) * 4; off < 20 || off > len(tcp) {
+		return nil, false
+	}
+	return tcp, true
+}
+
+// tcpSegmentSize returns the size of the TCP packet pkt if it carries data.
+func tcpSegmentSize(pkt []byte) (int, bool) {
+	tcp, ok := tcpHeader(pkt)
+	if !ok || len(tcp) == int(tcp[12]>>4)*4 {
+		return 0, false
+	}
+	return len(pkt), true
+}
+
+// ipChecksum returns the checksum of the IPv4 header of pkt, whose own
+// checksum field is zero.
+func ipChecksum(pkt []byte) uint16 {
+	var sum uint32
+	for i := 0; i < int(pkt[0]&0x0f)*4; i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(pkt[i:]))
+	}
+	for sum > 0xffff {
+		sum = sum&0xffff + sum>>16
+	}
+	return ^uint16(sum)
+}
@@ -0,0 +1,190 @@
+package wiresocks
+
+import (
+	"encoding/binary"
+	"net/netip"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+
+	"github.com/bepass-org/warp-plus/wireguard/tun"
+)
+
+// testSYN returns a TCP SYN packet announcing mss, with a valid checksum.
+func testSYN(v6 bool, mss uint16) []byte {
+	ipLen := 20
+	if v6 {
+		ipLen = 40
+	}
+	pkt := make([]byte, ipLen+28)
+	if v6 {
+		pkt[0] = 6 << 4
+		pkt[6] = 6
+		copy(pkt[8:], netip.MustParseAddr("fd00::1").AsSlice())
+		copy(pkt[24:], netip.MustParseAddr("2606:4700:4700::1111").AsSlice())
+	} else {
+		pkt[0] = 4<<4 | 5
+		binary.BigEndian.PutUint16(pkt[2:], uint16(len(pkt)))
+		pkt[9] = 6
+		copy(pkt[12:], netip.MustParseAddr("172.16.0.2").AsSlice())
+		copy(pkt[16:], netip.MustParseAddr("1.1.1.1").AsSlice())
+	}
+	tcp := pkt[ipLen:]
+	binary.BigEndian.PutUint16(tcp[0:], 40000)
+	binary.BigEndian.PutUint16(tcp[2:], 443)
+	tcp[12] = 7 << 4 // 28 bytes
+	tcp[13] = 0x02   // SYN
+	copy(tcp[20:], []byte{2, 4, byte(mss >> 8), byte(mss), 1, 1, 4, 2})
+	binary.BigEndian.PutUint16(tcp[16:], tcpChecksum(pkt, ipLen))
+	return pkt
+}
+
+// tcpChecksum computes the checksum of the TCP packet pkt, which is zero
+// for a packet with a valid checksum.
+func tcpChecksum(pkt []byte, ipLen int) uint16 {
+	var sum uint32
+	add := func(b []byte) {
+		for i := 0; i+1 < len(b); i += 2 {
+			sum += uint32(binary.BigEndian.Uint16(b[i:]))
+		}
+	}
+	tcp := pkt[ipLen:]
+	if ipLen == 40 {
+		add(pkt[8:40])
+	} else {
+		add(pkt[12:20])
+	}
+	sum += 6 + uint32(len(tcp))
+	add(tcp)
+	for sum > 0xffff {
+		sum = sum&0xffff + sum>>16
+	}
+	return ^uint16(sum)
+}
+
+// ipv4TCPFlags is the offset of the TCP flags in the packets of testSYN.
+const ipv4TCPFlags = 20 + 13
+
+func TestTCPSegmentSize(t *testing.T) {
+	_, ok := tcpSegmentSize(testSYN(false, 1380))
+	qt.Assert(t, ok, qt.IsFalse, qt.Commentf("SYN without data"))
+
+	pkt := append(testSYN(false, 1380), make([]byte, 1000)...)
+	size, ok := tcpSegmentSize(pkt)
+	qt.Assert(t, ok, qt.IsTrue)
+	qt.Assert(t, size, qt.Equals, len(pkt))
+}
+
+// discardTun is a tun that drops the packets written to it.
+type discardTun struct {
+	tun.Device
+	mtu int
+}
+
+func (d *discardTun) Write(bufs [][]byte, offset int) (int, error) { return len(bufs), nil }
+func (d *discardTun) MTU() (int, error)                            { return d.mtu, nil }
+
+func TestPathWatcherShrunk(t *testing.T) {
+	dev := &discardTun{mtu: 1420}
+	w := newPathWatcher(dev, nil)
+	segment := func(size int) []byte {
+		pkt := append(testSYN(false, 1380), make([]byte, size-48)...)
+		pkt[ipv4TCPFlags] = 0x10 // ACK
+		return pkt
+	}
+	receive := func(size, n int) {
+		for i := 0; i < n; i++ {
+			w.Write([][]byte{segment(size)}, 0)
+		}
+	}
+
+	receive(1000, mtuMinSegments)
+	qt.Assert(t, w.shrunk(), qt.IsTrue)
+	qt.Assert(t, w.shrunk(), qt.IsFalse, qt.Commentf("counters reset on check"))
+
+	receive(1000, mtuMinSegments)
+	receive(1400, 1)
+	qt.Assert(t, w.shrunk(), qt.IsFalse)
+
+	receive(200, 10*mtuMinSegments)
+	qt.Assert(t, w.shrunk(), qt.IsFalse, qt.Commentf("small segments say nothing"))
+
+	// Once lowered, full size is the new MTU.
+	dev.mtu = 1300
+	receive(1000, mtuMinSegments)
+	receive(1300, 1)
+	qt.Assert(t, w.shrunk(), qt.IsFalse)
+}
+
+// echoReply turns the echo request req into the reply to it.
+func echoReply(req []byte) []byte {
+	reply := append([]byte(nil), req...)
+	if reply[0]>>4 == 4 {
+		copy(reply[12:16], req[16:20])
+		copy(reply[16:20], req[12:16])
+		reply[20] = 0 // Echo reply
+	} else {
+		copy(reply[8:24], req[24:40])
+		copy(reply[24:40], req[8:24])
+		reply[40] = 129 // Echo reply
+	}
+	return reply
+}
+
+func TestProberObserve(t *testing.T) {
+	for _, v6 := range []bool{false, true} {
+		p := &prober{
+			src:     netip.MustParseAddr("172.16.0.2"),
+			dst:     netip.MustParseAddr("1.1.1.1"),
+			id:      0x1234,
+			seq:     7,
+			replies: make(chan probeReply, 1),
+		}
+		if v6 {
+			p.src = netip.MustParseAddr("2606:4700:110:8a36::2")
+			p.dst = netip.MustParseAddr("2606:4700:4700::1111")
+		}
+		c := qt.Commentf("v6 %t", v6)
+
+		req, err := p.request(1300)
+		qt.Assert(t, err, qt.IsNil, c)
+		qt.Assert(t, req, qt.HasLen, 1300, c)
+		if !v6 {
+			qt.Assert(t, ipChecksum(req), qt.Equals, uint16(0), c)
+		}
+
+		p.observe(req)
+		qt.Assert(t, p.replies, qt.HasLen, 0, qt.Commentf("v6 %t: request taken for a reply", v6))
+
+		p.observe(echoReply(req))
+		qt.Assert(t, <-p.replies, qt.Equals, probeReply{seq: 7, size: 1300}, c)
+
+		other := *p
+		other.id++
+		req, err = other.request(1300)
+		qt.Assert(t, err, qt.IsNil, c)
+		p.observe(echoReply(req))
+		qt.Assert(t, p.replies, qt.HasLen, 0, qt.Commentf("v6 %t: reply to another id", v6))
+
+		other = *p
+		other.dst = p.src
+		req, err = other.request(1300)
+		qt.Assert(t, err, qt.IsNil, c)
+		p.observe(echoReply(req))
+		qt.Assert(t, p.replies, qt.HasLen, 0, qt.Commentf("v6 %t: reply from another address", v6))
+	}
+}
+
+func TestProbeTarget(t *testing.T) {
+	conf := &Configuration{Interface: &InterfaceConfig{
+		Addresses: []netip.Prefix{netip.MustParsePrefix("fd00::2/128")},
+		DNS:       []netip.Addr{netip.MustParseAddr("1.1.1.1"), netip.MustParseAddr("2606:4700:4700::1111")},
+	}}
+	addr, err := ProbeTarget(conf)
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, addr, qt.Equals, netip.MustParseAddr("2606:4700:4700::1111"))
+
+	conf.Interface.DNS = conf.Interface.DNS[:1]
+	_, err = ProbeTarget(conf)
+	qt.Assert(t, err, qt.IsNotNil)
+}
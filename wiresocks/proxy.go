@@ -2,10 +2,13 @@ package wiresocks
 
 import (
 	"context"
+	"fmt"
 	"io"
 	"log/slog"
 	"net"
 	"net/netip"
+	"strconv"
+	"sync/atomic"
 
 	"github.com/bepass-org/warp-plus/proxy/pkg/mixed"
 	"github.com/bepass-org/warp-plus/proxy/pkg/statute"
@@ -15,10 +18,14 @@ import (
 
 // VirtualTun stores a reference to netstack network and DNS configuration
 type VirtualTun struct {
-	Tnet      *netstack.Net
-	Logger    *slog.Logger
-	Dev       *device.Device
-	Ctx       context.Context
+	Tnet    *netstack.Net
+	Logger  *slog.Logger
+	Dev     *device.Device
+	Ctx     context.Context
+	router  *router
+	path    *pathWatcher
+	capture *captureTun
+	carried atomic.Pointer[VirtualTun] // Tunnel this one carries, if any
 }
 
 // StartProxy spawns a socks5 server.
@@ -49,10 +56,15 @@ func (vt *VirtualTun) StartProxy(bindAddress netip.AddrPort) (netip.AddrPort, er
 
 func (vt *VirtualTun) generalHandler(req *statute.ProxyRequest) error {
 	vt.Logger.Info("handling connection", "protocol", req.Network, "destination", req.Destination)
-	conn, err := vt.Tnet.Dial(req.Network, req.Destination)
+	conn, peer, err := vt.dial(req.Network, req.Destination)
 	if err != nil {
 		return err
 	}
+	if peer != nil {
+		peer.active.Add(1)
+		peer.total.Add(1)
+		defer peer.active.Add(-1)
+	}
 	// Close the connections when this function exits
 	defer conn.Close()
 	defer req.Conn.Close()
@@ -82,6 +94,89 @@ func (vt *VirtualTun) generalHandler(req *statute.ProxyRequest) error {
 	return nil
 }
 
+// dial connects to destination through the peer whose AllowedIPs carry it,
+// from the interface address that peer expects. Without a router it leaves
+// the choice to netstack.
+func (vt *VirtualTun) dial(network, destination string) (net.Conn, *peerRoute, error) {
+	if vt.router == nil {
+		conn, err := vt.Tnet.Dial(network, destination)
+		return conn, nil, err
+	}
+
+	host, port, err := net.SplitHostPort(destination)
+	if err != nil {
+		return nil, nil, err
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid port in %s", destination)
+	}
+
+	addrs, err := vt.lookupHost(host)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = fmt.Errorf("no peer allows %s", destination)
+	for _, addr := range addrs {
+		peer, src, ok := vt.router.lookup(addr)
+		if !ok {
+			continue
+		}
+		dst := netip.AddrPortFrom(addr, uint16(p))
+
+		var conn net.Conn
+		switch network {
+		case "tcp", "tcp4", "tcp6":
+			conn, err = vt.Tnet.DialContextTCPAddrPortFrom(vt.Ctx, netip.AddrPortFrom(src, 0), dst)
+		case "udp", "udp4", "udp6":
+			conn, err = vt.Tnet.DialUDPAddrPort(netip.AddrPortFrom(src, 0), dst)
+		default:
+			return nil, nil, fmt.Errorf("unsupported network %s", network)
+		}
+		if err != nil {
+			// Try the next address, as net.Dial does
+			continue
+		}
+		vt.Logger.Debug("routed connection", "destination", dst, "peer", peer.publicKey, "source", src)
+		return conn, peer, nil
+	}
+
+	return nil, nil, err
+}
+
+// DialContext connects to address through the tunnel, as proxied
+// connections are. It can be passed to warp.SetDialContext to reach the
+// WARP API from inside the tunnel.
+func (vt *VirtualTun) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	if vt.router == nil {
+		return vt.Tnet.DialContext(ctx, network, address)
+	}
+	conn, _, err := vt.dial(network, address)
+	return conn, err
+}
+
+// lookupHost returns the addresses of host, resolved through the tunnel if
+// it is a name.
+func (vt *VirtualTun) lookupHost(host string) ([]netip.Addr, error) {
+	if addr, err := netip.ParseAddr(host); err == nil {
+		return []netip.Addr{addr.Unmap()}, nil
+	}
+
+	names, err := vt.Tnet.LookupContextHost(vt.Ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	addrs := make([]netip.Addr, 0, len(names))
+	for _, name := range names {
+		if addr, err := netip.ParseAddr(name); err == nil {
+			addrs = append(addrs, addr.Unmap())
+		}
+	}
+	return addrs, nil
+}
+
 func (vt *VirtualTun) Stop() {
 	if vt.Dev != nil {
 		if err := vt.Dev.Down(); err != nil {
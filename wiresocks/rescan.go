@@ -0,0 +1,228 @@
+package wiresocks
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/netip"
+	"sync/atomic"
+	"time"
+
+	"github.com/bepass-org/warp-plus/ipscanner"
+	"github.com/bepass-org/warp-plus/warp"
+	"github.com/bepass-org/warp-plus/wireguard/device"
+)
+
+// RescanOptions struct holds the options for rescanning while the tunnel runs
+type RescanOptions struct {
+	ScanOptions
+	Interval    time.Duration // How often the current endpoint is checked, zero for 30s
+	Rate        int           // Background scan probes per second, zero for 2
+	MaxFailures int           // Failed checks in a row before switching, zero for 3
+}
+
+// withDefaults fills in the zero fields of o.
+func (o RescanOptions) withDefaults() RescanOptions {
+	if o.Interval <= 0 {
+		o.Interval = 30 * time.Second
+	}
+	if o.Rate <= 0 {
+		o.Rate = 2
+	}
+	if o.MaxFailures <= 0 {
+		o.MaxFailures = 3
+	}
+	return o
+}
+
+// Rescanner keeps a warm list of good endpoints while the tunnel runs, and
+// moves the running device to the best of them once the current endpoint
+// degrades.
+//
+// The current endpoint is judged from the state of the peer in the device,
+// as a handshake with the tunnel's own key would replace its session.
+// Candidates are probed with WARP handshakes from the host network, with a
+// throwaway key, so they measure the path the tunnel would take.
+type Rescanner struct {
+	vt       *VirtualTun
+	l        *slog.Logger
+	opts     RescanOptions
+	peerKey  string // hex encoded public key of the peer to move
+	pk       device.NoisePublicKey
+	current  netip.AddrPort
+	failures int
+	lastRx   uint64      // Bytes received from the peer at the last check
+	failed   atomic.Bool // Whether a handshake failed since the last check
+	// probe handshakes with a candidate endpoint and returns its RTT.
+	probe   func(ctx context.Context, addr netip.AddrPort) (time.Duration, error)
+	scanner *ipscanner.IPScanner
+}
+
+// NewRescanner returns a Rescanner for the peer of vt with the given hex
+// encoded public key, which currently uses endpoint current.
+func NewRescanner(l *slog.Logger, vt *VirtualTun, peerKey string, current netip.AddrPort, opts RescanOptions) (*Rescanner, error) {
+	opts = opts.withDefaults()
+
+	var pk device.NoisePublicKey
+	if err := pk.FromHex(peerKey); err != nil {
+		return nil, err
+	}
+
+	_, publicKey, err := profileKeys(opts.profile())
+	if err != nil {
+		return nil, err
+	}
+	key, err := warp.GeneratePrivateKey()
+	if err != nil {
+		return nil, err
+	}
+	privateKey := key.String()
+
+	l = l.With("subsystem", "rescan")
+	return &Rescanner{
+		vt:      vt,
+		l:       l,
+		opts:    opts,
+		peerKey: peerKey,
+		pk:      pk,
+		current: current,
+		probe: func(ctx context.Context, addr netip.AddrPort) (time.Duration, error) {
+			return ipscanner.ValidateWarpEndpoint(ctx, addr, privateKey, publicKey)
+		},
+		scanner: ipscanner.NewScanner(
+			ipscanner.WithLogger(l.With("subsystem", "scanner")),
+			ipscanner.WithWarpPing(),
+			ipscanner.WithWarpPrivateKey(privateKey),
+			ipscanner.WithWarpPeerPublicKey(publicKey),
+			ipscanner.WithUseIPv4(opts.V4),
+			ipscanner.WithUseIPv6(opts.V6),
+			ipscanner.WithMaxDesirableRTT(opts.MaxRTT),
+			ipscanner.WithCidrList(warp.WarpPrefixes()),
+			// Stay out of the way of the tunnel: few probes, slowly.
+			ipscanner.WithConcurrency(2),
+			ipscanner.WithRateLimit(opts.Rate),
+			ipscanner.WithIPQueueSize(4),
+			ipscanner.WithIPQueueTTL(5*opts.Interval),
+		),
+	}, nil
+}
+
+// Run scans in the background and checks the current endpoint every
+// Interval until ctx is done.
+func (r *Rescanner) Run(ctx context.Context) {
+	r.vt.Dev.OnPeerEvent(func(e device.PeerEvent) {
+		if e.Type == device.PeerHandshakeFailed && e.PublicKey == r.pk {
+			r.failed.Store(true)
+		}
+	})
+	if stats, ok := r.vt.Dev.PeerStatsFor(r.pk); ok {
+		r.lastRx = stats.RxBytes
+	}
+
+	r.scanner.Run(ctx)
+
+	t := time.NewTicker(r.opts.Interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+
+		stats, ok := r.vt.Dev.PeerStatsFor(r.pk)
+		if !ok {
+			r.l.Warn("peer is gone, stopping", "peer", r.peerKey)
+			return
+		}
+		if !r.degraded(stats, time.Now()) {
+			continue
+		}
+
+		if err := r.switchEndpoint(ctx); err != nil {
+			r.l.Warn("unable to switch endpoint", "endpoint", r.current, "error", err)
+		}
+	}
+}
+
+// degraded checks the current endpoint against stats, the state of the
+// peer at now, and reports whether it failed MaxFailures checks in a row.
+// A check fails if a handshake failed since the last one, or if nothing
+// was received while the session is older than the device accepts.
+func (r *Rescanner) degraded(stats device.PeerStats, now time.Time) bool {
+	received := stats.RxBytes > r.lastRx
+	r.lastRx = stats.RxBytes
+	age := now.Sub(stats.LastHandshake)
+
+	switch {
+	case r.failed.Swap(false):
+		r.failures++
+		r.l.Debug("handshake failed", "endpoint", r.current, "failures", r.failures)
+	case !received && age > device.RejectAfterTime:
+		r.failures++
+		r.l.Debug("endpoint silent", "endpoint", r.current, "failures", r.failures, "handshake-age", age)
+	default:
+		r.failures = 0
+		r.l.Debug("endpoint healthy", "endpoint", r.current, "handshake-age", age)
+	}
+
+	return r.failures >= r.opts.MaxFailures
+}
+
+// switchEndpoint moves the peer to the best scanned endpoint that still
+// answers a handshake.
+func (r *Rescanner) switchEndpoint(ctx context.Context) error {
+	candidates := r.scanner.GetAvailableIPs()
+	addr, rtt, ok := r.pick(ctx, candidates)
+	if !ok {
+		return fmt.Errorf("no working endpoint among %d candidates", len(candidates))
+	}
+
+	if err := r.vt.SetEndpoint(r.peerKey, addr); err != nil {
+		return err
+	}
+
+	r.l.Info("switched endpoint", "from", r.current, "to", addr, "rtt", rtt)
+	r.current = addr
+	r.failures = 0
+	return nil
+}
+
+// pick returns the first of candidates, other than the current endpoint,
+// that answers a probe within MaxRTT.
+func (r *Rescanner) pick(ctx context.Context, candidates []ipscanner.IPInfo) (netip.AddrPort, time.Duration, bool) {
+	for _, c := range candidates {
+		if c.AddrPort == r.current {
+			continue
+		}
+
+		rtt, err := r.probe(ctx, c.AddrPort)
+		if err != nil || rtt > r.opts.MaxRTT {
+			continue
+		}
+		return c.AddrPort, rtt, true
+	}
+	return netip.AddrPort{}, 0, false
+}
+
+// SetEndpoint moves the peer with the given hex encoded public key to
+// endpoint, without restarting the device. The current session is dropped
+// so the next packet triggers a handshake with the new endpoint.
+func (vt *VirtualTun) SetEndpoint(peerKey string, endpoint netip.AddrPort) error {
+	err := vt.Dev.IpcSet(fmt.Sprintf("public_key=%s\nupdate_only=true\nendpoint=%s\n", peerKey, endpoint))
+	if err != nil {
+		return err
+	}
+
+	var pk device.NoisePublicKey
+	if err := pk.FromHex(peerKey); err != nil {
+		return err
+	}
+	if peer := vt.Dev.LookupPeer(pk); peer != nil {
+		peer.ExpireCurrentKeypairs()
+		peer.SendHandshakeInitiation(false)
+	}
+
+	return nil
+}
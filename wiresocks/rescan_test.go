@@ -0,0 +1,146 @@
+package wiresocks
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/bepass-org/warp-plus/ipscanner"
+	"github.com/bepass-org/warp-plus/wireguard/device"
+	qt "github.com/frankban/quicktest"
+	"github.com/google/go-cmp/cmp/cmpopts"
+)
+
+func TestRescannerDegraded(t *testing.T) {
+	now := time.Now()
+	fresh := now.Add(-time.Minute)
+	stale := now.Add(-device.RejectAfterTime - time.Second)
+
+	// check is the state of the peer at one check.
+	type check struct {
+		rx            uint64
+		lastHandshake time.Time
+		failed        bool // A handshake failed since the previous check
+	}
+
+	tests := []struct {
+		name   string
+		checks []check
+		want   []bool
+	}{{
+		name:   "traffic flowing",
+		checks: []check{{100, fresh, false}, {200, fresh, false}, {300, fresh, false}, {400, fresh, false}},
+		want:   []bool{false, false, false, false},
+	}, {
+		name:   "idle with a live session",
+		checks: []check{{0, fresh, false}, {0, fresh, false}, {0, fresh, false}, {0, fresh, false}},
+		want:   []bool{false, false, false, false},
+	}, {
+		name:   "silent past the session lifetime",
+		checks: []check{{0, stale, false}, {0, stale, false}, {0, stale, false}, {0, stale, false}},
+		want:   []bool{false, false, true, true},
+	}, {
+		name:   "stale session still receiving",
+		checks: []check{{100, stale, false}, {200, stale, false}, {300, stale, false}},
+		want:   []bool{false, false, false},
+	}, {
+		name:   "handshakes failing while receiving",
+		checks: []check{{100, fresh, true}, {200, fresh, true}, {300, fresh, true}},
+		want:   []bool{false, false, true},
+	}, {
+		name:   "recovery resets the count",
+		checks: []check{{0, stale, false}, {0, stale, true}, {100, fresh, false}, {100, stale, false}, {100, stale, false}},
+		want:   []bool{false, false, false, false, false},
+	}}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &Rescanner{
+				l:    slog.Default(),
+				opts: RescanOptions{}.withDefaults(),
+			}
+			for i, c := range tt.checks {
+				r.failed.Store(c.failed)
+				got := r.degraded(device.PeerStats{RxBytes: c.rx, LastHandshake: c.lastHandshake}, now)
+				qt.Check(t, got, qt.Equals, tt.want[i], qt.Commentf("check %d", i))
+			}
+		})
+	}
+}
+
+func TestRescannerPick(t *testing.T) {
+	current := netip.MustParseAddrPort("162.159.192.1:2408")
+	a := netip.MustParseAddrPort("162.159.192.2:2408")
+	b := netip.MustParseAddrPort("162.159.192.3:2408")
+	c := netip.MustParseAddrPort("162.159.192.4:2408")
+
+	// The probes of each candidate, a zero RTT for no answer.
+	rtts := map[netip.AddrPort]time.Duration{
+		current: 10 * time.Millisecond,
+		a:       0,
+		b:       300 * time.Millisecond,
+		c:       50 * time.Millisecond,
+	}
+
+	tests := []struct {
+		name       string
+		candidates []netip.AddrPort
+		maxRTT     time.Duration
+		want       netip.AddrPort
+		wantRTT    time.Duration
+		probed     []netip.AddrPort
+	}{{
+		name:       "first that answers in time",
+		candidates: []netip.AddrPort{current, a, b, c},
+		maxRTT:     100 * time.Millisecond,
+		want:       c,
+		wantRTT:    50 * time.Millisecond,
+		probed:     []netip.AddrPort{a, b, c},
+	}, {
+		name:       "slow answer within a larger limit",
+		candidates: []netip.AddrPort{a, b, c},
+		maxRTT:     time.Second,
+		want:       b,
+		wantRTT:    300 * time.Millisecond,
+		probed:     []netip.AddrPort{a, b},
+	}, {
+		name:       "none works",
+		candidates: []netip.AddrPort{current, a, b},
+		maxRTT:     100 * time.Millisecond,
+		probed:     []netip.AddrPort{a, b},
+	}, {
+		name:   "no candidates",
+		maxRTT: 100 * time.Millisecond,
+	}}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var probed []netip.AddrPort
+			r := &Rescanner{
+				opts:    RescanOptions{ScanOptions: ScanOptions{MaxRTT: tt.maxRTT}},
+				current: current,
+				probe: func(ctx context.Context, addr netip.AddrPort) (time.Duration, error) {
+					probed = append(probed, addr)
+					if rtts[addr] == 0 {
+						return 0, errors.New("no answer")
+					}
+					return rtts[addr], nil
+				},
+			}
+
+			var candidates []ipscanner.IPInfo
+			for _, addr := range tt.candidates {
+				candidates = append(candidates, ipscanner.IPInfo{AddrPort: addr})
+			}
+
+			addr, rtt, ok := r.pick(context.Background(), candidates)
+			qt.Assert(t, ok, qt.Equals, tt.want.IsValid())
+			qt.Assert(t, addr, qt.Equals, tt.want)
+			qt.Assert(t, rtt, qt.Equals, tt.wantRTT)
+			qt.Assert(t, probed, qt.CmpEquals(cmpopts.EquateComparable(netip.AddrPort{})), tt.probed)
+		})
+	}
+}
@@ -0,0 +1,134 @@
+package wiresocks
+
+import (
+	"encoding/hex"
+	"net/netip"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/bepass-org/warp-plus/wireguard/device"
+)
+
+// route sends the destinations in prefix through a peer.
+type route struct {
+	prefix netip.Prefix
+	peer   *peerRoute
+}
+
+// peerRoute holds what the proxy knows about one peer.
+type peerRoute struct {
+	publicKey string // hex encoded
+	active    atomic.Int64
+	total     atomic.Uint64
+	hops      atomic.Uint64
+	lastHop   atomic.Int64 // Unix nanoseconds, zero before the first hop
+}
+
+// router picks the peer for a destination by longest prefix match over the
+// peers' AllowedIPs, as the device does, and the interface address to send
+// from, so each peer sees the address it expects.
+type router struct {
+	routes    []route // longest prefix first
+	addresses []netip.Prefix
+	peers     map[string]*peerRoute
+}
+
+// newRouter returns a router for the peers and interface addresses of conf.
+func newRouter(conf *Configuration) *router {
+	r := &router{
+		addresses: conf.Interface.Addresses,
+		peers:     make(map[string]*peerRoute, len(conf.Peers)),
+	}
+	for _, peer := range conf.Peers {
+		p := &peerRoute{publicKey: peer.PublicKey}
+		r.peers[peer.PublicKey] = p
+		for _, prefix := range peer.AllowedIPs {
+			r.routes = append(r.routes, route{prefix: prefix.Masked(), peer: p})
+		}
+	}
+	sort.SliceStable(r.routes, func(i, j int) bool {
+		return r.routes[i].prefix.Bits() > r.routes[j].prefix.Bits()
+	})
+	return r
+}
+
+// lookup returns the peer that carries dst, and the interface address to
+// use as its source. ok is false if no peer allows dst.
+func (r *router) lookup(dst netip.Addr) (peer *peerRoute, src netip.Addr, ok bool) {
+	dst = dst.Unmap()
+	for _, rt := range r.routes {
+		if rt.prefix.Contains(dst) {
+			peer = rt.peer
+			break
+		}
+	}
+	if peer == nil {
+		return nil, netip.Addr{}, false
+	}
+
+	// Prefer an address on the destination's network, such as 10.0.0.2/8
+	// for an office peer, then any address of the same family.
+	for _, prefix := range r.addresses {
+		if prefix.Contains(dst) {
+			return peer, prefix.Addr(), true
+		}
+	}
+	for _, prefix := range r.addresses {
+		if prefix.Addr().Is4() == dst.Is4() {
+			return peer, prefix.Addr(), true
+		}
+	}
+	return nil, netip.Addr{}, false
+}
+
+// PeerStatus is the state of one peer of the device.
+type PeerStatus struct {
+	PublicKey           string // hex encoded
+	Endpoint            string
+	AllowedIPs          []netip.Prefix
+	LastHandshake       time.Time // Zero if no handshake happened yet
+	RxBytes             uint64
+	TxBytes             uint64
+	PersistentKeepalive int
+	ActiveConnections   int64     // Proxied connections open through the peer
+	TotalConnections    uint64    // Proxied connections since start
+	PortHops            uint64    // Times the peer's flow moved to fresh ports
+	LastPortHop         time.Time // Zero if the flow never moved
+}
+
+// PeerStatus returns the status of every peer of the device.
+func (vt *VirtualTun) PeerStatus() []PeerStatus {
+	return vt.peerStatus(vt.Dev.PeerStats())
+}
+
+// peerStatus adds the connection and hop counters of the router to the
+// device's stats of each peer, sorted by public key.
+func (vt *VirtualTun) peerStatus(stats []device.PeerStats) []PeerStatus {
+	peers := make([]PeerStatus, 0, len(stats))
+	for _, st := range stats {
+		p := PeerStatus{
+			PublicKey:           hex.EncodeToString(st.PublicKey[:]),
+			Endpoint:            st.Endpoint,
+			AllowedIPs:          st.AllowedIPs,
+			LastHandshake:       st.LastHandshake,
+			RxBytes:             st.RxBytes,
+			TxBytes:             st.TxBytes,
+			PersistentKeepalive: int(st.PersistentKeepalive / time.Second),
+		}
+		if vt.router != nil {
+			if r, ok := vt.router.peers[p.PublicKey]; ok {
+				p.ActiveConnections = r.active.Load()
+				p.TotalConnections = r.total.Load()
+				p.PortHops = r.hops.Load()
+				if nano := r.lastHop.Load(); nano != 0 {
+					p.LastPortHop = time.Unix(0, nano)
+				}
+			}
+		}
+		peers = append(peers, p)
+	}
+
+	sort.Slice(peers, func(i, j int) bool { return peers[i].PublicKey < peers[j].PublicKey })
+	return peers
+}
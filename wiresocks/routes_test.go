@@ -0,0 +1,118 @@
+package wiresocks
+
+import (
+	"encoding/hex"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/bepass-org/warp-plus/wireguard/device"
+	qt "github.com/frankban/quicktest"
+)
+
+func TestRouterLookup(t *testing.T) {
+	conf := &Configuration{
+		Interface: &InterfaceConfig{
+			Addresses: []netip.Prefix{
+				netip.MustParsePrefix("172.16.0.2/32"),
+				netip.MustParsePrefix("10.0.0.5/8"),
+				netip.MustParsePrefix("2606:4700:110:8cc0::2/128"),
+			},
+		},
+		Peers: []PeerConfig{{
+			PublicKey:  "warp",
+			AllowedIPs: []netip.Prefix{netip.MustParsePrefix("0.0.0.0/0"), netip.MustParsePrefix("::/0")},
+		}, {
+			PublicKey:  "office",
+			AllowedIPs: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")},
+		}, {
+			PublicKey:  "printer",
+			AllowedIPs: []netip.Prefix{netip.MustParsePrefix("10.1.2.3/32")},
+		}},
+	}
+	r := newRouter(conf)
+
+	tests := []struct {
+		dst  string
+		peer string
+		src  string
+	}{
+		{dst: "1.1.1.1", peer: "warp", src: "172.16.0.2"},
+		{dst: "10.20.30.40", peer: "office", src: "10.0.0.5"},
+		{dst: "10.1.2.3", peer: "printer", src: "10.0.0.5"},
+		{dst: "::ffff:10.1.2.3", peer: "printer", src: "10.0.0.5"},
+		{dst: "2606:4700::1111", peer: "warp", src: "2606:4700:110:8cc0::2"},
+	}
+	for _, tt := range tests {
+		peer, src, ok := r.lookup(netip.MustParseAddr(tt.dst))
+		qt.Assert(t, ok, qt.IsTrue, qt.Commentf("%s", tt.dst))
+		qt.Check(t, peer.publicKey, qt.Equals, tt.peer, qt.Commentf("%s", tt.dst))
+		qt.Check(t, src, qt.Equals, netip.MustParseAddr(tt.src), qt.Commentf("%s", tt.dst))
+	}
+}
+
+func TestRouterNoRoute(t *testing.T) {
+	r := newRouter(&Configuration{
+		Interface: &InterfaceConfig{Addresses: []netip.Prefix{netip.MustParsePrefix("10.0.0.5/24")}},
+		Peers: []PeerConfig{{
+			PublicKey:  "office",
+			AllowedIPs: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/24")},
+		}},
+	})
+
+	_, _, ok := r.lookup(netip.MustParseAddr("1.1.1.1"))
+	qt.Assert(t, ok, qt.IsFalse)
+
+	// A route without an interface address of its family can't be used either.
+	r.routes = append(r.routes, route{prefix: netip.MustParsePrefix("::/0"), peer: r.peers["office"]})
+	_, _, ok = r.lookup(netip.MustParseAddr("2606:4700::1111"))
+	qt.Assert(t, ok, qt.IsFalse)
+}
+
+func TestPeerStatus(t *testing.T) {
+	var warpKey, officeKey device.NoisePublicKey
+	warpKey[0], officeKey[0] = 1, 2
+	warp, office := hex.EncodeToString(warpKey[:]), hex.EncodeToString(officeKey[:])
+
+	vt := &VirtualTun{router: newRouter(&Configuration{
+		Interface: &InterfaceConfig{},
+		Peers:     []PeerConfig{{PublicKey: warp}, {PublicKey: office}},
+	})}
+	hop := time.Unix(1700000100, 0)
+	r := vt.router.peers[office]
+	r.active.Add(2)
+	r.total.Add(5)
+	r.hops.Add(1)
+	r.lastHop.Store(hop.UnixNano())
+
+	handshake := time.Unix(1700000000, 500)
+	stats := []device.PeerStats{{
+		PublicKey:           officeKey,
+		Endpoint:            "198.51.100.1:51820",
+		LastHandshake:       handshake,
+		RxBytes:             4096,
+		TxBytes:             1024,
+		PersistentKeepalive: 25 * time.Second,
+		AllowedIPs:          []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")},
+	}, {
+		PublicKey:  warpKey,
+		AllowedIPs: []netip.Prefix{netip.MustParsePrefix("0.0.0.0/0")},
+	}}
+
+	qt.Assert(t, vt.peerStatus(stats), qt.CmpEquals(cmpNetip), []PeerStatus{{
+		PublicKey:  warp,
+		AllowedIPs: []netip.Prefix{netip.MustParsePrefix("0.0.0.0/0")},
+	}, {
+		PublicKey:           office,
+		Endpoint:            "198.51.100.1:51820",
+		AllowedIPs:          []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")},
+		LastHandshake:       handshake,
+		RxBytes:             4096,
+		TxBytes:             1024,
+		PersistentKeepalive: 25,
+		ActiveConnections:   2,
+		TotalConnections:    5,
+		PortHops:            1,
+		LastPortHop:         hop,
+	}})
+}
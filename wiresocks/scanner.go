@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"log/slog"
+	"net/netip"
 	"time"
 
 	"github.com/bepass-org/warp-plus/ipscanner"
@@ -14,16 +15,32 @@ import (
 
 // ScanOptions struct holds the options for the IP scan
 type ScanOptions struct {
-	V4     bool   // IPv4 scan enabled
-	V6     bool   // IPv6 scan enabled
+	V4     bool // IPv4 scan enabled
+	V6     bool // IPv6 scan enabled
 	MaxRTT time.Duration
 	// MaxRTT is the maximum round-trip time for the scan
+	Profile string // WireGuard profile whose keys are used for probing
+	Cache   string // Scan result cache, empty disables caching
+}
+
+// profile returns the WireGuard profile used for probing.
+func (o ScanOptions) profile() string {
+	if o.Profile == "" {
+		return "./primary/wgcf-profile.ini"
+	}
+	return o.Profile
 }
 
 // RunScan function initiates an IP scan with the given options
 func RunScan(ctx context.Context, l *slog.Logger, opts ScanOptions) (result []ipscanner.IPInfo, err error) {
+	return runScan(ctx, l, opts, nil)
+}
+
+// runScan runs the scan of RunScan, calling failed, if set, with every
+// endpoint that didn't answer a probe.
+func runScan(ctx context.Context, l *slog.Logger, opts ScanOptions, failed func(netip.AddrPort)) (result []ipscanner.IPInfo, err error) {
 	// Load the configuration file
-	cfg, err := ini.Load("./primary/wgcf-profile.ini")
+	cfg, err := ini.Load(opts.profile())
 	if err != nil {
 		return nil, fmt.Errorf("failed to read file: %w", err)
 	}
@@ -35,7 +52,7 @@ func RunScan(ctx context.Context, l *slog.Logger, opts ScanOptions) (result []ip
 	publicKey := cfg.Section("Peer").Key("PublicKey").String()
 
 	// Initialize a new IP scanner
-	scanner := ipscanner.NewScanner(
+	options := []ipscanner.Option{
 		ipscanner.WithLogger(l.With(slog.String("subsystem", "scanner"))),
 		ipscanner.WithWarpPing(),
 		ipscanner.WithWarpPrivateKey(privateKey),
@@ -44,20 +61,38 @@ func RunScan(ctx context.Context, l *slog.Logger, opts ScanOptions) (result []ip
 		ipscanner.WithUseIPv6(opts.V6),
 		ipscanner.WithMaxDesirableRTT(opts.MaxRTT),
 		ipscanner.WithCidrList(warp.WarpPrefixes()),
-	)
+	}
+	if failed != nil {
+		// The callback sees every event, where subscribers may miss some.
+		options = append(options, ipscanner.WithEventCallback(func(ev ipscanner.Event) {
+			if ev.Type == ipscanner.EventProbeFailed {
+				failed(ev.AddrPort)
+			}
+		}))
+	}
+	scanner := ipscanner.NewScanner(options...)
 
 	// Set a timeout context for the scan
 	ctx, cancel := context.WithTimeout(ctx, 2*time.Minute)
 	defer cancel()
 
-	// Start the IP scan
+	// Start the IP scan, following the queue as it fills up
+	events := scanner.Subscribe(16)
 	scanner.Run(ctx)
 
-	// Set up a ticker to check the scan progress
-	t := time.NewTicker(1 * time.Second)
-	defer t.Stop()
+	for ev := range events {
+		if ev.Type != ipscanner.EventQueueChanged || len(ev.Queue) < 2 {
+			continue
+		}
+
+		// Remember the ports that answered so random endpoints use them.
+		if err := warp.SetReachablePorts(scanner.ReachablePorts()); err != nil {
+			l.Warn("unable to save reachable ports", "error", err)
+		}
 
-	// Continuously check the scan progress until it's done
-	for {
-		ipList := scanner.GetAvailableIPs()
-		if len(ipList) > 1 {
+		return ev.Queue[:2], nil
+	}
+
+	// The scan ended when the context was done - canceled externally
+	return nil, errors.New("user canceled the operation")
+}
@@ -0,0 +1,38 @@
+package wiresocks
+
+import (
+	"errors"
+	"net"
+)
+
+// ServeUAPI serves the device's UAPI on a socket named name, the way a
+// kernel interface of that name would, so tools such as `wg show` and
+// `wg set` can inspect and change the running device. It returns once the
+// socket listens, and closes it when the tunnel's context is done.
+func (vt *VirtualTun) ServeUAPI(name string) (net.Addr, error) {
+	ln, err := uapiListen(name)
+	if err != nil {
+		return nil, err
+	}
+
+	go func() {
+		<-vt.Ctx.Done()
+		ln.Close()
+	}()
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if errors.Is(err, net.ErrClosed) || vt.Ctx.Err() != nil {
+				return
+			}
+			if err != nil {
+				vt.Logger.Warn("uapi accept failed", "error", err)
+				return
+			}
+			go vt.Dev.IpcHandle(conn)
+		}
+	}()
+
+	return ln.Addr(), nil
+}
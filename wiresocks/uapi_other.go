@@ -0,0 +1,13 @@
+//go:build !(linux || darwin || freebsd || openbsd || windows)
+
+package wiresocks
+
+import (
+	"errors"
+	"net"
+)
+
+// uapiListen fails, as there is no UAPI transport on this platform.
+func uapiListen(name string) (net.Listener, error) {
+	return nil, errors.New("uapi is not supported on this platform")
+}
@@ -0,0 +1,19 @@
+//go:build linux || darwin || freebsd || openbsd
+
+package wiresocks
+
+import (
+	"net"
+
+	"github.com/bepass-org/warp-plus/wireguard/ipc"
+)
+
+// uapiListen listens on the UAPI unix socket for name, under the directory
+// wg looks in.
+func uapiListen(name string) (net.Listener, error) {
+	file, err := ipc.UAPIOpen(name)
+	if err != nil {
+		return nil, err
+	}
+	return ipc.UAPIListen(name, file)
+}
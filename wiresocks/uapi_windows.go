@@ -0,0 +1,12 @@
+package wiresocks
+
+import (
+	"net"
+
+	"github.com/bepass-org/warp-plus/wireguard/ipc"
+)
+
+// uapiListen listens on the UAPI named pipe for name.
+func uapiListen(name string) (net.Listener, error) {
+	return ipc.UAPIListen(name)
+}
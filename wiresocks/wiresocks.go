@@ -3,14 +3,22 @@ package wiresocks
 import (
 	"bytes"
 	"context"
+	"encoding/hex"
 	"fmt"
 	"log/slog"
+	"net/netip"
+	"slices"
+	"time"
 
 	"github.com/bepass-org/warp-plus/wireguard/conn"
 	"github.com/bepass-org/warp-plus/wireguard/device"
 	"github.com/bepass-org/warp-plus/wireguard/tun/netstack"
 )
 
+// reresolveInterval is how often host name endpoints are looked up again
+// while the device runs.
+const reresolveInterval = 2 * time.Minute
+
 // StartWireguard creates a tun interface on netstack given a configuration
 func StartWireguard(ctx context.Context, l *slog.Logger, conf *Configuration) (*VirtualTun, error) {
 	// Initialize a new bytes buffer to store the wireguard configuration
@@ -18,14 +26,24 @@ func StartWireguard(ctx context.Context, l *slog.Logger, conf *Configuration) (*
 
 	// Write the private key of the interface to the buffer
 	request.WriteString(fmt.Sprintf("private_key=%s\n", conf.Interface.PrivateKey))
+	if conf.Interface.ListenPort != 0 {
+		request.WriteString(fmt.Sprintf("listen_port=%d\n", conf.Interface.ListenPort))
+	}
 
 	// Loop through the peers and write their configuration to the buffer
 	for _, peer := range conf.Peers {
 		request.WriteString(fmt.Sprintf("public_key=%s\n", peer.PublicKey))
-		request.WriteString(fmt.Sprintf("persistent_keepalive_interval=%d\n", peer.KeepAlive))
+		request.WriteString(fmt.Sprintf("persistent_keepalive_interval=%d\n", peer.PersistentKeepalive))
 		request.WriteString(fmt.Sprintf("preshared_key=%s\n", peer.PreSharedKey))
-		request.WriteString(fmt.Sprintf("endpoint=%s\n", peer.Endpoint))
-		request.WriteString(fmt.Sprintf("trick=%t\n", peer.Trick))
+		if peer.Endpoint != "" {
+			endpoint, err := resolveEndpoint(ctx, peer.Endpoint)
+			if err != nil {
+				return nil, fmt.Errorf("unable to resolve endpoint %s: %w", peer.Endpoint, err)
+			}
+			request.WriteString(fmt.Sprintf("endpoint=%s\n", endpoint))
+		}
+		request.WriteString(peer.Obfuscation.UAPI())
+		request.WriteString(peer.Noise.UAPI())
 
 		// Write the allowed IPs for the peer to the buffer
 		for _, cidr := range peer.AllowedIPs {
@@ -33,14 +51,112 @@ func StartWireguard(ctx context.Context, l *slog.Logger, conf *Configuration) (*
 		}
 	}
 
+	// The tun interface takes plain addresses, routing is up to the allowed IPs
+	addresses := make([]netip.Addr, 0, len(conf.Interface.Addresses))
+	for _, prefix := range conf.Interface.Addresses {
+		addresses = append(addresses, prefix.Addr())
+	}
+
 	// Create a new tun interface and network stack with the specified addresses, DNS, and MTU
-	tun, tnet, err := netstack.CreateNetTUN(conf.Interface.Addresses, conf.Interface.DNS, conf.Interface.MTU)
+	tun, tnet, err := netstack.CreateNetTUN(addresses, conf.Interface.DNS, conf.Interface.MTU)
 	if err != nil {
 		return nil, err
 	}
+	// Watch the TCP traffic for signs of the path MTU shrinking and for
+	// replies to MTU probes, and capture the packets as they leave and
+	// enter netstack on demand
+	path := newPathWatcher(tun, addresses)
+	capture := &captureTun{Device: path}
 
 	// Initialize a new wireguard device with the tun interface, a default bind, and a logger
-	dev := device.NewDevice(tun, conn.NewDefaultBind(), device.NewSLogger(l.With("subsystem", "wireguard-go")))
+	dev := device.NewDevice(capture, conn.NewDefaultBind(), device.NewSLogger(l.With("subsystem", "wireguard-go")))
 
 	// Set the wireguard interface configuration
 	err = dev.IpcSet(request.String())
+	if err != nil {
+		return nil, err
+	}
+
+	// Bring up the wireguard device
+	err = dev.Up()
+	if err != nil {
+		return nil, err
+	}
+
+	vt := &VirtualTun{
+		Tnet:    tnet,
+		Logger:  l.With("subsystem", "vtun"),
+		Dev:     dev,
+		Ctx:     ctx,
+		router:  newRouter(conf),
+		path:    path,
+		capture: capture,
+	}
+
+	dev.OnPeerEvent(vt.logPeerEvent)
+
+	// Follow host name endpoints as their addresses change
+	for _, peer := range conf.Peers {
+		if _, err := netip.ParseAddrPort(peer.Endpoint); err != nil && peer.Endpoint != "" {
+			go vt.reresolve(peer.PublicKey, peer.Endpoint)
+		}
+	}
+
+	// Move the flows of peers that ask for it to fresh ports now and then
+	for _, peer := range conf.Peers {
+		if peer.Hopping.Enabled() {
+			go vt.hopPorts(peer.PublicKey, peer.Hopping)
+		}
+	}
+
+	return vt, nil
+}
+
+// reresolve looks the host name endpoint of a peer up every
+// reresolveInterval, and moves the peer once the name no longer points to
+// the address in use.
+func (vt *VirtualTun) reresolve(peerKey, endpoint string) {
+	current, _ := resolveEndpoint(vt.Ctx, endpoint)
+
+	t := time.NewTicker(reresolveInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-vt.Ctx.Done():
+			return
+		case <-t.C:
+		}
+
+		addrs, err := lookupEndpoint(vt.Ctx, endpoint)
+		if err != nil {
+			vt.Logger.Debug("unable to resolve endpoint", "endpoint", endpoint, "error", err)
+			continue
+		}
+		if slices.Contains(addrs, current) {
+			continue
+		}
+		addr := addrs[0]
+
+		if err := vt.SetEndpoint(peerKey, addr); err != nil {
+			vt.Logger.Warn("unable to update endpoint", "endpoint", endpoint, "error", err)
+			continue
+		}
+		vt.Logger.Info("endpoint address changed", "endpoint", endpoint, "from", current, "to", addr)
+		current = addr
+	}
+}
+
+// logPeerEvent logs handshakes that fail and endpoints that change, which
+// usually explain a stalled tunnel.
+func (vt *VirtualTun) logPeerEvent(e device.PeerEvent) {
+	peer := hex.EncodeToString(e.PublicKey[:])
+	switch e.Type {
+	case device.PeerHandshakeComplete:
+		vt.Logger.Debug("handshake complete", "peer", peer)
+	case device.PeerHandshakeFailed:
+		vt.Logger.Warn("handshake failed, giving up until there is traffic", "peer", peer)
+	case device.PeerEndpointChanged:
+		vt.Logger.Info("peer endpoint changed", "peer", peer, "endpoint", e.Endpoint)
+	}
+}